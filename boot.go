@@ -4,14 +4,21 @@ import (
 	"os"
 	"runtime"
 
+	"github.com/Masterminds/cookoo"
 	cookoolog "github.com/Masterminds/cookoo/log"
 	"github.com/codegangsta/cli"
 	pkglog "github.com/deis/pkg/log"
 	"github.com/deis/sa-builder/fetcher"
 	"github.com/deis/sa-builder/pkg"
 	"github.com/deis/sa-builder/pkg/conf"
+	"github.com/deis/sa-builder/pkg/controller"
+	"github.com/deis/sa-builder/pkg/git"
 	"github.com/deis/sa-builder/pkg/gitreceive"
+	"github.com/deis/sa-builder/pkg/healthsrv"
+	"github.com/deis/sa-builder/pkg/jsonlog"
+	"github.com/deis/sa-builder/pkg/metrics"
 	"github.com/deis/sa-builder/pkg/sshd"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
 )
 
 const (
@@ -23,7 +30,24 @@ func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
 
+// healthChecks returns the readiness checks of the SSH server: it needs to reach both the Kubernetes API
+// and the controller to run builds
+func healthChecks(cnf *sshd.Config) []healthsrv.Check {
+	var kube healthsrv.Check
+	if ns, err := cnf.Namespace(); err != nil {
+		kube = healthsrv.FailedCheck("kubernetes", err)
+	} else if kubeClient, err := client.NewInCluster(); err != nil {
+		kube = healthsrv.FailedCheck("kubernetes", err)
+	} else {
+		kube = healthsrv.KubeCheck(kubeClient.Namespaces(), ns)
+	}
+	return []healthsrv.Check{kube, healthsrv.ControllerCheck(cnf.ControllerAuthTimeout())}
+}
+
 func main() {
+	if jsonlog.Enabled() {
+		pkglog.DefaultLogger = pkglog.NewLogger(jsonlog.NewWriter(os.Stdout, "info", nil), jsonlog.NewWriter(os.Stderr, "error", nil), false)
+	}
 	if os.Getenv("DEBUG") == "true" {
 		pkglog.DefaultLogger.SetDebug(true)
 		cookoolog.Level = cookoolog.LogDebug
@@ -44,9 +68,31 @@ func main() {
 					os.Exit(1)
 				}
 				pkglog.Info("starting fetcher on port %d", cnf.FetcherPort)
-				go fetcher.Serve(cnf.FetcherPort)
+				go fetcher.Serve(cnf.FetcherPort, cnf.SlugUploadStallTimeout())
+				if cnf.MetricsPort > 0 {
+					pkglog.Info("starting metrics server on port %d", cnf.MetricsPort)
+					go func() {
+						if err := metrics.Serve(cnf.MetricsPort, metrics.NewRegistry()); err != nil {
+							pkglog.Err("metrics server failed [%s]", err)
+						}
+					}()
+				}
+				var healthSrv *healthsrv.Server
+				if cnf.HealthServerPort > 0 {
+					var err error
+					if healthSrv, err = healthsrv.Start(cnf.HealthServerPort, healthChecks(cnf)); err != nil {
+						pkglog.Err("starting health server on port %d [%s]", cnf.HealthServerPort, err)
+						os.Exit(1)
+					}
+					pkglog.Info("started health server on port %d", cnf.HealthServerPort)
+				}
 				pkglog.Info("starting SSH server on %s:%d", cnf.SSHHostIP, cnf.SSHHostPort)
-				os.Exit(pkg.Run(cnf.SSHHostIP, cnf.SSHHostPort, "boot"))
+				// Run returns once the SSH server has shut down, on SIGTERM
+				status := pkg.Run(cnf, "boot")
+				if healthSrv != nil {
+					healthSrv.Close()
+				}
+				os.Exit(status)
 			},
 		},
 		{
@@ -60,6 +106,10 @@ func main() {
 					os.Exit(1)
 				}
 				cnf.CheckDurations()
+				if err := cnf.Validate(); err != nil {
+					pkglog.Err("Invalid config for %s [%s]", gitReceiveConfAppName, err)
+					os.Exit(1)
+				}
 
 				if err := gitreceive.Run(cnf); err != nil {
 					pkglog.Err("running git receive hook [%s]", err)
@@ -67,6 +117,78 @@ func main() {
 				}
 			},
 		},
+		{
+			Name:    "git-notify",
+			Aliases: []string{"gn"},
+			Usage:   "Run the post-receive hook that notifies of deploys",
+			Action: func(c *cli.Context) {
+				cnf := new(gitreceive.Config)
+				if err := conf.EnvConfig(gitReceiveConfAppName, cnf); err != nil {
+					pkglog.Err("Error getting config for %s [%s]", gitReceiveConfAppName, err)
+					os.Exit(1)
+				}
+
+				if err := gitreceive.Notify(cnf); err != nil {
+					pkglog.Err("running git notify hook [%s]", err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "rebuild",
+			Usage: "Build an app again at a branch or sha that is already in its repo: rebuild <app> <ref>",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) != 2 {
+					pkglog.Err("usage: rebuild <app> <ref>")
+					os.Exit(1)
+				}
+				// a rebuild doesn't come from a push, so the push's part of the config is made up
+				for k, v := range gitreceive.RebuildEnv(c.Args()[0]) {
+					os.Setenv(k, v)
+				}
+				if os.Getenv("GIT_HOME") == "" {
+					os.Setenv("GIT_HOME", git.DefaultGitHome())
+				}
+				cnf := new(gitreceive.Config)
+				if err := conf.EnvConfig(gitReceiveConfAppName, cnf); err != nil {
+					pkglog.Err("Error getting config for %s [%s]", gitReceiveConfAppName, err)
+					os.Exit(1)
+				}
+				cnf.CheckDurations()
+				if err := cnf.Validate(); err != nil {
+					pkglog.Err("Invalid config for %s [%s]", gitReceiveConfAppName, err)
+					os.Exit(1)
+				}
+				if err := gitreceive.Rebuild(cnf, c.Args()[1]); err != nil {
+					pkglog.Err("rebuilding %s [%s]", c.Args()[0], err)
+					os.Exit(1)
+				}
+			},
+		},
+		{
+			Name:  "cleanup-repos",
+			Usage: "Remove the repos of apps that no longer exist in the controller",
+			Action: func(c *cli.Context) {
+				cnf := new(sshd.Config)
+				if err := conf.EnvConfig(serverConfAppName, cnf); err != nil {
+					pkglog.Err("getting config for %s [%s]", serverConfAppName, err)
+					os.Exit(1)
+				}
+				apps, err := controller.Apps(cnf.ControllerAuthTimeout())
+				if err != nil {
+					pkglog.Err("listing apps from the controller [%s]", err)
+					os.Exit(1)
+				}
+				cxt := cookoo.NewContext()
+				cxt.AddLogger("stdout", os.Stdout)
+				removed, err := git.RemoveOrphanedRepos(cxt, git.DefaultGitHome(), apps)
+				if err != nil {
+					pkglog.Err("removing orphaned repos [%s]", err)
+					os.Exit(1)
+				}
+				pkglog.Info("removed %d orphaned repos", len(removed))
+			},
+		},
 	}
 
 	app.Run(os.Args)
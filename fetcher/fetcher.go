@@ -1,6 +1,7 @@
 package fetcher
 
 import (
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -19,12 +21,16 @@ const (
 )
 
 // Serve will start the fetcher server and block until it stops. Since it blocks, it's a best practice to execute this func in a goroutine.
-func Serve(port int) {
+//
+// Slug uploads that make no progress for uploadStallTimeout are aborted. A zero uploadStallTimeout disables the check.
+func Serve(port int, uploadStallTimeout time.Duration) {
 	rtr := mux.NewRouter()
 	rtr.HandleFunc("/git/home/{name}/tar", getTar).Methods("GET")
 	rtr.HandleFunc("/git/home/{name}/slug", getSlug).Methods("GET")
+	rtr.HandleFunc("/git/home/{name}/progress", getProgress).Methods("GET")
 	rtr.HandleFunc("/git/home/health", health).Methods("GET")
-	rtr.HandleFunc("/git/home/{name}/{type}", putSlug).Methods("PUT")
+	rtr.HandleFunc("/git/home/{name}/{type}", putSlug(uploadStallTimeout)).Methods("PUT")
+	rtr.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 	hostStr := fmt.Sprintf(":%d", port)
 	http.ListenAndServe(hostStr, rtr)
 }
@@ -53,21 +59,61 @@ func getSlug(w http.ResponseWriter, r *http.Request) {
 	w.Write(dat)
 }
 
-func putSlug(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	name := params["name"]
-	log.Println(name)
-	err := os.MkdirAll(slugdirectory+name, 0755)
-	if err != nil {
-		fmt.Println(err)
-	}
-	output, err := os.Create(slugdirectory + name + "/slug.tgz")
-	if err != nil {
-		fmt.Println(err)
+func putSlug(stallTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		name := params["name"]
+		log.Println(name)
+		err := os.MkdirAll(slugdirectory+name, 0755)
+		if err != nil {
+			fmt.Println(err)
+		}
+		slugPath := slugdirectory + name + "/slug.tgz"
+		output, err := os.Create(slugPath)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		fmt.Println(r.ContentLength)
+
+		uploads.start(name, r.ContentLength)
+		defer uploads.finish(name)
+		timer := newStallTimer(stallTimeout)
+		defer timer.Stop()
+
+		body := &progressReader{r: r.Body, onProgress: func(read int64) {
+			timer.Reset()
+			uploads.update(name, read)
+		}}
+		done := make(chan error, 1)
+		go func() {
+			n, err := io.Copy(output, body)
+			uploadedBytes.Add(name, n)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			output.Close()
+			if err != nil {
+				log.Printf("uploading slug %s (%s)", name, err)
+				os.Remove(slugPath)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		case <-timer.Stalled():
+			p, _ := uploads.get(name)
+			log.Printf("%s: %s after %d of %d bytes", errUploadStalled, name, p.Bytes, p.Total)
+			stalledUploads.Add(1)
+			// closing the connection unblocks the copy, after which the partial slug can be removed
+			w.Header().Set("Connection", "close")
+			http.Error(w, errUploadStalled.Error(), http.StatusRequestTimeout)
+			go func() {
+				<-done
+				output.Close()
+				os.Remove(slugPath)
+			}()
+		}
 	}
-	defer output.Close()
-	defer r.Body.Close()
-	fmt.Println(r.ContentLength)
-	io.Copy(output, r.Body)
-	return
 }
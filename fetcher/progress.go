@@ -0,0 +1,155 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errUploadStalled = errors.New("slug upload stalled")
+
+	// uploadedBytes and stalledUploads are published through expvar on /debug/vars
+	uploadedBytes  = expvar.NewMap("slug_upload_bytes")
+	stalledUploads = expvar.NewInt("slug_upload_stalls")
+
+	uploads = &uploadRegistry{progress: map[string]*UploadProgress{}, retention: finishedUploadRetention}
+)
+
+// finishedUploadRetention is how long the progress of a finished upload is kept, so that the hook polling for
+// it sees it done before it is removed
+const finishedUploadRetention = 10 * time.Second
+
+// UploadProgress is the state of an in-flight slug upload, as served by the progress endpoint
+type UploadProgress struct {
+	Bytes int64 `json:"bytes"`
+	Total int64 `json:"total"`
+	Done  bool  `json:"done"`
+}
+
+// uploadRegistry tracks the progress of all in-flight uploads, keyed by slug name. Finished uploads are
+// removed once retention has passed.
+type uploadRegistry struct {
+	mut       sync.Mutex
+	progress  map[string]*UploadProgress
+	retention time.Duration
+}
+
+func (u *uploadRegistry) start(name string, total int64) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	u.progress[name] = &UploadProgress{Total: total}
+}
+
+func (u *uploadRegistry) update(name string, read int64) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if p, ok := u.progress[name]; ok {
+		p.Bytes = read
+	}
+}
+
+// finish marks the upload of name as done, whether it succeeded or failed, and removes it after retention
+func (u *uploadRegistry) finish(name string) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	p, ok := u.progress[name]
+	if !ok {
+		return
+	}
+	p.Done = true
+	time.AfterFunc(u.retention, func() {
+		u.mut.Lock()
+		defer u.mut.Unlock()
+		// a new upload of the same slug may have started since
+		if u.progress[name] == p {
+			delete(u.progress, name)
+		}
+	})
+}
+
+func (u *uploadRegistry) get(name string) (UploadProgress, bool) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	p, ok := u.progress[name]
+	if !ok {
+		return UploadProgress{}, false
+	}
+	return *p, true
+}
+
+// progressReader wraps an io.Reader and calls onProgress with the running byte count after every
+// successful read
+type progressReader struct {
+	r          io.Reader
+	read       int64
+	onProgress func(read int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		if p.onProgress != nil {
+			p.onProgress(p.read)
+		}
+	}
+	return n, err
+}
+
+// stallTimer closes the channel returned by Stalled if Reset is not called at least once every
+// timeout. A zero or negative timeout disables stall detection.
+type stallTimer struct {
+	mut     sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	stalled chan struct{}
+}
+
+func newStallTimer(timeout time.Duration) *stallTimer {
+	s := &stallTimer{timeout: timeout, stalled: make(chan struct{})}
+	if timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() { close(s.stalled) })
+	}
+	return s
+}
+
+// Reset pushes the stall deadline out by the timeout. It has no effect once the timer has fired.
+func (s *stallTimer) Reset() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.timer != nil && s.timer.Stop() {
+		s.timer.Reset(s.timeout)
+	}
+}
+
+// Stop disables the timer
+func (s *stallTimer) Stop() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// Stalled returns a channel that is closed when the upload has stalled
+func (s *stallTimer) Stalled() <-chan struct{} {
+	return s.stalled
+}
+
+func getProgress(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	p, ok := uploads.get(name)
+	if !ok {
+		http.Error(w, name+" is not being uploaded", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
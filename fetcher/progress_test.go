@@ -0,0 +1,100 @@
+package fetcher
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStallTimerFires(t *testing.T) {
+	timer := newStallTimer(20 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.Stalled():
+	case <-time.After(time.Second):
+		t.Fatalf("expected stall timer to fire")
+	}
+}
+
+func TestStallTimerReset(t *testing.T) {
+	timer := newStallTimer(50 * time.Millisecond)
+	defer timer.Stop()
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		timer.Reset()
+	}
+	select {
+	case <-timer.Stalled():
+		t.Fatalf("stall timer fired even though progress was being made")
+	default:
+	}
+	select {
+	case <-timer.Stalled():
+	case <-time.After(time.Second):
+		t.Fatalf("expected stall timer to fire after progress stopped")
+	}
+}
+
+func TestStallTimerDisabled(t *testing.T) {
+	timer := newStallTimer(0)
+	defer timer.Stop()
+	timer.Reset()
+	select {
+	case <-timer.Stalled():
+		t.Fatalf("expected a zero timeout to disable stall detection")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	var reported []int64
+	data := bytes.Repeat([]byte("a"), 100)
+	pr := &progressReader{r: bytes.NewReader(data), onProgress: func(read int64) {
+		reported = append(reported, read)
+	}}
+	if _, err := ioutil.ReadAll(pr); err != nil {
+		t.Fatalf("reading (%s)", err)
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != int64(len(data)) {
+		t.Errorf("expected final progress of %d bytes, got %v", len(data), reported)
+	}
+}
+
+func TestUploadRegistry(t *testing.T) {
+	reg := &uploadRegistry{progress: map[string]*UploadProgress{}}
+	if _, ok := reg.get("app"); ok {
+		t.Fatalf("expected no progress for an upload that hasn't started")
+	}
+	reg.start("app", 10)
+	reg.update("app", 4)
+	if p, _ := reg.get("app"); p.Bytes != 4 || p.Total != 10 || p.Done {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	reg.finish("app")
+	if p, _ := reg.get("app"); !p.Done {
+		t.Errorf("expected upload to be done, got %+v", p)
+	}
+}
+
+func TestUploadRegistryRemovesFinished(t *testing.T) {
+	reg := &uploadRegistry{progress: map[string]*UploadProgress{}, retention: 20 * time.Millisecond}
+	reg.start("app", 10)
+	reg.finish("app")
+	reg.start("other", 10)
+	reg.finish("other")
+	// a new upload of other before the old one is removed is kept
+	reg.start("other", 20)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := reg.get("app"); ok {
+		t.Errorf("expected a finished upload to be removed")
+	}
+	if p, ok := reg.get("other"); !ok || p.Total != 20 || p.Done {
+		t.Errorf("expected the new upload of other to be kept, got %+v (%t)", p, ok)
+	}
+	reg.mut.Lock()
+	defer reg.mut.Unlock()
+	if len(reg.progress) != 1 {
+		t.Errorf("expected only the upload in progress to be left, got %v", reg.progress)
+	}
+}
@@ -4,14 +4,17 @@
 package pkg
 
 import (
-	"fmt"
-
 	"github.com/Masterminds/cookoo"
 	clog "github.com/Masterminds/cookoo/log"
+	"github.com/deis/sa-builder/pkg/controller"
+	"github.com/deis/sa-builder/pkg/git"
+	"github.com/deis/sa-builder/pkg/jsonlog"
 	"github.com/deis/sa-builder/pkg/sshd"
 
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 // Return codes that will be sent to the shell.
@@ -28,7 +31,7 @@ const (
 // Git.
 //
 // Run returns on of the Status* status code constants.
-func Run(sshHostIP string, sshHostPort int, cmd string) int {
+func Run(cnf *sshd.Config, cmd string) int {
 	reg, router, ocxt := cookoo.Cookoo()
 	log.SetFlags(0) // Time is captured elsewhere.
 
@@ -36,18 +39,99 @@ func Run(sshHostIP string, sshHostPort int, cmd string) int {
 	// access so that goroutines don't get into race conditions.
 	cxt := cookoo.SyncContext(ocxt)
 	cxt.Put("cookoo.Router", router)
-	cxt.AddLogger("stdout", os.Stdout)
+	if jsonlog.Enabled() {
+		cxt.AddLogger("stdout", jsonlog.NewWriter(os.Stdout, "info", nil))
+	} else {
+		cxt.AddLogger("stdout", os.Stdout)
+	}
 
 	// Build the routes. See routes.go.
 	routes(reg)
 
+	if err := git.CheckOnCorruptPack(cnf.OnCorruptPack); err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	if err := git.CheckNotifyURL(cnf.NotifyURL); err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	hookTpl, err := git.LoadPreReceiveHookTemplate(cnf.PreReceiveHookTemplate)
+	if err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	bins := git.Binaries{Git: cnf.GitBin, ReceivePack: cnf.GitReceivePackBin, UploadPack: cnf.GitUploadPackBin}
+	if err := bins.Check(); err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	modes, err := git.ParseModes(cnf.GitRepoMode, cnf.GitHookMode)
+	if err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	if err := CheckImagePullPolicy(cnf.ImagePullPolicy); err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	if err := sshd.CheckFingerprintAlgorithm(cnf.FingerprintAlgorithm); err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+	addr, err := cnf.ListenAddress()
+	if err != nil {
+		clog.Errf(cxt, "Invalid configuration: %s", err)
+		return StatusLocalError
+	}
+
+	cxt.Put(sshd.HostKeyTypes, cnf.HostKeyTypeNames())
+	cxt.Put(sshd.HostKeyPaths, cnf.HostKeyPathList())
+	cxt.Put(sshd.HostKeyDir, cnf.HostKeyDir)
+
 	// Bootstrap the background services. If this fails, we stop.
 	if err := router.HandleRequest("boot", cxt, false); err != nil {
 		clog.Errf(cxt, "Fatal errror on boot: %s", err)
 		return StatusLocalError
 	}
 
-	cxt.Put(sshd.Address, fmt.Sprintf("%s:%d", sshHostIP, sshHostPort))
+	cxt.Put(sshd.Address, addr)
+	cxt.Put(git.AllowUploadPack, cnf.GitUploadPackEnabled)
+	cxt.Put(git.OnCorruptPack, cnf.OnCorruptPack)
+	cxt.Put(git.ProtectedRepos, cnf.ProtectedRepoPatterns())
+	cxt.Put(git.AllowedApps, cnf.AllowedAppNames())
+	podNamespace, err := cnf.Namespace()
+	if err != nil {
+		clog.Warnf(cxt, "Pushes will be rejected: %s", err)
+	}
+	cxt.Put(git.PodNamespace, podNamespace)
+	cxt.Put(git.NotifyURL, cnf.NotifyURL)
+	cxt.Put(git.PreReceiveHookTemplate, hookTpl)
+	cxt.Put(git.GitBinaries, bins)
+	cxt.Put(git.GitTrace, cnf.GitTraceEnabled)
+	cxt.Put(git.KeepHistory, cnf.KeepHistory)
+	cxt.Put(git.RepoModes, modes)
+	cxt.Put(git.BuildSlots, git.NewSlots(cnf.MaxConcurrentBuilds, cnf.BuildSlotTimeout()))
+	cxt.Put(git.DiskQuota, git.Quota{Repo: cnf.RepoDiskQuota(), Total: cnf.TotalDiskQuota(), Push: cnf.MaxPushSize()})
+	cxt.Put(sshd.AuthorizedKeys, cnf.AuthorizedKeysFile)
+	cxt.Put(sshd.AdminKeys, cnf.AdminKeysFile)
+	cxt.Put(sshd.FingerprintAlgorithm, cnf.FingerprintAlgorithm)
+	cxt.Put(sshd.AuthKeyPolicy, cnf.KeyPolicy())
+	cxt.Put(sshd.ShutdownGracePeriod, cnf.ShutdownGracePeriod())
+	cxt.Put(sshd.MaxConnectionsPerIP, cnf.MaxConnectionsPerIP)
+	cxt.Put(sshd.MaxConnections, cnf.MaxConnections)
+	cxt.Put(sshd.HandshakeTimeout, cnf.HandshakeTimeout())
+	cxt.Put(sshd.IdleTimeout, cnf.IdleTimeout())
+	cxt.Put(sshd.KeepAliveInterval, cnf.KeepAliveInterval())
+	if cnf.ControllerAuthEnabled {
+		cxt.Put(sshd.UserCache, controller.NewUserCache(cnf.ControllerAuthCacheTTL()))
+		cxt.Put(sshd.ControllerTimeout, cnf.ControllerAuthTimeout())
+	}
+
+	if interval := cnf.RepoCleanupInterval(); interval > 0 {
+		listApps := func() ([]string, error) { return controller.Apps(cnf.ControllerAuthTimeout()) }
+		go git.ReconcileRepos(cxt, git.DefaultGitHome(), listApps, interval, nil)
+	}
 
 	// Supply route names for handling various internal routing. While this
 	// isn't necessary for Cookoo, it makes it easy for us to mock these
@@ -56,6 +140,30 @@ func Run(sshHostIP string, sshHostPort int, cmd string) int {
 	cxt.Put("route.sshd.sshPing", "sshPing")
 	cxt.Put("route.sshd.sshGitReceive", "sshGitReceive")
 
+	// Drain the SSH service on SIGTERM, as sent by Kubernetes when the pod is stopped.
+	closer := make(chan interface{}, 1)
+	cxt.Put(sshd.Closer, closer)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		clog.Infof(cxt, "Received SIGTERM, no longer accepting SSH connections.")
+		closer <- true
+	}()
+
+	// Reload the host keys on SIGHUP, offering new ones alongside the current ones so they can be rotated. Only
+	// keys of new types are added, the current key of a type is never replaced.
+	reload := make(chan interface{}, 1)
+	cxt.Put(sshd.ReloadHostKeys, reload)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			clog.Infof(cxt, "Received SIGHUP, reloading SSH host keys.")
+			reload <- true
+		}
+	}()
+
 	// Start the SSH service.
 	// TODO: We could refactor Serve to be a command, and then run this as
 	// a route.
@@ -2,20 +2,29 @@ package controller
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/deis/builder/pkg/conf"
+	"github.com/deis/sa-builder/pkg/conf"
 	"golang.org/x/crypto/ssh"
 )
 
 const (
 	hostEnvName = "DEIS_WORKFLOW_SERVICE_HOST"
 	portEnvName = "DEIS_WORKFLOW_SERVICE_PORT"
+	// tlsEnvName makes the controller be called over https if it is true
+	tlsEnvName = "CONTROLLER_TLS"
+	// insecureEnvName turns off verification of the controller's certificate if it is true. It is meant for dev
+	// clusters whose controller has a self-signed certificate.
+	insecureEnvName = "CONTROLLER_INSECURE_SKIP_VERIFY"
 )
 
 // UserInfo represent the required information from a user to make a push and interact with deis/workflow
@@ -38,9 +47,41 @@ func controllerURLStr(additionalPath ...string) (string, error) {
 		return "", fmt.Errorf("missing required '%v' environment variable", portEnvName)
 	}
 
-	return fmt.Sprintf("http://%s:%s/%s", host, port, strings.Join(additionalPath, "/")), nil
+	scheme := "http"
+	if useTLS, _ := strconv.ParseBool(os.Getenv(tlsEnvName)); useTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s/%s", scheme, host, port, strings.Join(additionalPath, "/")), nil
+}
+
+// httpClient returns a client for controller requests that time out after timeout, which skips verifying the
+// controller's certificate if CONTROLLER_INSECURE_SKIP_VERIFY is true
+func httpClient(timeout time.Duration) *http.Client {
+	insecure, _ := strconv.ParseBool(os.Getenv(insecureEnvName))
+	return newHTTPClient(timeout, insecure)
+}
+
+// newHTTPClient returns a client that times out after timeout and, if insecure is true, accepts any
+// certificate. Only controller requests use it, object storage and the Kubernetes API are always verified.
+func newHTTPClient(timeout time.Duration, insecure bool) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if insecure {
+		client.Transport = insecureTransport
+	}
+	return client
+}
+
+// insecureTransport is the transport of every client that skips verification, so that they share its
+// connections instead of each opening their own.
+var insecureTransport = &http.Transport{
+	Proxy:           http.ProxyFromEnvironment,
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 }
 
+// getBuilderKey returns the key used to authenticate with the controller. It is a variable so tests can
+// replace it.
+var getBuilderKey = conf.GetBuilderKey
+
 // fingerprint generates a colon-separated fingerprint string from a public key.
 func fingerprint(key ssh.PublicKey) string {
 	hash := md5.Sum(key.Marshal())
@@ -61,8 +102,9 @@ func fingerprint(key ssh.PublicKey) string {
 	return string(fp)
 }
 
-// UserInfoFromKey makes a request to the controller to get the user info from they given key
-func UserInfoFromKey(key ssh.PublicKey) (*UserInfo, error) {
+// UserInfoFromKey makes a request to the controller to get the user info from they given key. The request
+// fails if the controller doesn't respond within timeout.
+func UserInfoFromKey(key ssh.PublicKey, timeout time.Duration) (*UserInfo, error) {
 	fp := fingerprint(key)
 	url, err := controllerURLStr("v2", "hooks", "key", fp)
 	if err != nil {
@@ -74,7 +116,7 @@ func UserInfoFromKey(key ssh.PublicKey) (*UserInfo, error) {
 		return nil, err
 	}
 
-	builderKey, err := conf.GetBuilderKey()
+	builderKey, err := getBuilderKey()
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +126,8 @@ func UserInfoFromKey(key ssh.PublicKey) (*UserInfo, error) {
 	req.Header.Add("User-Agent", "deis-builder")
 	req.Header.Add("X-Deis-Builder-Auth", builderKey)
 
-	res, err := http.DefaultClient.Do(req)
+	client := httpClient(timeout)
+	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -101,3 +144,114 @@ func UserInfoFromKey(key ssh.PublicKey) (*UserInfo, error) {
 	ret.Fingerprint = fp
 	return ret, nil
 }
+
+// appList is the controller's list of every app
+type appList struct {
+	Apps []string `json:"apps"`
+}
+
+// Apps returns the names of all the apps in the controller, failing if it doesn't respond within timeout.
+func Apps(timeout time.Duration) ([]string, error) {
+	url, err := controllerURLStr("v2", "hooks", "apps")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	builderKey, err := getBuilderKey()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("User-Agent", "deis-builder")
+	req.Header.Add("X-Deis-Builder-Auth", builderKey)
+
+	client := httpClient(timeout)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing apps from %s returned status code %d", url, res.StatusCode)
+	}
+	list := appList{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Apps, nil
+}
+
+// Healthy checks that the controller is up, waiting up to timeout for it to respond
+func Healthy(timeout time.Duration) error {
+	url, err := controllerURLStr("healthz")
+	if err != nil {
+		return err
+	}
+	client := httpClient(timeout)
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller health check %s returned status code %d", url, res.StatusCode)
+	}
+	return nil
+}
+
+// UserCache caches the user info of keys that were successfully looked up from the controller
+type UserCache struct {
+	ttl     time.Duration
+	mut     sync.Mutex
+	entries map[string]userCacheEntry
+}
+
+type userCacheEntry struct {
+	info    *UserInfo
+	expires time.Time
+}
+
+// NewUserCache returns a UserCache that keeps user info for ttl
+func NewUserCache(ttl time.Duration) *UserCache {
+	return &UserCache{ttl: ttl, entries: map[string]userCacheEntry{}}
+}
+
+// Get returns the cached user info for key, if it hasn't expired
+func (u *UserCache) Get(key ssh.PublicKey) (*UserInfo, bool) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	fp := fingerprint(key)
+	entry, ok := u.entries[fp]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(u.entries, fp)
+		return nil, false
+	}
+	return entry.info, true
+}
+
+// Put caches info for key
+func (u *UserCache) Put(key ssh.PublicKey, info *UserInfo) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	u.entries[fingerprint(key)] = userCacheEntry{info: info, expires: time.Now().Add(u.ttl)}
+}
+
+// CachedUserInfoFromKey is UserInfoFromKey, but returns user info from cache if it has been looked up within
+// the cache's TTL
+func CachedUserInfoFromKey(cache *UserCache, key ssh.PublicKey, timeout time.Duration) (*UserInfo, error) {
+	if info, ok := cache.Get(key); ok {
+		return info, nil
+	}
+	info, err := UserInfoFromKey(key, timeout)
+	if err != nil {
+		return nil, err
+	}
+	cache.Put(key, info)
+	return info, nil
+}
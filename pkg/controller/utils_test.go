@@ -1,7 +1,17 @@
 package controller
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -48,3 +58,196 @@ func TestFingerprint(t *testing.T) {
 		t.Errorf("Expected fingerprint %s to match %s.", fp, testingClientFingerprint)
 	}
 }
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key (%s)", err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("creating public key (%s)", err)
+	}
+	return pub
+}
+
+// startController starts a fake controller that answers key lookups with user after delay, and points
+// UserInfoFromKey at it. It returns the number of lookups the controller has served.
+func startController(t *testing.T, user string, delay time.Duration) (*int32, func()) {
+	var lookups int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.Header.Get("X-Deis-Builder-Auth") != "testkey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		time.Sleep(delay)
+		json.NewEncoder(w).Encode(UserInfo{Username: user, Apps: []string{"myapp"}})
+	}))
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing test server address (%s)", err)
+	}
+	os.Setenv(hostEnvName, host)
+	os.Setenv(portEnvName, port)
+	getBuilderKey = func() (string, error) { return "testkey", nil }
+	return &lookups, srv.Close
+}
+
+func TestUserInfoFromKey(t *testing.T) {
+	_, stop := startController(t, "alice", 0)
+	defer stop()
+
+	key := testPublicKey(t)
+	info, err := UserInfoFromKey(key, time.Second)
+	if err != nil {
+		t.Fatalf("looking up key (%s)", err)
+	}
+	if info.Username != "alice" {
+		t.Errorf("expected user alice, got %s", info.Username)
+	}
+	if info.Fingerprint != fingerprint(key) {
+		t.Errorf("expected fingerprint %s, got %s", fingerprint(key), info.Fingerprint)
+	}
+}
+
+func TestUserInfoFromKeyTimeout(t *testing.T) {
+	_, stop := startController(t, "alice", 500*time.Millisecond)
+	defer stop()
+
+	start := time.Now()
+	if _, err := UserInfoFromKey(testPublicKey(t), 50*time.Millisecond); err == nil {
+		t.Errorf("expected a slow controller to fail the lookup")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the lookup to give up after the timeout, took %s", elapsed)
+	}
+}
+
+func TestCachedUserInfoFromKey(t *testing.T) {
+	lookups, stop := startController(t, "alice", 0)
+	defer stop()
+
+	key := testPublicKey(t)
+	cache := NewUserCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		info, err := CachedUserInfoFromKey(cache, key, time.Second)
+		if err != nil {
+			t.Fatalf("looking up key (%s)", err)
+		}
+		if info.Username != "alice" {
+			t.Errorf("expected user alice, got %s", info.Username)
+		}
+	}
+	if *lookups != 1 {
+		t.Errorf("expected 1 controller lookup, got %d", *lookups)
+	}
+
+	expired := NewUserCache(0)
+	CachedUserInfoFromKey(expired, key, time.Second)
+	CachedUserInfoFromKey(expired, key, time.Second)
+	if *lookups != 3 {
+		t.Errorf("expected expired entries to be looked up again, got %d lookups", *lookups)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	status := int32(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing test server address (%s)", err)
+	}
+	os.Setenv(hostEnvName, host)
+	os.Setenv(portEnvName, port)
+	defer os.Unsetenv(hostEnvName)
+	defer os.Unsetenv(portEnvName)
+
+	if err := Healthy(time.Second); err != nil {
+		t.Errorf("expected a healthy controller, got %s", err)
+	}
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if err := Healthy(time.Second); err == nil {
+		t.Errorf("expected an unhealthy controller to be reported")
+	}
+}
+
+func TestApps(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/hooks/apps" || r.Header.Get("X-Deis-Builder-Auth") != "testkey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(appList{Apps: []string{"myapp", "otherapp"}})
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing test server address (%s)", err)
+	}
+	os.Setenv(hostEnvName, host)
+	os.Setenv(portEnvName, port)
+	getBuilderKey = func() (string, error) { return "testkey", nil }
+
+	apps, err := Apps(time.Second)
+	if err != nil {
+		t.Fatalf("listing apps (%s)", err)
+	}
+	if len(apps) != 2 || apps[0] != "myapp" || apps[1] != "otherapp" {
+		t.Errorf("expected myapp and otherapp, got %v", apps)
+	}
+
+	getBuilderKey = func() (string, error) { return "wrongkey", nil }
+	if _, err := Apps(time.Second); err == nil {
+		t.Errorf("expected a rejected builder key to fail the listing")
+	}
+}
+
+func TestHTTPClientInsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	secure := newHTTPClient(time.Second, false)
+	if secure.Transport != nil {
+		t.Errorf("expected the secure client to use the default transport, got %+v", secure.Transport)
+	}
+	if _, err := secure.Get(srv.URL); err == nil {
+		t.Errorf("expected the secure client to reject the self-signed certificate")
+	}
+
+	insecure := newHTTPClient(time.Second, true)
+	transport, ok := insecure.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatalf("expected the insecure client to skip verification, got %+v", insecure.Transport)
+	}
+	if newHTTPClient(time.Minute, true).Transport != transport {
+		t.Errorf("expected the insecure clients to share their transport")
+	}
+	res, err := insecure.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected the insecure client to accept the self-signed certificate (%s)", err)
+	}
+	res.Body.Close()
+}
+
+func TestControllerURLStrTLS(t *testing.T) {
+	os.Setenv(hostEnvName, "deis-controller")
+	os.Setenv(portEnvName, "443")
+	defer os.Setenv(tlsEnvName, "")
+	for _, test := range []struct{ tls, expected string }{
+		{"", "http://deis-controller:443/healthz"},
+		{"true", "https://deis-controller:443/healthz"},
+	} {
+		os.Setenv(tlsEnvName, test.tls)
+		if url, err := controllerURLStr("healthz"); err != nil || url != test.expected {
+			t.Errorf("expected %s with %s=%q, got %s (%v)", test.expected, tlsEnvName, test.tls, url, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package git
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// GitBinaries is the context key for the Binaries that Receive runs.
+const GitBinaries string = "git.Binaries"
+
+// Binaries are the paths of the git programs that Receive runs. Receive runs git-receive-pack and
+// git-upload-pack directly rather than through git-shell, and uses git itself to create repos and manage
+// their refs. Empty fields are looked up on the PATH.
+type Binaries struct {
+	Git         string
+	ReceivePack string
+	UploadPack  string
+}
+
+// DefaultBinaries are the git programs found on the PATH.
+var DefaultBinaries = Binaries{Git: "git", ReceivePack: "git-receive-pack", UploadPack: "git-upload-pack"}
+
+// git returns the path of the git binary.
+func (b Binaries) git() string {
+	if b.Git == "" {
+		return DefaultBinaries.Git
+	}
+	return b.Git
+}
+
+// operation returns the path of the binary that runs operation, one of the operations allowed by
+// validateOperation.
+func (b Binaries) operation(operation string) string {
+	switch {
+	case operation == "git-receive-pack" && b.ReceivePack != "":
+		return b.ReceivePack
+	case operation == "git-upload-pack" && b.UploadPack != "":
+		return b.UploadPack
+	}
+	return operation
+}
+
+// Check returns an error naming the first of the binaries that can't be found or isn't executable.
+func (b Binaries) Check() error {
+	for _, bin := range []struct{ name, path string }{
+		{"GIT_BIN", b.git()},
+		{"GIT_RECEIVE_PACK_BIN", b.operation("git-receive-pack")},
+		{"GIT_UPLOAD_PACK_BIN", b.operation("git-upload-pack")},
+	} {
+		if _, err := exec.LookPath(bin.path); err != nil {
+			return fmt.Errorf("%s %s is not an executable (%s)", bin.name, bin.path, err)
+		}
+	}
+	return nil
+}
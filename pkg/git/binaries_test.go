@@ -0,0 +1,83 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeWrapper writes an executable script to dir/name that records its arguments in log and then runs bin.
+func writeWrapper(t *testing.T, dir, name, bin, log string) string {
+	path := filepath.Join(dir, name)
+	script := fmt.Sprintf("#!/bin/sh\necho %s \"$@\" >> %s\nexec %s \"$@\"\n", name, log, bin)
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("writing %s (%s)", path, err)
+	}
+	return path
+}
+
+func TestReceiveUsesConfiguredBinaries(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	binDir, err := ioutil.TempDir("", "git-bin")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(binDir)
+	log := filepath.Join(binDir, "calls.log")
+
+	bins := Binaries{
+		Git:         writeWrapper(t, binDir, "my-git", "git", log),
+		ReceivePack: writeWrapper(t, binDir, "my-receive-pack", "git-receive-pack", log),
+	}
+	if err := bins.Check(); err != nil {
+		t.Fatalf("expected the wrappers to pass the check, got %s", err)
+	}
+
+	// a flush packet tells receive-pack that the client has nothing to push
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      channel,
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/myapp.git'",
+		"gitHome":      gitHome,
+		"podNamespace": "deis",
+		"gitBinaries":  bins,
+	})
+	if _, err := Receive(cookoo.NewContext(), params); err != nil {
+		t.Fatalf("receiving (%s): %s", err, channel.stderr.String())
+	}
+
+	calls, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("reading the calls of the wrappers (%s)", err)
+	}
+	for _, call := range []string{"my-git init --bare", "my-git for-each-ref", "my-receive-pack myapp.git"} {
+		if !strings.Contains(string(calls), call) {
+			t.Errorf("expected %q to be run, got %q", call, calls)
+		}
+	}
+}
+
+func TestBinariesCheck(t *testing.T) {
+	if err := DefaultBinaries.Check(); err != nil {
+		t.Errorf("expected the git binaries on the PATH to pass the check, got %s", err)
+	}
+	if err := (Binaries{}).Check(); err != nil {
+		t.Errorf("expected empty binaries to default to the PATH, got %s", err)
+	}
+	err := Binaries{ReceivePack: "/nonexistent/git-receive-pack"}.Check()
+	if err == nil || !strings.Contains(err.Error(), "GIT_RECEIVE_PACK_BIN") {
+		t.Errorf("expected a missing git-receive-pack to be reported as GIT_RECEIVE_PACK_BIN, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+)
+
+// errNoApps is returned instead of removing every repo when the list of apps is empty, which is far more
+// likely to be a broken controller than a cluster without apps.
+var errNoApps = errors.New("the controller listed no apps, not removing any repos")
+
+// RemoveOrphanedRepos removes the repos in gitHome whose app isn't one of validApps, and returns the paths of
+// the repos it removed. Only bare repos named <app>.git are considered, so nothing else in gitHome is touched.
+func RemoveOrphanedRepos(c cookoo.Context, gitHome string, validApps []string) ([]string, error) {
+	if len(validApps) == 0 {
+		return nil, errNoApps
+	}
+	entries, err := ioutil.ReadDir(gitHome)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, fi := range entries {
+		if !fi.IsDir() || !strings.HasSuffix(fi.Name(), ".git") {
+			continue
+		}
+		app := strings.TrimSuffix(fi.Name(), ".git")
+		repoPath := filepath.Join(gitHome, fi.Name())
+		if checkIfAllowed(app, validApps) || !isBareRepo(repoPath) {
+			continue
+		}
+		if ok, err := removeRepo(repoPath); err != nil {
+			return removed, err
+		} else if !ok {
+			log.Infof(c, "Not removing the repo of deleted app %s at %s, a git operation is using it", app, repoPath)
+			continue
+		}
+		log.Infof(c, "Removed the repo of deleted app %s at %s", app, repoPath)
+		removed = append(removed, repoPath)
+	}
+	return removed, nil
+}
+
+// removeRepo removes the repo at repoPath unless a git operation is using it, and returns whether it did. It
+// holds the repo's lock, so that a push can't create the repo at the same time.
+func removeRepo(repoPath string) (bool, error) {
+	unlock := createLocks.lock(repoPath)
+	defer unlock()
+	if activeRepos.inUse(repoPath) {
+		return false, nil
+	}
+	return true, os.RemoveAll(repoPath)
+}
+
+// activeRepos counts the git operations in progress on each repo, so that cleanup leaves their repos alone.
+var activeRepos = &repoUsers{users: map[string]int{}}
+
+type repoUsers struct {
+	mut   sync.Mutex
+	users map[string]int
+}
+
+// use marks repoPath as in use until the returned func is called
+func (u *repoUsers) use(repoPath string) func() {
+	repoPath = filepath.Clean(repoPath)
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	u.users[repoPath]++
+	return func() {
+		u.mut.Lock()
+		defer u.mut.Unlock()
+		if u.users[repoPath]--; u.users[repoPath] == 0 {
+			delete(u.users, repoPath)
+		}
+	}
+}
+
+func (u *repoUsers) inUse(repoPath string) bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	return u.users[filepath.Clean(repoPath)] > 0
+}
+
+// ReconcileRepos removes orphaned repos from gitHome every interval, with the apps returned by listApps, until
+// stop is closed. Failures are logged and retried at the next interval.
+func ReconcileRepos(c cookoo.Context, gitHome string, listApps func() ([]string, error), interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		apps, err := listApps()
+		if err != nil {
+			log.Warnf(c, "Not cleaning up orphaned repos, listing apps failed (%s)", err)
+			continue
+		}
+		if _, err := RemoveOrphanedRepos(c, gitHome, apps); err != nil {
+			log.Warnf(c, "Cleaning up orphaned repos failed (%s)", err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// setupGitHome creates a git home with a bare repo for each of apps, and returns its path
+func setupGitHome(t *testing.T, apps ...string) string {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	for _, app := range apps {
+		runGit(t, gitHome, "init", "--bare", filepath.Join(gitHome, app+".git"))
+	}
+	return gitHome
+}
+
+func TestRemoveOrphanedRepos(t *testing.T) {
+	gitHome := setupGitHome(t, "myapp", "deleted", "alsodeleted")
+	defer os.RemoveAll(gitHome)
+	// things in the git home that aren't repos of apps are left alone
+	for _, dir := range []string{"notarepo.git", "builds"} {
+		if err := os.Mkdir(filepath.Join(gitHome, dir), 0755); err != nil {
+			t.Fatalf("creating %s (%s)", dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitHome, "file.git"), nil, 0644); err != nil {
+		t.Fatalf("writing file.git (%s)", err)
+	}
+
+	removed, err := RemoveOrphanedRepos(cookoo.NewContext(), gitHome, []string{"myapp", "newapp"})
+	if err != nil {
+		t.Fatalf("removing orphaned repos (%s)", err)
+	}
+	sort.Strings(removed)
+	expected := []string{filepath.Join(gitHome, "alsodeleted.git"), filepath.Join(gitHome, "deleted.git")}
+	if strings.Join(removed, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be removed, got %v", expected, removed)
+	}
+	for _, name := range []string{"alsodeleted.git", "deleted.git"} {
+		if _, err := os.Stat(filepath.Join(gitHome, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+	for _, name := range []string{"myapp.git", "notarepo.git", "builds", "file.git"} {
+		if _, err := os.Stat(filepath.Join(gitHome, name)); err != nil {
+			t.Errorf("expected %s to be kept (%s)", name, err)
+		}
+	}
+}
+
+func TestRemoveOrphanedReposInUse(t *testing.T) {
+	gitHome := setupGitHome(t, "pushing")
+	defer os.RemoveAll(gitHome)
+	repoPath := filepath.Join(gitHome, "pushing.git")
+
+	done := activeRepos.use(repoPath)
+	removed, err := RemoveOrphanedRepos(cookoo.NewContext(), gitHome, []string{"myapp"})
+	if err != nil {
+		t.Fatalf("removing orphaned repos (%s)", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected the repo of a git operation in progress to be kept, got %v removed", removed)
+	}
+	if _, err := os.Stat(repoPath); err != nil {
+		t.Errorf("expected pushing.git to be kept (%s)", err)
+	}
+
+	done()
+	if len(activeRepos.users) != 0 {
+		t.Errorf("expected finished git operations to be forgotten, got %v", activeRepos.users)
+	}
+	removed, err = RemoveOrphanedRepos(cookoo.NewContext(), gitHome, []string{"myapp"})
+	if err != nil {
+		t.Fatalf("removing orphaned repos (%s)", err)
+	}
+	if len(removed) != 1 || removed[0] != repoPath {
+		t.Errorf("expected %s to be removed once the git operation finished, got %v", repoPath, removed)
+	}
+}
+
+func TestRemoveOrphanedReposWithoutApps(t *testing.T) {
+	gitHome := setupGitHome(t, "myapp")
+	defer os.RemoveAll(gitHome)
+
+	if _, err := RemoveOrphanedRepos(cookoo.NewContext(), gitHome, nil); err != errNoApps {
+		t.Errorf("expected an empty app list to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(gitHome, "myapp.git")); err != nil {
+		t.Errorf("expected myapp.git to be kept (%s)", err)
+	}
+}
+
+func TestReconcileRepos(t *testing.T) {
+	gitHome := setupGitHome(t, "myapp", "deleted")
+	defer os.RemoveAll(gitHome)
+
+	listed := make(chan struct{}, 10)
+	listApps := func() ([]string, error) {
+		listed <- struct{}{}
+		return []string{"myapp"}, nil
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ReconcileRepos(cookoo.NewContext(), gitHome, listApps, 10*time.Millisecond, stop)
+		close(done)
+	}()
+	// by the second listing the first cleanup has finished
+	for i := 0; i < 2; i++ {
+		select {
+		case <-listed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the apps to be listed every interval")
+		}
+	}
+	close(stop)
+	<-done
+
+	if _, err := os.Stat(filepath.Join(gitHome, "deleted.git")); !os.IsNotExist(err) {
+		t.Errorf("expected deleted.git to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(gitHome, "myapp.git")); err != nil {
+		t.Errorf("expected myapp.git to be kept (%s)", err)
+	}
+}
@@ -0,0 +1,38 @@
+package git
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+)
+
+// ErrClientDisconnected is returned by Receive when the client hangs up before its build finished.
+var ErrClientDisconnected = errors.New("the client disconnected, so the build was stopped")
+
+// stopOnDisconnect sends SIGTERM to the process group of cmd, which must have been started with its own
+// group, once closed is closed. The pre-receive hook in that group then stops the build and deletes its
+// pod. The returned function stops watching closed, and reports whether cmd was stopped. A nil closed is
+// never closed.
+func stopOnDisconnect(c cookoo.Context, cmd *exec.Cmd, closed <-chan struct{}) func() bool {
+	done := make(chan struct{})
+	stopped := make(chan bool, 1)
+	go func() {
+		select {
+		case <-closed:
+			log.Infof(c, "Client disconnected, stopping %s.", cmd.Path)
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil {
+				log.Warnf(c, "Failed to stop %s (%s)", cmd.Path, err)
+			}
+			stopped <- true
+		case <-done:
+			stopped <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-stopped
+	}
+}
@@ -0,0 +1,54 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReceiveStopsBuildOnDisconnect(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	// the build never finishes on its own, and deletes its pod when it is stopped, like the hook does
+	deleted := filepath.Join(gitHome, "pod-deleted")
+	build := filepath.Join(gitHome, "build")
+	script := fmt.Sprintf("#!/bin/sh\ntrap 'echo deleted > %s; exit 1' TERM\nsleep 30 &\nwait\n", deleted)
+	if err := ioutil.WriteFile(build, []byte(script), 0755); err != nil {
+		t.Fatalf("writing %s (%s)", build, err)
+	}
+
+	closed := make(chan struct{})
+	time.AfterFunc(200*time.Millisecond, func() { close(closed) })
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":       channel,
+		"channelClosed": (<-chan struct{})(closed),
+		"request":       &ssh.Request{},
+		"operation":     "git-receive-pack",
+		"repoName":      "'/myapp.git'",
+		"gitHome":       gitHome,
+		"podNamespace":  "deis",
+		"gitBinaries":   Binaries{Git: "git", ReceivePack: build},
+	})
+	start := time.Now()
+	_, irq := Receive(cookoo.NewContext(), params)
+	if err, ok := irq.(error); !ok || !strings.Contains(err.Error(), ErrClientDisconnected.Error()) {
+		t.Errorf("expected the push to fail because the client disconnected, got %v", irq)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the build to be stopped when the client disconnected, it took %s", elapsed)
+	}
+	if _, err := os.Stat(deleted); err != nil {
+		t.Errorf("expected the build to clean up its pod when it was stopped (%s)", err)
+	}
+}
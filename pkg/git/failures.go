@@ -0,0 +1,86 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// failureClass is a common reason for a push to fail, recognized by fragments of the hook's output.
+type failureClass struct {
+	markers []string
+	message string
+}
+
+// failureClasses are checked in order, so a class whose output is followed by that of a more general one,
+// like a missing buildpack by a failed build, must come first.
+var failureClasses = []failureClass{
+	{
+		markers: corruptPackMarkers,
+		message: "The pushed objects were corrupt or incomplete, so nothing was changed. Push again.",
+	},
+	{
+		markers: []string{"Unable to select a buildpack", "could not be detected", "no buildpack"},
+		message: "No buildpack could detect the type of this app. Add the files your language's buildpack looks for, or set BUILDPACK_URL to the buildpack to use.",
+	},
+	{
+		markers: []string{"build did not finish within", "timed out", "deadline exceeded"},
+		message: "The build timed out. Try pushing again, and if it keeps happening make the build faster or ask your operator to raise BUILD_TIMEOUT.",
+	},
+	{
+		markers: []string{"objectstore", "object storage", "storage endpoint", "storage type", "slug upload stalled", "NoSuchBucket", "AccessDenied"},
+		message: "The build could not be stored in object storage. This is a problem with the builder's storage, not your app; contact your operator.",
+	},
+	{
+		markers: []string{"Failed to compile", "failed to compile", "returned a non-zero code", "Stopping build."},
+		message: "The app failed to build. Check the build output above for the error in your code or dependencies.",
+	},
+}
+
+// unknownFailureMessage is shown when a failed push doesn't match any failureClass.
+const unknownFailureMessage = "The push could not be built. See the output above for details."
+
+// classifyFailure returns the message telling the user what to fix for a push whose hook failed with output.
+func classifyFailure(output []byte) string {
+	for _, class := range failureClasses {
+		for _, marker := range class.markers {
+			if bytes.Contains(output, []byte(marker)) {
+				return class.message
+			}
+		}
+	}
+	return unknownFailureMessage
+}
+
+// failureNotice formats the message of classifyFailure so that it stands out at the end of `git push` output.
+func failureNotice(output []byte) string {
+	return fmt.Sprintf("\n!     Push failed: %s\n", classifyFailure(output))
+}
+
+// tailBuffer keeps the last max bytes written to it. It may be written to concurrently.
+type tailBuffer struct {
+	mut sync.Mutex
+	max int
+	buf []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns the bytes kept.
+func (t *tailBuffer) Bytes() []byte {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return append([]byte(nil), t.buf...)
+}
@@ -0,0 +1,42 @@
+package git
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	cases := []struct {
+		output   string
+		expected string
+	}{
+		{"-----> Unable to select a buildpack\nStopping build.\n", "No buildpack"},
+		{"Step 4 : RUN make\nThe command '/bin/sh -c make' returned a non-zero code: 2\n", "failed to build"},
+		{"-----> Python app detected\n !     Push rejected, failed to compile Python app\nStopping build.\n", "failed to build"},
+		{"running git receive hook [build did not finish within 30m0s, deleted builder pod slugbuild-myapp]", "timed out"},
+		{"running git receive hook [missing /var/run/secrets/deis/objectstore/creds/accesskey]", "object storage"},
+		{"error: unpack-objects abnormal exit\n", "corrupt"},
+		{"something unexpected\n", "could not be built"},
+	}
+	for _, c := range cases {
+		if msg := classifyFailure([]byte(c.output)); !strings.Contains(msg, c.expected) {
+			t.Errorf("expected the message for %q to contain %q, got %q", c.output, c.expected, msg)
+		}
+	}
+	if notice := failureNotice([]byte("Stopping build.")); !strings.HasPrefix(notice, "\n!     Push failed: ") {
+		t.Errorf("expected a prefixed notice, got %q", notice)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buf := newTailBuffer(8)
+	buf.Write([]byte("0123"))
+	buf.Write([]byte("456789"))
+	if string(buf.Bytes()) != "23456789" {
+		t.Errorf("expected the last 8 bytes, got %q", buf.Bytes())
+	}
+	buf.Write([]byte("abcdefghijkl"))
+	if string(buf.Bytes()) != "efghijkl" {
+		t.Errorf("expected the last 8 bytes, got %q", buf.Bytes())
+	}
+}
@@ -0,0 +1,34 @@
+package git
+
+import (
+	"os/exec"
+	"sync"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+)
+
+// KeepHistory is the context key for whether repos are left as they are after a push, rather than garbage
+// collected.
+const KeepHistory = "git.KeepHistory"
+
+// repoGCs tracks the garbage collections started by gcRepo, so that tests can wait for them.
+var repoGCs sync.WaitGroup
+
+// gcRepo runs git gc on the repo at repoPath with the git binary gitBin, in the background so that the push
+// that triggered it isn't held up. It packs the repo's objects and prunes the unreachable ones, such as those
+// of force-pushed or deleted branches, once they are older than git's grace period, which keeps the objects
+// of pushes in progress. A failure is logged, and the next push runs gc again.
+func gcRepo(c cookoo.Context, gitBin, repoPath string) {
+	repoGCs.Add(1)
+	go func() {
+		defer repoGCs.Done()
+		cmd := exec.Command(gitBin, "gc", "--quiet")
+		cmd.Dir = repoPath
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Warnf(c, "git gc of %s failed: %s (%s)", repoPath, out, err)
+			return
+		}
+		log.Debugf(c, "Garbage collected %s", repoPath)
+	}()
+}
@@ -0,0 +1,61 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+// receiveCalls runs an empty push with keepHistory, and returns the calls of the git binary it made
+func receiveCalls(t *testing.T, keepHistory bool) string {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	binDir, err := ioutil.TempDir("", "git-bin")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(binDir)
+	log := filepath.Join(binDir, "calls.log")
+
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      channel,
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/myapp.git'",
+		"gitHome":      gitHome,
+		"podNamespace": "deis",
+		"gitBinaries":  Binaries{Git: writeWrapper(t, binDir, "my-git", "git", log)},
+		"keepHistory":  keepHistory,
+	})
+	if _, irq := Receive(cookoo.NewContext(), params); irq != nil {
+		t.Fatalf("receiving (%v): %s", irq, channel.stderr.String())
+	}
+	repoGCs.Wait()
+
+	calls, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("reading the calls of git (%s)", err)
+	}
+	return string(calls)
+}
+
+func TestReceiveGCWithoutHistory(t *testing.T) {
+	if calls := receiveCalls(t, false); !strings.Contains(calls, "my-git gc --quiet") {
+		t.Errorf("expected git gc to run after the push, got calls %q", calls)
+	}
+}
+
+func TestReceiveKeepsHistory(t *testing.T) {
+	if calls := receiveCalls(t, true); strings.Contains(calls, " gc") {
+		t.Errorf("expected git gc not to run when history is kept, got calls %q", calls)
+	}
+}
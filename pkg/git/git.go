@@ -8,19 +8,42 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/cookoo"
 	"github.com/Masterminds/cookoo/log"
+	"github.com/deis/sa-builder/pkg/jsonlog"
 	"github.com/deis/sa-builder/pkg/sshd"
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	// AllowUploadPack is the context key for whether git-upload-pack may be served.
+	AllowUploadPack string = "git.AllowUploadPack"
+	// ProtectedRepos is the context key for the repo name patterns reserved for admin keys.
+	ProtectedRepos string = "git.ProtectedRepos"
+	// AllowedApps is the context key for the apps that may be pushed to, nil for any app.
+	AllowedApps string = "git.AllowedApps"
+	// NotifyURL is the context key for the URL that is notified of every successful deploy.
+	NotifyURL string = "git.NotifyURL"
+	// PreReceiveHookTemplate is the context key for the template of the pre-receive hook.
+	PreReceiveHookTemplate string = "git.PreReceiveHookTemplate"
+	// PodNamespace is the context key for the Kubernetes namespace that pushes are built in.
+	PodNamespace string = "git.PodNamespace"
+)
+
 // prereceiveHookTplStr is the template for a pre-receive hook. The following template variables are passed into it:
 //
 // 	.GitHome: the path to Git's home directory.
@@ -41,15 +64,93 @@ boot git-receive | strip_remote_prefix
 
 var preReceiveHookTpl = template.Must(template.New("hooks").Parse(preReceiveHookTplStr))
 
+// gitHomeSentinel is the git home that custom pre-receive hook templates are test-run with, to check that
+// they use it.
+const gitHomeSentinel = "/deis-builder-git-home-check"
+
+// LoadPreReceiveHookTemplate returns the pre-receive hook template in the file at path, or the built-in
+// template if path is empty. The template gets the same variables as the built-in one, and must use .GitHome.
+func LoadPreReceiveHookTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return preReceiveHookTpl, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read pre-receive hook template %s (%s)", path, err)
+	}
+	tpl, err := template.New("hooks").Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse pre-receive hook template %s (%s)", path, err)
+	}
+	var out bytes.Buffer
+	if err := tpl.Execute(&out, map[string]string{"GitHome": gitHomeSentinel}); err != nil {
+		return nil, fmt.Errorf("Cannot render pre-receive hook template %s (%s)", path, err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(gitHomeSentinel)) {
+		return nil, fmt.Errorf("Pre-receive hook template %s does not use {{.GitHome}}", path)
+	}
+	return tpl, nil
+}
+
+// postReceiveHookTplStr is the template for a post-receive hook, which git only runs once the pre-receive
+// hook has built and deployed the push. The following template variables are passed into it:
+//
+// 	.GitHome: the path to Git's home directory.
+// 	.NotifyURL: the URL to notify of the deploy, quoted for the shell.
+const postReceiveHookTplStr = `#!/bin/bash
+strip_remote_prefix() {
+    stdbuf -i0 -o0 -e0 sed "s/^/"$'\e[1G'"/"
+}
+
+GIT_HOME={{.GitHome}} \
+SSH_CONNECTION="$SSH_CONNECTION" \
+SSH_ORIGINAL_COMMAND="$SSH_ORIGINAL_COMMAND" \
+REPOSITORY="$RECEIVE_REPO" \
+USERNAME="$RECEIVE_USER" \
+FINGERPRINT="$RECEIVE_FINGERPRINT" \
+POD_NAMESPACE="$POD_NAMESPACE" \
+NOTIFY_URL={{.NotifyURL}} \
+boot git-notify | strip_remote_prefix
+`
+
+var postReceiveHookTpl = template.Must(template.New("hooks").Parse(postReceiveHookTplStr))
+
 // Receive receives a Git repo.
-// This will only work for git-receive-pack.
+//
+// For git-receive-pack, this creates the repo if necessary and installs the pre-receive hook that builds
+// the app. If allowUploadPack is true, git-upload-pack serves existing repos read-only, without the hook
+// or a build.
 //
 // Params:
 // 	- operation (string): e.g. git-receive-pack
 // 	- repoName (string): The repository name, in the form '/REPO.git'.
 // 	- channel (ssh.Channel): The channel.
-// 	- request (*ssh.Request): The channel.
-// 	- gitHome (string): Defaults to /home/git.
+// 	- request (*ssh.Request): The exec request, which Receive replies to before it runs git.
+// 	- gitHome (string): Defaults to $GIT_HOME, or /home/git if that is unset.
+// 	- allowUploadPack (bool): Also serve git-upload-pack. Defaults to false.
+// 	- onCorruptPack (string): OnCorruptPackReset or OnCorruptPackPreserve. Defaults to OnCorruptPackReset.
+// 	- protectedRepos ([]string): Repo name patterns that only admin keys may create or push to.
+// 	- allowedApps ([]string): The apps that may be pushed to. Defaults to none, which allows any app.
+// 	- permissions (*ssh.Permissions): The permissions of the authenticated key.
+// 	- key (ssh.PublicKey): The key the client authenticated with.
+// 	- fingerprintAlgorithm (string): The sshd.Fingerprint* algorithm for the fingerprint passed to the
+// 	  hook. Defaults to sshd.FingerprintSHA256.
+// 	- diskQuota (Quota): The disk quota that pushes are held to. Defaults to no quota.
+// 	- podNamespace (string): The Kubernetes namespace to build in. Defaults to $POD_NAMESPACE.
+// 	- preReceiveHookTpl (*template.Template): The template of the pre-receive hook, as loaded by
+// 	  LoadPreReceiveHookTemplate. Defaults to the built-in template.
+// 	- notifyURL (string): The URL that the post-receive hook notifies of deploys. Defaults to none, which
+// 	  doesn't install the hook.
+// 	- gitBinaries (Binaries): The git programs to run. Defaults to DefaultBinaries.
+// 	- buildSlots (*Slots): Limits how many pushes build at once. Defaults to no limit.
+// 	- keepAliveInterval (time.Duration): How often keepalives are sent on the channel while the build runs.
+// 	  Defaults to 0, which sends none.
+// 	- gitTrace (bool): Log the end of the traces of git, and of the git commands the hook runs, at debug level. Defaults to false.
+// 	- repoModes (Modes): The permissions of the repos and hooks that are created. Defaults to DefaultModes.
+// 	- keepHistory (bool): Leave the repo as it is after a successful push. If false, git gc runs on the repo
+// 	  after each successful push. Defaults to true.
+// 	- channelClosed (<-chan struct{}): Closed when the client disconnects, which stops git and the build.
+// 	  Defaults to none, which builds until the hook exits.
 // 	- userInfo (*controller.UserInfo): Deis user information.
 //
 // Returns:
@@ -58,51 +159,153 @@ func Receive(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 	if ok, z := p.Requires("channel", "request"); !ok {
 		return nil, fmt.Errorf("Missing requirements %q", z)
 	}
+	// the client waits for the exec request to be answered. Rejections are reported on stderr and in the exit
+	// status, so the request is accepted even if the push is then rejected.
+	if request, ok := p.Get("request", nil).(execRequest); ok {
+		if err := request.Reply(true, nil); err != nil {
+			return nil, fmt.Errorf("Failed to reply to the exec request (%s)", err)
+		}
+	}
 	repoName := p.Get("repoName", "").(string)
 	operation := p.Get("operation", "").(string)
 	channel := p.Get("channel", nil).(ssh.Channel)
-	gitHome := p.Get("gitHome", "/home/git").(string)
+	gitHome := p.Get("gitHome", DefaultGitHome()).(string)
+	allowUploadPack := p.Get("allowUploadPack", false).(bool)
+	onCorruptPack := p.Get("onCorruptPack", OnCorruptPackReset).(string)
+	protectedRepos := p.Get("protectedRepos", []string{}).([]string)
+	allowedApps, _ := p.Get("allowedApps", nil).([]string)
+	permissions, _ := p.Get("permissions", nil).(*ssh.Permissions)
+	key, _ := p.Get("key", nil).(ssh.PublicKey)
+	quota, _ := p.Get("diskQuota", Quota{}).(Quota)
+	notifyURL, _ := p.Get("notifyURL", "").(string)
+	podNamespace, _ := p.Get("podNamespace", os.Getenv("POD_NAMESPACE")).(string)
+	bins, _ := p.Get("gitBinaries", DefaultBinaries).(Binaries)
+	slots, _ := p.Get("buildSlots", nil).(*Slots)
+	keepAlive, _ := p.Get("keepAliveInterval", time.Duration(0)).(time.Duration)
+	channelClosed, _ := p.Get("channelClosed", nil).(<-chan struct{})
+	gitTrace, _ := p.Get("gitTrace", false).(bool)
+	keepHistory, _ := p.Get("keepHistory", true).(bool)
+	modes, _ := p.Get("repoModes", DefaultModes).(Modes)
+	hookTpl, ok := p.Get("preReceiveHookTpl", nil).(*template.Template)
+	if !ok || hookTpl == nil {
+		hookTpl = preReceiveHookTpl
+	}
+	fingerprint := sshd.Fingerprint(key, p.Get("fingerprintAlgorithm", sshd.FingerprintSHA256).(string))
+
+	user := "builder"
+	if permissions != nil && permissions.Extensions["user"] != "" {
+		user = permissions.Extensions["user"]
+	}
 
-	log.Debugf(c, "receiving git repo name: %s, operation: %s, fingerprint: %s, user: %s", repoName, operation, sshd.Fingerprint(), "builder")
+	logFields := jsonlog.Fields{"repo": repoName, "user": user, "fingerprint": fingerprint}
+	log.Debugf(c, "%s", jsonlog.Tag(fmt.Sprintf("receiving git repo name: %s, operation: %s, fingerprint: %s, user: %s", repoName, operation, fingerprint, user), logFields))
+
+	if err := validateOperation(operation, allowUploadPack); err != nil {
+		log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected git operation: %s", err), logFields))
+		channel.Stderr().Write([]byte(err.Error()))
+		return nil, err
+	}
 
 	repo, err := cleanRepoName(repoName)
 	if err != nil {
-		log.Warnf(c, "Illegal repo name: %s.", err)
+		log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Illegal repo name: %s.", err), logFields))
 		channel.Stderr().Write([]byte("No repo given"))
 		return nil, err
 	}
 
-	repo += ".git"
+	if err := checkProtected(repo, protectedRepos, permissions); err != nil {
+		log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected push to %s: %s", repo, err), logFields))
+		channel.Stderr().Write([]byte(err.Error()))
+		return nil, err
+	}
 
-	repoPath := filepath.Join(gitHome, repo)
-	log.Debugf(c, "creating repo directory %s", repoPath)
-	if _, err := createRepo(c, repoPath); err != nil {
-		err = fmt.Errorf("Did not create new repo (%s)", err)
-		log.Warnf(c, err.Error())
+	if err := checkAllowedApp(repo, allowedApps, permissions); err != nil {
+		log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected push to %s: %s", repo, err), logFields))
+		channel.Stderr().Write([]byte(err.Error()))
 		return nil, err
 	}
 
-	log.Debugf(c, "writing pre-receive hook under %s", repoPath)
-	if err := createPreReceiveHook(c, gitHome, repoPath); err != nil {
-		err = fmt.Errorf("Did not write pre-receive hook (%s)", err)
+	repo += ".git"
+
+	repoPath := filepath.Join(gitHome, repo)
+	defer activeRepos.use(repoPath)()
+	receiving := operation == "git-receive-pack"
+	var refsBefore refSnapshot
+	var in io.Reader = channel
+	if receiving {
+		if err := checkNamespace(podNamespace); err != nil {
+			log.Errf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected push to %s: %s", repo, err), logFields))
+			channel.Stderr().Write([]byte(err.Error()))
+			return nil, err
+		}
+
+		log.Debugf(c, "creating repo directory %s", repoPath)
+		if _, err := createRepo(c, bins.git(), repoPath, modes.Repo); err != nil {
+			err = fmt.Errorf("Did not create new repo (%s)", err)
+			log.Warnf(c, err.Error())
+			return nil, err
+		}
+
+		log.Debugf(c, "writing pre-receive hook under %s", repoPath)
+		if err := createPreReceiveHook(c, hookTpl, gitHome, repoPath, modes.Hook); err != nil {
+			err = fmt.Errorf("Did not write pre-receive hook (%s)", err)
+			log.Warnf(c, err.Error())
+			return nil, err
+		}
+		if err := createPostReceiveHook(c, gitHome, repoPath, notifyURL, modes.Hook); err != nil {
+			err = fmt.Errorf("Did not write post-receive hook (%s)", err)
+			log.Warnf(c, err.Error())
+			return nil, err
+		}
+
+		refsBefore, err = snapshotRefs(bins.git(), repoPath)
+		if err != nil {
+			log.Warnf(c, err.Error())
+			return nil, err
+		}
+
+		in, err = quota.limitReader(channel, gitHome, repoPath, repo)
+		if err != nil {
+			log.Warnf(c, "%s", jsonlog.Tag(err.Error(), logFields))
+			channel.Stderr().Write([]byte(err.Error()))
+			return nil, err
+		}
+
+		release, err := slots.acquire(channel.Stderr())
+		if err != nil {
+			log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected push to %s: %s", repo, err), logFields))
+			channel.Stderr().Write([]byte(err.Error()))
+			return nil, err
+		}
+		defer release()
+	} else if fi, err := os.Stat(repoPath); err != nil || !fi.IsDir() {
+		// git-upload-pack only serves existing repos, read-only
+		err = fmt.Errorf("Repository %s does not exist", repo)
 		log.Warnf(c, err.Error())
+		channel.Stderr().Write([]byte(err.Error()))
 		return nil, err
 	}
 
-	cmd := exec.Command("git-shell", "-c", fmt.Sprintf("%s '%s'", operation, repo))
-	log.Infof(c, strings.Join(cmd.Args, " "))
+	cmd := gitCommand(bins, operation, repo, gitHome)
+	log.Infof(c, "%s", jsonlog.Tag(strings.Join(cmd.Args, " "), logFields))
 
 	var errbuff bytes.Buffer
 
-	cmd.Dir = gitHome
-	cmd.Env = []string{
-		fmt.Sprintf("RECEIVE_USER=%s", "builder"),
-		fmt.Sprintf("RECEIVE_REPO=%s", repo),
-		fmt.Sprintf("RECEIVE_FINGERPRINT=%s", sshd.Fingerprint()),
-		fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s '%s'", operation, repo),
-		fmt.Sprintf("SSH_CONNECTION=%s", c.Get("SSH_CONNECTION", "0 0 0 0").(string)),
+	rawSSHConnection := c.Get("SSH_CONNECTION", unknownSSHConnection).(string)
+	sshConnection, err := normalizeSSHConnection(rawSSHConnection)
+	if err != nil {
+		log.Warnf(c, "Passing SSH_CONNECTION %q to the hook as %q: %s", rawSSHConnection, unknownSSHConnection, err)
+		sshConnection = unknownSSHConnection
+	}
+	// the hook's own variables come last, so they win over any inherited from the server's environment
+	cmd.Env = append(os.Environ(), hookEnv(operation, repo, user, fingerprint, podNamespace, sshConnection)...)
+	if gitTrace {
+		logTrace, err := traceCommand(c, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up the git trace (%s)", err)
+		}
+		defer logTrace()
 	}
-	cmd.Env = append(cmd.Env, os.Environ()...)
 
 	log.Debugf(c, "Working Dir: %s", cmd.Dir)
 	log.Debugf(c, "Environment: %s", strings.Join(cmd.Env, ","))
@@ -111,8 +314,12 @@ func Receive(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 	if err != nil {
 		return nil, err
 	}
-	cmd.Stdout = channel
-	cmd.Stderr = io.MultiWriter(channel.Stderr(), &errbuff)
+	// the end of the hook's output is kept to tell the user why a failed push failed
+	output := newTailBuffer(hookOutputTail)
+	cmd.Stdout = io.MultiWriter(channel, output)
+	cmd.Stderr = io.MultiWriter(channel.Stderr(), &errbuff, output)
+	// in a group of their own, git and the hook can be stopped together when the client disconnects
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	if err := cmd.Start(); err != nil {
 		err = fmt.Errorf("Failed to start git pre-receive hook: %s (%s)", err, errbuff.Bytes())
@@ -120,7 +327,13 @@ func Receive(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 		return nil, err
 	}
 
-	if _, err := io.Copy(inpipe, channel); err != nil {
+	if _, err := io.Copy(inpipe, in); err != nil {
+		if quotaErr, ok := err.(ErrQuotaExceeded); ok {
+			abortReceive(c, cmd, bins.git(), repoPath, refsBefore)
+			log.Warnf(c, "%s", jsonlog.Tag(quotaErr.Error(), logFields))
+			channel.Stderr().Write([]byte(quotaErr.Error()))
+			return nil, quotaErr
+		}
 		err = fmt.Errorf("Failed to write git objects into the git pre-receive hook (%s)", err)
 		log.Warnf(c, err.Error())
 		return nil, err
@@ -128,20 +341,216 @@ func Receive(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt)
 
 	fmt.Println("Waiting for git-receive to run.")
 	fmt.Println("Waiting for deploy.")
-	if err := cmd.Wait(); err != nil {
-		err = fmt.Errorf("Failed to run git pre-receive hook: %s (%s)", errbuff.Bytes(), err)
-		log.Errf(c, err.Error())
+	// the build can run for a long time without any output, which load balancers take for a dead connection
+	stopKeepAlive := make(chan struct{})
+	defer close(stopKeepAlive)
+	go sshd.KeepAlive(channel, keepAlive, stopKeepAlive)
+	stopWatching := stopOnDisconnect(c, cmd, channelClosed)
+	waitErr := cmd.Wait()
+	disconnected := stopWatching()
+	if waitErr != nil {
+		err := exitError{
+			error:  fmt.Errorf("Failed to run git pre-receive hook: %s (%s)", errbuff.Bytes(), waitErr),
+			status: commandExitStatus(waitErr),
+		}
+		if disconnected {
+			err.error = ErrClientDisconnected
+		}
+		log.Errf(c, "%s", jsonlog.Tag(err.Error(), logFields))
+		if receiving {
+			channel.Stderr().Write([]byte(failureNotice(output.Bytes())))
+			if rerr := recoverFromFailedReceive(c, bins.git(), repoPath, onCorruptPack, refsBefore, errbuff.Bytes()); rerr != nil {
+				log.Errf(c, "Failed to reset %s after a corrupt pack (%s)", repoPath, rerr)
+			}
+		}
 		return nil, err
 	}
 	if errbuff.Len() > 0 {
 		log.Warnf(c, "Unreported error: %s", errbuff.Bytes())
 	}
-	log.Infof(c, "Deploy complete.\n")
+	log.Infof(c, "%s", jsonlog.Tag("Deploy complete.\n", logFields))
+	if receiving && !keepHistory {
+		gcRepo(c, bins.git(), repoPath)
+	}
 
 	return nil, nil
 }
 
+// execRequest is the SSH exec request that started a git operation, such as an *ssh.Request.
+type execRequest interface {
+	Reply(ok bool, payload []byte) error
+}
+
+// exitError is a failure of the git command, which the SSH server passes on to the client as its exit status.
+type exitError struct {
+	error
+	status uint32
+}
+
+// ExitStatus returns the exit status of the failed git command.
+func (e exitError) ExitStatus() uint32 {
+	return e.status
+}
+
+// commandExitStatus returns the exit status of a command that Wait failed with err, using the shell's
+// convention of 128 plus the signal for commands that were killed. Errors without a status give 1.
+func commandExitStatus(err error) uint32 {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 1
+	}
+	if status.Signaled() {
+		return 128 + uint32(status.Signal())
+	}
+	return uint32(status.ExitStatus())
+}
+
+// hookOutputTail is how much of the end of the hook's output is searched for the reason a push failed.
+const hookOutputTail = 64 * 1024
+
+// abortReceive stops the git-receive-pack cmd before it has received the whole push, and restores the refs of
+// the repo at repoPath to before with the git binary gitBin, removing any temporary packs the push left behind.
+func abortReceive(c cookoo.Context, cmd *exec.Cmd, gitBin, repoPath string, before refSnapshot) {
+	if err := cmd.Process.Kill(); err != nil {
+		log.Warnf(c, "Failed to stop git-receive-pack (%s)", err)
+	}
+	cmd.Wait()
+	if err := restoreRefs(gitBin, repoPath, before); err != nil {
+		log.Errf(c, "Failed to reset %s after an aborted push (%s)", repoPath, err)
+	}
+}
+
+// gitCommand returns the command that runs operation (one of the operations allowed by validateOperation)
+// from bins on repo, relative to gitHome. The repo is passed as its own argument, so it is never interpreted by a shell.
+func gitCommand(bins Binaries, operation, repo, gitHome string) *exec.Cmd {
+	cmd := exec.Command(bins.operation(operation), repo)
+	cmd.Dir = gitHome
+	return cmd
+}
+
+// unknownSSHConnection is the SSH_CONNECTION of sessions whose addresses aren't known
+const unknownSSHConnection = "0 0 0 0"
+
+// normalizeSSHConnection returns sshConnection with its fields separated by single spaces, or an error if it
+// isn't the client IP, client port, server IP and server port that the hook expects. unknownSSHConnection is
+// returned as it is.
+func normalizeSSHConnection(sshConnection string) (string, error) {
+	fields := strings.Fields(sshConnection)
+	normalized := strings.Join(fields, " ")
+	if normalized == unknownSSHConnection {
+		return normalized, nil
+	}
+	if len(fields) != 4 {
+		return "", fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	for i, field := range fields {
+		if i%2 == 0 {
+			// IPv6 link local addresses may have a zone
+			if net.ParseIP(strings.SplitN(field, "%", 2)[0]) == nil {
+				return "", fmt.Errorf("%q is not an IP address", field)
+			}
+		} else if port, err := strconv.ParseUint(field, 10, 16); err != nil || port == 0 {
+			return "", fmt.Errorf("%q is not a port", field)
+		}
+	}
+	return normalized, nil
+}
+
+// hookEnv returns the environment that the pre-receive hook reads
+func hookEnv(operation, repo, user, fingerprint, podNamespace, sshConnection string) []string {
+	return []string{
+		fmt.Sprintf("RECEIVE_USER=%s", user),
+		fmt.Sprintf("RECEIVE_REPO=%s", repo),
+		fmt.Sprintf("RECEIVE_FINGERPRINT=%s", fingerprint),
+		fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s '%s'", operation, repo),
+		fmt.Sprintf("SSH_CONNECTION=%s", sshConnection),
+		fmt.Sprintf("POD_NAMESPACE=%s", podNamespace),
+	}
+}
+
+// namespaceRegex matches valid Kubernetes namespace names, which are DNS labels.
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// checkNamespace returns an error if podNamespace, the namespace that builds run in, is not set or is not
+// a valid namespace name.
+func checkNamespace(podNamespace string) error {
+	if podNamespace == "" {
+		return errors.New("the builder does not know which namespace to build in, set POD_NAMESPACE on the builder")
+	}
+	if !namespaceRegex.MatchString(podNamespace) {
+		return fmt.Errorf("the builder's namespace %q is not a valid Kubernetes namespace", podNamespace)
+	}
+	return nil
+}
+
+// DefaultGitHome returns the git home from the GIT_HOME environment variable, falling back to /home/git.
+func DefaultGitHome() string {
+	if gitHome := os.Getenv("GIT_HOME"); gitHome != "" {
+		return gitHome
+	}
+	return "/home/git"
+}
+
+// ErrUnsupportedOperation is returned when a client asks for a git operation that Receive does not serve.
+type ErrUnsupportedOperation struct {
+	operation string
+}
+
+func (e ErrUnsupportedOperation) Error() string {
+	return fmt.Sprintf("unsupported git operation %q", e.operation)
+}
+
+// validateOperation checks that operation is one of the git operations that may be run.
+// git-upload-pack is only allowed if allowUploadPack is true.
+func validateOperation(operation string, allowUploadPack bool) error {
+	switch operation {
+	case "git-receive-pack":
+		return nil
+	case "git-upload-pack":
+		if allowUploadPack {
+			return nil
+		}
+	}
+	return ErrUnsupportedOperation{operation: operation}
+}
+
+// ErrReservedRepo is returned when a key without the admin scope pushes to a protected repo.
+type ErrReservedRepo struct {
+	repo string
+}
+
+func (e ErrReservedRepo) Error() string {
+	return fmt.Sprintf("repository name is reserved: %s", e.repo)
+}
+
+// checkProtected returns an ErrReservedRepo if repo matches one of the protected patterns and permissions
+// don't have the admin scope. Patterns use path.Match syntax.
+func checkProtected(repo string, protected []string, permissions *ssh.Permissions) error {
+	if sshd.IsAdmin(permissions) {
+		return nil
+	}
+	for _, pattern := range protected {
+		// the pattern is validated when it's matched, so a malformed one protects nothing
+		if matched, _ := path.Match(pattern, repo); matched {
+			return ErrReservedRepo{repo: repo}
+		}
+	}
+	return nil
+}
+
+// maxRepoNameLen is the longest allowed repo name, so that it is also a valid DNS label.
+const maxRepoNameLen = 63
+
+var repoNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 // cleanRepoName cleans a repository name for a git-sh operation.
+//
+// The cleaned name may only contain letters, digits, underscores and dashes, and may be at most
+// maxRepoNameLen characters long.
 func cleanRepoName(name string) (string, error) {
 	if len(name) == 0 {
 		return name, errors.New("Empty repo name.")
@@ -150,37 +559,97 @@ func cleanRepoName(name string) (string, error) {
 		return "", errors.New("Cannot change directory in file name.")
 	}
 	name = strings.Replace(name, "'", "", -1)
-	return strings.TrimPrefix(strings.TrimSuffix(name, ".git"), "/"), nil
+	name = strings.TrimPrefix(strings.TrimSuffix(name, ".git"), "/")
+	if len(name) > maxRepoNameLen {
+		return "", fmt.Errorf("Repo name is longer than %d characters.", maxRepoNameLen)
+	}
+	if !repoNameRegex.MatchString(name) {
+		return "", fmt.Errorf("Repo name %q may only contain letters, digits, underscores and dashes.", name)
+	}
+	return name, nil
+}
+
+// repoLocks serializes work on the same repository, while work on different repositories proceeds in
+// parallel. Locks are dropped once nobody holds or waits for them, so the map only holds repos in use.
+type repoLocks struct {
+	mut   sync.Mutex
+	locks map[string]*repoLock
+}
+
+type repoLock struct {
+	sync.Mutex
+	refs int
 }
 
-var createLock sync.Mutex
+func newRepoLocks() *repoLocks {
+	return &repoLocks{locks: map[string]*repoLock{}}
+}
+
+// lock locks repoPath, and returns the func that unlocks it
+func (r *repoLocks) lock(repoPath string) func() {
+	repoPath = filepath.Clean(repoPath)
+	r.mut.Lock()
+	l, ok := r.locks[repoPath]
+	if !ok {
+		l = &repoLock{}
+		r.locks[repoPath] = l
+	}
+	l.refs++
+	r.mut.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(r.locks, repoPath)
+		}
+	}
+}
+
+var createLocks = newRepoLocks()
 
-// createRepo creates a new Git repo if it is not present already.
+// createRepo creates a new Git repo with the permissions mode if it is not present already, using the git
+// binary gitBin.
 //
 // Largely inspired by gitreceived from Flynn.
 //
 // Returns a bool indicating whether a project was created (true) or already
 // existed (false).
-func createRepo(c cookoo.Context, repoPath string) (bool, error) {
-	createLock.Lock()
-	defer createLock.Unlock()
+func createRepo(c cookoo.Context, gitBin, repoPath string, mode os.FileMode) (bool, error) {
+	unlock := createLocks.lock(repoPath)
+	defer unlock()
 
 	fi, err := os.Stat(repoPath)
 	if err == nil && fi.IsDir() {
-		// Nothing to do.
-		log.Infof(c, "Directory %s already exists.", repoPath)
+		if isBareRepo(repoPath) {
+			log.Infof(c, "Directory %s already exists.", repoPath)
+			// repos created before push options were advertised get them too
+			return false, configureRepo(c, gitBin, repoPath)
+		}
+		// an interrupted git init leaves a directory that every push would fail in. Initializing it again
+		// fills in what is missing without touching any objects or refs that are there.
+		log.Warnf(c, "Directory %s is not a valid bare repo, initializing it again.", repoPath)
+		if err := initBareRepo(c, gitBin, repoPath); err != nil {
+			return false, fmt.Errorf("%s is a corrupt repo and could not be repaired (%s)", repoPath, err)
+		}
+		if !isBareRepo(repoPath) {
+			return false, fmt.Errorf("%s is a corrupt repo and could not be repaired", repoPath)
+		}
 		return false, nil
 	} else if os.IsNotExist(err) {
 		log.Infof(c, "Creating new directory at %s", repoPath)
 		// Create directory
-		if err := os.MkdirAll(repoPath, 0755); err != nil {
+		if err := os.MkdirAll(repoPath, mode); err != nil {
 			log.Warnf(c, "Failed to create repository: %s", err)
 			return false, err
 		}
-		cmd := exec.Command("git", "init", "--bare")
-		cmd.Dir = repoPath
-		if out, err := cmd.CombinedOutput(); err != nil {
-			log.Warnf(c, "git init output: %s", out)
+		// MkdirAll applies the umask
+		if err := os.Chmod(repoPath, mode); err != nil {
+			return false, err
+		}
+		if err := initBareRepo(c, gitBin, repoPath); err != nil {
 			return false, err
 		}
 
@@ -191,22 +660,138 @@ func createRepo(c cookoo.Context, repoPath string) (bool, error) {
 	return false, err
 }
 
-// createPreReceiveHook renders preReceiveHookTpl to repoPath/hooks/pre-receive
-func createPreReceiveHook(c cookoo.Context, gitHome, repoPath string) error {
+// initBareRepo runs git init --bare in the directory repoPath, with the git binary gitBin.
+func initBareRepo(c cookoo.Context, gitBin, repoPath string) error {
+	cmd := exec.Command(gitBin, "init", "--bare")
+	cmd.Dir = repoPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf(c, "git init output: %s", out)
+		return err
+	}
+	return configureRepo(c, gitBin, repoPath)
+}
+
+// configureRepo sets the git config of the repo at repoPath that pushes rely on. receive-pack only accepts push
+// options, such as the release-version of a build, from repos with receive.advertisePushOptions set.
+func configureRepo(c cookoo.Context, gitBin, repoPath string) error {
+	cmd := exec.Command(gitBin, "config", "receive.advertisePushOptions", "true")
+	cmd.Dir = repoPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf(c, "git config output: %s", out)
+		return err
+	}
+	return nil
+}
+
+// isBareRepo returns true if repoPath has the files and directories of a bare git repo.
+func isBareRepo(repoPath string) bool {
+	for _, name := range []string{"HEAD", "config"} {
+		if fi, err := os.Stat(filepath.Join(repoPath, name)); err != nil || !fi.Mode().IsRegular() {
+			return false
+		}
+	}
+	for _, name := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(repoPath, name)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// createPreReceiveHook renders tpl to repoPath/hooks/pre-receive, with the permissions mode
+func createPreReceiveHook(c cookoo.Context, tpl *template.Template, gitHome, repoPath string, mode os.FileMode) error {
 	// parse & generate the template anew each receive for each new git home
 	var hookByteBuf bytes.Buffer
-	if err := preReceiveHookTpl.Execute(&hookByteBuf, map[string]string{"GitHome": gitHome}); err != nil {
+	if err := tpl.Execute(&hookByteBuf, map[string]string{"GitHome": gitHome}); err != nil {
 		return err
 	}
 
 	writePath := filepath.Join(repoPath, "hooks", "pre-receive")
 	log.Debugf(c, "Writing pre-receive hook to %s", writePath)
-	if err := ioutil.WriteFile(writePath, hookByteBuf.Bytes(), 0755); err != nil {
+	if err := writeHook(writePath, hookByteBuf.Bytes(), mode); err != nil {
 		return fmt.Errorf("Cannot write pre-receive hook to %s (%s)", writePath, err)
 	}
 	return nil
 }
 
+// createPostReceiveHook installs the post-receive hook that notifies notifyURL of deploys to the repo at
+// repoPath, with the permissions mode. If notifyURL is empty, notifications are off and any hook written
+// before is removed.
+func createPostReceiveHook(c cookoo.Context, gitHome, repoPath, notifyURL string, mode os.FileMode) error {
+	writePath := filepath.Join(repoPath, "hooks", "post-receive")
+	if notifyURL == "" {
+		if err := os.Remove(writePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Cannot remove post-receive hook %s (%s)", writePath, err)
+		}
+		return nil
+	}
+
+	var hookByteBuf bytes.Buffer
+	vars := map[string]string{"GitHome": gitHome, "NotifyURL": shellQuote(notifyURL)}
+	if err := postReceiveHookTpl.Execute(&hookByteBuf, vars); err != nil {
+		return err
+	}
+	log.Debugf(c, "Writing post-receive hook to %s", writePath)
+	if err := writeHook(writePath, hookByteBuf.Bytes(), mode); err != nil {
+		return fmt.Errorf("Cannot write post-receive hook to %s (%s)", writePath, err)
+	}
+	return nil
+}
+
+// writeHook writes the hook data to path with the permissions mode. The mode is set even if the hook was
+// there already, or the umask would take bits away, since WriteFile only sets it on new files.
+func writeHook(path string, data []byte, mode os.FileMode) error {
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CheckNotifyURL returns an error if notifyURL is set but is not an http or https URL.
+func CheckNotifyURL(notifyURL string) error {
+	if notifyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(notifyURL)
+	if err != nil {
+		return fmt.Errorf("notify URL %q is invalid (%s)", notifyURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("notify URL %q is invalid, expected an http or https URL", notifyURL)
+	}
+	return nil
+}
+
+// ErrUnknownApp is returned for a push to a repo that isn't one of the apps the user may push to.
+type ErrUnknownApp struct {
+	app string
+}
+
+func (e ErrUnknownApp) Error() string {
+	return fmt.Sprintf("push rejected, %s is not an app you can push to", e.app)
+}
+
+// checkAllowedApp returns an ErrUnknownApp if app is not in allowedApps, or not one of the apps that
+// permissions' key may push to, as looked up in the controller or set by the key's apps option. An empty
+// allowedApps, or permissions without apps, don't limit the apps. Admin keys may push to any app.
+func checkAllowedApp(app string, allowedApps []string, permissions *ssh.Permissions) error {
+	if sshd.IsAdmin(permissions) {
+		return nil
+	}
+	if len(allowedApps) > 0 && !checkIfAllowed(app, allowedApps) {
+		return ErrUnknownApp{app: app}
+	}
+	if userApps, ok := sshd.AppsFromPermissions(permissions); ok && !checkIfAllowed(app, userApps) {
+		return ErrUnknownApp{app: app}
+	}
+	return nil
+}
+
 // checkIfAllowed verifies if an application is contained in a list of allowed applications
 func checkIfAllowed(app string, validApps []string) bool {
 	for _, validApp := range validApps {
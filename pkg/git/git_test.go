@@ -0,0 +1,610 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/deis/sa-builder/pkg/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestValidateOperation(t *testing.T) {
+	cases := []struct {
+		operation       string
+		allowUploadPack bool
+		ok              bool
+	}{
+		{"git-receive-pack", false, true},
+		{"git-receive-pack", true, true},
+		{"git-upload-pack", true, true},
+		{"git-upload-pack", false, false},
+		{"", false, false},
+		{"git-upload-archive", true, false},
+		{"git-shell", true, false},
+		{"git-receive-pack; rm -rf /", true, false},
+		{"git-receive-pack && cat /etc/passwd", true, false},
+		{"git-receive-pack '/etc'", true, false},
+		{"git-receive-pack\n", true, false},
+		{"$(git-receive-pack)", true, false},
+		{"GIT-RECEIVE-PACK", true, false},
+	}
+	for _, c := range cases {
+		err := validateOperation(c.operation, c.allowUploadPack)
+		if c.ok && err != nil {
+			t.Errorf("expected operation %q (upload-pack allowed: %t) to be allowed, got %s", c.operation, c.allowUploadPack, err)
+		}
+		if !c.ok {
+			if err == nil {
+				t.Errorf("expected operation %q (upload-pack allowed: %t) to be rejected", c.operation, c.allowUploadPack)
+			} else if _, ok := err.(ErrUnsupportedOperation); !ok {
+				t.Errorf("expected an ErrUnsupportedOperation for %q, got %s", c.operation, err)
+			}
+		}
+	}
+}
+
+func TestCheckProtected(t *testing.T) {
+	protected := []string{"deis-*", "router"}
+	user := &ssh.Permissions{Extensions: map[string]string{sshd.ScopeExtension: sshd.ScopeUser}}
+	admin := &ssh.Permissions{Extensions: map[string]string{sshd.ScopeExtension: sshd.ScopeAdmin}}
+
+	cases := []struct {
+		repo  string
+		perms *ssh.Permissions
+		ok    bool
+	}{
+		{"router", user, false},
+		{"deis-controller", user, false},
+		{"deis-controller", nil, false},
+		{"router", admin, true},
+		{"deis-controller", admin, true},
+		{"myapp", user, true},
+		{"routers", user, true},
+	}
+	for _, c := range cases {
+		err := checkProtected(c.repo, protected, c.perms)
+		if c.ok && err != nil {
+			t.Errorf("expected push to %s with %v to be allowed, got %s", c.repo, c.perms, err)
+		}
+		if !c.ok {
+			if err == nil {
+				t.Errorf("expected push to %s with %v to be denied", c.repo, c.perms)
+			} else if !strings.Contains(err.Error(), "repository name is reserved") {
+				t.Errorf("expected a reserved repository message for %s, got %s", c.repo, err)
+			}
+		}
+	}
+}
+
+func TestCheckAllowedApp(t *testing.T) {
+	user := &ssh.Permissions{Extensions: map[string]string{sshd.ScopeExtension: sshd.ScopeUser}}
+	admin := &ssh.Permissions{Extensions: map[string]string{sshd.ScopeExtension: sshd.ScopeAdmin}}
+	controllerUser := &ssh.Permissions{Extensions: map[string]string{sshd.ScopeExtension: sshd.ScopeUser, sshd.AppsExtension: "myapp,otherapp"}}
+
+	cases := []struct {
+		app     string
+		allowed []string
+		perms   *ssh.Permissions
+		ok      bool
+	}{
+		// no allowlist
+		{"anyapp", nil, user, true},
+		{"anyapp", nil, nil, true},
+		// configured allowlist
+		{"myapp", []string{"myapp", "otherapp"}, user, true},
+		{"unknown", []string{"myapp", "otherapp"}, user, false},
+		{"myap", []string{"myapp"}, user, false},
+		{"unknown", []string{"myapp"}, admin, true},
+		// the controller's apps of the user
+		{"otherapp", nil, controllerUser, true},
+		{"unknown", nil, controllerUser, false},
+		{"otherapp", []string{"myapp"}, controllerUser, false},
+	}
+	for _, c := range cases {
+		err := checkAllowedApp(c.app, c.allowed, c.perms)
+		if c.ok && err != nil {
+			t.Errorf("expected push to %s with allowlist %v and %v to be allowed, got %s", c.app, c.allowed, c.perms, err)
+		}
+		if !c.ok {
+			if _, isUnknown := err.(ErrUnknownApp); !isUnknown {
+				t.Errorf("expected push to %s with allowlist %v and %v to be rejected as unknown, got %v", c.app, c.allowed, c.perms, err)
+			}
+		}
+	}
+}
+
+func TestReceiveRejectsUnknownApp(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      channel,
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/unknown.git'",
+		"gitHome":      gitHome,
+		"podNamespace": "deis",
+		"allowedApps":  []string{"myapp"},
+	})
+	_, interrupt := Receive(cookoo.NewContext(), params)
+	if _, ok := interrupt.(ErrUnknownApp); !ok {
+		t.Fatalf("expected ErrUnknownApp, got %v", interrupt)
+	}
+	if !strings.Contains(channel.stderr.String(), "unknown is not an app you can push to") {
+		t.Errorf("expected the client to be told the app is unknown, got %q", channel.stderr.String())
+	}
+	if _, err := os.Stat(filepath.Join(gitHome, "unknown.git")); !os.IsNotExist(err) {
+		t.Errorf("expected no repo to be created for an unknown app")
+	}
+}
+
+func TestReceiveAppsOfKey(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	// a key with apps="checkout,billing" in authorized_keys
+	perms := &ssh.Permissions{Extensions: map[string]string{
+		"user":              "payments",
+		sshd.ScopeExtension: sshd.ScopeUser,
+		sshd.AppsExtension:  "checkout,billing",
+	}}
+	receiveApp := func(app string) (*fakeChannel, cookoo.Interrupt) {
+		channel := &fakeChannel{in: strings.NewReader("0000")}
+		params := cookoo.NewParamsWithValues(map[string]interface{}{
+			"channel":      channel,
+			"request":      &ssh.Request{},
+			"operation":    "git-receive-pack",
+			"repoName":     "'/" + app + ".git'",
+			"gitHome":      gitHome,
+			"podNamespace": "deis",
+			"permissions":  perms,
+		})
+		_, interrupt := Receive(cookoo.NewContext(), params)
+		return channel, interrupt
+	}
+
+	channel, interrupt := receiveApp("search")
+	if _, ok := interrupt.(ErrUnknownApp); !ok {
+		t.Fatalf("expected a push to an app outside the key's apps to be rejected, got %v", interrupt)
+	}
+	if !strings.Contains(channel.stderr.String(), "search is not an app you can push to") {
+		t.Errorf("expected the client to be told the app is unknown, got %q", channel.stderr.String())
+	}
+
+	if _, interrupt := receiveApp("billing"); interrupt != nil {
+		t.Fatalf("expected a push to one of the key's apps to be received, got %v", interrupt)
+	}
+	if _, err := os.Stat(filepath.Join(gitHome, "billing.git")); err != nil {
+		t.Errorf("expected the repo of the key's app to be created (%s)", err)
+	}
+}
+
+func TestNormalizeSSHConnection(t *testing.T) {
+	for _, c := range []struct {
+		raw, expected string
+		ok            bool
+	}{
+		{"10.0.0.5 53412 10.0.0.1 2223", "10.0.0.5 53412 10.0.0.1 2223", true},
+		{"fe80::1%eth0 53412 ::1 2223", "fe80::1%eth0 53412 ::1 2223", true},
+		{" 10.0.0.5  53412 10.0.0.1\t2223 ", "10.0.0.5 53412 10.0.0.1 2223", true},
+		// the default of sessions without known addresses
+		{"0 0 0 0", "0 0 0 0", true},
+		{"", "", false},
+		{"10.0.0.5 53412 10.0.0.1", "", false},
+		{"10.0.0.5 53412 10.0.0.1 2223 extra", "", false},
+		{"example.com 53412 10.0.0.1 2223", "", false},
+		{"10.0.0.5 ssh 10.0.0.1 2223", "", false},
+		{"10.0.0.5 53412 10.0.0.1 70000", "", false},
+		{"10.0.0.5 53412 10.0.0.1 2223;rm", "", false},
+	} {
+		got, err := normalizeSSHConnection(c.raw)
+		if c.ok && (err != nil || got != c.expected) {
+			t.Errorf("expected %q to be normalized to %q, got %q (%v)", c.raw, c.expected, got, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("expected %q to be rejected, got %q", c.raw, got)
+		}
+	}
+}
+
+func TestDefaultGitHome(t *testing.T) {
+	defer os.Setenv("GIT_HOME", os.Getenv("GIT_HOME"))
+
+	os.Unsetenv("GIT_HOME")
+	if gitHome := DefaultGitHome(); gitHome != "/home/git" {
+		t.Errorf("expected /home/git without GIT_HOME, got %s", gitHome)
+	}
+
+	os.Setenv("GIT_HOME", "/mnt/git")
+	if gitHome := DefaultGitHome(); gitHome != "/mnt/git" {
+		t.Errorf("expected GIT_HOME to override the default, got %s", gitHome)
+	}
+
+	// an explicit param wins over the environment
+	p := cookoo.NewParamsWithValues(map[string]interface{}{"gitHome": "/srv/git"})
+	if gitHome := p.Get("gitHome", DefaultGitHome()).(string); gitHome != "/srv/git" {
+		t.Errorf("expected the gitHome param to win over GIT_HOME, got %s", gitHome)
+	}
+}
+
+func TestPreReceiveHookUsesGitHome(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "hook")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(repoPath)
+	if err := os.MkdirAll(filepath.Join(repoPath, "hooks"), 0755); err != nil {
+		t.Fatalf("creating hooks dir (%s)", err)
+	}
+
+	if err := createPreReceiveHook(cookoo.NewContext(), preReceiveHookTpl, "/mnt/git", repoPath, DefaultModes.Hook); err != nil {
+		t.Fatalf("writing pre-receive hook (%s)", err)
+	}
+	hook, err := ioutil.ReadFile(filepath.Join(repoPath, "hooks", "pre-receive"))
+	if err != nil {
+		t.Fatalf("reading pre-receive hook (%s)", err)
+	}
+	if !strings.Contains(string(hook), "GIT_HOME=/mnt/git") {
+		t.Errorf("expected the hook to use the resolved git home, got:\n%s", hook)
+	}
+}
+
+func TestCleanRepoName(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{"'/myapp.git'", "myapp", true},
+		{"/myapp.git", "myapp", true},
+		{"myapp", "myapp", true},
+		{"my-app_2", "my-app_2", true},
+		{"/" + strings.Repeat("a", 63) + ".git", strings.Repeat("a", 63), true},
+		{"/" + strings.Repeat("a", 64) + ".git", "", false},
+		{"", "", false},
+		{"'/'", "", false},
+		{"/../etc/passwd", "", false},
+		{"/myapp;rm -rf /.git", "", false},
+		{"/$(whoami).git", "", false},
+		{"/`whoami`.git", "", false},
+		{"/my app.git", "", false},
+		{"/myapp&&id.git", "", false},
+		{"/my|app.git", "", false},
+		{"/sub/myapp.git", "", false},
+		{"/myapp\n.git", "", false},
+		{"/myapp.v2.git", "", false},
+	}
+	for _, c := range cases {
+		name, err := cleanRepoName(c.name)
+		if c.ok {
+			if err != nil {
+				t.Errorf("expected %q to be allowed, got %s", c.name, err)
+			} else if name != c.expected {
+				t.Errorf("expected %q to be cleaned to %q, got %q", c.name, c.expected, name)
+			}
+		} else if err == nil {
+			t.Errorf("expected %q to be rejected, got %q", c.name, name)
+		}
+	}
+}
+
+func TestGitCommand(t *testing.T) {
+	cmd := gitCommand(DefaultBinaries, "git-receive-pack", "myapp.git", "/home/git")
+	expected := []string{"git-receive-pack", "myapp.git"}
+	if strings.Join(cmd.Args, "\x00") != strings.Join(expected, "\x00") {
+		t.Errorf("expected argv %q, got %q", expected, cmd.Args)
+	}
+	if cmd.Dir != "/home/git" {
+		t.Errorf("expected the command to run in /home/git, got %s", cmd.Dir)
+	}
+
+	env := strings.Join(hookEnv("git-receive-pack", "myapp.git", "alice", "SHA256:abc", "deis", "1.2.3.4 5 6.7.8.9 2223"), "\n")
+	for _, e := range []string{
+		"RECEIVE_USER=alice",
+		"RECEIVE_REPO=myapp.git",
+		"RECEIVE_FINGERPRINT=SHA256:abc",
+		"SSH_ORIGINAL_COMMAND=git-receive-pack 'myapp.git'",
+		"SSH_CONNECTION=1.2.3.4 5 6.7.8.9 2223",
+		"POD_NAMESPACE=deis",
+	} {
+		if !strings.Contains(env, e) {
+			t.Errorf("expected %s in the hook environment, got:\n%s", e, env)
+		}
+	}
+}
+
+func TestCreateRepoConcurrent(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "repos")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	// several pushes to each of several repos at once. Every repo must end up a valid bare repo,
+	// created by exactly one of its pushes.
+	const repos, pushes = 5, 4
+	var wg sync.WaitGroup
+	created := make(chan string, repos*pushes)
+	for i := 0; i < repos; i++ {
+		repoPath := filepath.Join(gitHome, fmt.Sprintf("app%d.git", i))
+		for j := 0; j < pushes; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := createRepo(cookoo.NewContext(), "git", repoPath, DefaultModes.Repo)
+				if err != nil {
+					t.Errorf("creating %s (%s)", repoPath, err)
+				}
+				if ok {
+					created <- repoPath
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(created)
+
+	counts := map[string]int{}
+	for repoPath := range created {
+		counts[repoPath]++
+	}
+	for i := 0; i < repos; i++ {
+		repoPath := filepath.Join(gitHome, fmt.Sprintf("app%d.git", i))
+		if counts[repoPath] != 1 {
+			t.Errorf("expected %s to be created once, was created %d times", repoPath, counts[repoPath])
+		}
+		out, err := exec.Command("git", "--git-dir", repoPath, "rev-parse", "--is-bare-repository").Output()
+		if err != nil || strings.TrimSpace(string(out)) != "true" {
+			t.Errorf("expected %s to be a bare repo (%v, %s)", repoPath, err, out)
+		}
+	}
+	if len(createLocks.locks) != 0 {
+		t.Errorf("expected all repo locks to be released, %d left", len(createLocks.locks))
+	}
+}
+
+func TestCreateRepoRepairsCorruptRepo(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	c := cookoo.NewContext()
+
+	// a missing directory is created
+	missing := filepath.Join(gitHome, "missing.git")
+	if created, err := createRepo(c, "git", missing, DefaultModes.Repo); err != nil || !created {
+		t.Errorf("expected %s to be created, got %t (%v)", missing, created, err)
+	}
+	if !isBareRepo(missing) {
+		t.Errorf("expected %s to be a bare repo", missing)
+	}
+
+	// a valid repo is left alone
+	valid := filepath.Join(gitHome, "valid.git")
+	runGit(t, gitHome, "init", "--bare", valid)
+	if created, err := createRepo(c, "git", valid, DefaultModes.Repo); err != nil || created {
+		t.Errorf("expected %s to be used as it is, got %t (%v)", valid, created, err)
+	}
+
+	// an interrupted git init, and a repo that lost its HEAD, are initialized again
+	partial := filepath.Join(gitHome, "partial.git")
+	if err := os.Mkdir(partial, 0755); err != nil {
+		t.Fatalf("creating %s (%s)", partial, err)
+	}
+	noHead := filepath.Join(gitHome, "nohead.git")
+	runGit(t, gitHome, "init", "--bare", noHead)
+	if err := os.Remove(filepath.Join(noHead, "HEAD")); err != nil {
+		t.Fatalf("removing the HEAD of %s (%s)", noHead, err)
+	}
+	for _, repoPath := range []string{partial, noHead} {
+		if isBareRepo(repoPath) {
+			t.Fatalf("expected %s to be detected as corrupt", repoPath)
+		}
+		if _, err := createRepo(c, "git", repoPath, DefaultModes.Repo); err != nil {
+			t.Errorf("expected %s to be repaired, got %s", repoPath, err)
+		}
+		out, err := exec.Command("git", "--git-dir", repoPath, "rev-parse", "--is-bare-repository").Output()
+		if err != nil || strings.TrimSpace(string(out)) != "true" {
+			t.Errorf("expected %s to be a bare repo after the repair (%v, %s)", repoPath, err, out)
+		}
+	}
+
+	// a repo that can't be repaired is reported as corrupt
+	broken := filepath.Join(gitHome, "broken.git")
+	if err := os.Mkdir(broken, 0755); err != nil {
+		t.Fatalf("creating %s (%s)", broken, err)
+	}
+	if _, err := createRepo(c, "false", broken, DefaultModes.Repo); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("expected a repo that can't be repaired to be reported as corrupt, got %v", err)
+	}
+}
+
+func TestCreateRepoAcceptsPushOptions(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	c := cookoo.NewContext()
+
+	// a repo from before push options were advertised gets them on its next push
+	old := filepath.Join(gitHome, "old.git")
+	runGit(t, gitHome, "init", "--bare", old)
+	for _, repoPath := range []string{filepath.Join(gitHome, "new.git"), old} {
+		if _, err := createRepo(c, "git", repoPath, DefaultModes.Repo); err != nil {
+			t.Fatalf("creating %s (%s)", repoPath, err)
+		}
+		// the hook records the push options it gets, the way the pre-receive hook passes them to the build
+		hook := "#!/bin/sh\necho \"$GIT_PUSH_OPTION_COUNT $GIT_PUSH_OPTION_0\" > \"$GIT_DIR/options\"\n"
+		if err := ioutil.WriteFile(filepath.Join(repoPath, "hooks", "pre-receive"), []byte(hook), DefaultModes.Hook); err != nil {
+			t.Fatalf("writing pre-receive hook (%s)", err)
+		}
+
+		work := filepath.Join(gitHome, "work-"+filepath.Base(repoPath))
+		runGit(t, gitHome, "init", work)
+		runGit(t, work, "commit", "--allow-empty", "-m", "init")
+		runGit(t, work, "push", "-o", "release-version=4", repoPath, "HEAD:refs/heads/master")
+
+		options, err := ioutil.ReadFile(filepath.Join(repoPath, "options"))
+		if err != nil {
+			t.Fatalf("reading the push options the hook got (%s)", err)
+		}
+		if strings.TrimSpace(string(options)) != "1 release-version=4" {
+			t.Errorf("expected the hook of %s to get the release-version push option, got %q", repoPath, options)
+		}
+	}
+}
+
+func TestRepoLocksArePerRepo(t *testing.T) {
+	locks := newRepoLocks()
+	unlockA := locks.lock("/home/git/a.git")
+
+	// a held lock on one repo must not stall another
+	done := make(chan struct{})
+	go func() {
+		locks.lock("/home/git/b.git")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("locking b.git waited on the lock for a.git")
+	}
+
+	// while the same repo waits, whatever path spelling is used
+	done = make(chan struct{})
+	go func() {
+		locks.lock("/home/git/./a.git")()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("a.git was locked twice at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a.git was not handed over after unlocking")
+	}
+}
+
+func TestPostReceiveHook(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "hook")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(repoPath)
+	if err := os.MkdirAll(filepath.Join(repoPath, "hooks"), 0755); err != nil {
+		t.Fatalf("creating hooks dir (%s)", err)
+	}
+	hookPath := filepath.Join(repoPath, "hooks", "post-receive")
+
+	if err := createPostReceiveHook(cookoo.NewContext(), "/mnt/git", repoPath, "https://hooks.example.com/deploy?team=a&b='c'", DefaultModes.Hook); err != nil {
+		t.Fatalf("writing post-receive hook (%s)", err)
+	}
+	hook, err := ioutil.ReadFile(hookPath)
+	if err != nil {
+		t.Fatalf("reading post-receive hook (%s)", err)
+	}
+	for _, expected := range []string{"GIT_HOME=/mnt/git", `NOTIFY_URL='https://hooks.example.com/deploy?team=a&b='\''c'\'''`, "boot git-notify"} {
+		if !strings.Contains(string(hook), expected) {
+			t.Errorf("expected the hook to contain %s, got:\n%s", expected, hook)
+		}
+	}
+
+	// turning notifications off removes the hook
+	if err := createPostReceiveHook(cookoo.NewContext(), "/mnt/git", repoPath, "", DefaultModes.Hook); err != nil {
+		t.Fatalf("removing post-receive hook (%s)", err)
+	}
+	if _, err := os.Stat(hookPath); !os.IsNotExist(err) {
+		t.Errorf("expected no post-receive hook without a notify URL")
+	}
+	if err := createPostReceiveHook(cookoo.NewContext(), "/mnt/git", repoPath, "", DefaultModes.Hook); err != nil {
+		t.Errorf("expected no error when there is no hook to remove, got %s", err)
+	}
+}
+
+func TestCheckNotifyURL(t *testing.T) {
+	for _, valid := range []string{"", "http://example.com/hook", "https://hooks.slack.com/services/T0/B0/x"} {
+		if err := CheckNotifyURL(valid); err != nil {
+			t.Errorf("expected %q to be valid, got %s", valid, err)
+		}
+	}
+	for _, invalid := range []string{"example.com/hook", "ftp://example.com", "http://"} {
+		if err := CheckNotifyURL(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestLoadPreReceiveHookTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook-template")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tpl, err := LoadPreReceiveHookTemplate("")
+	if err != nil || tpl != preReceiveHookTpl {
+		t.Errorf("expected the built-in template without a path, got %v (%v)", tpl, err)
+	}
+
+	custom := filepath.Join(dir, "custom")
+	if err := ioutil.WriteFile(custom, []byte("#!/bin/bash\nGIT_HOME={{ .GitHome }} EXTRA=1 boot git-receive\n"), 0644); err != nil {
+		t.Fatalf("writing template (%s)", err)
+	}
+	tpl, err = LoadPreReceiveHookTemplate(custom)
+	if err != nil {
+		t.Fatalf("loading custom template (%s)", err)
+	}
+	repoPath := filepath.Join(dir, "myapp.git")
+	if err := os.MkdirAll(filepath.Join(repoPath, "hooks"), 0755); err != nil {
+		t.Fatalf("creating hooks dir (%s)", err)
+	}
+	if err := createPreReceiveHook(cookoo.NewContext(), tpl, "/mnt/git", repoPath, DefaultModes.Hook); err != nil {
+		t.Fatalf("writing pre-receive hook (%s)", err)
+	}
+	hook, err := ioutil.ReadFile(filepath.Join(repoPath, "hooks", "pre-receive"))
+	if err != nil {
+		t.Fatalf("reading pre-receive hook (%s)", err)
+	}
+	if !strings.Contains(string(hook), "GIT_HOME=/mnt/git EXTRA=1") {
+		t.Errorf("expected the custom hook, got:\n%s", hook)
+	}
+
+	invalid := map[string]string{
+		"unparseable": "GIT_HOME={{.GitHome boot git-receive",
+		"no-git-home": "#!/bin/bash\nboot git-receive\n",
+		"unknown-var": "GIT_HOME={{.GitHome}} USER={{.User}} boot git-receive",
+	}
+	for name, text := range invalid {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("writing template (%s)", err)
+		}
+		if _, err := LoadPreReceiveHookTemplate(path); err == nil {
+			t.Errorf("expected the %s template to be rejected", name)
+		}
+	}
+	if _, err := LoadPreReceiveHookTemplate(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected a missing template file to be rejected")
+	}
+}
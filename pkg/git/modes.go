@@ -0,0 +1,53 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// RepoModes is the context key for the Modes of the repos and hooks that Receive creates.
+const RepoModes = "git.RepoModes"
+
+// Modes are the permissions of the repo directories and hook files that Receive creates. They are set as
+// they are, whatever the umask, so that repos on a shared volume can be kept from other users.
+type Modes struct {
+	Repo os.FileMode
+	Hook os.FileMode
+}
+
+// DefaultModes lets every user read repos and run their hooks, and only the builder write them.
+var DefaultModes = Modes{Repo: 0755, Hook: 0755}
+
+// ParseModes returns the Modes of the octal permissions repo and hook, such as 0750, or an error if either
+// is not a permission or Check rejects them.
+func ParseModes(repo, hook string) (Modes, error) {
+	var modes Modes
+	for _, m := range []struct {
+		name  string
+		value string
+		mode  *os.FileMode
+	}{
+		{"GIT_REPO_MODE", repo, &modes.Repo},
+		{"GIT_HOOK_MODE", hook, &modes.Hook},
+	} {
+		perm, err := strconv.ParseUint(m.value, 8, 32)
+		if err != nil || perm > uint64(os.ModePerm) {
+			return Modes{}, fmt.Errorf("%s %q is not an octal permission like 0755", m.name, m.value)
+		}
+		*m.mode = os.FileMode(perm)
+	}
+	return modes, modes.Check()
+}
+
+// Check returns an error if the builder, which owns the repos and hooks, couldn't use repos or run hooks
+// with m: it must be able to read, write and enter repos, and to read and execute hooks.
+func (m Modes) Check() error {
+	if m.Repo&0700 != 0700 {
+		return fmt.Errorf("repo mode %#o must let the owner read, write and enter repos (0700)", m.Repo)
+	}
+	if m.Hook&0500 != 0500 {
+		return fmt.Errorf("hook mode %#o must let the owner read and execute hooks (0500)", m.Hook)
+	}
+	return nil
+}
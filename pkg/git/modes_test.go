@@ -0,0 +1,80 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseModes(t *testing.T) {
+	modes, err := ParseModes("0770", "750")
+	if err != nil {
+		t.Fatalf("parsing modes (%s)", err)
+	}
+	if modes.Repo != 0770 || modes.Hook != 0750 {
+		t.Errorf("expected repo mode 0770 and hook mode 0750, got %+v", modes)
+	}
+	if modes, err := ParseModes("0755", "0755"); err != nil || modes != DefaultModes {
+		t.Errorf("expected the default modes, got %+v (%v)", modes, err)
+	}
+
+	for _, c := range [][2]string{
+		{"rwxr-xr-x", "0755"},
+		{"0755", "0789"},
+		{"01755", "0755"},
+		// the builder can't write to the repo
+		{"0555", "0755"},
+		// the hook can't be run
+		{"0755", "0644"},
+		{"0755", "0300"},
+	} {
+		if _, err := ParseModes(c[0], c[1]); err == nil {
+			t.Errorf("expected repo mode %s and hook mode %s to be rejected", c[0], c[1])
+		}
+	}
+}
+
+func TestReceiveRepoModes(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	// group write is taken away by the usual umask of 022, and must be set anyway
+	modes := Modes{Repo: 0770, Hook: 0750}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      &fakeChannel{in: strings.NewReader("0000")},
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/myapp.git'",
+		"gitHome":      gitHome,
+		"podNamespace": "deis",
+		"notifyURL":    "https://hooks.example.com/deploy",
+		"repoModes":    modes,
+	})
+	if _, interrupt := Receive(cookoo.NewContext(), params); interrupt != nil {
+		t.Fatalf("receiving a push (%v)", interrupt)
+	}
+
+	repoPath := filepath.Join(gitHome, "myapp.git")
+	for path, mode := range map[string]os.FileMode{
+		repoPath: modes.Repo,
+		filepath.Join(repoPath, "hooks", "pre-receive"):  modes.Hook,
+		filepath.Join(repoPath, "hooks", "post-receive"): modes.Hook,
+	} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("expected %s to be created (%s)", path, err)
+			continue
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("expected %s to have mode %#o, got %#o", path, mode, fi.Mode().Perm())
+		}
+	}
+}
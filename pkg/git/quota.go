@@ -0,0 +1,116 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DiskQuota is the context key for the Quota that pushes are held to.
+const DiskQuota string = "git.DiskQuota"
+
+// Quota limits the disk space that pushes may use, in bytes. Zero fields are not enforced.
+type Quota struct {
+	// Repo is the maximum size of a single repo.
+	Repo int64
+	// Total is the maximum size of all repos in the git home together.
+	Total int64
+	// Push is the maximum amount of data a single push may send.
+	Push int64
+}
+
+// ErrQuotaExceeded is returned when a push would take a repo, the git home or the push itself over its quota.
+type ErrQuotaExceeded struct {
+	what  string
+	limit int64
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("push rejected, %s is over its disk quota of %d bytes", e.what, e.limit)
+}
+
+// limitReader returns a reader of r that fails with ErrQuotaExceeded once a push to repo, at repoPath under
+// gitHome, has sent more than the quota allows. It returns an error right away if the repo or the git home
+// is already full.
+func (q Quota) limitReader(r io.Reader, gitHome, repoPath, repo string) (io.Reader, error) {
+	lr := &quotaReader{r: r, remaining: -1}
+	lower := func(remaining int64, err ErrQuotaExceeded) {
+		if lr.remaining < 0 || remaining < lr.remaining {
+			lr.remaining, lr.err = remaining, err
+		}
+	}
+	if q.Push > 0 {
+		lower(q.Push, ErrQuotaExceeded{what: "the push", limit: q.Push})
+	}
+	if q.Repo > 0 {
+		used, err := dirSize(repoPath)
+		if err != nil {
+			return nil, err
+		}
+		quotaErr := ErrQuotaExceeded{what: "repo " + repo, limit: q.Repo}
+		if used >= q.Repo {
+			return nil, quotaErr
+		}
+		lower(q.Repo-used, quotaErr)
+	}
+	if q.Total > 0 {
+		used, err := dirSize(gitHome)
+		if err != nil {
+			return nil, err
+		}
+		quotaErr := ErrQuotaExceeded{what: "the git home", limit: q.Total}
+		if used >= q.Total {
+			return nil, quotaErr
+		}
+		lower(q.Total-used, quotaErr)
+	}
+	if lr.remaining < 0 {
+		return r, nil
+	}
+	return lr, nil
+}
+
+// quotaReader reads at most remaining bytes from r, and then fails with err if r has more to give.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (q *quotaReader) Read(b []byte) (int, error) {
+	// read one byte past the limit, so that input of exactly the allowed size is not rejected
+	if int64(len(b)) > q.remaining+1 {
+		b = b[:q.remaining+1]
+	}
+	n, err := q.r.Read(b)
+	if int64(n) > q.remaining {
+		n = int(q.remaining)
+		q.remaining = 0
+		return n, q.err
+	}
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// dirSize returns the total size of the files under path. Files removed while it runs, such as temporary
+// packs of a concurrent push, are skipped.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Cannot measure the disk usage of %s (%s)", path, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,116 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestQuotaReaderAbortsOversizedInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	quota := Quota{Push: 1024}
+	r, err := quota.limitReader(bytes.NewReader(make([]byte, 1<<20)), dir, filepath.Join(dir, "myapp.git"), "myapp.git")
+	if err != nil {
+		t.Fatalf("limiting reader (%s)", err)
+	}
+	var out bytes.Buffer
+	_, err = io.Copy(&out, r)
+	if _, ok := err.(ErrQuotaExceeded); !ok {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if out.Len() != 1024 {
+		t.Errorf("expected the copy to stop at 1024 bytes, copied %d", out.Len())
+	}
+
+	r, err = quota.limitReader(bytes.NewReader(make([]byte, 1024)), dir, filepath.Join(dir, "myapp.git"), "myapp.git")
+	if err != nil {
+		t.Fatalf("limiting reader (%s)", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Errorf("expected a push of exactly the quota to be allowed, got %s", err)
+	}
+}
+
+func TestQuotaReaderUsesSmallestLimit(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	repoPath := filepath.Join(gitHome, "myapp.git")
+	if err := os.Mkdir(repoPath, 0755); err != nil {
+		t.Fatalf("creating repo (%s)", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoPath, "objects"), make([]byte, 600), 0644); err != nil {
+		t.Fatalf("writing repo file (%s)", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitHome, "other"), make([]byte, 300), 0644); err != nil {
+		t.Fatalf("writing git home file (%s)", err)
+	}
+
+	tests := []struct {
+		quota    Quota
+		copied   int
+		quotaErr string
+	}{
+		{Quota{Push: 500, Repo: 1000, Total: 2000}, 400, "repo myapp.git"},
+		{Quota{Push: 100, Repo: 1000, Total: 2000}, 100, "the push"},
+		{Quota{Repo: 2000, Total: 1000}, 100, "the git home"},
+	}
+	for _, test := range tests {
+		r, err := test.quota.limitReader(bytes.NewReader(make([]byte, 4096)), gitHome, repoPath, "myapp.git")
+		if err != nil {
+			t.Fatalf("limiting reader (%s)", err)
+		}
+		n, err := io.Copy(ioutil.Discard, r)
+		if err == nil || !strings.Contains(err.Error(), test.quotaErr) {
+			t.Errorf("%+v: expected a quota error for %s, got %v", test.quota, test.quotaErr, err)
+		}
+		if int(n) != test.copied {
+			t.Errorf("%+v: expected %d bytes to be copied, got %d", test.quota, test.copied, n)
+		}
+	}
+
+	if _, err := (Quota{Repo: 600}).limitReader(strings.NewReader(""), gitHome, repoPath, "myapp.git"); err == nil {
+		t.Errorf("expected a repo that is already full to be rejected")
+	}
+}
+
+func TestReceiveRejectsRepoOverQuota(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	runGit(t, gitHome, "init", "--bare", filepath.Join(gitHome, "myapp.git"))
+
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      channel,
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/myapp.git'",
+		"gitHome":      gitHome,
+		"diskQuota":    Quota{Repo: 1},
+		"podNamespace": "deis",
+	})
+	_, interrupt := Receive(cookoo.NewContext(), params)
+	if _, ok := interrupt.(ErrQuotaExceeded); !ok {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", interrupt)
+	}
+	if !strings.Contains(channel.stderr.String(), "disk quota") {
+		t.Errorf("expected the client to be told about the quota, got %q", channel.stderr.String())
+	}
+}
@@ -0,0 +1,214 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeChannel is an ssh.Channel that reads the client's side of the conversation from in
+type fakeChannel struct {
+	in     io.Reader
+	out    bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func (f *fakeChannel) Read(data []byte) (int, error)  { return f.in.Read(data) }
+func (f *fakeChannel) Write(data []byte) (int, error) { return f.out.Write(data) }
+func (f *fakeChannel) Close() error                   { return nil }
+func (f *fakeChannel) CloseWrite() error              { return nil }
+func (f *fakeChannel) Stderr() io.ReadWriter          { return &f.stderr }
+func (f *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func receive(gitHome, operation, repoName string, allowUploadPack bool, channel ssh.Channel) error {
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":         channel,
+		"request":         &ssh.Request{},
+		"operation":       operation,
+		"repoName":        repoName,
+		"gitHome":         gitHome,
+		"allowUploadPack": allowUploadPack,
+		"podNamespace":    "deis",
+	})
+	_, err := Receive(cookoo.NewContext(), params)
+	if err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+func TestReceiveUploadPack(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	repoPath := filepath.Join(gitHome, "myapp.git")
+	runGit(t, gitHome, "init", "--bare", repoPath)
+	runGit(t, gitHome, "init", "work")
+	work := filepath.Join(gitHome, "work")
+	runGit(t, work, "commit", "--allow-empty", "-m", "deployed")
+	runGit(t, work, "push", repoPath, "HEAD:refs/heads/master")
+
+	// a flush packet tells upload-pack that the client doesn't want anything after the ref advertisement
+	channel := &fakeChannel{in: strings.NewReader("0000")}
+	if err := receive(gitHome, "git-upload-pack", "'/myapp.git'", true, channel); err != nil {
+		t.Fatalf("serving git-upload-pack (%s): %s", err, channel.stderr.String())
+	}
+	if !strings.Contains(channel.out.String(), "refs/heads/master") {
+		t.Errorf("expected the refs to be advertised, got %q", channel.out.String())
+	}
+	if _, err := os.Stat(filepath.Join(repoPath, "hooks", "pre-receive")); !os.IsNotExist(err) {
+		t.Errorf("expected no pre-receive hook to be written for git-upload-pack")
+	}
+}
+
+func TestReceiveUploadPackRejected(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	// not enabled
+	err = receive(gitHome, "git-upload-pack", "'/myapp.git'", false, &fakeChannel{in: strings.NewReader("0000")})
+	if _, ok := err.(ErrUnsupportedOperation); !ok {
+		t.Errorf("expected git-upload-pack to be rejected when disabled, got %v", err)
+	}
+
+	// unknown operations are rejected even when upload-pack is enabled
+	err = receive(gitHome, "git-upload-archive", "'/myapp.git'", true, &fakeChannel{in: strings.NewReader("0000")})
+	if _, ok := err.(ErrUnsupportedOperation); !ok {
+		t.Errorf("expected git-upload-archive to be rejected, got %v", err)
+	}
+
+	// git-upload-pack never creates repos
+	if err := receive(gitHome, "git-upload-pack", "'/newapp.git'", true, &fakeChannel{in: strings.NewReader("0000")}); err == nil {
+		t.Errorf("expected git-upload-pack of a missing repo to fail")
+	}
+	if _, err := os.Stat(filepath.Join(gitHome, "newapp.git")); !os.IsNotExist(err) {
+		t.Errorf("expected git-upload-pack not to create a repo")
+	}
+}
+
+func TestReceiveRequiresNamespace(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	for _, ns := range []string{"", "Not_A_Namespace"} {
+		channel := &fakeChannel{in: strings.NewReader("0000")}
+		params := cookoo.NewParamsWithValues(map[string]interface{}{
+			"channel":      channel,
+			"request":      &ssh.Request{},
+			"operation":    "git-receive-pack",
+			"repoName":     "'/myapp.git'",
+			"gitHome":      gitHome,
+			"podNamespace": ns,
+		})
+		if _, err := Receive(cookoo.NewContext(), params); err == nil {
+			t.Errorf("expected a push with namespace %q to be rejected", ns)
+		}
+		if !strings.Contains(channel.stderr.String(), "namespace") {
+			t.Errorf("expected the client to be told about the namespace, got %q", channel.stderr.String())
+		}
+		if _, err := os.Stat(filepath.Join(gitHome, "myapp.git")); !os.IsNotExist(err) {
+			t.Errorf("expected no repo to be created without a namespace")
+		}
+	}
+}
+
+func TestReceiveExitStatus(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	runGit(t, gitHome, "init", "--bare", filepath.Join(gitHome, "myapp.git"))
+
+	// a flush packet is a clean exit, anything that isn't a pkt-line is a protocol error
+	if err := receive(gitHome, "git-upload-pack", "'/myapp.git'", true, &fakeChannel{in: strings.NewReader("0000")}); err != nil {
+		t.Fatalf("serving git-upload-pack (%s)", err)
+	}
+	err = receive(gitHome, "git-upload-pack", "'/myapp.git'", true, &fakeChannel{in: strings.NewReader("not a pkt-line")})
+	status, ok := err.(interface {
+		ExitStatus() uint32
+	})
+	if !ok {
+		t.Fatalf("expected an error with the exit status of git-upload-pack, got %v", err)
+	}
+	if status.ExitStatus() != 128 {
+		t.Errorf("expected git's exit status 128 for a protocol error, got %d", status.ExitStatus())
+	}
+}
+
+func TestCommandExitStatus(t *testing.T) {
+	cases := []struct {
+		script   string
+		expected uint32
+	}{
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+	}
+	for _, c := range cases {
+		err := exec.Command("sh", "-c", c.script).Run()
+		if status := commandExitStatus(err); status != c.expected {
+			t.Errorf("%s: expected exit status %d, got %d", c.script, c.expected, status)
+		}
+	}
+	if status := commandExitStatus(errors.New("not started")); status != 1 {
+		t.Errorf("expected exit status 1 for an error without one, got %d", status)
+	}
+}
+
+// fakeRequest records the replies Receive sends to the exec request.
+type fakeRequest struct {
+	replies []bool
+	payload [][]byte
+}
+
+func (r *fakeRequest) Reply(ok bool, payload []byte) error {
+	r.replies = append(r.replies, ok)
+	r.payload = append(r.payload, payload)
+	return nil
+}
+
+func TestReceiveRepliesToRequest(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+
+	// the request is accepted even when the operation is then rejected, which the client sees on stderr
+	req := &fakeRequest{}
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":   &fakeChannel{in: strings.NewReader("0000")},
+		"request":   req,
+		"operation": "git-upload-archive",
+		"repoName":  "'/myapp.git'",
+		"gitHome":   gitHome,
+	})
+	if _, err := Receive(cookoo.NewContext(), params); err == nil {
+		t.Fatalf("expected git-upload-archive to be rejected")
+	}
+	if len(req.replies) != 1 {
+		t.Fatalf("expected 1 reply to the exec request, got %d", len(req.replies))
+	}
+	if !req.replies[0] || req.payload[0] != nil {
+		t.Errorf("expected Reply(true, nil), got Reply(%t, %v)", req.replies[0], req.payload[0])
+	}
+}
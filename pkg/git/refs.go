@@ -0,0 +1,139 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+)
+
+const (
+	// OnCorruptPack is the context key for what to do with a repo after a corrupt pack is received.
+	OnCorruptPack string = "git.OnCorruptPack"
+
+	// OnCorruptPackReset restores the repo's refs to their pre-push state so the repo stays usable.
+	OnCorruptPackReset = "reset"
+	// OnCorruptPackPreserve leaves the repo exactly as the failed push left it, for debugging.
+	OnCorruptPackPreserve = "preserve"
+)
+
+// corruptPackMarkers are fragments of git-receive-pack's stderr that indicate a corrupt or incomplete pack.
+var corruptPackMarkers = []string{
+	"index-pack failed",
+	"index-pack abnormal exit",
+	"unpack-objects abnormal exit",
+	"unpacker error",
+	"pack has bad object",
+	"pack has junk at the end",
+	"pack is corrupted",
+	"early EOF",
+	"premature end of pack file",
+	"did not receive expected object",
+	"inflate returned",
+}
+
+// CheckOnCorruptPack returns an error if mode is not one of the OnCorruptPack* modes.
+func CheckOnCorruptPack(mode string) error {
+	switch mode {
+	case OnCorruptPackReset, OnCorruptPackPreserve:
+		return nil
+	}
+	return fmt.Errorf("unknown corrupt pack mode %q, expected %q or %q", mode, OnCorruptPackReset, OnCorruptPackPreserve)
+}
+
+// isCorruptPack reports whether the stderr of a failed git-receive-pack indicates a corrupt or incomplete pack.
+func isCorruptPack(stderr []byte) bool {
+	for _, marker := range corruptPackMarkers {
+		if bytes.Contains(stderr, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// refSnapshot maps the full name of every ref in a repo to the object it points to.
+type refSnapshot map[string]string
+
+// snapshotRefs records the current state of all refs in the repo at repoPath, using the git binary gitBin.
+func snapshotRefs(gitBin, repoPath string) (refSnapshot, error) {
+	cmd := exec.Command(gitBin, "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list refs in %s (%s)", repoPath, err)
+	}
+	refs := refSnapshot{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		refs[fields[1]] = fields[0]
+	}
+	return refs, scanner.Err()
+}
+
+// restoreRefs moves every ref in the repo at repoPath back to where it was in snapshot, deleting refs that
+// were created since and removing any temporary packs left behind by an interrupted index-pack.
+func restoreRefs(gitBin, repoPath string, snapshot refSnapshot) error {
+	current, err := snapshotRefs(gitBin, repoPath)
+	if err != nil {
+		return err
+	}
+	for ref := range current {
+		if _, ok := snapshot[ref]; !ok {
+			if err := updateRef(gitBin, repoPath, "-d", ref); err != nil {
+				return err
+			}
+		}
+	}
+	for ref, sha := range snapshot {
+		if current[ref] != sha {
+			if err := updateRef(gitBin, repoPath, ref, sha); err != nil {
+				return err
+			}
+		}
+	}
+
+	tmpPacks, err := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "tmp_*"))
+	if err != nil {
+		return err
+	}
+	for _, tmpPack := range tmpPacks {
+		if err := os.Remove(tmpPack); err != nil {
+			return fmt.Errorf("Cannot remove incomplete pack %s (%s)", tmpPack, err)
+		}
+	}
+	return nil
+}
+
+func updateRef(gitBin, repoPath string, args ...string) error {
+	cmd := exec.Command(gitBin, append([]string{"update-ref"}, args...)...)
+	cmd.Dir = repoPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git update-ref %s failed: %s (%s)", strings.Join(args, " "), out, err)
+	}
+	return nil
+}
+
+// recoverFromFailedReceive applies the mode (one of the OnCorruptPack* constants) to the repo at repoPath
+// if stderr shows that the receive failed because of a corrupt pack. before is the snapshot of the repo's
+// refs taken before the receive started.
+func recoverFromFailedReceive(c cookoo.Context, gitBin, repoPath, mode string, before refSnapshot, stderr []byte) error {
+	if !isCorruptPack(stderr) {
+		return nil
+	}
+	if mode == OnCorruptPackPreserve {
+		log.Warnf(c, "Received a corrupt pack, preserving %s for debugging.", repoPath)
+		return nil
+	}
+	log.Warnf(c, "Received a corrupt pack, resetting refs in %s to their state before the push.", repoPath)
+	return restoreRefs(gitBin, repoPath, before)
+}
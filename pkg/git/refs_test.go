@@ -0,0 +1,144 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+)
+
+const corruptPackStderr = "error: index-pack died of signal 15\nfatal: index-pack failed\n"
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s (%s)", strings.Join(args, " "), out, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// setupFailedPush creates a bare repo with a master branch, snapshots its refs, and then leaves it the way an
+// interrupted push of a corrupt pack might: master moved, a new branch created and a temporary pack on disk.
+func setupFailedPush(t *testing.T) (string, refSnapshot, func()) {
+	dir, err := ioutil.TempDir("", "corrupt-pack")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	repoPath := filepath.Join(dir, "app.git")
+	runGit(t, dir, "init", "--bare", repoPath)
+	runGit(t, dir, "init", "work")
+	work := filepath.Join(dir, "work")
+	runGit(t, work, "commit", "--allow-empty", "-m", "first")
+	runGit(t, work, "push", repoPath, "HEAD:refs/heads/master")
+
+	before, err := snapshotRefs("git", repoPath)
+	if err != nil {
+		t.Fatalf("snapshotting refs (%s)", err)
+	}
+
+	runGit(t, work, "commit", "--allow-empty", "-m", "second")
+	runGit(t, work, "push", repoPath, "HEAD:refs/heads/master", "HEAD:refs/heads/feature")
+	tmpPack := filepath.Join(repoPath, "objects", "pack", "tmp_pack_abc123")
+	if err := ioutil.WriteFile(tmpPack, []byte("PACK"), 0644); err != nil {
+		t.Fatalf("writing temporary pack (%s)", err)
+	}
+	return repoPath, before, func() { os.RemoveAll(dir) }
+}
+
+func TestIsCorruptPack(t *testing.T) {
+	if !isCorruptPack([]byte(corruptPackStderr)) {
+		t.Errorf("expected index-pack failure to be detected as a corrupt pack")
+	}
+	if !isCorruptPack([]byte("fatal: early EOF\n")) {
+		t.Errorf("expected early EOF to be detected as a corrupt pack")
+	}
+	if isCorruptPack([]byte("remote: deploys to app are frozen by policy\n")) {
+		t.Errorf("expected a rejected push not to be detected as a corrupt pack")
+	}
+}
+
+func TestRecoverFromFailedReceiveReset(t *testing.T) {
+	repoPath, before, cleanup := setupFailedPush(t)
+	defer cleanup()
+
+	if err := recoverFromFailedReceive(cookoo.NewContext(), "git", repoPath, OnCorruptPackReset, before, []byte(corruptPackStderr)); err != nil {
+		t.Fatalf("resetting repo (%s)", err)
+	}
+	after, err := snapshotRefs("git", repoPath)
+	if err != nil {
+		t.Fatalf("snapshotting refs (%s)", err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected refs %v after reset, got %v", before, after)
+	}
+	for ref, sha := range before {
+		if after[ref] != sha {
+			t.Errorf("expected %s to be reset to %s, got %s", ref, sha, after[ref])
+		}
+	}
+	if tmpPacks, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "tmp_*")); len(tmpPacks) > 0 {
+		t.Errorf("expected temporary packs to be removed, found %v", tmpPacks)
+	}
+}
+
+func TestRecoverFromFailedReceivePreserve(t *testing.T) {
+	repoPath, before, cleanup := setupFailedPush(t)
+	defer cleanup()
+
+	failed, err := snapshotRefs("git", repoPath)
+	if err != nil {
+		t.Fatalf("snapshotting refs (%s)", err)
+	}
+	if err := recoverFromFailedReceive(cookoo.NewContext(), "git", repoPath, OnCorruptPackPreserve, before, []byte(corruptPackStderr)); err != nil {
+		t.Fatalf("preserving repo (%s)", err)
+	}
+	after, err := snapshotRefs("git", repoPath)
+	if err != nil {
+		t.Fatalf("snapshotting refs (%s)", err)
+	}
+	for ref, sha := range failed {
+		if after[ref] != sha {
+			t.Errorf("expected %s to be preserved at %s, got %s", ref, sha, after[ref])
+		}
+	}
+	if tmpPacks, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "tmp_*")); len(tmpPacks) != 1 {
+		t.Errorf("expected the temporary pack to be preserved, found %v", tmpPacks)
+	}
+}
+
+func TestRecoverFromFailedReceiveNotCorrupt(t *testing.T) {
+	repoPath, before, cleanup := setupFailedPush(t)
+	defer cleanup()
+
+	if err := recoverFromFailedReceive(cookoo.NewContext(), "git", repoPath, OnCorruptPackReset, before, []byte("hook declined")); err != nil {
+		t.Fatalf("recovering repo (%s)", err)
+	}
+	after, err := snapshotRefs("git", repoPath)
+	if err != nil {
+		t.Fatalf("snapshotting refs (%s)", err)
+	}
+	if _, ok := after["refs/heads/feature"]; !ok {
+		t.Errorf("expected refs to be left alone when the pack is not corrupt")
+	}
+}
+
+func TestCheckOnCorruptPack(t *testing.T) {
+	for _, mode := range []string{OnCorruptPackReset, OnCorruptPackPreserve} {
+		if err := CheckOnCorruptPack(mode); err != nil {
+			t.Errorf("expected %q to be valid, got %s", mode, err)
+		}
+	}
+	if err := CheckOnCorruptPack("discard"); err == nil {
+		t.Errorf("expected unknown mode to be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Repo is a repo in the git home, as returned by ListRepos.
+type Repo struct {
+	// Name is the name of the app, without the .git suffix
+	Name string
+	Path string
+	// SHA is the commit that HEAD points to or, if the branch of HEAD was never pushed, the commit of the
+	// branch that was pushed to last. It is empty if nothing was pushed to the repo.
+	SHA string
+}
+
+// ListRepos returns the bare repos named <app>.git in gitHome, sorted by name. The refs of each repo are read
+// from its files rather than with git, so that listing a git home with hundreds of repos stays cheap.
+func ListRepos(gitHome string) ([]Repo, error) {
+	entries, err := ioutil.ReadDir(gitHome)
+	if err != nil {
+		return nil, err
+	}
+	var repos []Repo
+	for _, fi := range entries {
+		if !fi.IsDir() || !strings.HasSuffix(fi.Name(), ".git") {
+			continue
+		}
+		repoPath := filepath.Join(gitHome, fi.Name())
+		if !isBareRepo(repoPath) {
+			continue
+		}
+		sha, err := headSHA(repoPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading the refs of %s (%s)", repoPath, err)
+		}
+		repos = append(repos, Repo{Name: strings.TrimSuffix(fi.Name(), ".git"), Path: repoPath, SHA: sha})
+	}
+	return repos, nil
+}
+
+// headSHA returns the commit that HEAD of the bare repo at repoPath points to, falling back to the branch
+// that was updated last if HEAD's branch doesn't exist.
+func headSHA(repoPath string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(head, "ref: ") {
+		// a detached HEAD holds the commit itself
+		return head, nil
+	}
+	sha, err := resolveRef(repoPath, strings.TrimPrefix(head, "ref: "))
+	if err != nil || sha != "" {
+		return sha, err
+	}
+	return lastUpdatedBranch(repoPath)
+}
+
+// resolveRef returns the commit that the ref name points to in the repo at repoPath, or "" if there is no
+// such ref. Loose refs take precedence over packed-refs, like they do for git.
+func resolveRef(repoPath, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, filepath.FromSlash(name)))
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	packed, err := readPackedRefs(repoPath)
+	if err != nil {
+		return "", err
+	}
+	return packed[name], nil
+}
+
+// readPackedRefs returns the refs in the packed-refs file of the repo at repoPath, by name.
+func readPackedRefs(repoPath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repoPath, "packed-refs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// skip the header and the peeled objects of annotated tags
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, nil
+}
+
+// lastUpdatedBranch returns the commit of the loose branch ref in the repo at repoPath that was modified
+// last, or "" if it has none. git-receive-pack writes the loose ref of every branch that is pushed.
+func lastUpdatedBranch(repoPath string) (string, error) {
+	var sha string
+	var latest time.Time
+	err := filepath.Walk(filepath.Join(repoPath, "refs", "heads"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !fi.ModTime().After(latest) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sha, latest = strings.TrimSpace(string(data)), fi.ModTime()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return sha, err
+}
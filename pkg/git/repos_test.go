@@ -0,0 +1,52 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListRepos(t *testing.T) {
+	gitHome := setupGitHome(t, "empty", "mainonly", "myapp", "packed")
+	defer os.RemoveAll(gitHome)
+	for _, app := range []string{"empty", "mainonly", "myapp", "packed"} {
+		runGit(t, filepath.Join(gitHome, app+".git"), "symbolic-ref", "HEAD", "refs/heads/master")
+	}
+	runGit(t, gitHome, "init", "work")
+	work := filepath.Join(gitHome, "work")
+	runGit(t, work, "commit", "--allow-empty", "-m", "first")
+	first := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "push", filepath.Join(gitHome, "myapp.git"), "HEAD:refs/heads/master")
+	runGit(t, work, "push", filepath.Join(gitHome, "packed.git"), "HEAD:refs/heads/master")
+	runGit(t, filepath.Join(gitHome, "packed.git"), "pack-refs", "--all")
+	runGit(t, work, "commit", "--allow-empty", "-m", "second")
+	second := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "push", filepath.Join(gitHome, "mainonly.git"), "HEAD:refs/heads/main")
+	// things in the git home that aren't repos of apps are not listed
+	if err := os.Mkdir(filepath.Join(gitHome, "notarepo.git"), 0755); err != nil {
+		t.Fatalf("creating notarepo.git (%s)", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(gitHome, "file.git"), nil, 0644); err != nil {
+		t.Fatalf("writing file.git (%s)", err)
+	}
+
+	repos, err := ListRepos(gitHome)
+	if err != nil {
+		t.Fatalf("listing repos (%s)", err)
+	}
+	expected := []Repo{
+		{Name: "empty", Path: filepath.Join(gitHome, "empty.git"), SHA: ""},
+		{Name: "mainonly", Path: filepath.Join(gitHome, "mainonly.git"), SHA: second},
+		{Name: "myapp", Path: filepath.Join(gitHome, "myapp.git"), SHA: first},
+		{Name: "packed", Path: filepath.Join(gitHome, "packed.git"), SHA: first},
+	}
+	if len(repos) != len(expected) {
+		t.Fatalf("expected %d repos, got %+v", len(expected), repos)
+	}
+	for i, repo := range repos {
+		if repo != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], repo)
+		}
+	}
+}
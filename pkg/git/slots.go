@@ -0,0 +1,63 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// BuildSlots is the context key for the *Slots that limit how many builds run at once.
+const BuildSlots string = "git.BuildSlots"
+
+// Slots limits the number of pushes that build at once, so that a burst of pushes queues instead of
+// launching a builder pod for each. A nil *Slots doesn't limit anything.
+type Slots struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// NewSlots returns Slots that let max builds run at once, with pushes beyond that waiting up to timeout, or
+// forever if it is 0, for one of them to finish. It returns nil, which doesn't limit builds, if max is 0.
+func NewSlots(max int, timeout time.Duration) *Slots {
+	if max <= 0 {
+		return nil
+	}
+	return &Slots{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// ErrNoBuildSlot is returned for a push that waited too long for a build slot.
+type ErrNoBuildSlot struct {
+	waited time.Duration
+}
+
+func (e ErrNoBuildSlot) Error() string {
+	return fmt.Sprintf("push rejected, no build slot became free within %s. Try again later", e.waited)
+}
+
+// acquire takes a build slot, waiting for one if they are all taken and telling the user on w that the push
+// is queued. The slot is held until the returned func is called.
+func (s *Slots) acquire(w io.Writer) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() { <-s.slots }
+	select {
+	case s.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	fmt.Fprintf(w, "Waiting for a build slot, %d builds are already running...\n", cap(s.slots))
+	var expired <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return release, nil
+	case <-expired:
+		return nil, ErrNoBuildSlot{waited: s.timeout}
+	}
+}
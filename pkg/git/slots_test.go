@@ -0,0 +1,102 @@
+package git
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that may be written to concurrently
+type lockedBuffer struct {
+	mut sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return b.buf.String()
+}
+
+func TestSlotsSerializeExcessBuilds(t *testing.T) {
+	const max, builds = 2, 6
+	slots := NewSlots(max, 10*time.Second)
+
+	var mut sync.Mutex
+	running, peak := 0, 0
+	var wg sync.WaitGroup
+	var out lockedBuffer
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := slots.acquire(&out)
+			if err != nil {
+				t.Errorf("acquiring a build slot (%s)", err)
+				return
+			}
+			mut.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mut.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mut.Lock()
+			running--
+			mut.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if peak != max {
+		t.Errorf("expected at most %d builds to run at once, %d did", max, peak)
+	}
+	if waits := strings.Count(out.String(), "Waiting for a build slot"); waits < builds-max {
+		t.Errorf("expected at least %d builds to be told they are queued, %d were", builds-max, waits)
+	}
+}
+
+func TestSlotsTimeout(t *testing.T) {
+	slots := NewSlots(1, 10*time.Millisecond)
+	release, err := slots.acquire(&bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("acquiring a free build slot (%s)", err)
+	}
+	if _, err := slots.acquire(&bytes.Buffer{}); err == nil {
+		t.Errorf("expected a push to give up waiting for a build slot")
+	} else if _, ok := err.(ErrNoBuildSlot); !ok {
+		t.Errorf("expected ErrNoBuildSlot, got %v", err)
+	}
+
+	release()
+	release, err = slots.acquire(&bytes.Buffer{})
+	if err != nil {
+		t.Errorf("expected a released build slot to be free (%s)", err)
+	} else {
+		release()
+	}
+}
+
+func TestNilSlotsDontLimit(t *testing.T) {
+	slots := NewSlots(0, time.Second)
+	if slots != nil {
+		t.Fatalf("expected no limit for MAX_CONCURRENT_BUILDS=0")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := slots.acquire(&bytes.Buffer{}); err != nil {
+			t.Errorf("expected unlimited build slots, got %s", err)
+		}
+	}
+}
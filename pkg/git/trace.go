@@ -0,0 +1,66 @@
+package git
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+)
+
+// GitTrace is the context key for whether the traces of git are logged.
+const GitTrace = "git.Trace"
+
+// traceTailSize is how much of the end of a git trace is logged.
+const traceTailSize = 16 * 1024
+
+// traceVars are the env vars that turn on the traces of git.
+var traceVars = []string{"GIT_TRACE", "GIT_TRACE_PACKET", "GIT_TRACE_SETUP", "GIT_TRACE_PERFORMANCE"}
+
+// traceEnv returns the env vars that make git append its traces to path. Since path is absolute, the git
+// commands that the hook runs trace into it too.
+func traceEnv(path string) []string {
+	env := make([]string, 0, len(traceVars))
+	for _, v := range traceVars {
+		env = append(env, v+"="+path)
+	}
+	return env
+}
+
+// traceCommand makes git, run by cmd, trace into a temp file. The returned function logs the end of the
+// traces at debug level and removes the file, once cmd has finished.
+func traceCommand(c cookoo.Context, cmd *exec.Cmd) (func(), error) {
+	f, err := ioutil.TempFile("", "git-trace")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	cmd.Env = append(cmd.Env, traceEnv(f.Name())...)
+	return func() {
+		defer os.Remove(f.Name())
+		trace, err := traceTail(f.Name())
+		if err != nil {
+			log.Warnf(c, "Failed to read the git trace of %s (%s)", strings.Join(cmd.Args, " "), err)
+			return
+		}
+		log.Debugf(c, "Git trace of %s:\n%s", strings.Join(cmd.Args, " "), trace)
+	}, nil
+}
+
+// traceTail returns the last traceTailSize bytes of the trace file at path. The packet trace of a push holds
+// every line that was sent, so the whole file can be far too big to log.
+func traceTail(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tail := newTailBuffer(traceTailSize)
+	if _, err := io.Copy(tail, f); err != nil {
+		return nil, err
+	}
+	return tail.Bytes(), nil
+}
@@ -0,0 +1,87 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+// receiveEnv runs Receive with a ReceivePack that writes its environment to a file and reads the flush
+// packet the client sends, and returns the environment
+func receiveEnv(t *testing.T, gitTrace bool) string {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	envFile := filepath.Join(gitHome, "env")
+	receivePack := filepath.Join(gitHome, "receive-pack")
+	script := fmt.Sprintf("#!/bin/sh\nenv > %s\nhead -c 4 > /dev/null\n", envFile)
+	if err := ioutil.WriteFile(receivePack, []byte(script), 0755); err != nil {
+		t.Fatalf("writing %s (%s)", receivePack, err)
+	}
+
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"channel":      &fakeChannel{in: strings.NewReader("0000")},
+		"request":      &ssh.Request{},
+		"operation":    "git-receive-pack",
+		"repoName":     "'/myapp.git'",
+		"gitHome":      gitHome,
+		"podNamespace": "deis",
+		"gitBinaries":  Binaries{Git: "git", ReceivePack: receivePack},
+		"gitTrace":     gitTrace,
+	})
+	if _, irq := Receive(cookoo.NewContext(), params); irq != nil {
+		t.Fatalf("receiving (%v)", irq)
+	}
+	env, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatalf("reading the env of receive-pack (%s)", err)
+	}
+	return string(env)
+}
+
+func TestReceiveGitTrace(t *testing.T) {
+	env := receiveEnv(t, true)
+	for _, v := range traceVars {
+		if !strings.Contains(env, "\n"+v+"=/") {
+			t.Errorf("expected %s to be set to a trace file when tracing is enabled, got env\n%s", v, env)
+		}
+	}
+}
+
+func TestReceiveNoGitTrace(t *testing.T) {
+	env := receiveEnv(t, false)
+	for _, v := range traceVars {
+		if strings.Contains(env, "\n"+v+"=") {
+			t.Errorf("expected %s not to be set when tracing is disabled, got env\n%s", v, env)
+		}
+	}
+}
+
+func TestTraceTail(t *testing.T) {
+	f, err := ioutil.TempFile("", "git-trace")
+	if err != nil {
+		t.Fatalf("creating temp file (%s)", err)
+	}
+	defer os.Remove(f.Name())
+	trace := strings.Repeat("packet: git< 0000\n", traceTailSize) + "end of the trace\n"
+	if _, err := f.WriteString(trace); err != nil {
+		t.Fatalf("writing the trace (%s)", err)
+	}
+	f.Close()
+
+	tail, err := traceTail(f.Name())
+	if err != nil {
+		t.Fatalf("reading the trace (%s)", err)
+	}
+	if len(tail) != traceTailSize || !strings.HasSuffix(trace, string(tail)) {
+		t.Errorf("expected the last %d bytes of the trace, got %d bytes", traceTailSize, len(tail))
+	}
+}
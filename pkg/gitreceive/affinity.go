@@ -0,0 +1,118 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// affinityAnnotation is the annotation the scheduler reads a pod's affinity from. The Kubernetes 1.1 API this
+// builder uses has no affinity field, so builder pods carry their affinity in the alpha annotation that later
+// schedulers honor. Schedulers without affinity support ignore it.
+const affinityAnnotation = "scheduler.alpha.kubernetes.io/affinity"
+
+const (
+	antiAffinityPreferred = "preferred"
+	antiAffinityRequired  = "required"
+	hostnameTopologyKey   = "kubernetes.io/hostname"
+	// affinityWeight is the weight of preferred affinity terms, the most the scheduler allows
+	affinityWeight = 100
+)
+
+// affinity is the value of affinityAnnotation, as in the v1 API's Affinity
+type affinity struct {
+	NodeAffinity    *nodeAffinity    `json:"nodeAffinity,omitempty"`
+	PodAntiAffinity *podAntiAffinity `json:"podAntiAffinity,omitempty"`
+}
+
+type nodeAffinity struct {
+	Preferred []preferredSchedulingTerm `json:"preferredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type preferredSchedulingTerm struct {
+	Weight     int              `json:"weight"`
+	Preference nodeSelectorTerm `json:"preference"`
+}
+
+type nodeSelectorTerm struct {
+	MatchExpressions []nodeSelectorRequirement `json:"matchExpressions"`
+}
+
+type nodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values"`
+}
+
+type podAntiAffinity struct {
+	Required  []podAffinityTerm         `json:"requiredDuringSchedulingIgnoredDuringExecution,omitempty"`
+	Preferred []weightedPodAffinityTerm `json:"preferredDuringSchedulingIgnoredDuringExecution,omitempty"`
+}
+
+type weightedPodAffinityTerm struct {
+	Weight          int             `json:"weight"`
+	PodAffinityTerm podAffinityTerm `json:"podAffinityTerm"`
+}
+
+type podAffinityTerm struct {
+	LabelSelector labelSelector `json:"labelSelector"`
+	TopologyKey   string        `json:"topologyKey"`
+}
+
+type labelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels"`
+}
+
+// PodAffinity returns the value of affinityAnnotation for builder pods, or "" if no affinity is configured.
+//
+// BuilderPodAntiAffinity spreads builder pods over nodes by hostname, either as a preference or as a
+// requirement. BuilderPodNodeAffinity is a comma separated list of key=value pairs of node labels that
+// builder pods prefer, e.g. to land next to a cache. A value may list several, as in cache=warm|hot. Nodes
+// that builder pods require are set with BuilderPodNodeSelector instead.
+func (c Config) PodAffinity() (string, error) {
+	var aff affinity
+	labels, err := parseKeyValues(c.BuilderPodNodeAffinity, "node affinity label")
+	if err != nil {
+		return "", err
+	}
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var term nodeSelectorTerm
+		for _, k := range keys {
+			term.MatchExpressions = append(term.MatchExpressions, nodeSelectorRequirement{
+				Key:      k,
+				Operator: "In",
+				Values:   strings.Split(labels[k], "|"),
+			})
+		}
+		aff.NodeAffinity = &nodeAffinity{Preferred: []preferredSchedulingTerm{{Weight: affinityWeight, Preference: term}}}
+	}
+
+	builders := podAffinityTerm{
+		LabelSelector: labelSelector{MatchLabels: map[string]string{heritageLabel: builderHeritage}},
+		TopologyKey:   hostnameTopologyKey,
+	}
+	switch c.BuilderPodAntiAffinity {
+	case "":
+	case antiAffinityPreferred:
+		aff.PodAntiAffinity = &podAntiAffinity{Preferred: []weightedPodAffinityTerm{{Weight: affinityWeight, PodAffinityTerm: builders}}}
+	case antiAffinityRequired:
+		aff.PodAntiAffinity = &podAntiAffinity{Required: []podAffinityTerm{builders}}
+	default:
+		return "", fmt.Errorf("BUILDER_POD_ANTI_AFFINITY %q is invalid, it must be %s or %s", c.BuilderPodAntiAffinity, antiAffinityPreferred, antiAffinityRequired)
+	}
+
+	if aff.NodeAffinity == nil && aff.PodAntiAffinity == nil {
+		return "", nil
+	}
+	raw, err := json.Marshal(aff)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,71 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPodAffinity(t *testing.T) {
+	tests := []struct {
+		conf     Config
+		expected string
+	}{
+		{
+			Config{BuilderPodAntiAffinity: "preferred"},
+			`{"podAntiAffinity": {"preferredDuringSchedulingIgnoredDuringExecution": [{"weight": 100, "podAffinityTerm": {
+				"labelSelector": {"matchLabels": {"heritage": "deis-builder"}}, "topologyKey": "kubernetes.io/hostname"}}]}}`,
+		},
+		{
+			Config{BuilderPodAntiAffinity: "required"},
+			`{"podAntiAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": [{
+				"labelSelector": {"matchLabels": {"heritage": "deis-builder"}}, "topologyKey": "kubernetes.io/hostname"}]}}`,
+		},
+		{
+			Config{BuilderPodNodeAffinity: "zone=east, cache=warm|hot"},
+			`{"nodeAffinity": {"preferredDuringSchedulingIgnoredDuringExecution": [{"weight": 100, "preference": {"matchExpressions": [
+				{"key": "cache", "operator": "In", "values": ["warm", "hot"]},
+				{"key": "zone", "operator": "In", "values": ["east"]}]}}]}}`,
+		},
+		{
+			Config{BuilderPodAntiAffinity: "required", BuilderPodNodeAffinity: "cache=warm"},
+			`{"nodeAffinity": {"preferredDuringSchedulingIgnoredDuringExecution": [{"weight": 100, "preference": {"matchExpressions": [
+				{"key": "cache", "operator": "In", "values": ["warm"]}]}}]},
+			"podAntiAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": [{
+				"labelSelector": {"matchLabels": {"heritage": "deis-builder"}}, "topologyKey": "kubernetes.io/hostname"}]}}`,
+		},
+	}
+	for _, test := range tests {
+		raw, err := test.conf.PodAffinity()
+		if err != nil {
+			t.Errorf("affinity for %+v: %s", test.conf, err)
+			continue
+		}
+		var got, expected interface{}
+		if err := json.Unmarshal([]byte(raw), &got); err != nil {
+			t.Errorf("affinity for %+v is not JSON: %q", test.conf, raw)
+			continue
+		}
+		if err := json.Unmarshal([]byte(test.expected), &expected); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected affinity %s for %+v, got %s", test.expected, test.conf, raw)
+		}
+	}
+
+	if raw, err := (Config{}).PodAffinity(); raw != "" || err != nil {
+		t.Errorf("expected no affinity without config, got %q (%v)", raw, err)
+	}
+}
+
+func TestPodAffinityInvalid(t *testing.T) {
+	err := Config{BuilderPodAntiAffinity: "always"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), `BUILDER_POD_ANTI_AFFINITY "always" is invalid`) {
+		t.Errorf("expected an unknown anti-affinity to be rejected, got %v", err)
+	}
+	if err := (Config{BuilderPodNodeAffinity: "cache"}).Validate(); err == nil {
+		t.Errorf("expected a node affinity label without a value to be rejected")
+	}
+}
@@ -0,0 +1,122 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/deis/pkg/log"
+	"gopkg.in/yaml.v2"
+	"k8s.io/kubernetes/pkg/api/resource"
+)
+
+// appConfigFile is the file at the root of an app's repo that holds its build settings
+const appConfigFile = "deis.yaml"
+
+// appConfig is the build settings an app declares in its appConfigFile, for example:
+//
+//	build:
+//	  buildpack: https://github.com/heroku/heroku-buildpack-go
+//	  timeout: 600
+//	  cpu: 500m
+//	  memory: 1Gi
+//
+// Settings that are left out keep the builder's configuration.
+type appConfig struct {
+	Build struct {
+		Buildpack string `yaml:"buildpack"`
+		// TimeoutSec is the build timeout in seconds
+		TimeoutSec int    `yaml:"timeout"`
+		CPU        string `yaml:"cpu"`
+		Memory     string `yaml:"memory"`
+	} `yaml:"build"`
+}
+
+// readAppConfig returns the appConfigFile in the tree of the commit sha in the repo at repoDir, or nil if the
+// tree has none. The file is read from git's objects, so that the settings are known before the builder pod
+// is made.
+func readAppConfig(repoDir, sha string) (*appConfig, error) {
+	out, err := repoCmd(repoDir, "git", "ls-tree", "--name-only", sha, "--", appConfigFile).Output()
+	if err != nil {
+		return nil, fmt.Errorf("looking for %s in %s (%s)", appConfigFile, sha, err)
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return nil, nil
+	}
+	data, err := repoCmd(repoDir, "git", "cat-file", "blob", sha+":"+appConfigFile).Output()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from %s (%s)", appConfigFile, sha, err)
+	}
+	ac := &appConfig{}
+	if err := yaml.Unmarshal(data, ac); err != nil {
+		return nil, fmt.Errorf("%s is malformed (%s)", appConfigFile, err)
+	}
+	return ac, nil
+}
+
+// withAppConfig returns a copy of conf with the settings of ac applied, or conf itself if ac is nil. The
+// user's settings can't go beyond the builder's limits: the timeout is clamped to BUILD_TIMEOUT, and resource
+// requests to BUILDER_POD_MAX_CPU and BUILDER_POD_MAX_MEM and to the pod's limits. A buildpack of the user's
+// is built without BUILDPACK_SECRET.
+func withAppConfig(conf *Config, ac *appConfig) (*Config, error) {
+	if ac == nil {
+		return conf, nil
+	}
+	merged := *conf
+	if ac.Build.Buildpack != "" && ac.Build.Buildpack != conf.BuildpackURL {
+		merged.BuildpackURL = ac.Build.Buildpack
+		// the operator's credentials are only for the operator's buildpack, never for one the pusher picked
+		if conf.BuildpackSecret != "" {
+			log.Info("Not mounting BUILDPACK_SECRET for the buildpack of %s", appConfigFile)
+			merged.BuildpackSecret = ""
+		}
+	}
+	if t := ac.Build.TimeoutSec; t > 0 {
+		if conf.BuildTimeoutSec > 0 && t > conf.BuildTimeoutSec {
+			log.Info("The %s build timeout of %ds is over the limit, using %ds", appConfigFile, t, conf.BuildTimeoutSec)
+			t = conf.BuildTimeoutSec
+		}
+		merged.BuildTimeoutSec = t
+	}
+	cpu, err := clampQuantity("cpu", ac.Build.CPU, conf.BuilderPodMaxCPU, conf.BuilderPodCPULimit)
+	if err != nil {
+		return nil, err
+	} else if cpu != "" {
+		merged.BuilderPodCPURequest = cpu
+	}
+	mem, err := clampQuantity("memory", ac.Build.Memory, conf.BuilderPodMaxMem, conf.BuilderPodMemLimit)
+	if err != nil {
+		return nil, err
+	} else if mem != "" {
+		merged.BuilderPodMemRequest = mem
+	}
+	return &merged, nil
+}
+
+// clampQuantity returns the resource quantity value, or the smallest of maxes if value is more than it.
+// Empty values and maxes are ignored.
+func clampQuantity(name, value string, maxes ...string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return "", fmt.Errorf("%s %s %q is invalid (%s)", appConfigFile, name, value, err)
+	}
+	clamped := value
+	for _, max := range maxes {
+		if max == "" {
+			continue
+		}
+		maxQ, err := resource.ParseQuantity(max)
+		if err != nil {
+			return "", fmt.Errorf("builder pod %s quantity %q is invalid (%s)", name, max, err)
+		}
+		if q.Cmp(*maxQ) > 0 {
+			q, clamped = maxQ, max
+		}
+	}
+	if clamped != value {
+		log.Info("The %s %s request of %s is over the limit, using %s", appConfigFile, name, value, clamped)
+	}
+	return clamped, nil
+}
@@ -0,0 +1,148 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAppConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "app-config")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	gitOutput(t, dir, "init")
+	without := commitFiles(t, dir, "Procfile")
+
+	yml := "build:\n  buildpack: https://github.com/heroku/heroku-buildpack-go\n  timeout: 600\n  cpu: 500m\n  memory: 8Gi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, appConfigFile), []byte(yml), 0644); err != nil {
+		t.Fatalf("writing %s (%s)", appConfigFile, err)
+	}
+	with := commitFiles(t, dir, "Procfile")
+
+	ac, err := readAppConfig(dir, without)
+	if err != nil {
+		t.Fatalf("reading app config (%s)", err)
+	}
+	if ac != nil {
+		t.Errorf("expected no app config in a tree without %s, got %+v", appConfigFile, ac)
+	}
+
+	// the working tree is changed after the commit, the config is read from the commit
+	os.Remove(filepath.Join(dir, appConfigFile))
+	ac, err = readAppConfig(dir, with)
+	if err != nil {
+		t.Fatalf("reading app config (%s)", err)
+	}
+	if ac == nil {
+		t.Fatalf("expected the app config of %s", with)
+	}
+
+	conf := &Config{
+		BuildpackURL:         "https://github.com/heroku/heroku-buildpack-ruby",
+		BuildTimeoutSec:      1800,
+		BuilderPodCPURequest: "100m",
+		BuilderPodMemRequest: "256Mi",
+		BuilderPodMaxCPU:     "2",
+		BuilderPodMaxMem:     "4Gi",
+	}
+	merged, err := withAppConfig(conf, ac)
+	if err != nil {
+		t.Fatalf("applying app config (%s)", err)
+	}
+	if merged.BuildpackURL != "https://github.com/heroku/heroku-buildpack-go" {
+		t.Errorf("expected the app's buildpack, got %s", merged.BuildpackURL)
+	}
+	if merged.BuildTimeoutSec != 600 {
+		t.Errorf("expected a build timeout of 600s, got %d", merged.BuildTimeoutSec)
+	}
+	if merged.BuilderPodCPURequest != "500m" {
+		t.Errorf("expected a cpu request of 500m, got %s", merged.BuilderPodCPURequest)
+	}
+	if merged.BuilderPodMemRequest != "4Gi" {
+		t.Errorf("expected the memory request to be clamped to 4Gi, got %s", merged.BuilderPodMemRequest)
+	}
+	if conf.BuildpackURL != "https://github.com/heroku/heroku-buildpack-ruby" {
+		t.Errorf("expected withAppConfig not to change the builder's config")
+	}
+}
+
+func TestWithAppConfigBuildpackSecret(t *testing.T) {
+	conf := &Config{
+		BuildpackURL:    "https://github.com/example/private-buildpack",
+		BuildpackSecret: "buildpack-secret",
+	}
+	ac := &appConfig{}
+	ac.Build.Buildpack = "https://github.com/attacker/buildpack"
+	merged, err := withAppConfig(conf, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.BuildpackSecret != "" {
+		t.Errorf("expected no buildpack secret for the app's buildpack, got %s", merged.BuildpackSecret)
+	}
+	pod := slugbuilderPod(false, true, "test", "default", nil, "tar", "put-url", merged.BuildpackURL, merged.BuildpackSecret, "")
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == buildpackCreds {
+			t.Errorf("expected the buildpack credentials not to be mounted for the app's buildpack")
+		}
+	}
+	if conf.BuildpackSecret != "buildpack-secret" {
+		t.Errorf("expected withAppConfig not to change the builder's config")
+	}
+
+	// naming the operator's own buildpack keeps its credentials
+	ac.Build.Buildpack = conf.BuildpackURL
+	if merged, err = withAppConfig(conf, ac); err != nil {
+		t.Fatal(err)
+	}
+	if merged.BuildpackSecret != "buildpack-secret" {
+		t.Errorf("expected the operator's buildpack to keep its secret, got %q", merged.BuildpackSecret)
+	}
+}
+
+func TestWithAppConfigClamps(t *testing.T) {
+	conf := &Config{
+		BuildTimeoutSec:      300,
+		BuilderPodCPURequest: "100m",
+		BuilderPodMemRequest: "256Mi",
+		BuilderPodCPULimit:   "1",
+		BuilderPodMaxCPU:     "2",
+		BuilderPodMaxMem:     "4Gi",
+	}
+	ac := &appConfig{}
+	ac.Build.TimeoutSec = 3600
+	ac.Build.CPU = "1500m"
+	merged, err := withAppConfig(conf, ac)
+	if err != nil {
+		t.Fatalf("applying app config (%s)", err)
+	}
+	if merged.BuildTimeoutSec != 300 {
+		t.Errorf("expected the timeout to be clamped to 300s, got %d", merged.BuildTimeoutSec)
+	}
+	// the pod's limit is lower than the max request
+	if merged.BuilderPodCPURequest != "1" {
+		t.Errorf("expected the cpu request to be clamped to 1, got %s", merged.BuilderPodCPURequest)
+	}
+	if merged.BuilderPodMemRequest != "256Mi" {
+		t.Errorf("expected the memory request to be left alone, got %s", merged.BuilderPodMemRequest)
+	}
+
+	// without a builder timeout, the app's is used as it is
+	conf.BuildTimeoutSec = 0
+	if merged, err = withAppConfig(conf, ac); err != nil {
+		t.Fatalf("applying app config (%s)", err)
+	} else if merged.BuildTimeoutSec != 3600 {
+		t.Errorf("expected a build timeout of 3600s, got %d", merged.BuildTimeoutSec)
+	}
+
+	ac.Build.CPU = "lots"
+	if _, err := withAppConfig(conf, ac); err == nil {
+		t.Errorf("expected an invalid cpu request to fail")
+	}
+	if merged, err := withAppConfig(conf, nil); err != nil || merged != conf {
+		t.Errorf("expected no app config to leave the config as it is, got %+v (%v)", merged, err)
+	}
+}
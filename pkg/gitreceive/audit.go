@@ -0,0 +1,107 @@
+package gitreceive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deis/pkg/log"
+)
+
+const (
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+)
+
+// auditRecord is the deploy audit trail entry for a single build
+type auditRecord struct {
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint"`
+	App         string    `json:"app"`
+	Sha         string    `json:"sha"`
+	Namespace   string    `json:"namespace"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	DurationSec float64   `json:"duration_sec"`
+	Artifact    string    `json:"artifact,omitempty"`
+}
+
+// newAuditRecord returns the audit record for a build of sha that finished with result
+func newAuditRecord(conf *Config, sha string, result *BuildResult) auditRecord {
+	rec := auditRecord{
+		User:        conf.Username,
+		Fingerprint: conf.Fingerprint,
+		App:         conf.App(),
+		Sha:         sha,
+		Namespace:   conf.PodNamespace,
+		Result:      auditResultSuccess,
+		StartedAt:   result.Start.UTC(),
+		DurationSec: result.Duration.Seconds(),
+		Artifact:    result.Artifact(),
+	}
+	if !result.Succeeded() {
+		rec.Result = auditResultFailure
+		rec.Error = result.Error
+	}
+	return rec
+}
+
+// auditEmitter sends audit records to an external append-only log
+type auditEmitter interface {
+	Emit(rec auditRecord) error
+}
+
+// noopAuditEmitter is the auditEmitter used when no audit log is configured
+type noopAuditEmitter struct{}
+
+func (noopAuditEmitter) Emit(auditRecord) error { return nil }
+
+// httpAuditEmitter POSTs each audit record as JSON to url
+type httpAuditEmitter struct {
+	url    string
+	client *http.Client
+}
+
+func (h httpAuditEmitter) Emit(rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("User-Agent", userAgent)
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("audit log %s returned status code %d", h.url, res.StatusCode)
+	}
+	return nil
+}
+
+func newAuditEmitter(conf *Config) auditEmitter {
+	if conf.AuditURL == "" {
+		return noopAuditEmitter{}
+	}
+	return httpAuditEmitter{url: conf.AuditURL, client: &http.Client{Timeout: conf.AuditTimeout()}}
+}
+
+// emitAudit sends rec with emitter. Failures are always logged, but are only returned if failClosed is true
+func emitAudit(emitter auditEmitter, rec auditRecord, failClosed bool) error {
+	if err := emitter.Emit(rec); err != nil {
+		log.Err("AUDIT RECORD NOT EMITTED for %s at %s by %s (%s)", rec.App, rec.Sha, rec.User, err)
+		if failClosed {
+			return fmt.Errorf("emitting deploy audit record (%s)", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testAuditConfig() *Config {
+	return &Config{
+		Username:     "builder",
+		Fingerprint:  "12:34:56",
+		Repository:   "myapp.git",
+		PodNamespace: "deis",
+	}
+}
+
+func TestHTTPAuditEmitter(t *testing.T) {
+	var received auditRecord
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decoding audit record (%s)", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	conf := testAuditConfig()
+	conf.AuditURL = srv.URL
+	conf.AuditTimeoutMSec = 1000
+	rec := newAuditRecord(conf, approvedSha, &BuildResult{Start: time.Now(), Image: "myapp:git-c3b4e4ba"})
+	if err := emitAudit(newAuditEmitter(conf), rec, true); err != nil {
+		t.Fatalf("emitting audit record (%s)", err)
+	}
+	if received.App != "myapp" || received.Sha != approvedSha || received.Result != auditResultSuccess {
+		t.Errorf("expected a successful deploy of myapp at %s, got %+v", approvedSha, received)
+	}
+	if received.User != "builder" || received.Fingerprint != "12:34:56" || received.Namespace != "deis" {
+		t.Errorf("expected the deploying user, key and namespace, got %+v", received)
+	}
+	if received.Artifact != "myapp:git-c3b4e4ba" {
+		t.Errorf("expected the built artifact, got %q", received.Artifact)
+	}
+}
+
+func TestAuditFailureRecord(t *testing.T) {
+	rec := newAuditRecord(testAuditConfig(), approvedSha, &BuildResult{Start: time.Now(), Error: "Stopping build."})
+	if rec.Result != auditResultFailure || rec.Error != "Stopping build." {
+		t.Errorf("expected a failed build record, got %+v", rec)
+	}
+}
+
+func TestEmitAuditFailOpenAndClosed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	conf := testAuditConfig()
+	conf.AuditURL = srv.URL
+	conf.AuditTimeoutMSec = 1000
+	emitter := newAuditEmitter(conf)
+	rec := newAuditRecord(conf, approvedSha, &BuildResult{Start: time.Now()})
+
+	if err := emitAudit(emitter, rec, false); err != nil {
+		t.Errorf("expected a failed emit not to fail the push when failing open, got %s", err)
+	}
+	if err := emitAudit(emitter, rec, true); err == nil {
+		t.Errorf("expected a failed emit to fail the push when failing closed")
+	}
+}
+
+func TestNoopAuditEmitter(t *testing.T) {
+	emitter := newAuditEmitter(testAuditConfig())
+	if _, ok := emitter.(noopAuditEmitter); !ok {
+		t.Errorf("expected a no-op emitter without an audit URL, got %T", emitter)
+	}
+	if err := emitAudit(emitter, auditRecord{}, true); err != nil {
+		t.Errorf("expected the no-op emitter to succeed, got %s", err)
+	}
+}
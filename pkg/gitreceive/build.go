@@ -10,11 +10,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/deis/pkg/log"
 	"github.com/deis/sa-builder/pkg"
 	"github.com/deis/sa-builder/pkg/gitreceive/git"
 	"github.com/deis/sa-builder/pkg/gitreceive/storage"
+	"golang.org/x/net/context"
 	"gopkg.in/yaml.v2"
 
 	"k8s.io/kubernetes/pkg/api"
@@ -39,11 +41,16 @@ func run(cmd *exec.Cmd) error {
 	return cmd.Run()
 }
 
-func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
+// build builds the app at rawGitSha and returns its result, which has the built artifact: the slug URL for
+// buildpack builds or the image name for Dockerfile builds. The result is returned on failure too, with the
+// reason the build failed. Cancelling ctx stops the build and deletes its pod.
+func build(ctx context.Context, conf *Config, kubeClient *client.Client, oldRev, rawGitSha, branch string) (result *BuildResult, err error) {
+	result = newBuildResult()
+	defer func() { result.finish(err) }()
 	repo := conf.Repository
 	gitSha, err := git.NewSha(rawGitSha)
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	appName := conf.App()
@@ -53,15 +60,23 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 
 	slugName := fmt.Sprintf("%s:git-%s", appName, gitSha.Short())
 	if err := os.MkdirAll(buildDir, os.ModeDir); err != nil {
-		return fmt.Errorf("making the build directory %s (%s)", buildDir, err)
+		return result, fmt.Errorf("making the build directory %s (%s)", buildDir, err)
 	}
 	tmpDir := buildDir + gitSha.Short()
 	err = os.MkdirAll(tmpDir, 0777)
 	if err != nil {
-		return fmt.Errorf("unable to create tmpdir %s (%s)", buildDir, err)
+		return result, fmt.Errorf("unable to create tmpdir %s (%s)", buildDir, err)
 	}
 
-	slugBuilderInfo := storage.NewSlugBuilderInfo(appName, slugName, gitSha)
+	storageBackend, err := conf.StorageBackend()
+	if err != nil {
+		return result, err
+	}
+	releaseVersion := conf.BuildReleaseVersion()
+	slugBuilderInfo, err := storage.NewVersionedSlugBuilderInfo(storageBackend, conf.StorageKeys(), appName, slugName, releaseVersion, gitSha)
+	if err != nil {
+		return result, fmt.Errorf("building storage keys for %s (%s)", slugName, err)
+	}
 
 	// build a tarball from the new objects
 	appTgz := fmt.Sprintf("%s.tar.gz", appName)
@@ -69,7 +84,7 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 	gitArchiveCmd.Stdout = os.Stdout
 	gitArchiveCmd.Stderr = os.Stderr
 	if err := run(gitArchiveCmd); err != nil {
-		return fmt.Errorf("running %s (%s)", strings.Join(gitArchiveCmd.Args, " "), err)
+		return result, fmt.Errorf("running %s (%s)", strings.Join(gitArchiveCmd.Args, " "), err)
 	}
 
 	// untar the archive into the temp dir
@@ -77,7 +92,17 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 	tarCmd.Stdout = os.Stdout
 	tarCmd.Stderr = os.Stderr
 	if err := run(tarCmd); err != nil {
-		return fmt.Errorf("running %s (%s)", strings.Join(tarCmd.Args, " "), err)
+		return result, fmt.Errorf("running %s (%s)", strings.Join(tarCmd.Args, " "), err)
+	}
+	if err := checkLFS(conf.GitLFS, tmpDir); err != nil {
+		return result, err
+	}
+	ac, err := readAppConfig(repoDir, gitSha.Full())
+	if err != nil {
+		return result, err
+	}
+	if conf, err = withAppConfig(conf, ac); err != nil {
+		return result, err
 	}
 
 	bType := getBuildTypeForDir(tmpDir)
@@ -87,35 +112,113 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 	if bType == buildTypeProcfile {
 		rawProcFile, err := ioutil.ReadFile(fmt.Sprintf("%s/Procfile", tmpDir))
 		if err != nil {
-			return fmt.Errorf("reading %s/Procfile", tmpDir)
+			return result, fmt.Errorf("reading %s/Procfile", tmpDir)
 		}
 		if err := yaml.Unmarshal(rawProcFile, &procType); err != nil {
-			return fmt.Errorf("procfile %s/ProcFile is malformed (%s)", tmpDir, err)
+			return result, fmt.Errorf("procfile %s/ProcFile is malformed (%s)", tmpDir, err)
 		}
 	}
 
+	retry := newRetryPolicy(conf)
+	env, err := buildEnv(ctx, kubeClient.Secrets(conf.PodNamespace), buildEnvSecretName(conf.BuildEnvSecret, appName), nil, retry)
+	if err != nil {
+		return result, err
+	}
+	env = filterEnv(env, splitList(conf.BuildEnvAllowlist), splitList(conf.BuildEnvDenylist))
+	// The global env is set by the operator, so the allow and deny lists for app env don't apply to it.
+	globalEnv, err := conf.GlobalBuildEnvVars()
+	if err != nil {
+		return result, err
+	}
+	env = withGlobalEnv(globalEnv, env)
+
 	var pod *api.Pod
 	var buildPodName string
+	var imageRefs []string
+	buildType := slugBuildLabel
 	if usingDockerfile {
+		imageRefs, err = imageTags(conf.DockerImageTags, conf.RegistryImage(appName), gitSha, branch)
+		if err != nil {
+			return result, err
+		}
 		buildPodName = dockerBuilderPodName(appName, gitSha.Short())
 		pod = dockerBuilderPod(
 			conf.Debug,
 			false,
 			buildPodName,
-			conf.PodNamespace,
+			conf.BuilderPodNamespace(),
+			env,
 			slugBuilderInfo.TarURL(),
-			slugName,
+			conf.RegistryImage(slugName),
+			conf.DockerBuilderImage,
 		)
+		if len(imageRefs) > 0 {
+			addEnvToPod(*pod, imgTagsKey, strings.Join(imageRefs, ","))
+		}
+		addRegistryCredentials(pod, conf)
+		buildType = dockerBuildLabel
 	} else {
 		buildPodName = slugBuilderPodName(appName, gitSha.Short())
 		pod = slugbuilderPod(
 			conf.Debug,
 			false,
 			buildPodName,
-			conf.PodNamespace,
+			conf.BuilderPodNamespace(),
+			env,
 			slugBuilderInfo.TarURL(),
 			slugBuilderInfo.PushURL(),
+			conf.BuildpackURL,
+			conf.BuildpackSecret,
+			conf.SlugBuilderImage,
 		)
+		if conf.SlugGzip {
+			addEnvToPod(*pod, slugGzipKey, "true")
+		}
+	}
+
+	resources, err := builderResources(conf)
+	if err != nil {
+		return result, err
+	}
+	pod.Spec.Containers[0].Resources = resources
+
+	nodeSelector, err := conf.NodeSelector()
+	if err != nil {
+		return result, err
+	}
+	pod.Spec.NodeSelector = nodeSelector
+
+	annotations, err := conf.PodAnnotations()
+	if err != nil {
+		return result, err
+	}
+	podAffinity, err := conf.PodAffinity()
+	if err != nil {
+		return result, err
+	}
+	podTolerations, err := conf.PodTolerations()
+	if err != nil {
+		return result, err
+	}
+	annotations = mergeAnnotations(annotations, map[string]string{
+		releaseVersionAnnotation: releaseVersion,
+		affinityAnnotation:       podAffinity,
+		tolerationsAnnotation:    podTolerations,
+	})
+	labelBuilderPod(pod, appName, conf.PodNamespace, gitSha.Short(), buildType, annotations)
+
+	pod.Spec.ImagePullSecrets = imagePullSecrets(conf)
+	setServiceAccount(pod, conf)
+	setActiveDeadline(pod, conf)
+	setRestartPolicy(pod, conf)
+	pod.Spec.Containers[0].ImagePullPolicy = conf.BuilderPullPolicy(pod.Spec.Containers[0].Image)
+
+	if conf.InjectCommitRange {
+		rangeEnv, err := commitRangeEnv(repoDir, oldRev, gitSha.Full(), conf.InjectChangedFiles)
+		if err != nil {
+			return result, err
+		}
+		addCommitRangeToPod(*pod, rangeEnv)
 	}
 
 	log.Info("Starting build... but first, coffee!")
@@ -127,48 +230,56 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 		log.Debug("Error creating json representaion of pod spec: %v", err)
 	}
 
-	podsInterface := kubeClient.Pods(conf.PodNamespace)
+	podsInterface := kubeClient.Pods(conf.BuilderPodNamespace())
 
-	newPod, err := podsInterface.Create(pod)
+	newPod, err := startBuilderPod(ctx, conf, podsInterface, pod, retry, os.Stdout)
 	if err != nil {
-		return fmt.Errorf("creating builder pod (%s)", err)
+		return result, err
+	} else if newPod == nil {
+		return result, nil
 	}
+	result.PodName = newPod.Name
 
-	if err := waitForPod(kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
-		return fmt.Errorf("watching events for builder pod startup (%s)", err)
+	if err := waitForPodStart(ctx, kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
+		return result, err
 	}
 
-	req := kubeClient.Get().Namespace(newPod.Namespace).Name(newPod.Name).Resource("pods").SubResource("log").VersionedParams(
-		&api.PodLogOptions{
-			Follow: true,
-		}, api.Scheme)
-
-	rc, err := req.Stream()
-	if err != nil {
-		return fmt.Errorf("attempting to stream logs (%s)", err)
-	}
-	defer rc.Close()
-
-	size, err := io.Copy(os.Stdout, rc)
-	if err != nil {
-		return fmt.Errorf("fetching builder logs (%s)", err)
+	stopProgress := make(chan struct{})
+	// only the fetcher behind the S3 API compatible storage reports on uploads
+	if !usingDockerfile && conf.StorageType == storage.TypeS3 {
+		go reportUploadProgress(os.Stdout, uploadProgressURL(slugBuilderInfo.PushURL()), conf.ObjectStorageTickDuration(), stopProgress)
 	}
-	log.Debug("size of streamed logs %v", size)
+	logSource := k8sPodLogSource{kubeClient: kubeClient, namespace: newPod.Namespace, name: newPod.Name}
+	logsDone := make(chan error, 1)
+	go func() {
+		size, err := tailLogs(os.Stdout, logSource, newLogStreamPool(conf), conf.LogPollInterval())
+		log.Debug("size of streamed logs %v", size)
+		logsDone <- err
+	}()
 
 	// check the state and exit code of the build pod.
 	// if the code is not 0 return error
-	if err := waitForPodEnd(kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
-		return fmt.Errorf("error getting builder pod status (%s)", err)
+	err = waitForBuild(ctx, kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuildTimeout())
+	if err != nil {
+		close(stopProgress)
+		return result, fmt.Errorf("error getting builder pod status (%s)", err)
 	}
-	buildPod, err := kubeClient.Pods(newPod.Namespace).Get(newPod.Name)
+	// the builder pod has finished, clean it up, along with older ones, once its result is known
+	defer gcBuilderPods(kubeClient, newPod.Namespace, newPod.Name, conf.BuildPodRetention(), time.Now())
+	err = <-logsDone
+	close(stopProgress)
 	if err != nil {
-		return fmt.Errorf("error getting builder pod status (%s)", err)
+		return result, fmt.Errorf("fetching builder logs (%s)", err)
+	}
+	buildPod, err := getPod(ctx, kubeClient.Pods(newPod.Namespace), newPod.Name, retry)
+	if err != nil {
+		return result, fmt.Errorf("error getting builder pod status (%s)", err)
 	}
 
 	for _, containerStatus := range buildPod.Status.ContainerStatuses {
 		state := containerStatus.State.Terminated
 		if state.ExitCode != 0 {
-			return fmt.Errorf("Stopping build.")
+			return result, fmt.Errorf("Stopping build.")
 		}
 	}
 
@@ -178,20 +289,31 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 		conf.Debug,
 		false,
 		buildPodName,
-		conf.PodNamespace,
+		conf.BuilderPodNamespace(),
 		slugBuilderInfo.SlugURL(),
 	)
+	setServiceAccount(pod, conf)
 
-	newPod, err = podsInterface.Create(pod)
+	newPod, err = createPod(ctx, podsInterface, pod, retry)
 	if err != nil {
-		return fmt.Errorf("creating builder pod (%s)", err)
+		return result, fmt.Errorf("creating builder pod (%s)", err)
 	}
 
-	if err := waitForPod(kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
-		return fmt.Errorf("watching events for builder pod startup (%s)", err)
+	if err := waitForPodStart(ctx, kubeClient, newPod.Namespace, newPod.Name, conf.BuilderPodTickDuration(), conf.BuilderPodWaitDuration()); err != nil {
+		return result, err
 	}
 
 	log.Info("Build complete.")
+	if usingDockerfile {
+		result.Image = conf.RegistryImage(slugName)
+		result.ImageTags = imageRefs
+		log.Info("Image: %s", result.Image)
+		for _, ref := range imageRefs {
+			log.Info("Tagged: %s", ref)
+		}
+	} else {
+		result.SlugURL = slugBuilderInfo.SlugURL()
+	}
 	log.Info("Launching app.")
 	log.Info("Launching...")
 
@@ -223,12 +345,26 @@ func build(conf *Config, kubeClient *client.Client, rawGitSha string) error {
 	// 	log.Info("To learn more, use 'deis help' or visit http://deis.io\n")
 	//
 
-	gcCmd := repoCmd(repoDir, "git", "gc")
-	if err := run(gcCmd); err != nil {
-		return fmt.Errorf("cleaning up the repository with %s (%s)", strings.Join(gcCmd.Args, " "), err)
-	}
+	// the repo is garbage collected by the SSH server after the push, unless KEEP_HISTORY is set
+	return result, nil
+}
 
-	return nil
+// startBuilderPod creates the builder pod. In a dry run the pod spec is written to out instead, and a nil
+// pod is returned.
+func startBuilderPod(ctx context.Context, conf *Config, pods client.PodInterface, pod *api.Pod, retry retryPolicy, out io.Writer) (*api.Pod, error) {
+	if conf.DryRun {
+		spec, err := prettyPrintJSON(pod)
+		if err != nil {
+			return nil, fmt.Errorf("printing builder pod spec (%s)", err)
+		}
+		fmt.Fprintf(out, "Dry run, not starting builder pod %s:\n%s", pod.Name, spec)
+		return nil, nil
+	}
+	newPod, err := createPod(ctx, pods, pod, retry)
+	if err != nil {
+		return nil, fmt.Errorf("creating builder pod (%s)", err)
+	}
+	return newPod, nil
 }
 
 func prettyPrintJSON(data interface{}) (string, error) {
@@ -0,0 +1,96 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/deis/pkg/log"
+	"golang.org/x/net/context"
+	apierrs "k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// appVar is replaced with the app name in the name of the build env secret
+const appVar = "{app}"
+
+// buildEnvSecretName returns the name of the secret holding appName's build env, from a template that
+// may contain appVar, or "" if there is none
+func buildEnvSecretName(tpl, appName string) string {
+	return strings.Replace(tpl, appVar, appName, -1)
+}
+
+// buildEnv returns env merged over the keys of the secret named secretName, so that every key of the
+// secret becomes a builder env var unless env sets it too. A missing secret leaves env as it is, since not
+// every app has build time config.
+//
+// The Kubernetes 1.1 API this builder uses has no ConfigMaps, so the config is kept in a secret.
+func buildEnv(ctx context.Context, secrets client.SecretsInterface, secretName string, env map[string]interface{}, retry retryPolicy) (map[string]interface{}, error) {
+	if secretName == "" {
+		return env, nil
+	}
+	var data map[string][]byte
+	err := retry.do(ctx, "getting secret "+secretName, func() error {
+		secret, err := secrets.Get(secretName)
+		if err == nil {
+			data = secret.Data
+		}
+		return err
+	})
+	if apierrs.IsNotFound(err) {
+		log.Debug("No build env secret %s, building without it", secretName)
+		return env, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting build env secret %s (%s)", secretName, err)
+	}
+
+	merged := make(map[string]interface{}, len(data)+len(env))
+	for k, v := range data {
+		merged[k] = string(v)
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// filterEnv returns the vars of env that are in allow, or all of them if allow is empty, without those in
+// deny. A key in both lists is denied. Only the names of dropped vars are logged, since their values may be
+// credentials.
+func filterEnv(env map[string]interface{}, allow, deny []string) map[string]interface{} {
+	if len(allow) == 0 && len(deny) == 0 {
+		return env
+	}
+	allowed := make(map[string]bool, len(allow))
+	for _, k := range allow {
+		allowed[k] = true
+	}
+	denied := make(map[string]bool, len(deny))
+	for _, k := range deny {
+		denied[k] = true
+	}
+	filtered := make(map[string]interface{}, len(env))
+	for k, v := range env {
+		if denied[k] || (len(allowed) > 0 && !allowed[k]) {
+			log.Debug("Not passing env var %s to the builder pod", k)
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
+
+// withGlobalEnv returns env merged over global, so that every builder pod gets the global env vars unless
+// the app's env sets them too.
+func withGlobalEnv(global map[string]string, env map[string]interface{}) map[string]interface{} {
+	if len(global) == 0 {
+		return env
+	}
+	merged := make(map[string]interface{}, len(global)+len(env))
+	for k, v := range global {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged
+}
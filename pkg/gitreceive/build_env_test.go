@@ -0,0 +1,117 @@
+package gitreceive
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/api"
+	apierrs "k8s.io/kubernetes/pkg/api/errors"
+)
+
+// fakeSecrets is a client.SecretsInterface serving secrets from a map
+type fakeSecrets struct {
+	secrets map[string]map[string][]byte
+	err     error
+}
+
+func (f fakeSecrets) Get(name string) (*api.Secret, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	data, ok := f.secrets[name]
+	if !ok {
+		return nil, apierrs.NewNotFound("secrets", name)
+	}
+	return &api.Secret{ObjectMeta: api.ObjectMeta{Name: name}, Data: data}, nil
+}
+
+func (f fakeSecrets) Create(secret *api.Secret) (*api.Secret, error) { return secret, nil }
+func (f fakeSecrets) Update(secret *api.Secret) (*api.Secret, error) { return secret, nil }
+func (f fakeSecrets) Delete(name string) error                       { return nil }
+
+func TestBuildEnv(t *testing.T) {
+	retry := retryPolicy{attempts: 1, delay: time.Millisecond}
+	secrets := fakeSecrets{secrets: map[string]map[string][]byte{
+		"myapp-build-env": {"NPM_TOKEN": []byte("s3cret"), "NODE_ENV": []byte("production")},
+	}}
+
+	// the explicit env wins over the secret
+	env, err := buildEnv(context.Background(), secrets, buildEnvSecretName("{app}-build-env", "myapp"), map[string]interface{}{"NODE_ENV": "test"}, retry)
+	if err != nil {
+		t.Fatalf("building env (%s)", err)
+	}
+	expected := map[string]interface{}{"NPM_TOKEN": "s3cret", "NODE_ENV": "test"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected env %v, got %v", expected, env)
+	}
+	pod := slugbuilderPod(false, false, "test", "default", env, "tar", "put-url", "", "", "")
+	checkForEnv(t, pod, "NPM_TOKEN", "s3cret")
+	checkForEnv(t, pod, "NODE_ENV", "test")
+
+	// a missing secret, or none at all, leaves the env alone
+	for _, name := range []string{buildEnvSecretName("{app}-build-env", "otherapp"), ""} {
+		env, err = buildEnv(context.Background(), secrets, name, map[string]interface{}{"NODE_ENV": "test"}, retry)
+		if err != nil {
+			t.Errorf("expected secret %q to be skipped, got %s", name, err)
+		}
+		if !reflect.DeepEqual(env, map[string]interface{}{"NODE_ENV": "test"}) {
+			t.Errorf("expected the env to be unchanged without secret %q, got %v", name, env)
+		}
+	}
+
+	if _, err := buildEnv(context.Background(), fakeSecrets{err: apierrs.NewForbidden("secrets", "myapp-build-env", errors.New("denied"))}, "myapp-build-env", nil, retry); err == nil {
+		t.Errorf("expected a forbidden secret to fail the build")
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	env := map[string]interface{}{
+		"NPM_TOKEN":             "s3cret",
+		"NODE_ENV":              "production",
+		"AWS_SECRET_ACCESS_KEY": "hunter2",
+	}
+	tests := []struct {
+		allow, deny []string
+		expected    map[string]interface{}
+	}{
+		{nil, nil, env},
+		{nil, []string{"AWS_SECRET_ACCESS_KEY"}, map[string]interface{}{"NPM_TOKEN": "s3cret", "NODE_ENV": "production"}},
+		{[]string{"NODE_ENV", "MISSING"}, nil, map[string]interface{}{"NODE_ENV": "production"}},
+		// deny wins over allow
+		{[]string{"NODE_ENV", "NPM_TOKEN"}, []string{"NPM_TOKEN"}, map[string]interface{}{"NODE_ENV": "production"}},
+	}
+	for _, test := range tests {
+		if got := filterEnv(env, test.allow, test.deny); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("filterEnv(allow %v, deny %v) = %v, expected %v", test.allow, test.deny, got, test.expected)
+		}
+	}
+	if len(env) != 3 {
+		t.Errorf("expected filterEnv not to change its input, got %v", env)
+	}
+}
+
+func TestWithGlobalEnv(t *testing.T) {
+	global, err := Config{GlobalBuildEnv: "HTTP_PROXY=http://proxy:3128,NODE_ENV=production"}.GlobalBuildEnvVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := withGlobalEnv(global, map[string]interface{}{"NODE_ENV": "test", "NPM_TOKEN": "s3cret"})
+	expected := map[string]interface{}{"HTTP_PROXY": "http://proxy:3128", "NODE_ENV": "test", "NPM_TOKEN": "s3cret"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected the app env to win over the global env, got %v", env)
+	}
+	pod := slugbuilderPod(false, false, "test", "default", env, "tar", "put-url", "", "", "")
+	checkForEnv(t, pod, "HTTP_PROXY", "http://proxy:3128")
+	checkForEnv(t, pod, "NODE_ENV", "test")
+	pod = dockerBuilderPod(false, false, "test", "default", withGlobalEnv(global, nil), "tar", "image", "")
+	checkForEnv(t, pod, "HTTP_PROXY", "http://proxy:3128")
+	checkForEnv(t, pod, "NODE_ENV", "production")
+
+	env = map[string]interface{}{"NODE_ENV": "test"}
+	if got := withGlobalEnv(nil, env); !reflect.DeepEqual(got, env) {
+		t.Errorf("expected no global env to leave the env alone, got %v", got)
+	}
+}
@@ -0,0 +1,131 @@
+package gitreceive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deis/pkg/log"
+	"github.com/deis/sa-builder/pkg/conf"
+)
+
+const (
+	buildEventStarted  = "build-started"
+	buildEventFinished = "build-finished"
+)
+
+// buildEvent tells the controller that a build started or finished, for its release tracking
+type buildEvent struct {
+	Event       string    `json:"event"`
+	App         string    `json:"app"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint"`
+	Sha         string    `json:"sha"`
+	Branch      string    `json:"branch"`
+	Namespace   string    `json:"namespace"`
+	Time        time.Time `json:"time"`
+	// Result, Error, Artifact, Pod and DurationSec are only set on build-finished events
+	Result      string  `json:"result,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	Artifact    string  `json:"artifact,omitempty"`
+	Pod         string  `json:"pod,omitempty"`
+	DurationSec float64 `json:"duration_sec,omitempty"`
+}
+
+// newBuildStartedEvent returns the event for the start of a build of sha on branch
+func newBuildStartedEvent(conf *Config, sha, branch string) buildEvent {
+	return buildEvent{
+		Event:       buildEventStarted,
+		App:         conf.App(),
+		User:        conf.Username,
+		Fingerprint: conf.Fingerprint,
+		Sha:         sha,
+		Branch:      branch,
+		Namespace:   conf.PodNamespace,
+		Time:        time.Now().UTC(),
+	}
+}
+
+// newBuildFinishedEvent returns the event for a build of sha on branch that finished with result
+func newBuildFinishedEvent(conf *Config, sha, branch string, result *BuildResult) buildEvent {
+	ev := newBuildStartedEvent(conf, sha, branch)
+	ev.Event = buildEventFinished
+	ev.Result = auditResultSuccess
+	ev.Artifact = result.Artifact()
+	ev.Pod = result.PodName
+	ev.DurationSec = result.Duration.Seconds()
+	if !result.Succeeded() {
+		ev.Result = auditResultFailure
+		ev.Error = result.Error
+	}
+	return ev
+}
+
+// getBuilderKey returns the key used to authenticate with the controller. It is a variable so tests can
+// replace it.
+var getBuilderKey = conf.GetBuilderKey
+
+// buildEventSender POSTs build events to an endpoint of the controller. A nil *buildEventSender sends
+// nothing.
+type buildEventSender struct {
+	url    string
+	client *http.Client
+}
+
+// newBuildEventSender returns the sender for the controller endpoint conf.BuildEventsPath, or nil if it is
+// not set.
+func newBuildEventSender(conf *Config) *buildEventSender {
+	if conf.BuildEventsPath == "" {
+		return nil
+	}
+	// a copy, so that the timeout doesn't apply to the other controller requests
+	client := *controllerClient(conf)
+	client.Timeout = conf.BuildEventsTimeout()
+	return &buildEventSender{
+		url:    controllerURLStr(conf, strings.TrimPrefix(conf.BuildEventsPath, "/")),
+		client: &client,
+	}
+}
+
+func (s *buildEventSender) send(ev buildEvent) error {
+	if s == nil {
+		return nil
+	}
+	builderKey, err := getBuilderKey()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	setReqHeaders(builderKey, req)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned status code %d", s.url, res.StatusCode)
+	}
+	return nil
+}
+
+// emitBuildEvent sends ev with sender. Failures are always logged, but are only returned if strict is true
+func emitBuildEvent(sender *buildEventSender, ev buildEvent, strict bool) error {
+	if err := sender.send(ev); err != nil {
+		log.Err("sending the %s event of %s at %s to the controller (%s)", ev.Event, ev.App, ev.Sha, err)
+		if strict {
+			return fmt.Errorf("sending the %s event to the controller (%s)", ev.Event, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testBuildEventsConfig returns a config that sends build events to srv
+func testBuildEventsConfig(t *testing.T, srv *httptest.Server) *Config {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parsing test server URL (%s)", err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatalf("splitting test server host (%s)", err)
+	}
+	conf := testAuditConfig()
+	conf.WorkflowHost, conf.WorkflowPort = host, port
+	conf.BuildEventsPath = "/v2/hooks/events"
+	conf.BuildEventsTimeoutMSec = 1000
+	return conf
+}
+
+func TestBuildEventsSent(t *testing.T) {
+	origKey := getBuilderKey
+	getBuilderKey = func() (string, error) { return "testbuilderkey", nil }
+	defer func() { getBuilderKey = origKey }()
+
+	var events []buildEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/hooks/events" {
+			t.Errorf("expected events to be sent to /v2/hooks/events, got %s", r.URL.Path)
+		}
+		if key := r.Header.Get("X-Deis-Builder-Auth"); key != "testbuilderkey" {
+			t.Errorf("expected the builder key to authenticate the event, got %q", key)
+		}
+		var ev buildEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decoding build event (%s)", err)
+		}
+		events = append(events, ev)
+	}))
+	defer srv.Close()
+
+	conf := testBuildEventsConfig(t, srv)
+	sender := newBuildEventSender(conf)
+	if err := emitBuildEvent(sender, newBuildStartedEvent(conf, approvedSha, "master"), true); err != nil {
+		t.Fatalf("sending build-started (%s)", err)
+	}
+	finished := newBuildFinishedEvent(conf, approvedSha, "master", &BuildResult{SlugURL: "http://storage/git/home/myapp:git-c3b4e4ba/push/slug.tgz"})
+	if err := emitBuildEvent(sender, finished, true); err != nil {
+		t.Fatalf("sending build-finished (%s)", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected a build-started and a build-finished event, got %+v", events)
+	}
+	started := events[0]
+	if started.Event != buildEventStarted || started.App != "myapp" || started.Sha != approvedSha || started.Branch != "master" {
+		t.Errorf("expected myapp's build of %s on master to have started, got %+v", approvedSha, started)
+	}
+	if started.User != "builder" || started.Fingerprint != "12:34:56" || started.Namespace != "deis" || started.Time.IsZero() {
+		t.Errorf("expected the pushing user, key, namespace and time, got %+v", started)
+	}
+	if started.Result != "" || started.Artifact != "" {
+		t.Errorf("expected build-started to have no result, got %+v", started)
+	}
+	if ev := events[1]; ev.Event != buildEventFinished || ev.Result != auditResultSuccess || ev.Artifact != finished.Artifact || ev.Sha != approvedSha {
+		t.Errorf("expected a successful build-finished with the slug, got %+v", ev)
+	}
+}
+
+func TestBuildEventsInsecureSkipVerify(t *testing.T) {
+	origKey := getBuilderKey
+	getBuilderKey = func() (string, error) { return "testbuilderkey", nil }
+	defer func() { getBuilderKey = origKey }()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	conf := testBuildEventsConfig(t, srv)
+	conf.ControllerTLS = true
+	ev := newBuildStartedEvent(conf, approvedSha, "master")
+	if err := emitBuildEvent(newBuildEventSender(conf), ev, true); err == nil {
+		t.Errorf("expected the controller's self-signed certificate to be rejected")
+	}
+
+	conf.ControllerInsecureSkipVerify = true
+	sender := newBuildEventSender(conf)
+	if err := emitBuildEvent(sender, ev, true); err != nil {
+		t.Errorf("expected CONTROLLER_INSECURE_SKIP_VERIFY to apply to build events, got %s", err)
+	}
+	if sender.client.Timeout != time.Second {
+		t.Errorf("expected build events to time out after BUILD_EVENTS_TIMEOUT_MSEC, got %s", sender.client.Timeout)
+	}
+	if http.DefaultClient.Timeout != 0 || insecureControllerClient.Timeout != 0 {
+		t.Errorf("expected the timeout of build events not to apply to other controller requests")
+	}
+}
+
+func TestBuildFinishedEventFailure(t *testing.T) {
+	ev := newBuildFinishedEvent(testAuditConfig(), approvedSha, "master", &BuildResult{Error: "Stopping build."})
+	if ev.Event != buildEventFinished || ev.Result != auditResultFailure || ev.Error != "Stopping build." {
+		t.Errorf("expected a failed build-finished event, got %+v", ev)
+	}
+}
+
+func TestEmitBuildEventStrict(t *testing.T) {
+	origKey := getBuilderKey
+	getBuilderKey = func() (string, error) { return "testbuilderkey", nil }
+	defer func() { getBuilderKey = origKey }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	conf := testBuildEventsConfig(t, srv)
+	sender := newBuildEventSender(conf)
+	ev := newBuildStartedEvent(conf, approvedSha, "master")
+	if err := emitBuildEvent(sender, ev, false); err != nil {
+		t.Errorf("expected a failed event not to fail the build unless strict, got %s", err)
+	}
+	if err := emitBuildEvent(sender, ev, true); err == nil {
+		t.Errorf("expected a failed event to fail the build when strict")
+	}
+
+	getBuilderKey = func() (string, error) { return "", errors.New("no builder key") }
+	if err := emitBuildEvent(sender, ev, true); err == nil {
+		t.Errorf("expected a missing builder key to fail the build when strict")
+	}
+}
+
+func TestNoBuildEventSender(t *testing.T) {
+	sender := newBuildEventSender(testAuditConfig())
+	if sender != nil {
+		t.Fatalf("expected no sender without BUILD_EVENTS_PATH, got %+v", sender)
+	}
+	if err := emitBuildEvent(sender, newBuildStartedEvent(testAuditConfig(), approvedSha, "master"), true); err != nil {
+		t.Errorf("expected no events to be sent without BUILD_EVENTS_PATH, got %s", err)
+	}
+}
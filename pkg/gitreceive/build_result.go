@@ -0,0 +1,47 @@
+package gitreceive
+
+import (
+	"time"
+)
+
+// BuildResult is the outcome of a build, for the hooks that report on it once it has finished
+type BuildResult struct {
+	// SlugURL is the slug of a buildpack build
+	SlugURL string
+	// Image is the image of a Dockerfile build, and ImageTags the other references it was pushed as
+	Image     string
+	ImageTags []string
+	// PodName is the builder pod, empty if the build failed before it was started or in a dry run
+	PodName  string
+	Start    time.Time
+	Duration time.Duration
+	// Error is the reason the build failed, empty if it succeeded
+	Error string
+}
+
+// newBuildResult returns the result of a build starting now
+func newBuildResult() *BuildResult {
+	return &BuildResult{Start: time.Now()}
+}
+
+// finish records that the build finished with err
+func (r *BuildResult) finish(err error) {
+	r.Duration = time.Since(r.Start)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Succeeded returns true if the build didn't fail
+func (r *BuildResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+// Artifact returns the image of a Dockerfile build or the slug URL of a buildpack build, or "" if nothing was
+// built
+func (r *BuildResult) Artifact() string {
+	if r.Image != "" {
+		return r.Image
+	}
+	return r.SlugURL
+}
@@ -0,0 +1,56 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBuildResultSuccess(t *testing.T) {
+	result := newBuildResult()
+	result.Image = "myapp:git-c3b4e4ba"
+	result.PodName = "dockerbuild-myapp-c3b4e4ba-12345678"
+	time.Sleep(time.Millisecond)
+	result.finish(nil)
+	if !result.Succeeded() || result.Error != "" {
+		t.Errorf("expected a successful build, got %+v", result)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("expected the build's duration, got %s", result.Duration)
+	}
+	if result.Artifact() != "myapp:git-c3b4e4ba" {
+		t.Errorf("expected the image to be the artifact, got %s", result.Artifact())
+	}
+
+	ev := newBuildFinishedEvent(testAuditConfig(), approvedSha, "master", result)
+	if ev.Pod != result.PodName || ev.DurationSec != result.Duration.Seconds() || ev.Artifact != result.Image {
+		t.Errorf("expected the build-finished event to have the pod, duration and image, got %+v", ev)
+	}
+}
+
+func TestBuildResultFailure(t *testing.T) {
+	result := newBuildResult()
+	result.SlugURL = "http://storage/git/home/myapp:git-c3b4e4ba/push/slug.tgz"
+	result.finish(errors.New("Stopping build."))
+	if result.Succeeded() || result.Error != "Stopping build." {
+		t.Errorf("expected a failed build with its reason, got %+v", result)
+	}
+	if result.Artifact() != result.SlugURL {
+		t.Errorf("expected the slug to be the artifact, got %s", result.Artifact())
+	}
+}
+
+func TestBuildReturnsResultOnFailure(t *testing.T) {
+	result, err := build(context.Background(), &Config{Repository: "myapp.git"}, nil, zeroRev, "notasha", "master")
+	if err == nil {
+		t.Fatalf("expected building an invalid sha to fail")
+	}
+	if result == nil {
+		t.Fatalf("expected a result for the failed build")
+	}
+	if result.Error != err.Error() || result.Start.IsZero() || result.PodName != "" || result.Artifact() != "" {
+		t.Errorf("expected a failed result without a pod or artifact, got %+v", result)
+	}
+}
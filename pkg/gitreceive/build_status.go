@@ -0,0 +1,133 @@
+package gitreceive
+
+import (
+	"fmt"
+
+	"github.com/deis/sa-builder/pkg/gitreceive/git"
+	"github.com/deis/sa-builder/pkg/gitreceive/storage"
+
+	"k8s.io/kubernetes/pkg/api"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+// BuildStatus is the state of the build of an app at a git sha, as returned by GetBuildStatus
+type BuildStatus string
+
+const (
+	// BuildPending is a build whose builder pod hasn't finished yet
+	BuildPending BuildStatus = "pending"
+	// BuildSuccess is a build whose builder pod succeeded, or whose slug is in object storage
+	BuildSuccess BuildStatus = "success"
+	// BuildFailed is a build whose builder pod failed, or finished without uploading the slug
+	BuildFailed BuildStatus = "failed"
+	// BuildUnknown is a build that left neither a builder pod nor a slug behind, such as one that never ran
+	BuildUnknown BuildStatus = "unknown"
+)
+
+// ObjectChecker reports whether an object exists in object storage
+type ObjectChecker interface {
+	ObjectExists(key string) (bool, error)
+}
+
+// GetBuildStatus returns the status of the build of appName at rawSha. It is read from the newest builder pod
+// of the build and, for buildpack builds, from whether the slug is at the SlugKey of the build in objects.
+// Since finished builder pods are cleaned up, a slug without a pod is a successful build. A nil objects only
+// looks at the builder pods.
+func GetBuildStatus(conf *Config, pods client.PodsNamespacer, objects ObjectChecker, appName, rawSha string) (BuildStatus, error) {
+	gitSha, err := git.NewSha(rawSha)
+	if err != nil {
+		return BuildUnknown, err
+	}
+	pod, err := newestBuilderPod(pods, conf.BuilderPodNamespace(), appName, conf.PodNamespace, gitSha.Short())
+	if err != nil {
+		return BuildUnknown, fmt.Errorf("listing the builder pods of %s at %s (%s)", appName, gitSha.Short(), err)
+	}
+	if pod != nil {
+		switch {
+		case pod.Status.Phase != api.PodSucceeded && pod.Status.Phase != api.PodFailed:
+			return BuildPending, nil
+		case pod.Status.Phase == api.PodFailed || !containersSucceeded(pod):
+			return BuildFailed, nil
+		case pod.Labels[buildTypeLabel] == dockerBuildLabel || objects == nil:
+			return BuildSuccess, nil
+		}
+	} else if objects == nil {
+		return BuildUnknown, nil
+	}
+
+	slugExists, err := slugExists(conf, objects, appName, gitSha)
+	if err != nil {
+		return BuildUnknown, err
+	}
+	switch {
+	case slugExists:
+		return BuildSuccess, nil
+	case pod != nil:
+		// the slugbuilder exited cleanly, but the slug never made it to object storage
+		return BuildFailed, nil
+	}
+	return BuildUnknown, nil
+}
+
+// newestBuilderPod returns the builder pod in ns that was created last for the build of appName, from
+// appNamespace, at shortSha, or nil if there is none.
+func newestBuilderPod(pods client.PodsNamespacer, ns, appName, appNamespace, shortSha string) (*api.Pod, error) {
+	set := labels.Set{heritageLabel: builderHeritage, appLabel: appName, appNamespaceLabel: appNamespace, gitShaLabel: shortSha}
+	list, err := pods.Pods(ns).List(labels.SelectorFromSet(set), fields.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var newest *api.Pod
+	for i, pod := range list.Items {
+		if !hasLabels(pod, set) {
+			continue
+		}
+		if bt := pod.Labels[buildTypeLabel]; bt != slugBuildLabel && bt != dockerBuildLabel {
+			continue
+		}
+		if newest == nil || newest.CreationTimestamp.Time.Before(pod.CreationTimestamp.Time) {
+			newest = &list.Items[i]
+		}
+	}
+	return newest, nil
+}
+
+// hasLabels returns true if pod has all of the labels in set
+func hasLabels(pod api.Pod, set labels.Set) bool {
+	for k, v := range set {
+		if pod.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// containersSucceeded returns true if every container of pod terminated with exit code 0
+func containersSucceeded(pod *api.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil || status.State.Terminated.ExitCode != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// slugExists returns true if the slug of the build of appName at gitSha is in objects
+func slugExists(conf *Config, objects ObjectChecker, appName string, gitSha *git.SHA) (bool, error) {
+	backend, err := conf.StorageBackend()
+	if err != nil {
+		return false, err
+	}
+	slugName := fmt.Sprintf("%s:git-%s", appName, gitSha.Short())
+	info, err := storage.NewVersionedSlugBuilderInfo(backend, conf.StorageKeys(), appName, slugName, conf.BuildReleaseVersion(), gitSha)
+	if err != nil {
+		return false, err
+	}
+	exists, err := objects.ObjectExists(info.SlugKey())
+	if err != nil {
+		return false, fmt.Errorf("checking for the slug %s (%s)", info.SlugKey(), err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,101 @@
+package gitreceive
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+)
+
+// fakeObjects is an ObjectChecker for the objects whose keys it holds
+type fakeObjects map[string]bool
+
+func (f fakeObjects) ObjectExists(key string) (bool, error) { return f[key], nil }
+
+type failingObjects struct{}
+
+func (failingObjects) ObjectExists(key string) (bool, error) {
+	return false, errors.New("storage unavailable")
+}
+
+const testSlugKey = "home/myapp:git-c3b4e4ba/slug"
+
+// testStatusConfig returns a config for myapp, which stores slugs in S3 API compatible storage
+func testStatusConfig() *Config {
+	conf := testAuditConfig()
+	conf.StorageType, conf.StorageEndpoint = "s3", "http://minio.storage.svc:9000"
+	return conf
+}
+
+// statusPod returns a builder pod of myapp's build at approvedSha, created at created, whose container
+// exited with exitCode if phase is a finished one
+func statusPod(buildType string, phase api.PodPhase, exitCode int, created time.Time) api.Pod {
+	pod := api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:              "slugbuild-myapp-c3b4e4ba",
+			CreationTimestamp: unversioned.NewTime(created),
+			Labels: map[string]string{
+				heritageLabel:     builderHeritage,
+				appLabel:          "myapp",
+				appNamespaceLabel: "deis",
+				gitShaLabel:       "c3b4e4ba",
+				buildTypeLabel:    buildType,
+			},
+		},
+		Status: api.PodStatus{Phase: phase},
+	}
+	if phase == api.PodSucceeded || phase == api.PodFailed {
+		pod.Status.ContainerStatuses = []api.ContainerStatus{{State: api.ContainerState{
+			Terminated: &api.ContainerStateTerminated{ExitCode: exitCode},
+		}}}
+	}
+	return pod
+}
+
+func TestGetBuildStatus(t *testing.T) {
+	now := time.Now()
+	otherSha := statusPod(slugBuildLabel, api.PodRunning, 0, now)
+	otherSha.Labels[gitShaLabel] = "71a09fbe"
+	cases := []struct {
+		name     string
+		pods     []api.Pod
+		objects  ObjectChecker
+		expected BuildStatus
+	}{
+		{"running", []api.Pod{statusPod(slugBuildLabel, api.PodRunning, 0, now)}, fakeObjects{}, BuildPending},
+		{"scheduling", []api.Pod{statusPod(dockerBuildLabel, api.PodPending, 0, now)}, nil, BuildPending},
+		{"pod failed", []api.Pod{statusPod(slugBuildLabel, api.PodFailed, 1, now)}, fakeObjects{}, BuildFailed},
+		{"container failed", []api.Pod{statusPod(slugBuildLabel, api.PodSucceeded, 2, now)}, fakeObjects{testSlugKey: true}, BuildFailed},
+		{"slug uploaded", []api.Pod{statusPod(slugBuildLabel, api.PodSucceeded, 0, now)}, fakeObjects{testSlugKey: true}, BuildSuccess},
+		{"slug missing", []api.Pod{statusPod(slugBuildLabel, api.PodSucceeded, 0, now)}, fakeObjects{}, BuildFailed},
+		{"image built", []api.Pod{statusPod(dockerBuildLabel, api.PodSucceeded, 0, now)}, fakeObjects{}, BuildSuccess},
+		{"pod cleaned up", nil, fakeObjects{testSlugKey: true}, BuildSuccess},
+		{"never built", []api.Pod{otherSha}, fakeObjects{}, BuildUnknown},
+		{"no storage", nil, nil, BuildUnknown},
+		{"rebuilt", []api.Pod{
+			statusPod(slugBuildLabel, api.PodRunning, 0, now),
+			statusPod(slugBuildLabel, api.PodFailed, 1, now.Add(-time.Hour)),
+		}, fakeObjects{}, BuildPending},
+	}
+	for _, c := range cases {
+		pods := &finishedPods{items: c.pods}
+		status, err := GetBuildStatus(testStatusConfig(), pods, c.objects, "myapp", approvedSha)
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", c.name, err)
+		} else if status != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, status)
+		}
+	}
+}
+
+func TestGetBuildStatusErrors(t *testing.T) {
+	pods := &finishedPods{items: []api.Pod{statusPod(slugBuildLabel, api.PodSucceeded, 0, time.Now())}}
+	if status, err := GetBuildStatus(testStatusConfig(), pods, failingObjects{}, "myapp", approvedSha); err == nil || status != BuildUnknown {
+		t.Errorf("expected a storage failure to give an unknown status and an error, got %s (%v)", status, err)
+	}
+	if _, err := GetBuildStatus(testStatusConfig(), pods, fakeObjects{}, "myapp", "notasha"); err == nil {
+		t.Errorf("expected an invalid sha to be rejected")
+	}
+}
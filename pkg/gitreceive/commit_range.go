@@ -0,0 +1,53 @@
+package gitreceive
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	gitOldRevKey       = "GIT_OLD_REV"
+	gitNewRevKey       = "GIT_NEW_REV"
+	gitChangedFilesKey = "GIT_CHANGED_FILES"
+)
+
+// zeroRev is the old revision git passes to hooks when a ref is created, and the new one when it is deleted
+var zeroRev = strings.Repeat("0", 40)
+
+// commitRangeEnv returns the builder pod env vars describing the pushed commit range. On the first push of a
+// ref there is no old revision, so GIT_OLD_REV is omitted and, if withFiles is true, every file in the tree at
+// newRev is listed as changed. Changed files are separated by newlines.
+func commitRangeEnv(repoDir, oldRev, newRev string, withFiles bool) (map[string]string, error) {
+	env := map[string]string{gitNewRevKey: newRev}
+	firstPush := oldRev == "" || oldRev == zeroRev
+	if !firstPush {
+		env[gitOldRevKey] = oldRev
+	}
+	if !withFiles {
+		return env, nil
+	}
+
+	var cmd []string
+	if firstPush {
+		cmd = []string{"git", "ls-tree", "-r", "--name-only", newRev}
+	} else {
+		cmd = []string{"git", "diff", "--name-only", oldRev, newRev}
+	}
+	out, err := repoCmd(repoDir, cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing changed files with %s (%s)", strings.Join(cmd, " "), err)
+	}
+	env[gitChangedFilesKey] = strings.TrimSuffix(string(out), "\n")
+	return env, nil
+}
+
+// addCommitRangeToPod adds the env vars from commitRangeEnv to pod
+func addCommitRangeToPod(pod api.Pod, env map[string]string) {
+	for _, key := range []string{gitOldRevKey, gitNewRevKey, gitChangedFilesKey} {
+		if value, ok := env[key]; ok {
+			addEnvToPod(pod, key, value)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s (%s)", strings.Join(args, " "), out, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitFiles appends a line to each of files in the repo at dir, commits them and returns the new commit's sha
+func commitFiles(t *testing.T, dir string, files ...string) string {
+	for _, name := range files {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("opening %s (%s)", name, err)
+		}
+		f.WriteString("change\n")
+		f.Close()
+	}
+	gitOutput(t, dir, "add", ".")
+	gitOutput(t, dir, "commit", "-m", "commit "+strings.Join(files, ","))
+	return gitOutput(t, dir, "rev-parse", "HEAD")
+}
+
+func TestCommitRangeEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commit-range")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	gitOutput(t, dir, "init")
+	first := commitFiles(t, dir, "Procfile", "app.go")
+	second := commitFiles(t, dir, "app.go", "app_test.go")
+
+	env, err := commitRangeEnv(dir, first, second, true)
+	if err != nil {
+		t.Fatalf("getting commit range env (%s)", err)
+	}
+	if env[gitOldRevKey] != first {
+		t.Errorf("expected %s=%s, got %q", gitOldRevKey, first, env[gitOldRevKey])
+	}
+	if env[gitNewRevKey] != second {
+		t.Errorf("expected %s=%s, got %q", gitNewRevKey, second, env[gitNewRevKey])
+	}
+	if env[gitChangedFilesKey] != "app.go\napp_test.go" {
+		t.Errorf("expected changed files app.go and app_test.go, got %q", env[gitChangedFilesKey])
+	}
+
+	// the first push of a ref has no old revision, so the whole tree is listed
+	env, err = commitRangeEnv(dir, zeroRev, second, true)
+	if err != nil {
+		t.Fatalf("getting commit range env (%s)", err)
+	}
+	if _, ok := env[gitOldRevKey]; ok {
+		t.Errorf("expected no %s on the first push, got %q", gitOldRevKey, env[gitOldRevKey])
+	}
+	if env[gitChangedFilesKey] != "Procfile\napp.go\napp_test.go" {
+		t.Errorf("expected the full tree on the first push, got %q", env[gitChangedFilesKey])
+	}
+
+	env, err = commitRangeEnv(dir, first, second, false)
+	if err != nil {
+		t.Fatalf("getting commit range env (%s)", err)
+	}
+	if _, ok := env[gitChangedFilesKey]; ok {
+		t.Errorf("expected no %s when changed files are disabled", gitChangedFilesKey)
+	}
+}
+
+func TestAddCommitRangeToPod(t *testing.T) {
+	pod := api.Pod{Spec: api.PodSpec{Containers: []api.Container{{Name: "deis-slugbuilder"}}}}
+	addCommitRangeToPod(pod, map[string]string{gitOldRevKey: "old", gitNewRevKey: "new"})
+
+	env := map[string]string{}
+	for _, e := range pod.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env[gitOldRevKey] != "old" || env[gitNewRevKey] != "new" {
+		t.Errorf("expected the commit range in the pod env, got %v", env)
+	}
+	if _, ok := env[gitChangedFilesKey]; ok {
+		t.Errorf("expected no %s in the pod env, got %q", gitChangedFilesKey, env[gitChangedFilesKey])
+	}
+}
@@ -1,8 +1,18 @@
 package gitreceive
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/deis/sa-builder/pkg"
+	"github.com/deis/sa-builder/pkg/gitreceive/storage"
+	"k8s.io/kubernetes/pkg/api"
 )
 
 const (
@@ -17,19 +27,91 @@ type Config struct {
 	RegistryHost string `envconfig:"DEIS_REGISTRY_SERVICE_HOST" default:"localhost"`
 	RegistryPort string `envconfig:"DEIS_REGISTRY_SERVICE_PORT" default:"5000"`
 
+	// calls the controller over https, skipping verification of its certificate if insecure, e.g. in dev
+	// clusters with a self-signed certificate
+	ControllerTLS                bool `envconfig:"CONTROLLER_TLS" default:"false"`
+	ControllerInsecureSkipVerify bool `envconfig:"CONTROLLER_INSECURE_SKIP_VERIFY" default:"false"`
+
+	// an external registry, such as ECR or GCR, that docker builds push to instead of the Deis registry
+	ExternalRegistryHost   string `envconfig:"REGISTRY_HOST" default:""`
+	ExternalRegistryPort   string `envconfig:"REGISTRY_PORT" default:""`
+	ExternalRegistrySecret string `envconfig:"REGISTRY_SECRET" default:""` // secret with a docker config.json for the registry
+
 	GitHome                       string `envconfig:"GIT_HOME" required:"true"`
 	SSHConnection                 string `envconfig:"SSH_CONNECTION" required:"true"`
 	SSHOriginalCommand            string `envconfig:"SSH_ORIGINAL_COMMAND" required:"true"`
 	Repository                    string `envconfig:"REPOSITORY" required:"true"`
 	Username                      string `envconfig:"USERNAME" required:"true"`
-	Fingerprint                   string `envconfig:"FINGERPRINT" required:"true"`
+	Fingerprint                   string `envconfig:"FINGERPRINT" required:"true"` // in the server's FINGERPRINT_ALGORITHM format
 	PodNamespace                  string `envconfig:"POD_NAMESPACE" required:"true"`
+	BuildNamespace                string `envconfig:"BUILD_NAMESPACE" default:""` // builder pods run here instead of in POD_NAMESPACE if set
 	StorageRegion                 string `envconfig:"STORAGE_REGION" default:"us-east-1"`
 	Debug                         bool   `envconfig:"DEBUG" default:"false"`
 	BuilderPodTickDurationMSec    int    `envconfig:"BUILDER_POD_TICK_DURATION" default:"100"`
 	BuilderPodWaitDurationMSec    int    `envconfig:"BUILDER_POD_WAIT_DURATION" default:"300000"` // 5 minutes
 	ObjectStorageTickDurationMSec int    `envconfing:"OBJECT_STORAGE_TICK_DURATION" default:"500"`
 	ObjectStorageWaitDurationMSec int    `envconfig:"OBJECT_STORAGE_WAIT_DURATION" default:"300000"` // 5 minutes
+	StorageType                   string `envconfig:"STORAGE_TYPE" default:"s3"`                     // s3 or azure, gcs is not supported yet
+	StorageBucket                 string `envconfig:"BUILDER_STORAGE_BUCKET" default:""`             // required for gcs
+	StorageAccount                string `envconfig:"BUILDER_STORAGE_ACCOUNT" default:""`            // required for azure
+	StorageContainer              string `envconfig:"BUILDER_STORAGE_CONTAINER" default:""`          // required for azure
+	StorageEndpoint               string `envconfig:"BUILDER_STORAGE_ENDPOINT" default:""`           // defaults to http://$DEIS_BUILDER_SERVICE_HOST:3000
+	StoragePrefix                 string `envconfig:"BUILDER_STORAGE_PREFIX" default:"git"`
+	StorageKeyPrefix              string `envconfig:"BUILDER_STORAGE_KEY_PREFIX" default:""`   // prepended to every object key, e.g. the builder's name
+	StorageKeyTemplate            string `envconfig:"BUILDER_STORAGE_KEY_TEMPLATE" default:""` // e.g. builds/{app}/{sha}, defaults to home/{app}:git-{sha}
+	StorageTLS                    bool   `envconfig:"BUILDER_STORAGE_TLS" default:"false"`
+	SlugGzip                      bool   `envconfig:"BUILDER_SLUG_GZIP" default:"false"`   // gzip slugs before uploading them, their keys end in .gz
+	StorageTLSPort                string `envconfig:"BUILDER_STORAGE_TLS_PORT" default:""` // defaults to the endpoint's port
+	BuildTimeoutSec               int    `envconfig:"BUILD_TIMEOUT" default:"1800"`        // 30 minutes, 0 for no limit
+	BuildPodDeadlineSec           int    `envconfig:"BUILD_POD_DEADLINE" default:"0"`      // the kubelet kills builder pods after this, 0 for never
+	KeepBuildPodsSec              int    `envconfig:"KEEP_BUILD_PODS_SECONDS" default:"0"` // how long finished builder pods are kept
+	KubeAPIRetries                int    `envconfig:"KUBE_API_RETRIES" default:"5"`        // attempts per Kubernetes API call
+	KubeAPIRetryDelayMSec         int    `envconfig:"KUBE_API_RETRY_DELAY" default:"500"`  // before the first retry, doubled after each
+	BuilderPodCPURequest          string `envconfig:"BUILDER_POD_CPU_REQUEST" default:"100m"`
+	BuilderPodMemRequest          string `envconfig:"BUILDER_POD_MEM_REQUEST" default:"256Mi"`
+	BuilderPodCPULimit            string `envconfig:"BUILDER_POD_CPU_LIMIT" default:""`
+	BuilderPodMemLimit            string `envconfig:"BUILDER_POD_MEM_LIMIT" default:""`
+	BuilderPodMaxCPU              string `envconfig:"BUILDER_POD_MAX_CPU" default:"2"`       // the most an app's deis.yaml can request
+	BuilderPodMaxMem              string `envconfig:"BUILDER_POD_MAX_MEM" default:"4Gi"`     // the most an app's deis.yaml can request
+	BuildpackURL                  string `envconfig:"BUILDPACK_URL" default:""`              // comma or newline separated for multi-buildpack builds
+	BuildpackSecret               string `envconfig:"BUILDPACK_SECRET" default:""`           // secret with user, token and/or ssh-key for a private BUILDPACK_URL
+	BuildEnvSecret                string `envconfig:"BUILD_ENV_SECRET" default:""`           // secret whose keys are builder env vars, {app} is the app name
+	BuildEnvAllowlist             string `envconfig:"BUILD_ENV_ALLOWLIST" default:""`        // comma separated, only these env vars reach builder pods if set
+	BuildEnvDenylist              string `envconfig:"BUILD_ENV_DENYLIST" default:""`         // comma separated env vars that never reach builder pods
+	GlobalBuildEnv                string `envconfig:"GLOBAL_BUILD_ENV" default:""`           // e.g. HTTP_PROXY=http://proxy:3128, given to every builder pod
+	BuilderPodNodeSelector        string `envconfig:"BUILDER_POD_NODE_SELECTOR" default:""`  // e.g. disktype=ssd,pool=builders
+	BuilderPodAnnotations         string `envconfig:"BUILDER_POD_ANNOTATIONS" default:""`    // e.g. team=payments,owner=ops
+	BuilderPodAntiAffinity        string `envconfig:"BUILDER_POD_ANTI_AFFINITY" default:""`  // preferred or required, to spread builder pods over nodes
+	BuilderPodNodeAffinity        string `envconfig:"BUILDER_POD_NODE_AFFINITY" default:""`  // e.g. cache=warm|hot, labels of the nodes builder pods prefer
+	BuilderPodTolerations         string `envconfig:"BUILDER_POD_TOLERATIONS" default:""`    // e.g. dedicated=builds:NoSchedule,gpu:PreferNoSchedule
+	BuilderImagePullSecrets       string `envconfig:"BUILDER_IMAGE_PULL_SECRETS" default:""` // comma separated secret names
+	BuilderServiceAccount         string `envconfig:"BUILDER_SERVICE_ACCOUNT" default:""`    // defaults to the namespace's default service account
+	BuilderRestartPolicy          string `envconfig:"BUILDER_POD_RESTART_POLICY" default:""` // Never or OnFailure, defaults to Never
+	SlugBuilderImage              string `envconfig:"SLUGBUILDER_IMAGE_NAME" default:""`     // defaults to smothiki/slugbuilder:v1.3
+	DockerBuilderImage            string `envconfig:"DOCKERBUILDER_IMAGE_NAME" default:""`   // defaults to quay.io/deisci/dockerbuilder:v2-beta
+	ImagePullPolicy               string `envconfig:"IMAGE_PULL_POLICY" default:""`          // IfNotPresent, Always or Never. Defaults to IfNotPresent for tagged images
+	LogStreamLimit                int    `envconfig:"LOG_STREAM_LIMIT" default:"10"`         // 0 for unlimited
+	LogStreamQueueDurationMSec    int    `envconfig:"LOG_STREAM_QUEUE_DURATION" default:"5000"`
+	LogPollIntervalMSec           int    `envconfig:"LOG_POLL_INTERVAL" default:"1000"`
+	LogStreamLockDir              string `envconfig:"LOG_STREAM_LOCK_DIR" default:"/tmp/deis-builder-log-streams"`
+	InjectCommitRange             bool   `envconfig:"INJECT_COMMIT_RANGE" default:"false"`
+	InjectChangedFiles            bool   `envconfig:"INJECT_CHANGED_FILES" default:"false"`
+	MaxLineSize                   int    `envconfig:"MAX_LINE_SIZE" default:"65536"`
+	MaxLines                      int    `envconfig:"MAX_LINES" default:"1000"` // 0 for unlimited
+	AuditURL                      string `envconfig:"AUDIT_URL" default:""`
+	AuditFailClosed               bool   `envconfig:"AUDIT_FAIL_CLOSED" default:"false"`
+	AuditTimeoutMSec              int    `envconfig:"AUDIT_TIMEOUT" default:"5000"`
+	NotifyURL                     string `envconfig:"NOTIFY_URL" default:""` // POSTed to by the post-receive hook after a deploy
+	NotifyTimeoutMSec             int    `envconfig:"NOTIFY_TIMEOUT" default:"5000"`
+	MetricsPort                   int    `envconfig:"METRICS_PORT" default:"0"` // the SSH server's metrics port, 0 to not report builds
+	DeployPolicyFile              string `envconfig:"DEPLOY_POLICY_FILE" default:""`
+	DockerImageTags               string `envconfig:"DOCKER_IMAGE_TAGS" default:""`        // e.g. {sha},{branch},latest
+	DeployBranch                  string `envconfig:"DEPLOY_BRANCH" default:""`            // defaults to main or master, pushes to other branches are not built
+	DryRun                        bool   `envconfig:"BUILDER_DRY_RUN" default:"false"`     // print the builder pod instead of starting it
+	GitLFS                        string `envconfig:"GIT_LFS" default:"reject"`            // or ignore, to build git LFS pointer files as they are
+	BuildEventsPath               string `envconfig:"BUILD_EVENTS_PATH" default:""`        // controller endpoint for build-started and build-finished events, e.g. v2/hooks/events
+	BuildEventsStrict             bool   `envconfig:"BUILD_EVENTS_STRICT" default:"false"` // fail the build if an event can't be sent
+	BuildEventsTimeoutMSec        int    `envconfig:"BUILD_EVENTS_TIMEOUT" default:"5000"`
 }
 
 func (c Config) App() string {
@@ -40,6 +122,28 @@ func (c Config) App() string {
 	return c.Repository[0:li]
 }
 
+// BuilderPodNamespace returns the namespace that builder pods run in: BuildNamespace if it is set, or else
+// the app's PodNamespace. Secrets that builder pods mount, like BuildpackSecret, must exist there.
+func (c Config) BuilderPodNamespace() string {
+	if c.BuildNamespace != "" {
+		return c.BuildNamespace
+	}
+	return c.PodNamespace
+}
+
+// RegistryImage returns imageName in the external registry, or imageName unchanged if there is no external
+// registry
+func (c Config) RegistryImage(imageName string) string {
+	if c.ExternalRegistryHost == "" {
+		return imageName
+	}
+	registry := c.ExternalRegistryHost
+	if c.ExternalRegistryPort != "" {
+		registry = net.JoinHostPort(registry, c.ExternalRegistryPort)
+	}
+	return registry + "/" + imageName
+}
+
 // BuilderPodTickDuration returns the size of the interval used to check for
 // the end of the execution of a Pod building an application
 func (c Config) BuilderPodTickDuration() time.Duration {
@@ -58,12 +162,198 @@ func (c Config) ObjectStorageTickDuration() time.Duration {
 	return time.Duration(time.Duration(c.ObjectStorageTickDurationMSec) * time.Millisecond)
 }
 
+// ObjectStorageEndpoint returns the base URL that slugs and tarballs are stored under, without the
+// StoragePrefix. When StorageTLS is set the URL uses https, on StorageTLSPort if that is set.
+func (c Config) ObjectStorageEndpoint() (string, error) {
+	endpoint := c.StorageEndpoint
+	if endpoint == "" {
+		endpoint = "http://" + os.Getenv("DEIS_BUILDER_SERVICE_HOST") + ":3000"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !c.StorageTLS {
+		return endpoint, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("storage endpoint %q is not a valid URL", endpoint)
+	}
+	u.Scheme = "https"
+	if c.StorageTLSPort != "" {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		u.Host = net.JoinHostPort(strings.Trim(host, "[]"), c.StorageTLSPort)
+	}
+	return u.String(), nil
+}
+
+// StorageBackend returns the object storage backend for StorageType that build artifacts are kept in
+func (c Config) StorageBackend() (storage.Backend, error) {
+	backendConf := storage.BackendConfig{
+		Type:      c.StorageType,
+		Prefix:    c.StoragePrefix,
+		Bucket:    c.StorageBucket,
+		Account:   c.StorageAccount,
+		Container: c.StorageContainer,
+	}
+	if c.StorageType == storage.TypeS3 {
+		var err error
+		if backendConf.Endpoint, err = c.ObjectStorageEndpoint(); err != nil {
+			return nil, err
+		}
+	}
+	return storage.NewBackend(backendConf)
+}
+
+// StorageKeys returns the scheme that the object keys of builds follow
+func (c Config) StorageKeys() storage.KeyScheme {
+	return storage.KeyScheme{Prefix: c.StorageKeyPrefix, Template: c.StorageKeyTemplate, Gzip: c.SlugGzip}
+}
+
 // ObjectStorageWaitDuration returns the maximum time to wait for the end of an
 // operation that involves the object storage
 func (c Config) ObjectStorageWaitDuration() time.Duration {
 	return time.Duration(time.Duration(c.ObjectStorageWaitDurationMSec) * time.Millisecond)
 }
 
+// BuildTimeout returns the maximum time a builder pod may run before it is deleted and the build fails. A
+// BUILD_TIMEOUT of 0 or less means no limit.
+func (c Config) BuildTimeout() time.Duration {
+	return time.Duration(c.BuildTimeoutSec) * time.Second
+}
+
+// BuildPodRetention returns how long finished builder pods are kept around for debugging before they are
+// deleted
+func (c Config) BuildPodRetention() time.Duration {
+	return time.Duration(c.KeepBuildPodsSec) * time.Second
+}
+
+// KubeAPIRetryDelay returns the delay before the first retry of a failed Kubernetes API call
+func (c Config) KubeAPIRetryDelay() time.Duration {
+	return time.Duration(c.KubeAPIRetryDelayMSec) * time.Millisecond
+}
+
+// LogStreamQueueDuration returns the maximum time to wait for a free log stream before falling
+// back to polling for the logs of a Pod building an application
+func (c Config) LogStreamQueueDuration() time.Duration {
+	return time.Duration(c.LogStreamQueueDurationMSec) * time.Millisecond
+}
+
+// LogPollInterval returns the interval between log fetches for builds that could not get a log stream
+func (c Config) LogPollInterval() time.Duration {
+	return time.Duration(c.LogPollIntervalMSec) * time.Millisecond
+}
+
+// AuditTimeout returns the maximum time to wait for the audit log to accept a deploy audit record
+func (c Config) AuditTimeout() time.Duration {
+	return time.Duration(c.AuditTimeoutMSec) * time.Millisecond
+}
+
+// NotifyTimeout returns the maximum time to wait for the notify URL to accept a deploy notification
+func (c Config) NotifyTimeout() time.Duration {
+	return time.Duration(c.NotifyTimeoutMSec) * time.Millisecond
+}
+
+// BuildEventsTimeout returns the maximum time to wait for the controller to accept a build event
+func (c Config) BuildEventsTimeout() time.Duration {
+	return time.Duration(c.BuildEventsTimeoutMSec) * time.Millisecond
+}
+
+// NodeSelector returns the node selector labels for builder pods, parsed from a comma separated list
+// of key=value pairs. It returns nil if no node selector is configured.
+func (c Config) NodeSelector() (map[string]string, error) {
+	return parseKeyValues(c.BuilderPodNodeSelector, "node selector label")
+}
+
+// envNameRegex matches the names of the env vars that GlobalBuildEnv can set
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// GlobalBuildEnvVars returns the env vars given to every builder pod, parsed from a comma or newline
+// separated list of key=value pairs. An item without = continues the value before it on its line, so that
+// NO_PROXY=localhost,.cluster.local keeps its comma. It returns nil if no global env is configured.
+func (c Config) GlobalBuildEnvVars() (map[string]string, error) {
+	if strings.TrimSpace(c.GlobalBuildEnv) == "" {
+		return nil, nil
+	}
+	env := map[string]string{}
+	for _, line := range strings.Split(c.GlobalBuildEnv, "\n") {
+		last := ""
+		for _, item := range strings.Split(line, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) == 1 && last != "" {
+				env[last] += "," + item
+				continue
+			}
+			if len(kv) != 2 || !envNameRegex.MatchString(kv[0]) {
+				return nil, fmt.Errorf("global build env var %q is not of the form key=value", item)
+			}
+			env[kv[0]] = kv[1]
+			last = kv[0]
+		}
+	}
+	return env, nil
+}
+
+// releaseVersionOption is the prefix of the git push option that sets the release version of a build, as in
+// git push -o release-version=3
+const releaseVersionOption = "release-version="
+
+// releaseVersionRegex matches the release versions that can be part of object keys
+var releaseVersionRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// BuildReleaseVersion returns the release version of the build from the release-version push option, or "" if
+// the push has none. Push options reach the hook as GIT_PUSH_OPTION_<n>, since the SSH server creates repos
+// with receive.advertisePushOptions set. The version comes with each push, so it only ever tags the build of
+// the app pushed.
+func (c Config) BuildReleaseVersion() string {
+	n, _ := strconv.Atoi(os.Getenv("GIT_PUSH_OPTION_COUNT"))
+	for i := 0; i < n; i++ {
+		if opt := os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", i)); strings.HasPrefix(opt, releaseVersionOption) {
+			return strings.TrimPrefix(opt, releaseVersionOption)
+		}
+	}
+	return ""
+}
+
+// PodAnnotations returns the extra annotations for builder pods, parsed from a comma separated list of
+// key=value pairs. It returns nil if no annotations are configured.
+func (c Config) PodAnnotations() (map[string]string, error) {
+	return parseKeyValues(c.BuilderPodAnnotations, "builder pod annotation")
+}
+
+// splitList returns the non-empty, trimmed items of the comma separated list s, or nil if it has none
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs, describing a malformed pair as a what
+func parseKeyValues(raw, what string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	kvs := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s %q is not of the form key=value", what, pair)
+		}
+		kvs[kv[0]] = kv[1]
+	}
+	return kvs, nil
+}
+
 // CheckDurations checks if ticks for builder and object storage are not bigger
 // than the maximum duration. In case of this it will set the tick to the default
 func (c *Config) CheckDurations() {
@@ -81,3 +371,55 @@ func (c *Config) CheckDurations() {
 		c.ObjectStorageTickDurationMSec = objectStorageTick
 	}
 }
+
+// Validate returns an error describing the first setting in c that is invalid
+func (c Config) Validate() error {
+	if err := pkg.CheckImagePullPolicy(c.ImagePullPolicy); err != nil {
+		return err
+	}
+	switch api.RestartPolicy(c.BuilderRestartPolicy) {
+	case "", api.RestartPolicyNever, api.RestartPolicyOnFailure:
+	default:
+		return fmt.Errorf("BUILDER_POD_RESTART_POLICY %q is invalid, it must be %s or %s", c.BuilderRestartPolicy, api.RestartPolicyNever, api.RestartPolicyOnFailure)
+	}
+	// the builder pods' put_url and TAR_URL must be HTTP URLs, and gcs objects are only located by gs://
+	// references until signed URLs are generated for them
+	if c.StorageType == storage.TypeGCS {
+		return fmt.Errorf("STORAGE_TYPE %s is not supported yet, builder pods can't read or write gs:// URLs", storage.TypeGCS)
+	}
+	if err := c.StorageKeys().Validate(); err != nil {
+		return err
+	}
+	if version := c.BuildReleaseVersion(); version != "" && !releaseVersionRegex.MatchString(version) {
+		return fmt.Errorf("release version %q is invalid, it may only contain letters, digits, '.', '_' and '-'", version)
+	}
+	switch c.GitLFS {
+	case "", lfsReject, lfsIgnore:
+	default:
+		return fmt.Errorf("GIT_LFS %q is invalid, it must be %s or %s", c.GitLFS, lfsReject, lfsIgnore)
+	}
+	if _, err := c.PodAffinity(); err != nil {
+		return err
+	}
+	if _, err := c.PodTolerations(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// BuilderPullPolicy returns the pull policy for the builder image. Unless ImagePullPolicy is set, images
+// pinned to a tag or digest are only pulled if they are not present, and untagged or latest images always.
+func (c Config) BuilderPullPolicy(image string) api.PullPolicy {
+	if c.ImagePullPolicy != "" {
+		return api.PullPolicy(c.ImagePullPolicy)
+	}
+	if strings.Contains(image, "@") {
+		return api.PullIfNotPresent
+	}
+	// a ':' before the last '/' belongs to a registry's port, not a tag
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i != -1 && name[i+1:] != "latest" {
+		return api.PullIfNotPresent
+	}
+	return api.PullAlways
+}
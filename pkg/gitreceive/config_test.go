@@ -1,7 +1,12 @@
 package gitreceive
 
 import (
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
 )
 
 type checkCase struct {
@@ -44,3 +49,271 @@ func TestCheckDurations(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeSelector(t *testing.T) {
+	for _, empty := range []string{"", " "} {
+		selector, err := Config{BuilderPodNodeSelector: empty}.NodeSelector()
+		if err != nil {
+			t.Errorf("parsing empty node selector (%s)", err)
+		}
+		if selector != nil {
+			t.Errorf("expected no node selector for %q, got %v", empty, selector)
+		}
+	}
+
+	selector, err := Config{BuilderPodNodeSelector: "disktype=ssd"}.NodeSelector()
+	if err != nil {
+		t.Fatalf("parsing node selector (%s)", err)
+	}
+	if len(selector) != 1 || selector["disktype"] != "ssd" {
+		t.Errorf("expected disktype=ssd, got %v", selector)
+	}
+
+	selector, err = Config{BuilderPodNodeSelector: "disktype=ssd, pool=builders,zone="}.NodeSelector()
+	if err != nil {
+		t.Fatalf("parsing node selector (%s)", err)
+	}
+	expected := map[string]string{"disktype": "ssd", "pool": "builders", "zone": ""}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Errorf("expected %v, got %v", expected, selector)
+	}
+
+	for _, malformed := range []string{"disktype", "=ssd", "disktype=ssd,,pool=builders"} {
+		if _, err := (Config{BuilderPodNodeSelector: malformed}).NodeSelector(); err == nil {
+			t.Errorf("expected %q to be rejected", malformed)
+		}
+	}
+}
+
+func TestObjectStorageEndpoint(t *testing.T) {
+	os.Setenv("DEIS_BUILDER_SERVICE_HOST", "10.1.2.3")
+	defer os.Unsetenv("DEIS_BUILDER_SERVICE_HOST")
+
+	cases := []struct {
+		conf     Config
+		expected string
+	}{
+		{Config{}, "http://10.1.2.3:3000"},
+		{Config{StorageEndpoint: "http://minio.storage.svc:9000/"}, "http://minio.storage.svc:9000"},
+		{Config{StorageTLS: true}, "https://10.1.2.3:3000"},
+		{Config{StorageTLS: true, StorageTLSPort: "3443"}, "https://10.1.2.3:3443"},
+		{Config{StorageEndpoint: "http://minio.storage.svc:9000", StorageTLS: true}, "https://minio.storage.svc:9000"},
+		{Config{StorageEndpoint: "http://minio.storage.svc", StorageTLS: true, StorageTLSPort: "443"}, "https://minio.storage.svc:443"},
+		{Config{StorageEndpoint: "http://[fd00::1]:9000", StorageTLS: true, StorageTLSPort: "9443"}, "https://[fd00::1]:9443"},
+	}
+	for _, c := range cases {
+		endpoint, err := c.conf.ObjectStorageEndpoint()
+		if err != nil {
+			t.Errorf("%+v: getting storage endpoint (%s)", c.conf, err)
+			continue
+		}
+		if endpoint != c.expected {
+			t.Errorf("%+v: expected storage endpoint %s, got %s", c.conf, c.expected, endpoint)
+		}
+	}
+
+	if _, err := (Config{StorageEndpoint: "minio:9000", StorageTLS: true}).ObjectStorageEndpoint(); err == nil {
+		t.Errorf("expected an endpoint without a scheme to be rejected when TLS is enabled")
+	}
+}
+
+func TestStorageBackend(t *testing.T) {
+	conf := Config{StorageType: "s3", StorageEndpoint: "http://minio.storage.svc:9000", StoragePrefix: "git"}
+	backend, err := conf.StorageBackend()
+	if err != nil {
+		t.Fatalf("getting s3 backend (%s)", err)
+	}
+	if url := backend.ObjectURL("key"); url != "http://minio.storage.svc:9000/git/key" {
+		t.Errorf("unexpected s3 object URL %s", url)
+	}
+
+	conf = Config{StorageType: "gcs", StorageBucket: "deis-slugs", StoragePrefix: "git"}
+	backend, err = conf.StorageBackend()
+	if err != nil {
+		t.Fatalf("getting gcs backend (%s)", err)
+	}
+	if url := backend.ObjectURL("key"); url != "gs://deis-slugs/git/key" {
+		t.Errorf("unexpected gcs object URL %s", url)
+	}
+
+	conf = Config{StorageType: "azure", StorageAccount: "deisbuilds", StorageContainer: "slugs", StoragePrefix: "git"}
+	backend, err = conf.StorageBackend()
+	if err != nil {
+		t.Fatalf("getting azure backend (%s)", err)
+	}
+	if url := backend.ObjectURL("key"); url != "https://deisbuilds.blob.core.windows.net/slugs/git/key" {
+		t.Errorf("unexpected azure object URL %s", url)
+	}
+
+	if _, err := (Config{StorageType: "gcs"}).StorageBackend(); err == nil {
+		t.Errorf("expected gcs storage without a bucket to be rejected")
+	}
+}
+
+func TestValidateRejectsGCS(t *testing.T) {
+	err := Config{StorageType: "gcs", StorageBucket: "deis-slugs"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), "STORAGE_TYPE gcs is not supported") {
+		t.Errorf("expected gcs storage to be rejected until builder pods can use its objects, got %v", err)
+	}
+	for _, supported := range []string{"", "s3"} {
+		if err := (Config{StorageType: supported}).Validate(); err != nil {
+			t.Errorf("expected STORAGE_TYPE %q to be valid, got %s", supported, err)
+		}
+	}
+}
+
+func TestBuilderPullPolicy(t *testing.T) {
+	cases := []struct {
+		policy   string
+		image    string
+		expected api.PullPolicy
+	}{
+		{"", "smothiki/slugbuilder:v1.3", api.PullIfNotPresent},
+		{"", "quay.io/deisci/dockerbuilder:v2-beta", api.PullIfNotPresent},
+		{"", "registry.local:5000/slugbuilder@sha256:abc123", api.PullIfNotPresent},
+		{"", "registry.local:5000/slugbuilder", api.PullAlways},
+		{"", "smothiki/slugbuilder:latest", api.PullAlways},
+		{"Always", "smothiki/slugbuilder:v1.3", api.PullAlways},
+		{"Never", "smothiki/slugbuilder:v1.3", api.PullNever},
+		{"IfNotPresent", "smothiki/slugbuilder", api.PullIfNotPresent},
+	}
+	for _, c := range cases {
+		conf := Config{ImagePullPolicy: c.policy}
+		if err := conf.Validate(); err != nil {
+			t.Errorf("expected pull policy %q to be valid, got %s", c.policy, err)
+		}
+		if policy := conf.BuilderPullPolicy(c.image); policy != c.expected {
+			t.Errorf("pull policy %q for %s: expected %s, got %s", c.policy, c.image, c.expected, policy)
+		}
+	}
+
+	err := Config{ImagePullPolicy: "Sometimes"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), `IMAGE_PULL_POLICY "Sometimes" is invalid`) {
+		t.Errorf("expected an invalid pull policy to be rejected, got %v", err)
+	}
+}
+
+func TestRegistryImage(t *testing.T) {
+	cases := []struct {
+		host     string
+		port     string
+		expected string
+	}{
+		{"", "", "myapp:git-c3b4e4ba"},
+		{"", "5000", "myapp:git-c3b4e4ba"},
+		{"gcr.io", "", "gcr.io/myapp:git-c3b4e4ba"},
+		{"registry.example.com", "5000", "registry.example.com:5000/myapp:git-c3b4e4ba"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", "", "123456789012.dkr.ecr.us-east-1.amazonaws.com/myapp:git-c3b4e4ba"},
+	}
+	for _, c := range cases {
+		conf := Config{ExternalRegistryHost: c.host, ExternalRegistryPort: c.port}
+		if image := conf.RegistryImage("myapp:git-c3b4e4ba"); image != c.expected {
+			t.Errorf("registry %q port %q: expected %s, got %s", c.host, c.port, c.expected, image)
+		}
+	}
+}
+
+func TestBuilderPodNamespace(t *testing.T) {
+	conf := Config{PodNamespace: "deis"}
+	if ns := conf.BuilderPodNamespace(); ns != "deis" {
+		t.Errorf("expected builder pods to run in the app namespace by default, got %s", ns)
+	}
+	conf.BuildNamespace = "deis-builds"
+	if ns := conf.BuilderPodNamespace(); ns != "deis-builds" {
+		t.Errorf("expected builder pods to run in BUILD_NAMESPACE, got %s", ns)
+	}
+
+	emptyEnv := map[string]interface{}{}
+	for name, pod := range map[string]*api.Pod{
+		"slug":   slugbuilderPod(false, false, "test", conf.BuilderPodNamespace(), emptyEnv, "tar", "put-url", "", "", ""),
+		"docker": dockerBuilderPod(false, false, "test", conf.BuilderPodNamespace(), emptyEnv, "tar", "img", ""),
+	} {
+		labelBuilderPod(pod, "myapp", conf.PodNamespace, "c3b4e4ba", name, nil)
+		if pod.ObjectMeta.Namespace != "deis-builds" {
+			t.Errorf("expected the %s builder pod in deis-builds, got %s", name, pod.ObjectMeta.Namespace)
+		}
+		if pod.ObjectMeta.Labels[appNamespaceLabel] != "deis" {
+			t.Errorf("expected the %s builder pod to be labeled with the app namespace, got %v", name, pod.ObjectMeta.Labels)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	cases := map[string][]string{
+		"":                         nil,
+		" , ,":                     nil,
+		"regcred":                  {"regcred"},
+		" regcred, othercred ,,x ": {"regcred", "othercred", "x"},
+	}
+	for s, expected := range cases {
+		if items := splitList(s); !reflect.DeepEqual(items, expected) {
+			t.Errorf("%q: expected %#v, got %#v", s, expected, items)
+		}
+	}
+}
+
+func TestValidateRestartPolicy(t *testing.T) {
+	for _, policy := range []string{"", "Never", "OnFailure"} {
+		if err := (Config{BuilderRestartPolicy: policy}).Validate(); err != nil {
+			t.Errorf("expected restart policy %q to be valid, got %s", policy, err)
+		}
+	}
+	err := Config{BuilderRestartPolicy: "Always"}.Validate()
+	if err == nil || !strings.Contains(err.Error(), `BUILDER_POD_RESTART_POLICY "Always" is invalid`) {
+		t.Errorf("expected a restart policy that never lets a build finish to be rejected, got %v", err)
+	}
+}
+
+func TestBuildReleaseVersion(t *testing.T) {
+	conf := Config{}
+	if v := conf.BuildReleaseVersion(); v != "" {
+		t.Errorf("expected no release version without the push option, got %q", v)
+	}
+
+	os.Setenv("GIT_PUSH_OPTION_COUNT", "2")
+	os.Setenv("GIT_PUSH_OPTION_0", "ci.skip")
+	os.Setenv("GIT_PUSH_OPTION_1", "release-version=4")
+	defer func() {
+		for _, name := range []string{"GIT_PUSH_OPTION_COUNT", "GIT_PUSH_OPTION_0", "GIT_PUSH_OPTION_1"} {
+			os.Unsetenv(name)
+		}
+	}()
+	if v := conf.BuildReleaseVersion(); v != "4" {
+		t.Errorf("expected the release version from the release-version push option, got %q", v)
+	}
+
+	os.Setenv("GIT_PUSH_OPTION_1", "release-version=../4")
+	err := conf.Validate()
+	if err == nil || !strings.Contains(err.Error(), `release version "../4" is invalid`) {
+		t.Errorf("expected a release version that isn't safe in object keys to be rejected, got %v", err)
+	}
+}
+
+func TestGlobalBuildEnvVars(t *testing.T) {
+	for _, empty := range []string{"", "  "} {
+		env, err := Config{GlobalBuildEnv: empty}.GlobalBuildEnvVars()
+		if err != nil || env != nil {
+			t.Errorf("expected no global env for %q, got %v (%v)", empty, env, err)
+		}
+	}
+
+	env, err := Config{GlobalBuildEnv: "HTTP_PROXY=http://proxy:3128, NO_PROXY=localhost,.cluster.local\nPIP_INDEX_URL=https://mirror/simple?a=b,EMPTY="}.GlobalBuildEnvVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"HTTP_PROXY":    "http://proxy:3128",
+		"NO_PROXY":      "localhost,.cluster.local",
+		"PIP_INDEX_URL": "https://mirror/simple?a=b",
+		"EMPTY":         "",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("expected global env %v, got %v", expected, env)
+	}
+
+	for _, malformed := range []string{"HTTP_PROXY", "=value", "NOT-A-NAME=x", "A=b\nc"} {
+		if _, err := (Config{GlobalBuildEnv: malformed}).GlobalBuildEnvVars(); err == nil {
+			t.Errorf("expected global env %q to be rejected", malformed)
+		}
+	}
+}
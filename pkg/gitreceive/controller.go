@@ -2,6 +2,7 @@ package gitreceive
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -31,9 +32,30 @@ func (u unexpectedControllerStatusCode) Error() string {
 }
 
 func controllerURLStr(conf *Config, additionalPath ...string) string {
-	return fmt.Sprintf("http://%s:%s/%s", conf.WorkflowHost, conf.WorkflowPort, strings.Join(additionalPath, "/"))
+	scheme := "http"
+	if conf.ControllerTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s/%s", scheme, conf.WorkflowHost, conf.WorkflowPort, strings.Join(additionalPath, "/"))
 }
 
+// controllerClient returns the client for controller requests, which skips verifying the controller's
+// certificate if conf's ControllerInsecureSkipVerify is set. Object storage and the Kubernetes API don't
+// use it, so they are always verified.
+func controllerClient(conf *Config) *http.Client {
+	if !conf.ControllerInsecureSkipVerify {
+		return http.DefaultClient
+	}
+	return insecureControllerClient
+}
+
+// insecureControllerClient is shared by all controller requests that skip verification, so that they reuse
+// its transport's connections.
+var insecureControllerClient = &http.Client{Transport: &http.Transport{
+	Proxy:           http.ProxyFromEnvironment,
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}}
+
 func setReqHeaders(builderKey string, req *http.Request) {
 	req.Header.Add("Content-Type", contentType)
 	req.Header.Add("Accept", contentType)
@@ -60,7 +82,7 @@ func getAppConfig(conf *Config, builderKey, userName, appName string) (*pkg.Conf
 	setReqHeaders(builderKey, req)
 
 	log.Debug("Workflow request POST /v2/hooks/config\n%s", string(data))
-	res, err := http.DefaultClient.Do(req)
+	res, err := controllerClient(conf).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +118,7 @@ func publishRelease(conf *Config, builderKey string, buildHook *pkg.BuildHook) (
 	}
 	setReqHeaders(builderKey, req)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := controllerClient(conf).Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -138,7 +160,7 @@ func receive(conf *Config, builderKey, gitSha string) error {
 	setReqHeaders(builderKey, req)
 
 	// TODO: use ctxhttp here (https://godoc.org/golang.org/x/net/context/ctxhttp)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := controllerClient(conf).Do(req)
 	if err != nil {
 		return err
 	}
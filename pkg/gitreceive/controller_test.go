@@ -0,0 +1,29 @@
+package gitreceive
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestControllerClient(t *testing.T) {
+	conf := &Config{WorkflowHost: "deis-controller", WorkflowPort: "443"}
+	if controllerClient(conf) != http.DefaultClient {
+		t.Errorf("expected the default client when verifying the controller's certificate")
+	}
+	if url := controllerURLStr(conf, "v2", "hooks", "push"); url != "http://deis-controller:443/v2/hooks/push" {
+		t.Errorf("expected an http controller URL, got %s", url)
+	}
+
+	conf.ControllerTLS = true
+	conf.ControllerInsecureSkipVerify = true
+	transport, ok := controllerClient(conf).Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("expected a client that skips verification, got %+v", controllerClient(conf).Transport)
+	}
+	if controllerClient(conf).Transport != transport {
+		t.Errorf("expected controller requests to share the transport that skips verification")
+	}
+	if url := controllerURLStr(conf, "v2", "hooks", "push"); url != "https://deis-controller:443/v2/hooks/push" {
+		t.Errorf("expected an https controller URL, got %s", url)
+	}
+}
@@ -0,0 +1,80 @@
+package gitreceive
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/deis/pkg/log"
+)
+
+// defaultDeployBranches are the branches deployed when DEPLOY_BRANCH is not set, in order of preference
+var defaultDeployBranches = []string{"main", "master"}
+
+// pushedRef is a single ref update of a push, as git passes it to the receive hooks
+type pushedRef struct {
+	oldRev  string
+	newRev  string
+	refName string
+}
+
+// readRefs reads every ref line of a push from r
+func readRefs(conf *Config, r io.Reader) ([]pushedRef, error) {
+	var refs []pushedRef
+	err := scanLines(r, conf.MaxLineSize, conf.MaxLines, func(line string) error {
+		oldRev, newRev, refName, err := readLine(line)
+		if err != nil {
+			return fmt.Errorf("reading STDIN (%s)", err)
+		}
+		log.Debug("read [%s,%s,%s]", oldRev, newRev, refName)
+		refs = append(refs, pushedRef{oldRev: oldRev, newRev: newRev, refName: refName})
+		return nil
+	})
+	return refs, err
+}
+
+// deployBranch returns the branch that a push of refs to a repo with the given branches deploys. That is
+// configured if it is set, or else main or master, whichever the repo or the push has, preferring main. A
+// repo with neither deploys the branch being pushed, if the push updates just one. deployBranch returns ""
+// if there is no branch to deploy.
+func deployBranch(configured string, branches []string, refs []pushedRef) string {
+	if configured != "" {
+		return configured
+	}
+	has := map[string]bool{}
+	for _, branch := range branches {
+		has[branch] = true
+	}
+	var pushed []string
+	for _, ref := range refs {
+		branch := strings.TrimPrefix(ref.refName, "refs/heads/")
+		if branch == ref.refName || isDeletion(ref.newRev) {
+			continue
+		}
+		has[branch] = true
+		pushed = append(pushed, branch)
+	}
+	for _, branch := range defaultDeployBranches {
+		if has[branch] {
+			return branch
+		}
+	}
+	if len(pushed) == 1 {
+		return pushed[0]
+	}
+	return ""
+}
+
+// listBranches returns the names of the branches in the repo at repoDir
+func listBranches(repoDir string) ([]string, error) {
+	cmd := repoCmd(repoDir, "git", "for-each-ref", "--format=%(refname)", "refs/heads/")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing the branches of %s (%s)", repoDir, err)
+	}
+	var branches []string
+	for _, refName := range strings.Fields(string(out)) {
+		branches = append(branches, strings.TrimPrefix(refName, "refs/heads/"))
+	}
+	return branches, nil
+}
@@ -0,0 +1,100 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func pushOf(branches ...string) []pushedRef {
+	var refs []pushedRef
+	for _, branch := range branches {
+		refs = append(refs, pushedRef{oldRev: zeroRev, newRev: approvedSha, refName: "refs/heads/" + branch})
+	}
+	return refs
+}
+
+func TestDeployBranch(t *testing.T) {
+	cases := []struct {
+		name       string
+		configured string
+		branches   []string
+		refs       []pushedRef
+		expected   string
+	}{
+		{"main only", "", []string{"main"}, pushOf("main"), "main"},
+		{"master only", "", []string{"master"}, pushOf("master"), "master"},
+		{"both present", "", []string{"master", "main"}, pushOf("master"), "main"},
+		{"main in the push", "", []string{"master"}, pushOf("main"), "main"},
+		{"first push of main", "", nil, pushOf("main", "feature"), "main"},
+		{"override", "release", []string{"main", "master"}, pushOf("main"), "release"},
+		{"neither, one branch pushed", "", []string{"feature"}, pushOf("trunk"), "trunk"},
+		{"neither, many branches pushed", "", nil, pushOf("trunk", "feature"), ""},
+		{"neither, only tags pushed", "", nil, []pushedRef{{zeroRev, approvedSha, "refs/tags/v1"}}, ""},
+		{"deleting the only pushed branch", "", nil, []pushedRef{{approvedSha, zeroRev, "refs/heads/trunk"}}, ""},
+	}
+	for _, c := range cases {
+		if branch := deployBranch(c.configured, c.branches, c.refs); branch != c.expected {
+			t.Errorf("%s: expected deploy branch %q, got %q", c.name, c.expected, branch)
+		}
+	}
+}
+
+func TestReceiveRefsDefaultDeployBranch(t *testing.T) {
+	conf := &Config{MaxLineSize: 1024}
+	push := zeroRev + " " + approvedSha + " refs/heads/main\n" + zeroRev + " " + approvedSha + " refs/heads/master\n"
+	var built []string
+	if err := receiveRefs(conf, strings.NewReader(push), []string{"master"}, func(oldRev, newRev, refName string) error {
+		built = append(built, refName)
+		return nil
+	}); err != nil {
+		t.Fatalf("receiving push (%s)", err)
+	}
+	if !reflect.DeepEqual(built, []string{"refs/heads/main"}) {
+		t.Errorf("expected main to be built, got %v", built)
+	}
+
+	built = nil
+	push = zeroRev + " " + approvedSha + " refs/heads/a\n" + zeroRev + " " + approvedSha + " refs/heads/b\n"
+	if err := receiveRefs(conf, strings.NewReader(push), nil, func(oldRev, newRev, refName string) error {
+		built = append(built, refName)
+		return nil
+	}); err != nil {
+		t.Fatalf("receiving push (%s)", err)
+	}
+	if len(built) != 0 {
+		t.Errorf("expected nothing to be built without a deploy branch, got %v", built)
+	}
+}
+
+func TestListBranches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "branches")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+		{"branch", "-M", "main"},
+		{"branch", "feature/login"},
+		{"tag", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("running git %s: %s (%s)", strings.Join(args, " "), out, err)
+		}
+	}
+
+	branches, err := listBranches(dir)
+	if err != nil {
+		t.Fatalf("listing branches (%s)", err)
+	}
+	if !reflect.DeepEqual(branches, []string{"feature/login", "main"}) {
+		t.Errorf("expected the main and feature/login branches, got %v", branches)
+	}
+}
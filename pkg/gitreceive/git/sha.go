@@ -12,12 +12,22 @@ const (
 
 var shaRegex = regexp.MustCompile(`^[\da-f]{40}$`)
 
+// ErrInvalidGitSha is returned for a sha that is not 40 lowercase hex characters
 type ErrInvalidGitSha struct {
 	sha string
 }
 
 func (e ErrInvalidGitSha) Error() string {
-	return fmt.Sprintf("git sha %s was invalid", e.sha)
+	return fmt.Sprintf("git sha %q was invalid, expected 40 lowercase hex characters", e.sha)
+}
+
+// ValidateSha returns ErrInvalidGitSha if rawSha is not a full git sha. Shas end up in object storage keys, so
+// anything else is rejected rather than trimmed or escaped.
+func ValidateSha(rawSha string) error {
+	if !shaRegex.MatchString(rawSha) {
+		return ErrInvalidGitSha{sha: rawSha}
+	}
+	return nil
 }
 
 type SHA struct {
@@ -26,8 +36,8 @@ type SHA struct {
 }
 
 func NewSha(rawSha string) (*SHA, error) {
-	if !shaRegex.MatchString(rawSha) {
-		return nil, ErrInvalidGitSha{sha: rawSha}
+	if err := ValidateSha(rawSha); err != nil {
+		return nil, err
 	}
 	return &SHA{full: rawSha, short: rawSha[0:8]}, nil
 }
@@ -42,3 +42,28 @@ func TestNewSha(t *testing.T) {
 		}
 	}
 }
+
+func TestShaRejectsInjection(t *testing.T) {
+	shaStrs := []string{
+		"71a09fbed590558ff822536584fc77248f07038",   // 39 characters
+		"71a09fbed590558ff822536584fc77248f0703841", // 41 characters
+		"71A09FBED590558FF822536584FC77248F070384",
+		"71a09fbe/../../../../../../etc/passwd00000",
+		"71a09fbed590558ff822536584fc77248f07038\n",
+		"71a09fbed590558ff822536584fc7724 8f070384",
+		"refs/heads/master",
+	}
+	for i, shaStr := range shaStrs {
+		sha, err := NewSha(shaStr)
+		if err == nil {
+			t.Errorf("expected error for sha %q (#%d), got %+v", shaStr, i, *sha)
+			continue
+		}
+		if _, ok := err.(ErrInvalidGitSha); !ok {
+			t.Errorf("expected an ErrInvalidGitSha for sha %q (#%d), got %s", shaStr, i, err)
+		}
+		if ValidateSha(shaStr) == nil {
+			t.Errorf("expected ValidateSha to reject %q (#%d)", shaStr, i)
+		}
+	}
+}
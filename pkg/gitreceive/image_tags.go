@@ -0,0 +1,48 @@
+package gitreceive
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/deis/sa-builder/pkg/gitreceive/git"
+)
+
+const (
+	shaTagVar    = "{sha}"
+	branchTagVar = "{branch}"
+)
+
+var (
+	// dockerTagRegex matches the tags that docker accepts
+	dockerTagRegex = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	// invalidTagChars matches the characters of a branch name that can't appear in a docker tag
+	invalidTagChars = regexp.MustCompile(`[^\w.-]`)
+)
+
+// branchName returns the short name of the branch that refName points to
+func branchName(refName string) string {
+	return strings.TrimPrefix(refName, "refs/heads/")
+}
+
+// imageTags renders the comma-separated list of tag templates in tpls into image references for
+// imageRepo. {sha} is replaced with the short git sha and {branch} with the branch name, with any
+// characters docker doesn't allow in a tag replaced by '-'. Duplicate tags are dropped, and an
+// error is returned if a rendered tag isn't a valid docker tag.
+func imageTags(tpls, imageRepo string, gitSha *git.SHA, branch string) ([]string, error) {
+	var refs []string
+	seen := map[string]bool{}
+	for _, tpl := range splitList(tpls) {
+		tag := strings.Replace(tpl, shaTagVar, gitSha.Short(), -1)
+		tag = strings.Replace(tag, branchTagVar, invalidTagChars.ReplaceAllString(branch, "-"), -1)
+		if !dockerTagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("invalid image tag %q (from template %q)", tag, tpl)
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		refs = append(refs, fmt.Sprintf("%s:%s", imageRepo, tag))
+	}
+	return refs, nil
+}
@@ -0,0 +1,58 @@
+package gitreceive
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/deis/sa-builder/pkg/gitreceive/git"
+)
+
+func TestImageTags(t *testing.T) {
+	sha, err := git.NewSha("c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de")
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	cases := []struct {
+		tpls     string
+		branch   string
+		expected []string
+	}{
+		{"", "master", nil},
+		{"{sha}", "master", []string{"myapp:c3b4e4ba"}},
+		{"{sha},latest,{branch}", "master", []string{"myapp:c3b4e4ba", "myapp:latest", "myapp:master"}},
+		{" git-{sha} , {branch}-latest ", "master", []string{"myapp:git-c3b4e4ba", "myapp:master-latest"}},
+		{"{branch}", "feature/new-thing", []string{"myapp:feature-new-thing"}},
+		{"latest,latest,{branch}", "latest", []string{"myapp:latest"}},
+	}
+	for _, c := range cases {
+		tags, err := imageTags(c.tpls, "myapp", sha, c.branch)
+		if err != nil {
+			t.Errorf("unexpected error for templates %q (%s)", c.tpls, err)
+			continue
+		}
+		if !reflect.DeepEqual(tags, c.expected) {
+			t.Errorf("expected tags %v for templates %q, got %v", c.expected, c.tpls, tags)
+		}
+	}
+}
+
+func TestImageTagsInvalid(t *testing.T) {
+	sha, err := git.NewSha("c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de")
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	for _, tpls := range []string{"-{sha}", ".latest", "tag with spaces", "tag:colon", "{sha}/x"} {
+		if tags, err := imageTags(tpls, "myapp", sha, "master"); err == nil {
+			t.Errorf("expected error for templates %q, got tags %v", tpls, tags)
+		}
+	}
+}
+
+func TestBranchName(t *testing.T) {
+	if b := branchName("refs/heads/master"); b != "master" {
+		t.Errorf("expected master, got %s", b)
+	}
+	if b := branchName("refs/heads/feature/x"); b != "feature/x" {
+		t.Errorf("expected feature/x, got %s", b)
+	}
+}
@@ -2,12 +2,19 @@ package gitreceive
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/deis/pkg/log"
 	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/api"
 	apierrs "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/resource"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
 	"k8s.io/kubernetes/pkg/util/wait"
 )
 
@@ -18,11 +25,29 @@ const (
 	dockerBuilderImage = "quay.io/deisci/dockerbuilder:v2-beta"
 
 	tarURLKey        = "TAR_URL"
+	imgTagsKey       = "IMG_TAGS"
 	putURLKey        = "put_url"
+	slugGzipKey      = "SLUG_GZIP"
+	buildpackURLKey  = "BUILDPACK_URL"
+	buildpackCreds   = "buildpack-creds"
+	buildpackSecrets = "/var/run/secrets/buildpack"
+	registryCreds    = "registry-creds"
+	registrySecrets  = "/var/run/secrets/registry"
 	debugKey         = "DEBUG"
 	minioUser        = "minio-user"
 	dockerSocketName = "docker-socket"
 	dockerSocketPath = "/var/run/docker.sock"
+
+	heritageLabel     = "heritage"
+	builderHeritage   = "deis-builder"
+	appLabel          = "app"
+	appNamespaceLabel = "app-namespace"
+	gitShaLabel       = "git-sha"
+	buildTypeLabel    = "build-type"
+	slugBuildLabel    = "slug"
+	dockerBuildLabel  = "docker"
+
+	releaseVersionAnnotation = "release-version"
 )
 
 func dockerBuilderPodName(appName, shortSha string) string {
@@ -35,11 +60,13 @@ func slugBuilderPodName(appName, shortSha string) string {
 	return fmt.Sprintf("slugbuild-%s-%s-%s", appName, shortSha, uid)
 }
 
-func dockerBuilderPod(debug, withAuth bool, name, namespace string, tarURL, imageName string) *api.Pod {
-	pod := buildPod(debug, withAuth, name, namespace)
+// dockerBuilderPod returns a pod that builds the Dockerfile app in tarURL into imageName. It runs builderImage,
+// or dockerBuilderImage if that is empty.
+func dockerBuilderPod(debug, withAuth bool, name, namespace string, env map[string]interface{}, tarURL, imageName, builderImage string) *api.Pod {
+	pod := buildPod(debug, withAuth, name, namespace, env)
 
 	pod.Spec.Containers[0].Name = dockerBuilderName
-	pod.Spec.Containers[0].Image = dockerBuilderImage
+	pod.Spec.Containers[0].Image = imageOrDefault(builderImage, dockerBuilderImage)
 
 	addEnvToPod(pod, "ACCESS_KEY_FILE", "/var/run/secrets/object/store/access_key")
 	addEnvToPod(pod, "ACCESS_SECRET_FILE", "/var/run/secrets/object/store/access_secret")
@@ -64,20 +91,126 @@ func dockerBuilderPod(debug, withAuth bool, name, namespace string, tarURL, imag
 	return &pod
 }
 
-func slugbuilderPod(debug, withAuth bool, name, namespace string, tarURL, putURL string) *api.Pod {
-	pod := buildPod(debug, withAuth, name, namespace)
+// slugbuilderPod returns a pod that builds a slug from tarURL and pushes it to putURL. buildpackURL is a
+// comma or newline separated list of buildpacks, which are run in the order given. If buildpackSecret names
+// a secret holding credentials for private buildpacks, it is mounted into the pod. It runs builderImage, or
+// slugBuilderImage if that is empty.
+func slugbuilderPod(debug, withAuth bool, name, namespace string, env map[string]interface{}, tarURL, putURL, buildpackURL, buildpackSecret, builderImage string) *api.Pod {
+	pod := buildPod(debug, withAuth, name, namespace, env)
 
 	pod.Spec.Containers[0].Name = slugBuilderName
-	pod.Spec.Containers[0].Image = slugBuilderImage
+	pod.Spec.Containers[0].Image = imageOrDefault(builderImage, slugBuilderImage)
 
 	addEnvToPod(pod, tarURLKey, tarURL)
 	addEnvToPod(pod, putURLKey, putURL)
+	if buildpacks := buildpackURLs(buildpackURL); len(buildpacks) > 0 {
+		addEnvToPod(pod, buildpackURLKey, strings.Join(buildpacks, ","))
+		if buildpackSecret != "" {
+			addBuildpackCredentials(&pod, buildpackSecret)
+		}
+	}
 
 	return &pod
 }
 
+// buildpackURLs returns the buildpacks in the comma or newline separated list buildpackURL, in order
+func buildpackURLs(buildpackURL string) []string {
+	var buildpacks []string
+	for _, url := range strings.FieldsFunc(buildpackURL, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if url = strings.TrimSpace(url); url != "" {
+			buildpacks = append(buildpacks, url)
+		}
+	}
+	return buildpacks
+}
+
+// labelBuilderPod labels pod with the app and short git sha it builds, the namespace the app was pushed from,
+// and its buildType: slugBuildLabel or dockerBuildLabel. annotations are merged into the pod's annotations.
+func labelBuilderPod(pod *api.Pod, appName, appNamespace, shortSha, buildType string, annotations map[string]string) {
+	pod.ObjectMeta.Labels[appLabel] = appName
+	pod.ObjectMeta.Labels[appNamespaceLabel] = appNamespace
+	pod.ObjectMeta.Labels[gitShaLabel] = shortSha
+	pod.ObjectMeta.Labels[buildTypeLabel] = buildType
+	if len(annotations) == 0 {
+		return
+	}
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		pod.ObjectMeta.Annotations[k] = v
+	}
+}
+
+// mergeAnnotations returns annotations with the non-empty values of extra added, replacing any under the same
+// keys. annotations may be nil, and the result is nil if there is nothing to add to it.
+func mergeAnnotations(annotations, extra map[string]string) map[string]string {
+	for k, v := range extra {
+		if v == "" {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// addRegistryCredentials mounts conf's ExternalRegistrySecret, holding a docker config.json, into pod and
+// points docker at it. Nothing is mounted unless both an external registry and its secret are configured.
+func addRegistryCredentials(pod *api.Pod, conf *Config) {
+	if conf.ExternalRegistryHost == "" || conf.ExternalRegistrySecret == "" {
+		return
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name: registryCreds,
+		VolumeSource: api.VolumeSource{
+			Secret: &api.SecretVolumeSource{
+				SecretName: conf.ExternalRegistrySecret,
+			},
+		},
+	})
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, api.VolumeMount{
+		Name:      registryCreds,
+		MountPath: registrySecrets,
+		ReadOnly:  true,
+	})
+
+	addEnvToPod(*pod, "DOCKER_CONFIG", registrySecrets)
+}
+
+func imageOrDefault(image, defaultImage string) string {
+	if image == "" {
+		return defaultImage
+	}
+	return image
+}
+
+// addBuildpackCredentials mounts the secret named secretName into pod, and points the slug builder at the
+// username, token and SSH key files it may contain
+func addBuildpackCredentials(pod *api.Pod, secretName string) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, api.Volume{
+		Name: buildpackCreds,
+		VolumeSource: api.VolumeSource{
+			Secret: &api.SecretVolumeSource{
+				SecretName: secretName,
+			},
+		},
+	})
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, api.VolumeMount{
+		Name:      buildpackCreds,
+		MountPath: buildpackSecrets,
+		ReadOnly:  true,
+	})
+
+	addEnvToPod(*pod, "BUILDPACK_USER_FILE", buildpackSecrets+"/user")
+	addEnvToPod(*pod, "BUILDPACK_TOKEN_FILE", buildpackSecrets+"/token")
+	addEnvToPod(*pod, "BUILDPACK_SSH_KEY_FILE", buildpackSecrets+"/ssh-key")
+}
+
 func slugrunnerPod(debug, withAuth bool, name, namespace string, putURL string) *api.Pod {
-	pod := buildPod(debug, withAuth, name, namespace)
+	pod := buildPod(debug, withAuth, name, namespace, nil)
 	pod.Spec.Containers[0].Name = "jaffa"
 	pod.Spec.Containers[0].Image = "quay.io/deisci/slugrunner:v2-beta"
 	pod.Spec.Containers[0].Args = []string{"start", "web"}
@@ -87,7 +220,8 @@ func slugrunnerPod(debug, withAuth bool, name, namespace string, putURL string)
 	return &pod
 }
 
-func buildPod(debug, withAuth bool, name, namespace string) api.Pod {
+// buildPod returns a pod with a single container, with env in that container's environment
+func buildPod(debug, withAuth bool, name, namespace string, env map[string]interface{}) api.Pod {
 	pod := api.Pod{
 		Spec: api.PodSpec{
 			RestartPolicy: api.RestartPolicyNever,
@@ -102,8 +236,8 @@ func buildPod(debug, withAuth bool, name, namespace string) api.Pod {
 			Name:      name,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"heritage": "deis",
-				"version":  "2.0.0-beta",
+				heritageLabel: builderHeritage,
+				"version":     "2.0.0-beta",
 			},
 		},
 	}
@@ -127,6 +261,15 @@ func buildPod(debug, withAuth bool, name, namespace string) api.Pod {
 		}
 	}
 
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		addEnvToPod(pod, k, fmt.Sprintf("%v", env[k]))
+	}
+
 	if debug {
 		addEnvToPod(pod, debugKey, "1")
 	}
@@ -134,6 +277,75 @@ func buildPod(debug, withAuth bool, name, namespace string) api.Pod {
 	return pod
 }
 
+// builderResources returns the resource requests and limits for builder containers from conf. Unset
+// quantities are left out, so an empty conf results in empty requirements.
+func builderResources(conf *Config) (api.ResourceRequirements, error) {
+	res := api.ResourceRequirements{}
+	quantities := []struct {
+		list     *api.ResourceList
+		resource api.ResourceName
+		value    string
+	}{
+		{&res.Requests, api.ResourceCPU, conf.BuilderPodCPURequest},
+		{&res.Requests, api.ResourceMemory, conf.BuilderPodMemRequest},
+		{&res.Limits, api.ResourceCPU, conf.BuilderPodCPULimit},
+		{&res.Limits, api.ResourceMemory, conf.BuilderPodMemLimit},
+	}
+	for _, q := range quantities {
+		if q.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return res, fmt.Errorf("builder pod %s quantity %q is invalid (%s)", q.resource, q.value, err)
+		}
+		if *q.list == nil {
+			*q.list = api.ResourceList{}
+		}
+		(*q.list)[q.resource] = *quantity
+	}
+	return res, nil
+}
+
+// imagePullSecrets returns references to the comma separated secrets in conf's BuilderImagePullSecrets, or
+// nil if none are configured
+func imagePullSecrets(conf *Config) []api.LocalObjectReference {
+	var refs []api.LocalObjectReference
+	for _, name := range splitList(conf.BuilderImagePullSecrets) {
+		refs = append(refs, api.LocalObjectReference{Name: name})
+	}
+	return refs
+}
+
+// setServiceAccount runs pod as conf's BuilderServiceAccount, leaving the namespace's default service account
+// in place if none is configured. Builder pods don't call the Kubernetes API, and they read object storage
+// credentials from mounted secrets, so the account needs no RBAC permissions of its own. It needs to be
+// allowed to mount the secrets the pod uses, like the minio-user object storage secret and any BuildpackSecret or
+// ExternalRegistrySecret, and to use any image pull secrets and pod security policy the namespace requires.
+func setServiceAccount(pod *api.Pod, conf *Config) {
+	if conf.BuilderServiceAccount != "" {
+		pod.Spec.ServiceAccountName = conf.BuilderServiceAccount
+	}
+}
+
+// setRestartPolicy sets the restart policy of pod to conf's BuilderRestartPolicy, or leaves it at Never so
+// that a failed build stays failed for inspection. With OnFailure, the kubelet restarts a failed build with
+// a backoff, and the build only fails once BUILD_TIMEOUT or BUILD_POD_DEADLINE is reached.
+func setRestartPolicy(pod *api.Pod, conf *Config) {
+	if conf.BuilderRestartPolicy != "" {
+		pod.Spec.RestartPolicy = api.RestartPolicy(conf.BuilderRestartPolicy)
+	}
+}
+
+// setActiveDeadline has the kubelet kill pod once it has run for conf's BuildPodDeadlineSec, so that a
+// runaway build is stopped even if the builder isn't around to delete it. No deadline is set if it's 0.
+func setActiveDeadline(pod *api.Pod, conf *Config) {
+	if conf.BuildPodDeadlineSec > 0 {
+		deadline := int64(conf.BuildPodDeadlineSec)
+		pod.Spec.ActiveDeadlineSeconds = &deadline
+	}
+}
+
 func addEnvToPod(pod api.Pod, key, value string) {
 	if len(pod.Spec.Containers) > 0 {
 		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, api.EnvVar{
@@ -144,9 +356,10 @@ func addEnvToPod(pod api.Pod, key, value string) {
 }
 
 // waitForPod waits for a pod in state running or failed
-func waitForPod(c *client.Client, ns, podName string, interval, timeout time.Duration) error {
+func waitForPod(ctx context.Context, c client.PodsNamespacer, ns, podName string, interval, timeout time.Duration) error {
 	condition := func(pod *api.Pod) (bool, error) {
-		if pod.Status.Phase == api.PodRunning {
+		// a pod that finished before it was seen running still has logs to read
+		if pod.Status.Phase == api.PodRunning || pod.Status.Phase == api.PodSucceeded {
 			return true, nil
 		}
 		if pod.Status.Phase == api.PodFailed {
@@ -155,11 +368,24 @@ func waitForPod(c *client.Client, ns, podName string, interval, timeout time.Dur
 		return false, nil
 	}
 
-	return waitForPodCondition(c, ns, podName, condition, interval, timeout)
+	return waitForPodCondition(ctx, c, ns, podName, condition, interval, timeout)
+}
+
+// waitForPodStart waits for the builder pod podName to start with waitForPod. If ctx is cancelled first, the
+// pod is deleted.
+func waitForPodStart(ctx context.Context, c client.PodsNamespacer, ns, podName string, interval, timeout time.Duration) error {
+	err := waitForPod(ctx, c, ns, podName, interval, timeout)
+	switch {
+	case err == nil:
+		return nil
+	case err == ctx.Err():
+		return abortBuild(c, ns, podName, fmt.Sprintf("build was cancelled (%s)", err))
+	}
+	return fmt.Errorf("watching events for builder pod startup (%s)", err)
 }
 
 // waitForPodEnd waits for a pod in state succeeded or failed
-func waitForPodEnd(c *client.Client, ns, podName string, interval, timeout time.Duration) error {
+func waitForPodEnd(ctx context.Context, c client.PodsNamespacer, ns, podName string, interval, timeout time.Duration) error {
 	condition := func(pod *api.Pod) (bool, error) {
 		if pod.Status.Phase == api.PodSucceeded {
 			return true, nil
@@ -170,18 +396,90 @@ func waitForPodEnd(c *client.Client, ns, podName string, interval, timeout time.
 		return false, nil
 	}
 
-	return waitForPodCondition(c, ns, podName, condition, interval, timeout)
+	return waitForPodCondition(ctx, c, ns, podName, condition, interval, timeout)
+}
+
+// waitForBuild waits up to timeout, or forever if timeout <= 0, for the builder pod to exit. If it doesn't, or ctx is cancelled first,
+// the pod is deleted and an error is returned, so that a stuck or abandoned build fails the push rather
+// than hanging it.
+func waitForBuild(ctx context.Context, c client.PodsNamespacer, ns, podName string, interval, timeout time.Duration) error {
+	err := waitForPodEnd(ctx, c, ns, podName, interval, timeout)
+	switch {
+	case err == wait.ErrWaitTimeout:
+		return abortBuild(c, ns, podName, fmt.Sprintf("build did not finish within %s", timeout))
+	case err != nil && err == ctx.Err():
+		return abortBuild(c, ns, podName, fmt.Sprintf("build was cancelled (%s)", err))
+	}
+	return err
 }
 
-// waitForPodCondition waits for a pod in state defined by a condition (func)
-func waitForPodCondition(c *client.Client, ns, podName string, condition func(pod *api.Pod) (bool, error),
+// abortBuild deletes the pod podName of a build that was stopped for reason, and returns the error that
+// fails the push.
+func abortBuild(c client.PodsNamespacer, ns, podName, reason string) error {
+	if err := c.Pods(ns).Delete(podName, nil); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("%s, and deleting builder pod %s failed (%s)", reason, podName, err)
+	}
+	return fmt.Errorf("%s, deleted builder pod %s", reason, podName)
+}
+
+// gcBuilderPods deletes the finished builder pods in ns that finished more than retention before now. With
+// no retention, podName is deleted right away. Failures are logged rather than returned, since cleaning up
+// must not fail a build whose result is already known.
+func gcBuilderPods(c client.PodsNamespacer, ns, podName string, retention time.Duration, now time.Time) {
+	pods := c.Pods(ns)
+	if retention <= 0 {
+		log.Debug("Deleting builder pod %s", podName)
+		if err := pods.Delete(podName, nil); err != nil && !apierrs.IsNotFound(err) {
+			log.Err("deleting builder pod %s (%s)", podName, err)
+		}
+	}
+
+	list, err := pods.List(labels.SelectorFromSet(labels.Set{heritageLabel: builderHeritage}), fields.Everything())
+	if err != nil {
+		log.Err("listing builder pods to clean up (%s)", err)
+		return
+	}
+	for _, pod := range list.Items {
+		if pod.Labels[heritageLabel] != builderHeritage || (retention <= 0 && pod.Name == podName) {
+			continue
+		}
+		finishedAt, ok := podFinishedAt(pod)
+		if !ok || now.Sub(finishedAt) < retention {
+			continue
+		}
+		log.Debug("Deleting builder pod %s, which finished at %s", pod.Name, finishedAt)
+		if err := pods.Delete(pod.Name, nil); err != nil && !apierrs.IsNotFound(err) {
+			log.Err("deleting builder pod %s (%s)", pod.Name, err)
+		}
+	}
+}
+
+// podFinishedAt returns when the last container of pod terminated, and false if pod hasn't finished
+func podFinishedAt(pod api.Pod) (time.Time, bool) {
+	if pod.Status.Phase != api.PodSucceeded && pod.Status.Phase != api.PodFailed {
+		return time.Time{}, false
+	}
+	var finishedAt time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated != nil && status.State.Terminated.FinishedAt.After(finishedAt) {
+			finishedAt = status.State.Terminated.FinishedAt.Time
+		}
+	}
+	return finishedAt, !finishedAt.IsZero()
+}
+
+// waitForPodCondition waits for a pod in state defined by a condition (func). It returns ctx.Err() if ctx is
+// done first.
+func waitForPodCondition(ctx context.Context, c client.PodsNamespacer, ns, podName string, condition func(pod *api.Pod) (bool, error),
 	interval, timeout time.Duration) error {
-	return wait.PollImmediate(interval, timeout, func() (bool, error) {
+	return pollImmediate(ctx, interval, timeout, func() (bool, error) {
 		pod, err := c.Pods(ns).Get(podName)
 		if err != nil {
-			if apierrs.IsNotFound(err) {
+			if !isRetryable(err) {
 				return true, err
 			}
+			// a transient API error is retried on the next tick
+			return false, nil
 		}
 
 		done, err := condition(pod)
@@ -192,3 +490,26 @@ func waitForPodCondition(c *client.Client, ns, podName string, condition func(po
 		return false, nil
 	})
 }
+
+// pollImmediate is wait.PollImmediate, except that it stops with ctx.Err() once ctx is done, and that a
+// timeout <= 0 means no timeout.
+func pollImmediate(ctx context.Context, interval, timeout time.Duration, condition wait.ConditionFunc) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for {
+		if done, err := condition(); err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return wait.ErrWaitTimeout
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,11 +1,21 @@
 package gitreceive
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/watch"
 )
 
 func TestDockerBuilderPodName(t *testing.T) {
@@ -63,7 +73,7 @@ func TestBuildPod(t *testing.T) {
 	}
 
 	for _, build := range slugBuilds {
-		pod = slugbuilderPod(build.debug, build.withAuth, build.name, build.namespace, build.env, build.tarURL, build.putURL, build.buildPack)
+		pod = slugbuilderPod(build.debug, build.withAuth, build.name, build.namespace, build.env, build.tarURL, build.putURL, build.buildPack, "", "")
 
 		if pod.ObjectMeta.Name != build.name {
 			t.Errorf("expected %v but returned %v ", build.name, pod.ObjectMeta.Name)
@@ -79,6 +89,10 @@ func TestBuildPod(t *testing.T) {
 		if build.buildPack != "" {
 			checkForEnv(t, pod, "BUILDPACK_URL", build.buildPack)
 		}
+		for k, v := range build.env {
+			checkForEnv(t, pod, k, v.(string))
+		}
+		checkResources(t, pod, api.ResourceRequirements{})
 	}
 
 	dockerBuilds := []dockerBuildCase{
@@ -93,7 +107,7 @@ func TestBuildPod(t *testing.T) {
 	}
 
 	for _, build := range dockerBuilds {
-		pod = dockerBuilderPod(build.debug, build.withAuth, build.name, build.namespace, build.env, build.tarURL, build.imgName)
+		pod = dockerBuilderPod(build.debug, build.withAuth, build.name, build.namespace, build.env, build.tarURL, build.imgName, "")
 
 		if pod.ObjectMeta.Name != build.name {
 			t.Errorf("expected %v but returned %v ", build.name, pod.ObjectMeta.Name)
@@ -105,6 +119,180 @@ func TestBuildPod(t *testing.T) {
 			checkForEnv(t, pod, "TAR_URL", build.tarURL)
 			checkForEnv(t, pod, "IMG_NAME", build.imgName)
 		}
+		checkResources(t, pod, api.ResourceRequirements{})
+	}
+
+	conf := &Config{
+		BuilderPodCPURequest: "100m",
+		BuilderPodMemRequest: "256Mi",
+		BuilderPodCPULimit:   "1",
+		BuilderPodMemLimit:   "2Gi",
+	}
+	resources, err := builderResources(conf)
+	if err != nil {
+		t.Fatalf("getting builder resources (%s)", err)
+	}
+	pod = slugbuilderPod(true, false, "test", "default", emptyEnv, "tar", "put-url", "", "", "")
+	pod.Spec.Containers[0].Resources = resources
+	checkResources(t, pod, api.ResourceRequirements{
+		Requests: api.ResourceList{api.ResourceCPU: resource.MustParse("100m"), api.ResourceMemory: resource.MustParse("256Mi")},
+		Limits:   api.ResourceList{api.ResourceCPU: resource.MustParse("1"), api.ResourceMemory: resource.MustParse("2Gi")},
+	})
+
+	resources, err = builderResources(&Config{BuilderPodMemLimit: "2Gi"})
+	if err != nil {
+		t.Fatalf("getting builder resources (%s)", err)
+	}
+	if len(resources.Requests) != 0 || len(resources.Limits) != 1 {
+		t.Errorf("expected only a memory limit, got %+v", resources)
+	}
+
+	if _, err := builderResources(&Config{BuilderPodCPULimit: "lots"}); err == nil {
+		t.Errorf("expected an invalid quantity to be rejected")
+	}
+
+	pod = slugbuilderPod(true, false, "test", "default", emptyEnv, "tar", "put-url", "", "", "")
+	pod.Spec.ImagePullSecrets = imagePullSecrets(&Config{})
+	if pod.Spec.ImagePullSecrets != nil {
+		t.Errorf("expected no image pull secrets, got %+v", pod.Spec.ImagePullSecrets)
+	}
+	pod = dockerBuilderPod(true, false, "test", "default", emptyEnv, "tar", "img", "")
+	pod.Spec.ImagePullSecrets = imagePullSecrets(&Config{BuilderImagePullSecrets: "quay-creds, ,registry-creds"})
+	if len(pod.Spec.ImagePullSecrets) != 2 || pod.Spec.ImagePullSecrets[0].Name != "quay-creds" || pod.Spec.ImagePullSecrets[1].Name != "registry-creds" {
+		t.Errorf("expected the quay-creds and registry-creds image pull secrets, got %+v", pod.Spec.ImagePullSecrets)
+	}
+
+	annotations, err := (&Config{BuilderPodAnnotations: "team=payments, owner=ops"}).PodAnnotations()
+	if err != nil {
+		t.Fatalf("parsing builder pod annotations (%s)", err)
+	}
+	for buildType, pod := range map[string]*api.Pod{
+		slugBuildLabel:   slugbuilderPod(true, false, "test", "default", emptyEnv, "tar", "put-url", "", "", ""),
+		dockerBuildLabel: dockerBuilderPod(true, false, "test", "default", emptyEnv, "tar", "img", ""),
+	} {
+		pod.ObjectMeta.Annotations = map[string]string{"owner": "builder", "existing": "kept"}
+		labelBuilderPod(pod, "myapp", "deis", "c3b4e4ba", buildType, annotations)
+		for k, v := range map[string]string{"heritage": "deis-builder", "app": "myapp", "app-namespace": "deis", "git-sha": "c3b4e4ba", "build-type": buildType} {
+			if pod.ObjectMeta.Labels[k] != v {
+				t.Errorf("expected label %s=%s on the %s builder pod, got %v", k, v, buildType, pod.ObjectMeta.Labels)
+			}
+		}
+		expected := map[string]string{"team": "payments", "owner": "ops", "existing": "kept"}
+		if !reflect.DeepEqual(pod.ObjectMeta.Annotations, expected) {
+			t.Errorf("expected annotations %v on the %s builder pod, got %v", expected, buildType, pod.ObjectMeta.Annotations)
+		}
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	if merged := mergeAnnotations(nil, map[string]string{releaseVersionAnnotation: "", affinityAnnotation: ""}); merged != nil {
+		t.Errorf("expected no annotations when there is nothing to add, got %v", merged)
+	}
+
+	merged := mergeAnnotations(nil, map[string]string{releaseVersionAnnotation: "4", affinityAnnotation: ""})
+	if !reflect.DeepEqual(merged, map[string]string{releaseVersionAnnotation: "4"}) {
+		t.Errorf("expected only the release version to be added, got %v", merged)
+	}
+
+	configured := map[string]string{"team": "payments", releaseVersionAnnotation: "3"}
+	merged = mergeAnnotations(configured, map[string]string{releaseVersionAnnotation: "4", tolerationsAnnotation: `[{"key":"gpu","operator":"Exists"}]`})
+	expected := map[string]string{"team": "payments", releaseVersionAnnotation: "4", tolerationsAnnotation: `[{"key":"gpu","operator":"Exists"}]`}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected the builder's annotations to win over the configured ones, got %v", merged)
+	}
+}
+
+func TestSlugBuilderPodBuildpacks(t *testing.T) {
+	cases := []struct {
+		buildpackURL string
+		expected     string
+	}{
+		{"https://github.com/heroku/heroku-buildpack-go", "https://github.com/heroku/heroku-buildpack-go"},
+		{"https://example.com/nodejs.tgz, https://example.com/go.tgz", "https://example.com/nodejs.tgz,https://example.com/go.tgz"},
+		{"https://example.com/nodejs.tgz\nhttps://example.com/ruby.tgz\n\nhttps://example.com/go.tgz\n", "https://example.com/nodejs.tgz,https://example.com/ruby.tgz,https://example.com/go.tgz"},
+	}
+	for _, c := range cases {
+		pod := slugbuilderPod(false, false, "test", "default", nil, "tar", "put-url", c.buildpackURL, "", "")
+		checkForEnv(t, pod, "BUILDPACK_URL", c.expected)
+	}
+
+	for _, empty := range []string{"", " , ", "\n"} {
+		pod := slugbuilderPod(false, false, "test", "default", nil, "tar", "put-url", empty, "", "")
+		for _, e := range pod.Spec.Containers[0].Env {
+			if e.Name == "BUILDPACK_URL" {
+				t.Errorf("expected no BUILDPACK_URL for buildpacks %q, got %q", empty, e.Value)
+			}
+		}
+	}
+}
+
+func TestSlugBuilderPodBuildpackCredentials(t *testing.T) {
+	cases := []struct {
+		buildpackURL string
+		secret       string
+		mounted      bool
+	}{
+		{"", "", false},
+		{"", "buildpack-secret", false},
+		{"https://github.com/example/private-buildpack", "", false},
+		{"https://github.com/example/private-buildpack", "buildpack-secret", true},
+	}
+	for _, c := range cases {
+		pod := slugbuilderPod(false, true, "test", "default", nil, "tar", "put-url", c.buildpackURL, c.secret, "")
+		var volume *api.Volume
+		for i, v := range pod.Spec.Volumes {
+			if v.Name == buildpackCreds {
+				volume = &pod.Spec.Volumes[i]
+			}
+		}
+		mounted := false
+		for _, m := range pod.Spec.Containers[0].VolumeMounts {
+			if m.Name == buildpackCreds {
+				mounted = m.MountPath == buildpackSecrets && m.ReadOnly
+			}
+		}
+		hasEnv := false
+		for _, e := range pod.Spec.Containers[0].Env {
+			if e.Name == "BUILDPACK_TOKEN_FILE" {
+				hasEnv = true
+			}
+		}
+
+		if !c.mounted {
+			if volume != nil || mounted || hasEnv {
+				t.Errorf("buildpack %q, secret %q: expected no credentials in the pod", c.buildpackURL, c.secret)
+			}
+			continue
+		}
+		if volume == nil || volume.Secret == nil || volume.Secret.SecretName != c.secret {
+			t.Errorf("expected a volume for secret %s, got %+v", c.secret, volume)
+		}
+		if !mounted {
+			t.Errorf("expected the credentials to be mounted read-only at %s", buildpackSecrets)
+		}
+		checkForEnv(t, pod, "BUILDPACK_USER_FILE", buildpackSecrets+"/user")
+		checkForEnv(t, pod, "BUILDPACK_TOKEN_FILE", buildpackSecrets+"/token")
+		checkForEnv(t, pod, "BUILDPACK_SSH_KEY_FILE", buildpackSecrets+"/ssh-key")
+	}
+}
+
+func checkResources(t *testing.T, pod *api.Pod, expected api.ResourceRequirements) {
+	actual := pod.Spec.Containers[0].Resources
+	for name, lists := range map[string][2]api.ResourceList{
+		"requests": {expected.Requests, actual.Requests},
+		"limits":   {expected.Limits, actual.Limits},
+	} {
+		exp, act := lists[0], lists[1]
+		if len(exp) != len(act) {
+			t.Errorf("expected %s %v, got %v", name, exp, act)
+			continue
+		}
+		for res, q := range exp {
+			actQ, ok := act[res]
+			if !ok || actQ.String() != q.String() {
+				t.Errorf("expected %s %s of %s, got %s", res, name, q.String(), actQ.String())
+			}
+		}
 	}
 }
 
@@ -113,7 +301,7 @@ func checkForEnv(t *testing.T, pod *api.Pod, key, expVal string) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
-	if val != val {
+	if val != expVal {
 		t.Errorf("expected %v but returned %v ", expVal, val)
 	}
 }
@@ -127,3 +315,307 @@ func envValueFromKey(pod *api.Pod, key string) (string, error) {
 
 	return "", fmt.Errorf("no key with name %v found in pod env", key)
 }
+
+// stuckPods is a client.PodsNamespacer whose pods run forever
+type stuckPods struct {
+	deleted []string
+}
+
+func (s *stuckPods) Pods(namespace string) client.PodInterface { return s }
+
+func (s *stuckPods) List(label labels.Selector, field fields.Selector) (*api.PodList, error) {
+	return &api.PodList{}, nil
+}
+
+func (s *stuckPods) Get(name string) (*api.Pod, error) {
+	return &api.Pod{ObjectMeta: api.ObjectMeta{Name: name}, Status: api.PodStatus{Phase: api.PodRunning}}, nil
+}
+
+func (s *stuckPods) Delete(name string, options *api.DeleteOptions) error {
+	s.deleted = append(s.deleted, name)
+	return nil
+}
+
+func (s *stuckPods) Create(pod *api.Pod) (*api.Pod, error)       { return pod, nil }
+func (s *stuckPods) Update(pod *api.Pod) (*api.Pod, error)       { return pod, nil }
+func (s *stuckPods) UpdateStatus(pod *api.Pod) (*api.Pod, error) { return pod, nil }
+func (s *stuckPods) Bind(binding *api.Binding) error             { return nil }
+
+func (s *stuckPods) Watch(label labels.Selector, field fields.Selector, resourceVersion string) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch not supported")
+}
+
+func TestWaitForBuildTimeout(t *testing.T) {
+	pods := &stuckPods{}
+	err := waitForBuild(context.Background(), pods, "deis", "slugbuild-test", time.Millisecond, 20*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected a timeout error for a pod that never finishes")
+	}
+	if !strings.Contains(err.Error(), "did not finish within") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(pods.deleted) != 1 || pods.deleted[0] != "slugbuild-test" {
+		t.Errorf("expected builder pod to be deleted, got %v", pods.deleted)
+	}
+}
+
+// finishingPods is a client.PodsNamespacer whose pods succeed after running for a number of gets
+type finishingPods struct {
+	stuckPods
+	runningGets int
+}
+
+func (f *finishingPods) Pods(namespace string) client.PodInterface { return f }
+
+func (f *finishingPods) Get(name string) (*api.Pod, error) {
+	if f.runningGets > 0 {
+		f.runningGets--
+		return f.stuckPods.Get(name)
+	}
+	return &api.Pod{ObjectMeta: api.ObjectMeta{Name: name}, Status: api.PodStatus{Phase: api.PodSucceeded}}, nil
+}
+
+func TestWaitForBuildNoTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		pods := &finishingPods{runningGets: 5}
+		if err := waitForBuild(context.Background(), pods, "deis", "slugbuild-test", time.Millisecond, timeout); err != nil {
+			t.Errorf("expected a timeout of %s to wait for the build to finish, got %s", timeout, err)
+		}
+		if len(pods.deleted) != 0 {
+			t.Errorf("expected no builder pod to be deleted with a timeout of %s, got %v", timeout, pods.deleted)
+		}
+	}
+}
+
+func TestWaitForBuildCancelled(t *testing.T) {
+	pods := &stuckPods{}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := waitForBuild(ctx, pods, "deis", "slugbuild-test", time.Millisecond, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Fatalf("expected the build to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the build to stop when it is cancelled, it took %s", elapsed)
+	}
+	if len(pods.deleted) != 1 || pods.deleted[0] != "slugbuild-test" {
+		t.Errorf("expected builder pod to be deleted, got %v", pods.deleted)
+	}
+}
+
+func TestDockerBuilderPodRegistryCredentials(t *testing.T) {
+	cases := []struct {
+		conf    Config
+		mounted bool
+	}{
+		{Config{}, false},
+		{Config{ExternalRegistrySecret: "registry-secret"}, false},
+		{Config{ExternalRegistryHost: "gcr.io"}, false},
+		{Config{ExternalRegistryHost: "gcr.io", ExternalRegistrySecret: "registry-secret"}, true},
+	}
+	for _, c := range cases {
+		pod := dockerBuilderPod(false, false, "test", "default", nil, "tar", c.conf.RegistryImage("myapp:git-c3b4e4ba"), "")
+		addRegistryCredentials(pod, &c.conf)
+		var volume *api.Volume
+		for i, v := range pod.Spec.Volumes {
+			if v.Name == registryCreds {
+				volume = &pod.Spec.Volumes[i]
+			}
+		}
+		mounted := false
+		for _, m := range pod.Spec.Containers[0].VolumeMounts {
+			if m.Name == registryCreds {
+				mounted = m.MountPath == registrySecrets && m.ReadOnly
+			}
+		}
+
+		if !c.mounted {
+			if volume != nil || mounted {
+				t.Errorf("registry %q, secret %q: expected no credentials in the pod", c.conf.ExternalRegistryHost, c.conf.ExternalRegistrySecret)
+			}
+			continue
+		}
+		if volume == nil || volume.Secret == nil || volume.Secret.SecretName != "registry-secret" {
+			t.Errorf("expected a volume for secret registry-secret, got %+v", volume)
+		}
+		if !mounted {
+			t.Errorf("expected the credentials to be mounted read-only at %s", registrySecrets)
+		}
+		checkForEnv(t, pod, "DOCKER_CONFIG", registrySecrets)
+		checkForEnv(t, pod, "IMG_NAME", "gcr.io/myapp:git-c3b4e4ba")
+	}
+}
+
+// finishedPods is a client.PodsNamespacer listing pods, which records deletes
+type finishedPods struct {
+	stuckPods
+	items []api.Pod
+}
+
+func (f *finishedPods) Pods(namespace string) client.PodInterface { return f }
+
+func (f *finishedPods) List(label labels.Selector, field fields.Selector) (*api.PodList, error) {
+	return &api.PodList{Items: f.items}, nil
+}
+
+func finishedPod(name, heritage string, phase api.PodPhase, finishedAt time.Time) api.Pod {
+	pod := api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: name, Labels: map[string]string{heritageLabel: heritage}},
+		Status:     api.PodStatus{Phase: phase},
+	}
+	if phase == api.PodSucceeded || phase == api.PodFailed {
+		pod.Status.ContainerStatuses = []api.ContainerStatus{{State: api.ContainerState{
+			Terminated: &api.ContainerStateTerminated{FinishedAt: unversioned.NewTime(finishedAt)},
+		}}}
+	}
+	return pod
+}
+
+func TestGCBuilderPods(t *testing.T) {
+	now := time.Now()
+	items := []api.Pod{
+		finishedPod("slugbuild-current", builderHeritage, api.PodSucceeded, now),
+		finishedPod("slugbuild-old-failure", builderHeritage, api.PodFailed, now.Add(-2*time.Hour)),
+		finishedPod("slugbuild-old-success", builderHeritage, api.PodSucceeded, now.Add(-2*time.Hour)),
+		finishedPod("slugbuild-recent-failure", builderHeritage, api.PodFailed, now.Add(-time.Minute)),
+		finishedPod("slugbuild-running", builderHeritage, api.PodRunning, time.Time{}),
+		finishedPod("someone-elses-pod", "deis", api.PodFailed, now.Add(-2*time.Hour)),
+	}
+
+	// without retention the finished build's pod goes right away, along with every other finished builder pod
+	pods := &finishedPods{items: items}
+	gcBuilderPods(pods, "deis", "slugbuild-current", 0, now)
+	expected := []string{"slugbuild-current", "slugbuild-old-failure", "slugbuild-old-success", "slugbuild-recent-failure"}
+	if !reflect.DeepEqual(pods.deleted, expected) {
+		t.Errorf("expected %v to be deleted, got %v", expected, pods.deleted)
+	}
+
+	// with retention, pods are kept until they have been finished for that long
+	pods = &finishedPods{items: items}
+	gcBuilderPods(pods, "deis", "slugbuild-current", time.Hour, now)
+	expected = []string{"slugbuild-old-failure", "slugbuild-old-success"}
+	if !reflect.DeepEqual(pods.deleted, expected) {
+		t.Errorf("expected %v to be deleted, got %v", expected, pods.deleted)
+	}
+}
+
+// createdPods is a client.PodsNamespacer which records creates
+type createdPods struct {
+	stuckPods
+	created []string
+}
+
+func (c *createdPods) Create(pod *api.Pod) (*api.Pod, error) {
+	c.created = append(c.created, pod.Name)
+	return pod, nil
+}
+
+func TestStartBuilderPodDryRun(t *testing.T) {
+	pod := slugbuilderPod(false, false, "slugbuild-test", "default", nil, "tar", "put-url", "", "", "")
+	pod.Spec.NodeSelector = map[string]string{"pool": "builders"}
+	retry := retryPolicy{attempts: 1}
+
+	pods := &createdPods{}
+	var out bytes.Buffer
+	started, err := startBuilderPod(context.Background(), &Config{DryRun: true}, pods, pod, retry, &out)
+	if err != nil {
+		t.Fatalf("dry run (%s)", err)
+	}
+	if started != nil || len(pods.created) != 0 {
+		t.Errorf("expected no pod to be created in a dry run, got %v", pods.created)
+	}
+	for _, s := range []string{"Dry run, not starting builder pod slugbuild-test", `"image": "` + slugBuilderImage + `"`, `"pool": "builders"`} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %s in the dry run output, got:\n%s", s, out.String())
+		}
+	}
+
+	out.Reset()
+	started, err = startBuilderPod(context.Background(), &Config{}, pods, pod, retry, &out)
+	if err != nil {
+		t.Fatalf("starting builder pod (%s)", err)
+	}
+	if started == nil || len(pods.created) != 1 || out.Len() != 0 {
+		t.Errorf("expected the pod to be created without printing it, got %v and %q", pods.created, out.String())
+	}
+}
+
+func TestBuilderPodImages(t *testing.T) {
+	slug := slugbuilderPod(false, false, "test", "default", nil, "tar", "put-url", "", "", "")
+	docker := dockerBuilderPod(false, false, "test", "default", nil, "tar", "img", "")
+	if image := slug.Spec.Containers[0].Image; image != slugBuilderImage {
+		t.Errorf("expected the default slug builder image %s, got %s", slugBuilderImage, image)
+	}
+	if image := docker.Spec.Containers[0].Image; image != dockerBuilderImage {
+		t.Errorf("expected the default docker builder image %s, got %s", dockerBuilderImage, image)
+	}
+
+	slug = slugbuilderPod(false, false, "test", "default", nil, "tar", "put-url", "", "", "mirror.example.com/slugbuilder:v1.4")
+	docker = dockerBuilderPod(false, false, "test", "default", nil, "tar", "img", "mirror.example.com/dockerbuilder:v2.1")
+	if image := slug.Spec.Containers[0].Image; image != "mirror.example.com/slugbuilder:v1.4" {
+		t.Errorf("expected the configured slug builder image, got %s", image)
+	}
+	if image := docker.Spec.Containers[0].Image; image != "mirror.example.com/dockerbuilder:v2.1" {
+		t.Errorf("expected the configured docker builder image, got %s", image)
+	}
+}
+
+func TestSetRestartPolicy(t *testing.T) {
+	emptyEnv := map[string]interface{}{}
+	for _, c := range []struct {
+		conf     Config
+		expected api.RestartPolicy
+	}{
+		{Config{}, api.RestartPolicyNever},
+		{Config{BuilderRestartPolicy: "Never"}, api.RestartPolicyNever},
+		{Config{BuilderRestartPolicy: "OnFailure"}, api.RestartPolicyOnFailure},
+	} {
+		for _, pod := range []*api.Pod{
+			slugbuilderPod(false, false, "test", "default", emptyEnv, "tar", "put-url", "", "", ""),
+			dockerBuilderPod(false, false, "test", "default", emptyEnv, "tar", "img", ""),
+		} {
+			setRestartPolicy(pod, &c.conf)
+			if pod.Spec.RestartPolicy != c.expected {
+				t.Errorf("BUILDER_POD_RESTART_POLICY %q: expected %s, got %s", c.conf.BuilderRestartPolicy, c.expected, pod.Spec.RestartPolicy)
+			}
+		}
+	}
+}
+
+func TestSetActiveDeadline(t *testing.T) {
+	emptyEnv := map[string]interface{}{}
+	pod := slugbuilderPod(false, false, "test", "default", emptyEnv, "tar", "put-url", "", "", "")
+	setActiveDeadline(pod, &Config{})
+	if pod.Spec.ActiveDeadlineSeconds != nil {
+		t.Errorf("expected no deadline without BUILD_POD_DEADLINE, got %d", *pod.Spec.ActiveDeadlineSeconds)
+	}
+	for _, pod := range []*api.Pod{
+		slugbuilderPod(false, false, "test", "default", emptyEnv, "tar", "put-url", "", "", ""),
+		dockerBuilderPod(false, false, "test", "default", emptyEnv, "tar", "img", ""),
+	} {
+		setActiveDeadline(pod, &Config{BuildPodDeadlineSec: 3600})
+		if d := pod.Spec.ActiveDeadlineSeconds; d == nil || *d != 3600 {
+			t.Errorf("expected the pod to have a deadline of 3600 seconds, got %v", d)
+		}
+	}
+}
+
+func TestSetServiceAccount(t *testing.T) {
+	emptyEnv := map[string]interface{}{}
+	pod := slugbuilderPod(false, false, "test", "default", emptyEnv, "tar", "put-url", "", "", "")
+	setServiceAccount(pod, &Config{})
+	if pod.Spec.ServiceAccountName != "" {
+		t.Errorf("expected no service account without BUILDER_SERVICE_ACCOUNT, got %s", pod.Spec.ServiceAccountName)
+	}
+	for _, pod := range []*api.Pod{
+		slugbuilderPod(false, false, "test", "default", emptyEnv, "tar", "put-url", "", "", ""),
+		dockerBuilderPod(false, false, "test", "default", emptyEnv, "tar", "img", ""),
+		slugrunnerPod(false, false, "test", "default", "slug-url"),
+	} {
+		setServiceAccount(pod, &Config{BuilderServiceAccount: "deis-builder-pods"})
+		if pod.Spec.ServiceAccountName != "deis-builder-pods" {
+			t.Errorf("expected the pod to run as deis-builder-pods, got %q", pod.Spec.ServiceAccountName)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package gitreceive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/deis/pkg/log"
+)
+
+// What to do with pushes that contain git LFS pointer files, as set by GIT_LFS.
+//
+// A git-lfs client uploads the content of LFS files to the LFS server of the remote through the LFS batch
+// API before it pushes, and the push itself only carries small pointer files. The builder doesn't serve the
+// batch API, so the content never reaches it and can't be proxied to object storage: an app built from such
+// a push gets the pointer files instead of its assets.
+const (
+	// lfsReject fails the build, telling the user which files are LFS pointers.
+	lfsReject = "reject"
+	// lfsIgnore builds the app with the pointer files in place of their content, and warns the user.
+	lfsIgnore = "ignore"
+)
+
+// lfsPointerMaxSize is the size that git-lfs pointer files are guaranteed to be smaller than.
+const lfsPointerMaxSize = 1024
+
+// lfsPointerVersions are the first lines of git-lfs pointer files, from current and pre-release clients.
+var lfsPointerVersions = [][]byte{
+	[]byte("version https://git-lfs.github.com/spec/v1\n"),
+	[]byte("version https://hawser.github.com/spec/v1\n"),
+}
+
+// isLFSPointer returns true if data is the content of a git-lfs pointer file
+func isLFSPointer(data []byte) bool {
+	if len(data) >= lfsPointerMaxSize || !bytes.Contains(data, []byte("\noid sha256:")) {
+		return false
+	}
+	for _, version := range lfsPointerVersions {
+		if bytes.HasPrefix(data, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// findLFSPointers returns the paths, relative to dir, of the git-lfs pointer files under dir
+func findLFSPointers(dir string) ([]string, error) {
+	var pointers []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() >= lfsPointerMaxSize {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isLFSPointer(data) {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			pointers = append(pointers, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("looking for git LFS files in %s (%s)", dir, err)
+	}
+	return pointers, nil
+}
+
+// checkLFS applies mode, one of the lfs* constants, to the app checked out at dir. An empty mode rejects.
+func checkLFS(mode, dir string) error {
+	pointers, err := findLFSPointers(dir)
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+	if mode == lfsIgnore {
+		log.Info("Warning: %d files are git LFS pointers, the builder does not support git LFS so they are built without their content (e.g. %s)", len(pointers), pointers[0])
+		return nil
+	}
+	return fmt.Errorf("%d files are git LFS pointers, but the builder does not support git LFS so their content is missing (e.g. %s). Commit them to git without LFS to deploy them", len(pointers), pointers[0])
+}
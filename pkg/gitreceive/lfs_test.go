@@ -0,0 +1,84 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLFSPointer = `version https://git-lfs.github.com/spec/v1
+oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393
+size 12345
+`
+
+func writeLFSTestApp(t *testing.T, withPointer bool) string {
+	dir, err := ioutil.TempDir("", "lfs-app")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	files := map[string]string{
+		"Procfile":         "web: ./server\n",
+		"docs/lfs.md":      "The first line of a pointer is " + strings.Split(testLFSPointer, "\n")[0] + "\n",
+		"static/empty.txt": "",
+	}
+	if withPointer {
+		files["static/logo.png"] = testLFSPointer
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("creating %s (%s)", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("writing %s (%s)", path, err)
+		}
+	}
+	return dir
+}
+
+func TestFindLFSPointers(t *testing.T) {
+	dir := writeLFSTestApp(t, true)
+	defer os.RemoveAll(dir)
+
+	pointers, err := findLFSPointers(dir)
+	if err != nil {
+		t.Fatalf("finding LFS pointers (%s)", err)
+	}
+	if len(pointers) != 1 || pointers[0] != filepath.Join("static", "logo.png") {
+		t.Errorf("expected only static/logo.png to be an LFS pointer, got %v", pointers)
+	}
+}
+
+func TestCheckLFS(t *testing.T) {
+	dir := writeLFSTestApp(t, true)
+	defer os.RemoveAll(dir)
+
+	for _, mode := range []string{lfsReject, ""} {
+		err := checkLFS(mode, dir)
+		if err == nil || !strings.Contains(err.Error(), "git LFS") || !strings.Contains(err.Error(), "logo.png") {
+			t.Errorf("mode %q: expected the LFS push to be rejected naming the file, got %v", mode, err)
+		}
+	}
+	if err := checkLFS(lfsIgnore, dir); err != nil {
+		t.Errorf("expected LFS pointers to be built with %s, got %s", lfsIgnore, err)
+	}
+
+	plain := writeLFSTestApp(t, false)
+	defer os.RemoveAll(plain)
+	if err := checkLFS(lfsReject, plain); err != nil {
+		t.Errorf("expected an app without LFS pointers to be built, got %s", err)
+	}
+}
+
+func TestValidateGitLFS(t *testing.T) {
+	for _, mode := range []string{"", lfsReject, lfsIgnore} {
+		if err := (Config{GitLFS: mode}).Validate(); err != nil {
+			t.Errorf("expected GIT_LFS %q to be valid, got %s", mode, err)
+		}
+	}
+	if err := (Config{GitLFS: "proxy"}).Validate(); err == nil {
+		t.Errorf("expected GIT_LFS proxy to be rejected")
+	}
+}
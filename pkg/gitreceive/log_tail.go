@@ -0,0 +1,253 @@
+package gitreceive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/deis/pkg/log"
+	"k8s.io/kubernetes/pkg/api"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// logStreamReconnects is how many times a dropped builder log stream is reopened before giving up
+const logStreamReconnects = 3
+
+// logStreamPool bounds the number of builder pod log streams open against the Kubernetes API at once.
+// Every push runs its own git-receive process, so the pool's slots are lock files in dir that are shared by
+// all of them. A pool with a size of 0 or less is unbounded.
+type logStreamPool struct {
+	dir          string
+	size         int
+	queueTimeout time.Duration
+	tick         time.Duration
+}
+
+func newLogStreamPool(conf *Config) *logStreamPool {
+	return &logStreamPool{
+		dir:          conf.LogStreamLockDir,
+		size:         conf.LogStreamLimit,
+		queueTimeout: conf.LogStreamQueueDuration(),
+		tick:         conf.BuilderPodTickDuration(),
+	}
+}
+
+// acquire waits up to the pool's queue timeout for a free slot. It returns a function that releases the
+// slot, or false if the pool stayed saturated for the whole timeout.
+func (p *logStreamPool) acquire() (func(), bool, error) {
+	if p.size <= 0 {
+		return func() {}, true, nil
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return nil, false, fmt.Errorf("creating log stream lock directory %s (%s)", p.dir, err)
+	}
+	deadline := time.Now().Add(p.queueTimeout)
+	for {
+		for i := 0; i < p.size; i++ {
+			release, ok, err := p.tryLockSlot(i)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				return release, true, nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, false, nil
+		}
+		time.Sleep(p.tick)
+	}
+}
+
+func (p *logStreamPool) tryLockSlot(i int) (func(), bool, error) {
+	path := filepath.Join(p.dir, fmt.Sprintf("slot-%d", i))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("opening log stream slot %s (%s)", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("locking log stream slot %s (%s)", path, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
+
+// podLogSource is the Kubernetes API a builder pod's logs are read from
+type podLogSource interface {
+	// stream follows the pod's logs until the pod exits
+	stream() (io.ReadCloser, error)
+	// fetch returns everything the pod has logged so far
+	fetch() ([]byte, error)
+	// finished reports whether the pod has exited, so that no more logs will be written
+	finished() (bool, error)
+	// restarts returns how many times the pod's containers have restarted
+	restarts() (int, error)
+}
+
+type k8sPodLogSource struct {
+	kubeClient *client.Client
+	namespace  string
+	name       string
+}
+
+func (k k8sPodLogSource) logRequest(follow bool) *client.Request {
+	return k.kubeClient.Get().Namespace(k.namespace).Name(k.name).Resource("pods").SubResource("log").VersionedParams(
+		&api.PodLogOptions{
+			Follow: follow,
+		}, api.Scheme)
+}
+
+func (k k8sPodLogSource) stream() (io.ReadCloser, error) {
+	return k.logRequest(true).Stream()
+}
+
+func (k k8sPodLogSource) fetch() ([]byte, error) {
+	return k.logRequest(false).DoRaw()
+}
+
+func (k k8sPodLogSource) finished() (bool, error) {
+	pod, err := k.kubeClient.Pods(k.namespace).Get(k.name)
+	if err != nil {
+		return false, err
+	}
+	return pod.Status.Phase == api.PodSucceeded || pod.Status.Phase == api.PodFailed, nil
+}
+
+func (k k8sPodLogSource) restarts() (int, error) {
+	pod, err := k.kubeClient.Pods(k.namespace).Get(k.name)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, status := range pod.Status.ContainerStatuses {
+		n += status.RestartCount
+	}
+	return n, nil
+}
+
+// tailLogs copies the logs from src to out. It follows a log stream if it can get a slot in pool, and
+// otherwise falls back to fetching the logs every pollInterval until the pod exits.
+func tailLogs(out io.Writer, src podLogSource, pool *logStreamPool, pollInterval time.Duration) (int64, error) {
+	release, ok, err := pool.acquire()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		log.Debug("all %d log streams are in use, polling for builder logs", pool.size)
+		return pollLogs(out, src, pollInterval)
+	}
+	defer release()
+	return followLogs(out, src, logStreamReconnects, pollInterval)
+}
+
+// followLogs copies the followed log stream of src to out until the pod exits. If the stream fails or ends
+// early, it is reopened up to reconnects times, waiting pause before each attempt. A reopened stream starts
+// from the beginning of the container's log, so the part that was already written is skipped, unless the
+// container restarted in the meantime.
+func followLogs(out io.Writer, src podLogSource, reconnects int, pause time.Duration) (int64, error) {
+	restarts, err := src.restarts()
+	if err != nil {
+		return 0, fmt.Errorf("checking builder pod status (%s)", err)
+	}
+	// offset is how much of the current container's log has been written
+	var written, offset int64
+	for attempt := 0; ; attempt++ {
+		w := &skipWriter{w: out, skip: offset}
+		err := copyStream(w, src)
+		written += w.written
+		offset += w.written
+		if w.err != nil {
+			return written, w.err
+		}
+		if err == nil {
+			done, ferr := src.finished()
+			if ferr != nil {
+				return written, fmt.Errorf("checking builder pod status (%s)", ferr)
+			}
+			if done {
+				return written, nil
+			}
+			err = errors.New("stream closed before the builder pod exited")
+		}
+		if attempt >= reconnects {
+			return written, fmt.Errorf("streaming logs (%s), gave up after %d reconnects", err, reconnects)
+		}
+		log.Debug("builder log stream dropped (%s), reconnecting", err)
+		time.Sleep(pause)
+		if n, err := src.restarts(); err == nil && n != restarts {
+			restarts, offset = n, 0
+		}
+	}
+}
+
+func copyStream(out io.Writer, src podLogSource) error {
+	rc, err := src.stream()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+// skipWriter discards the first skip bytes written to it and passes the rest through to w. Errors from w
+// are kept in err, so that they can be told apart from errors reading the stream.
+type skipWriter struct {
+	w       io.Writer
+	skip    int64
+	written int64
+	err     error
+}
+
+func (s *skipWriter) Write(b []byte) (int, error) {
+	skipped := 0
+	if s.skip > 0 {
+		if int64(len(b)) <= s.skip {
+			s.skip -= int64(len(b))
+			return len(b), nil
+		}
+		skipped = int(s.skip)
+		s.skip = 0
+	}
+	n, err := s.w.Write(b[skipped:])
+	s.written += int64(n)
+	s.err = err
+	return skipped + n, err
+}
+
+// pollLogs repeatedly fetches the logs from src, writing what's new to out, until the pod exits
+func pollLogs(out io.Writer, src podLogSource, pollInterval time.Duration) (int64, error) {
+	var written int64
+	for {
+		// check before fetching so that the last fetch is guaranteed to include everything
+		done, err := src.finished()
+		if err != nil {
+			return written, fmt.Errorf("checking builder pod status (%s)", err)
+		}
+		logs, err := src.fetch()
+		if err != nil {
+			return written, fmt.Errorf("fetching logs (%s)", err)
+		}
+		if int64(len(logs)) > written {
+			n, err := out.Write(logs[written:])
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		if done {
+			return written, nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
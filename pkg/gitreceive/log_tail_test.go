@@ -0,0 +1,254 @@
+package gitreceive
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testBuildLogs = "-----> Compiling app\n-----> Done\n"
+
+// fakeLogSource serves testBuildLogs. Streams stay open until release is closed, and maxOpen tracks the
+// largest number of streams that were open at once.
+type fakeLogSource struct {
+	release <-chan struct{}
+	open    *int32
+	maxOpen *int32
+	polled  *int32
+}
+
+type gatedReader struct {
+	io.Reader
+	release <-chan struct{}
+	onClose func()
+}
+
+func (g *gatedReader) Read(b []byte) (int, error) {
+	n, err := g.Reader.Read(b)
+	if err == io.EOF {
+		<-g.release
+	}
+	return n, err
+}
+
+func (g *gatedReader) Close() error {
+	g.onClose()
+	return nil
+}
+
+func (f fakeLogSource) stream() (io.ReadCloser, error) {
+	n := atomic.AddInt32(f.open, 1)
+	for {
+		max := atomic.LoadInt32(f.maxOpen)
+		if n <= max || atomic.CompareAndSwapInt32(f.maxOpen, max, n) {
+			break
+		}
+	}
+	return &gatedReader{
+		Reader:  bytes.NewBufferString(testBuildLogs),
+		release: f.release,
+		onClose: func() { atomic.AddInt32(f.open, -1) },
+	}, nil
+}
+
+func (f fakeLogSource) fetch() ([]byte, error) {
+	atomic.AddInt32(f.polled, 1)
+	return []byte(testBuildLogs), nil
+}
+
+func (f fakeLogSource) finished() (bool, error) {
+	return true, nil
+}
+
+func (f fakeLogSource) restarts() (int, error) {
+	return 0, nil
+}
+
+func TestTailLogsCapsStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-streams")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const poolSize, builds = 2, 5
+	pool := &logStreamPool{dir: dir, size: poolSize, queueTimeout: 50 * time.Millisecond, tick: 5 * time.Millisecond}
+	release := make(chan struct{})
+	var open, maxOpen, polled int32
+	src := fakeLogSource{release: release, open: &open, maxOpen: &maxOpen, polled: &polled}
+
+	outs := make([]bytes.Buffer, builds)
+	errs := make([]error, builds)
+	var wg sync.WaitGroup
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = tailLogs(&outs[i], src, pool, time.Millisecond)
+		}(i)
+	}
+
+	// the builds over the limit give up on streaming after the queue timeout and poll instead
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&polled) < builds-poolSize && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if maxOpen > poolSize {
+		t.Errorf("expected at most %d concurrent log streams, got %d", poolSize, maxOpen)
+	}
+	if polled != builds-poolSize {
+		t.Errorf("expected %d builds to fall back to polling, got %d", builds-poolSize, polled)
+	}
+	for i := 0; i < builds; i++ {
+		if errs[i] != nil {
+			t.Errorf("build %d: tailing logs (%s)", i, errs[i])
+		}
+		if outs[i].String() != testBuildLogs {
+			t.Errorf("build %d: expected logs %q, got %q", i, testBuildLogs, outs[i].String())
+		}
+	}
+}
+
+func TestTailLogsUnbounded(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	var open, maxOpen, polled int32
+	src := fakeLogSource{release: release, open: &open, maxOpen: &maxOpen, polled: &polled}
+
+	var out bytes.Buffer
+	if _, err := tailLogs(&out, src, &logStreamPool{size: 0}, time.Millisecond); err != nil {
+		t.Fatalf("tailing logs (%s)", err)
+	}
+	if polled != 0 || out.String() != testBuildLogs {
+		t.Errorf("expected logs to be streamed, got %q after %d polls", out.String(), polled)
+	}
+}
+
+// growingLogSource logs one more line every fetch, and finishes after the last one
+type growingLogSource struct {
+	lines   []string
+	fetches int
+}
+
+func (g *growingLogSource) stream() (io.ReadCloser, error) {
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (g *growingLogSource) fetch() ([]byte, error) {
+	g.fetches++
+	var logs bytes.Buffer
+	for i := 0; i < g.fetches && i < len(g.lines); i++ {
+		logs.WriteString(g.lines[i])
+	}
+	return logs.Bytes(), nil
+}
+
+func (g *growingLogSource) finished() (bool, error) {
+	return g.fetches >= len(g.lines)-1, nil
+}
+
+func (g *growingLogSource) restarts() (int, error) {
+	return 0, nil
+}
+
+func TestPollLogs(t *testing.T) {
+	src := &growingLogSource{lines: []string{"one\n", "two\n", "three\n"}}
+	var out bytes.Buffer
+	if _, err := pollLogs(&out, src, time.Millisecond); err != nil {
+		t.Fatalf("polling logs (%s)", err)
+	}
+	if out.String() != "one\ntwo\nthree\n" {
+		t.Errorf("expected each line to be written once, got %q", out.String())
+	}
+}
+
+// droppingLogSource serves logs whose streams fail partway through until drops runs out. If restartLogs is
+// set, the container restarts when the first stream drops and logs restartLogs from then on.
+type droppingLogSource struct {
+	logs        string
+	drops       int
+	opened      int
+	restartLogs string
+	restarted   bool
+}
+
+func (d *droppingLogSource) stream() (io.ReadCloser, error) {
+	d.opened++
+	if d.drops == 0 {
+		return ioutil.NopCloser(bytes.NewBufferString(d.logs)), nil
+	}
+	d.drops--
+	partial := bytes.NewBufferString(d.logs[:len(d.logs)/2])
+	if d.restartLogs != "" && !d.restarted {
+		d.logs, d.restarted = d.restartLogs, true
+	}
+	return ioutil.NopCloser(io.MultiReader(partial, errReader{io.ErrUnexpectedEOF})), nil
+}
+
+func (d *droppingLogSource) fetch() ([]byte, error) {
+	return []byte(d.logs), nil
+}
+
+func (d *droppingLogSource) finished() (bool, error) {
+	return d.drops == 0, nil
+}
+
+func (d *droppingLogSource) restarts() (int, error) {
+	if d.restarted {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func TestFollowLogsReconnects(t *testing.T) {
+	src := &droppingLogSource{logs: testBuildLogs, drops: 2}
+	var out bytes.Buffer
+	n, err := followLogs(&out, src, 3, time.Millisecond)
+	if err != nil {
+		t.Fatalf("following logs (%s)", err)
+	}
+	if out.String() != testBuildLogs || n != int64(len(testBuildLogs)) {
+		t.Errorf("expected logs to be written once, got %q (%d bytes)", out.String(), n)
+	}
+	if src.opened != 3 {
+		t.Errorf("expected 3 streams to be opened, got %d", src.opened)
+	}
+}
+
+func TestFollowLogsGivesUp(t *testing.T) {
+	src := &droppingLogSource{logs: testBuildLogs, drops: 10}
+	var out bytes.Buffer
+	if _, err := followLogs(&out, src, 2, time.Millisecond); err == nil {
+		t.Fatal("expected an error when the log stream keeps dropping")
+	}
+	if src.opened != 3 {
+		t.Errorf("expected 3 streams to be opened, got %d", src.opened)
+	}
+	if out.String() != testBuildLogs[:len(testBuildLogs)/2] {
+		t.Errorf("expected the partial logs to be written once, got %q", out.String())
+	}
+}
+
+func TestFollowLogsAfterRestart(t *testing.T) {
+	const restarted = "-----> Restarted\n"
+	src := &droppingLogSource{logs: testBuildLogs, drops: 1, restartLogs: restarted}
+	var out bytes.Buffer
+	if _, err := followLogs(&out, src, 3, time.Millisecond); err != nil {
+		t.Fatalf("following logs (%s)", err)
+	}
+	if expected := testBuildLogs[:len(testBuildLogs)/2] + restarted; out.String() != expected {
+		t.Errorf("expected the restarted container's logs in full, got %q", out.String())
+	}
+}
@@ -0,0 +1,95 @@
+package gitreceive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/deis/pkg/log"
+)
+
+// deployNotification is the body POSTed to the notify URL after a successful deploy
+type deployNotification struct {
+	Repo        string `json:"repo"`
+	App         string `json:"app"`
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+	Sha         string `json:"sha"`
+	Branch      string `json:"branch"`
+	Namespace   string `json:"namespace"`
+}
+
+// Notify runs the post-receive hook. It reads the refs of the push from stdin and POSTs a notification of
+// the deploy to conf.NotifyURL if the deploy branch was built.
+func Notify(conf *Config) error {
+	branches, err := listBranches(filepath.Join(conf.GitHome, conf.Repository))
+	if err != nil {
+		return err
+	}
+	return notifyRefs(conf, os.Stdin, branches, &http.Client{Timeout: conf.NotifyTimeout()})
+}
+
+// notifyRefs reads the refs of a push from r, and sends a notification with client if the deploy branch was
+// updated. branches are the branches of the repo, as used by deployBranch.
+func notifyRefs(conf *Config, r io.Reader, branches []string, client *http.Client) error {
+	if conf.NotifyURL == "" || conf.DryRun {
+		// dry runs didn't deploy anything
+		return nil
+	}
+	refs, err := readRefs(conf, r)
+	if err != nil {
+		return err
+	}
+	branch := deployBranch(conf.DeployBranch, branches, refs)
+	var sha, refName string
+	for _, ref := range refs {
+		if branch != "" && isDeployRef(ref.refName, branch) && !isDeletion(ref.newRev) {
+			sha, refName = ref.newRev, ref.refName
+		}
+	}
+	if sha == "" {
+		return nil
+	}
+
+	n := deployNotification{
+		Repo:        conf.Repository,
+		App:         conf.App(),
+		User:        conf.Username,
+		Fingerprint: conf.Fingerprint,
+		Sha:         sha,
+		Branch:      branchName(refName),
+		Namespace:   conf.PodNamespace,
+	}
+	if err := sendNotification(client, conf.NotifyURL, n); err != nil {
+		return fmt.Errorf("notifying %s of the deploy of %s (%s)", conf.NotifyURL, n.App, err)
+	}
+	log.Debug("notified %s of the deploy of %s at %s", conf.NotifyURL, n.App, n.Sha)
+	return nil
+}
+
+func sendNotification(client *http.Client, url string, n deployNotification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("User-Agent", userAgent)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned status code %d", url, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testNotifyConfig(url string) *Config {
+	conf := testAuditConfig()
+	conf.NotifyURL = url
+	conf.DeployBranch = "master"
+	conf.MaxLineSize = 1024
+	return conf
+}
+
+func TestNotifyRefs(t *testing.T) {
+	var received []deployNotification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n deployNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("decoding notification (%s)", err)
+		}
+		received = append(received, n)
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: time.Second}
+
+	push := zeroRev + " " + approvedSha + " refs/heads/feature\n" + zeroRev + " " + approvedSha + " refs/heads/master\n"
+	if err := notifyRefs(testNotifyConfig(srv.URL), strings.NewReader(push), nil, client); err != nil {
+		t.Fatalf("notifying (%s)", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(received))
+	}
+	n := received[0]
+	if n.Repo != "myapp.git" || n.App != "myapp" || n.Sha != approvedSha || n.Branch != "master" {
+		t.Errorf("expected a deploy of myapp at %s from master, got %+v", approvedSha, n)
+	}
+	if n.User != "builder" || n.Fingerprint != "12:34:56" {
+		t.Errorf("expected the pushing user and key, got %+v", n)
+	}
+
+	// nothing deployed, nothing to notify
+	push = zeroRev + " " + approvedSha + " refs/heads/feature\n"
+	if err := notifyRefs(testNotifyConfig(srv.URL), strings.NewReader(push), nil, client); err != nil {
+		t.Fatalf("notifying (%s)", err)
+	}
+	dryRun := testNotifyConfig(srv.URL)
+	dryRun.DryRun = true
+	if err := notifyRefs(dryRun, strings.NewReader(zeroRev+" "+approvedSha+" refs/heads/master\n"), nil, client); err != nil {
+		t.Fatalf("notifying (%s)", err)
+	}
+	if len(received) != 1 {
+		t.Errorf("expected no notifications for pushes that didn't deploy, got %d", len(received)-1)
+	}
+}
+
+func TestNotifyRefsFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	push := zeroRev + " " + approvedSha + " refs/heads/master\n"
+	err := notifyRefs(testNotifyConfig(srv.URL), strings.NewReader(push), nil, &http.Client{Timeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("expected the notify URL's status to be reported, got %v", err)
+	}
+}
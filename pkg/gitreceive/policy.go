@@ -0,0 +1,95 @@
+package gitreceive
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	policyUnrestricted     = "unrestricted"
+	policyFrozen           = "frozen"
+	policyApprovalRequired = "approval-required"
+)
+
+// appPolicy is the deploy policy for a single app
+type appPolicy struct {
+	Policy string `yaml:"policy"`
+	// Approved lists the git shas that may be deployed when Policy is approval-required
+	Approved []string `yaml:"approved"`
+}
+
+// policyResolver looks up the deploy policy for an app
+type policyResolver interface {
+	Policy(app string) (*appPolicy, error)
+}
+
+// filePolicyResolver reads policies from a YAML file mapping app names to their policy, for
+// example:
+//
+//	myapp:
+//	  policy: frozen
+//	otherapp:
+//	  policy: approval-required
+//	  approved:
+//	  - c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de
+//
+// The file is typically a mounted ConfigMap. It is re-read on every lookup so that policy changes take
+// effect on the next push without restarting the builder. Apps that aren't in the file are unrestricted.
+type filePolicyResolver struct {
+	path string
+}
+
+func (f filePolicyResolver) Policy(app string) (*appPolicy, error) {
+	unrestricted := &appPolicy{Policy: policyUnrestricted}
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return unrestricted, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading deploy policies from %s (%s)", f.path, err)
+	}
+	policies := map[string]*appPolicy{}
+	if err := yaml.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("deploy policies in %s are malformed (%s)", f.path, err)
+	}
+	if p, ok := policies[app]; ok && p != nil {
+		return p, nil
+	}
+	return unrestricted, nil
+}
+
+// newPolicyResolver returns the policy resolver configured in conf, or nil if no policies are configured
+func newPolicyResolver(conf *Config) policyResolver {
+	if conf.DeployPolicyFile == "" {
+		return nil
+	}
+	return filePolicyResolver{path: conf.DeployPolicyFile}
+}
+
+// checkPolicy returns an error with a message for the user if the policy for app forbids deploying gitSha
+func checkPolicy(resolver policyResolver, app, gitSha string) error {
+	if resolver == nil {
+		return nil
+	}
+	p, err := resolver.Policy(app)
+	if err != nil {
+		return err
+	}
+	switch p.Policy {
+	case "", policyUnrestricted:
+		return nil
+	case policyFrozen:
+		return fmt.Errorf("deploys to %s are frozen by policy", app)
+	case policyApprovalRequired:
+		for _, approved := range p.Approved {
+			if approved == gitSha {
+				return nil
+			}
+		}
+		return fmt.Errorf("deploys to %s require approval by policy, and %s has not been approved", app, gitSha)
+	default:
+		return fmt.Errorf("unknown deploy policy %q for %s", p.Policy, app)
+	}
+}
@@ -0,0 +1,86 @@
+package gitreceive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testPolicies = `
+frozenapp:
+  policy: frozen
+gatedapp:
+  policy: approval-required
+  approved:
+  - c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de
+openapp:
+  policy: unrestricted
+`
+	approvedSha   = "c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de"
+	unapprovedSha = "71a09fbed590558ff822536584fc77248f070384"
+)
+
+func writePolicies(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "policies")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	path := filepath.Join(dir, "policies.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing policies (%s)", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckPolicy(t *testing.T) {
+	path, cleanup := writePolicies(t, testPolicies)
+	defer cleanup()
+	resolver := filePolicyResolver{path: path}
+
+	err := checkPolicy(resolver, "frozenapp", approvedSha)
+	if err == nil || !strings.Contains(err.Error(), "deploys to frozenapp are frozen by policy") {
+		t.Errorf("expected frozen app to be rejected, got %v", err)
+	}
+	if err := checkPolicy(resolver, "gatedapp", approvedSha); err != nil {
+		t.Errorf("expected approved sha to be allowed, got %s", err)
+	}
+	if err := checkPolicy(resolver, "gatedapp", unapprovedSha); err == nil {
+		t.Errorf("expected unapproved sha to be rejected")
+	}
+	if err := checkPolicy(resolver, "openapp", unapprovedSha); err != nil {
+		t.Errorf("expected unrestricted app to be allowed, got %s", err)
+	}
+	if err := checkPolicy(resolver, "unknownapp", unapprovedSha); err != nil {
+		t.Errorf("expected app without a policy to be allowed, got %s", err)
+	}
+	if err := checkPolicy(nil, "frozenapp", unapprovedSha); err != nil {
+		t.Errorf("expected no policies to allow everything, got %s", err)
+	}
+}
+
+func TestPolicyHotReload(t *testing.T) {
+	path, cleanup := writePolicies(t, testPolicies)
+	defer cleanup()
+	resolver := filePolicyResolver{path: path}
+
+	if err := checkPolicy(resolver, "openapp", approvedSha); err != nil {
+		t.Fatalf("expected unrestricted app to be allowed, got %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("openapp:\n  policy: frozen\n"), 0644); err != nil {
+		t.Fatalf("rewriting policies (%s)", err)
+	}
+	if err := checkPolicy(resolver, "openapp", approvedSha); err == nil {
+		t.Errorf("expected policy change to take effect without a restart")
+	}
+}
+
+func TestMalformedPolicy(t *testing.T) {
+	path, cleanup := writePolicies(t, "openapp: [")
+	defer cleanup()
+	if err := checkPolicy(filePolicyResolver{path: path}, "openapp", approvedSha); err == nil {
+		t.Errorf("expected malformed policies to be reported")
+	}
+}
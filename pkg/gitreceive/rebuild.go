@@ -0,0 +1,73 @@
+package gitreceive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/deis/pkg/log"
+	"golang.org/x/net/context"
+
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// rebuildUser is the user that rebuilds are made by, as they don't come from a push
+const rebuildUser = "rebuild"
+
+// RebuildEnv returns the env vars of the git-receive config that a push sets but a rebuild of appName has
+// none of, so that a Config for the rebuild can be loaded from the environment.
+func RebuildEnv(appName string) map[string]string {
+	repo := appName + ".git"
+	return map[string]string{
+		"REPOSITORY":           repo,
+		"USERNAME":             rebuildUser,
+		"FINGERPRINT":          rebuildUser,
+		"SSH_CONNECTION":       rebuildUser,
+		"SSH_ORIGINAL_COMMAND": fmt.Sprintf("git-receive-pack '%s'", repo),
+	}
+}
+
+// Rebuild builds conf's app again at ref, a branch or sha that is already in the app's repo, without a new
+// push. It makes the same builder pod a push of ref would, from the git objects in the repo, so that a build
+// that failed for reasons outside the app can be retried without an empty commit.
+func Rebuild(conf *Config, ref string) error {
+	ctx, cancel := cancelOnSignal(syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer cancel()
+
+	kubeClient, err := client.NewInCluster()
+	if err != nil {
+		return fmt.Errorf("couldn't reach the api server (%s)", err)
+	}
+	result, err := rebuild(ctx, conf, kubeClient, ref)
+	if err != nil {
+		return err
+	}
+	if artifact := result.Artifact(); artifact != "" {
+		log.Info("Rebuilt %s at %s: %s", conf.App(), ref, artifact)
+	}
+	return nil
+}
+
+// rebuild resolves ref in conf's repo and builds the app at it
+func rebuild(ctx context.Context, conf *Config, kubeClient *client.Client, ref string) (*BuildResult, error) {
+	repoDir := filepath.Join(conf.GitHome, conf.Repository)
+	if fi, err := os.Stat(repoDir); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%s has no repo at %s, it has never been pushed", conf.App(), repoDir)
+	}
+	out, err := repoCmd(repoDir, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a branch or commit of %s", ref, conf.App())
+	}
+	sha := strings.TrimSpace(string(out))
+	// a branch keeps its name, for the image tags and build events of the rebuild
+	branch := ""
+	if err := repoCmd(repoDir, "git", "show-ref", "--verify", "--quiet", "refs/heads/"+ref).Run(); err == nil {
+		branch = ref
+	}
+	log.Info("Rebuilding %s at %s", conf.App(), sha)
+	// there is no previous revision, so the rebuild gets the commit range of a first push. Like a push, a
+	// rebuild is checked against the deploy policy and audited.
+	return checkedBuild(ctx, conf, kubeClient, newBuildReporters(conf), zeroRev, sha, branch)
+}
@@ -0,0 +1,125 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+func TestRebuild(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	work := filepath.Join(gitHome, "work")
+	gitOutput(t, gitHome, "init", work)
+	first := commitFiles(t, work, "Procfile")
+	second := commitFiles(t, work, "Procfile")
+	gitOutput(t, work, "branch", "-M", "master")
+	gitOutput(t, gitHome, "clone", "--bare", work, filepath.Join(gitHome, "myapp.git"))
+
+	type call struct{ oldRev, sha, branch string }
+	var calls []call
+	origBuild := runBuild
+	runBuild = func(ctx context.Context, conf *Config, kubeClient *client.Client, oldRev, sha, branch string) (*BuildResult, error) {
+		calls = append(calls, call{oldRev, sha, branch})
+		return &BuildResult{SlugURL: "http://storage/git/home/myapp:git-" + sha[:8] + "/slug"}, nil
+	}
+	defer func() { runBuild = origBuild }()
+
+	conf := &Config{GitHome: gitHome, Repository: "myapp.git"}
+	for _, c := range []struct{ ref, sha, branch string }{
+		{first, first, ""},
+		{"master", second, "master"},
+	} {
+		calls = nil
+		if _, err := rebuild(context.Background(), conf, nil, c.ref); err != nil {
+			t.Errorf("rebuilding %s (%s)", c.ref, err)
+			continue
+		}
+		if len(calls) != 1 || calls[0] != (call{zeroRev, c.sha, c.branch}) {
+			t.Errorf("expected a rebuild of %s to build %s on branch %q, got %+v", c.ref, c.sha, c.branch, calls)
+		}
+	}
+
+	calls = nil
+	if _, err := rebuild(context.Background(), conf, nil, "c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de"); err == nil {
+		t.Errorf("expected a rebuild of an unknown sha to fail")
+	}
+	if _, err := rebuild(context.Background(), &Config{GitHome: gitHome, Repository: "otherapp.git"}, nil, "master"); err == nil {
+		t.Errorf("expected a rebuild of an app without a repo to fail")
+	}
+	if len(calls) != 0 {
+		t.Errorf("expected failed rebuilds not to build, got %+v", calls)
+	}
+}
+
+func TestRebuildIsCheckedAndAudited(t *testing.T) {
+	gitHome, err := ioutil.TempDir("", "git-home")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(gitHome)
+	work := filepath.Join(gitHome, "work")
+	gitOutput(t, gitHome, "init", work)
+	commitFiles(t, work, "Procfile")
+	gitOutput(t, work, "branch", "-M", "master")
+	gitOutput(t, gitHome, "clone", "--bare", work, filepath.Join(gitHome, "myapp.git"))
+
+	builds := 0
+	origBuild := runBuild
+	runBuild = func(ctx context.Context, conf *Config, kubeClient *client.Client, oldRev, sha, branch string) (*BuildResult, error) {
+		builds++
+		return &BuildResult{SlugURL: "http://storage/slug"}, nil
+	}
+	defer func() { runBuild = origBuild }()
+
+	var records []auditRecord
+	audit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec auditRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		records = append(records, rec)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer audit.Close()
+
+	conf := &Config{GitHome: gitHome, Repository: "myapp.git", Username: rebuildUser, AuditURL: audit.URL, AuditFailClosed: true, AuditTimeoutMSec: 5000}
+	if _, err := rebuild(context.Background(), conf, nil, "master"); err == nil {
+		t.Errorf("expected a rebuild that can't be audited to fail with AUDIT_FAIL_CLOSED")
+	}
+	if builds != 1 || len(records) != 1 || records[0].User != rebuildUser {
+		t.Errorf("expected the rebuild to be audited as %s, got %d builds and records %+v", rebuildUser, builds, records)
+	}
+
+	policies := filepath.Join(gitHome, "policies.yaml")
+	if err := ioutil.WriteFile(policies, []byte("myapp:\n  policy: frozen\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builds = 0
+	if _, err := rebuild(context.Background(), &Config{GitHome: gitHome, Repository: "myapp.git", DeployPolicyFile: policies}, nil, "master"); err == nil {
+		t.Errorf("expected a rebuild of a frozen app to be rejected")
+	}
+	if builds != 0 {
+		t.Errorf("expected a frozen app not to be rebuilt")
+	}
+}
+
+func TestRebuildEnv(t *testing.T) {
+	env := RebuildEnv("myapp")
+	if env["REPOSITORY"] != "myapp.git" || env["SSH_ORIGINAL_COMMAND"] != "git-receive-pack 'myapp.git'" {
+		t.Errorf("expected the env of a push to myapp, got %v", env)
+	}
+	conf := &Config{Repository: env["REPOSITORY"]}
+	if conf.App() != "myapp" {
+		t.Errorf("expected the rebuild's app to be myapp, got %s", conf.App())
+	}
+}
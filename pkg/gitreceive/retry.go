@@ -0,0 +1,81 @@
+package gitreceive
+
+import (
+	"time"
+
+	"github.com/deis/pkg/log"
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/api"
+	apierrs "k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// retryPolicy retries Kubernetes API calls with a bounded exponential backoff, so that a brief API server
+// hiccup doesn't fail a push
+type retryPolicy struct {
+	// attempts is the maximum number of calls, including the first. Less than 1 means 1.
+	attempts int
+	// delay is the wait before the first retry, doubled for every retry after it
+	delay time.Duration
+}
+
+func newRetryPolicy(conf *Config) retryPolicy {
+	return retryPolicy{attempts: conf.KubeAPIRetries, delay: conf.KubeAPIRetryDelay()}
+}
+
+// do calls fn until it succeeds, fails with an error that isn't worth retrying, or the attempts run out.
+// It returns the last error from fn, or ctx.Err() if ctx is done before a retry.
+func (r retryPolicy) do(ctx context.Context, what string, fn func() error) error {
+	delay := r.delay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || attempt >= r.attempts {
+			return err
+		}
+		log.Debug("%s failed, retrying in %s (attempt %d of %d): %s", what, delay, attempt, r.attempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable returns false for errors that the API server will return again, such as a forbidden, missing or
+// existing resource, and true for everything else, such as server errors and dropped connections
+func isRetryable(err error) bool {
+	switch {
+	case apierrs.IsNotFound(err), apierrs.IsAlreadyExists(err), apierrs.IsForbidden(err), apierrs.IsUnauthorized(err), apierrs.IsBadRequest(err),
+		apierrs.IsInvalid(err), apierrs.IsConflict(err), apierrs.IsMethodNotSupported(err):
+		return false
+	}
+	return true
+}
+
+// createPod creates pod, retrying transient failures. If the pod already exists, as it does when a create
+// that failed to return was carried out anyway, it returns the existing pod.
+func createPod(ctx context.Context, pods client.PodInterface, pod *api.Pod, retry retryPolicy) (*api.Pod, error) {
+	var created *api.Pod
+	err := retry.do(ctx, "creating pod "+pod.Name, func() error {
+		var err error
+		created, err = pods.Create(pod)
+		return err
+	})
+	if apierrs.IsAlreadyExists(err) {
+		log.Info("pod %s already exists, using it", pod.Name)
+		return getPod(ctx, pods, pod.Name, retry)
+	}
+	return created, err
+}
+
+// getPod gets the pod named name, retrying transient failures
+func getPod(ctx context.Context, pods client.PodInterface, name string, retry retryPolicy) (*api.Pod, error) {
+	var pod *api.Pod
+	err := retry.do(ctx, "getting pod "+name, func() error {
+		var err error
+		pod, err = pods.Get(name)
+		return err
+	})
+	return pod, err
+}
@@ -0,0 +1,154 @@
+package gitreceive
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/api"
+	apierrs "k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// flakyPods is a client.PodsNamespacer whose calls fail with failErr until they have been made failures times
+type flakyPods struct {
+	stuckPods
+	failures int
+	failErr  error
+	calls    int
+}
+
+func (f *flakyPods) Pods(namespace string) client.PodInterface { return f }
+
+func (f *flakyPods) call() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.failErr
+	}
+	return nil
+}
+
+func (f *flakyPods) Create(pod *api.Pod) (*api.Pod, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (f *flakyPods) Get(name string) (*api.Pod, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return &api.Pod{ObjectMeta: api.ObjectMeta{Name: name}, Status: api.PodStatus{Phase: api.PodSucceeded}}, nil
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	retry := retryPolicy{attempts: 4, delay: time.Millisecond}
+	pod := &api.Pod{ObjectMeta: api.ObjectMeta{Name: "slugbuild-test"}}
+
+	pods := &flakyPods{failures: 3, failErr: apierrs.NewServiceUnavailable("etcd is catching up")}
+	created, err := createPod(context.Background(), pods, pod, retry)
+	if err != nil {
+		t.Fatalf("expected the create to succeed on the last attempt, got %s", err)
+	}
+	if created.Name != pod.Name || pods.calls != 4 {
+		t.Errorf("expected pod %s to be created on attempt 4, got %+v after %d attempts", pod.Name, created, pods.calls)
+	}
+
+	pods = &flakyPods{failures: 2, failErr: errors.New("connection reset by peer")}
+	if got, err := getPod(context.Background(), pods, "slugbuild-test", retry); err != nil || got.Name != "slugbuild-test" {
+		t.Errorf("expected the get to succeed after dropped connections, got %+v (%v)", got, err)
+	}
+
+	// the attempt budget is bounded
+	pods = &flakyPods{failures: 10, failErr: apierrs.NewInternalError(errors.New("boom"))}
+	if _, err := createPod(context.Background(), pods, pod, retry); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected the last error once the attempts ran out, got %v", err)
+	}
+	if pods.calls != 4 {
+		t.Errorf("expected 4 attempts, got %d", pods.calls)
+	}
+}
+
+// lostCreatePods is a client.PodsNamespacer whose first create fails with a dropped connection after creating
+// the pod, so that a retried create finds it already exists
+type lostCreatePods struct {
+	stuckPods
+	creates  int
+	existing *api.Pod
+}
+
+func (c *lostCreatePods) Pods(namespace string) client.PodInterface { return c }
+
+func (c *lostCreatePods) Create(pod *api.Pod) (*api.Pod, error) {
+	c.creates++
+	if c.existing != nil {
+		return nil, apierrs.NewAlreadyExists("pods", pod.Name)
+	}
+	c.existing = &api.Pod{ObjectMeta: api.ObjectMeta{Name: pod.Name, UID: "created"}}
+	return nil, errors.New("connection reset by peer")
+}
+
+func (c *lostCreatePods) Get(name string) (*api.Pod, error) {
+	if c.existing == nil || c.existing.Name != name {
+		return nil, apierrs.NewNotFound("pods", name)
+	}
+	return c.existing, nil
+}
+
+func TestCreatePodAlreadyExists(t *testing.T) {
+	retry := retryPolicy{attempts: 4, delay: time.Millisecond}
+	pods := &lostCreatePods{}
+	created, err := createPod(context.Background(), pods, &api.Pod{ObjectMeta: api.ObjectMeta{Name: "slugbuild-test"}}, retry)
+	if err != nil {
+		t.Fatalf("expected the pod created by the failed attempt to be used, got %s", err)
+	}
+	if created.UID != "created" {
+		t.Errorf("expected the existing pod, got %+v", created)
+	}
+	if pods.creates != 2 {
+		t.Errorf("expected the create not to be retried once the pod exists, got %d attempts", pods.creates)
+	}
+	if isRetryable(apierrs.NewAlreadyExists("pods", "slugbuild-test")) {
+		t.Errorf("expected an existing pod not to be retryable")
+	}
+}
+
+func TestRetryFailsFast(t *testing.T) {
+	retry := retryPolicy{attempts: 4, delay: time.Millisecond}
+	for _, failErr := range []error{
+		apierrs.NewForbidden("pods", "slugbuild-test", errors.New("quota exceeded")),
+		apierrs.NewNotFound("pods", "slugbuild-test"),
+		apierrs.NewBadRequest("invalid pod"),
+	} {
+		pods := &flakyPods{failures: 10, failErr: failErr}
+		if _, err := getPod(context.Background(), pods, "slugbuild-test", retry); err != failErr {
+			t.Errorf("expected %q to be returned, got %v", failErr, err)
+		}
+		if pods.calls != 1 {
+			t.Errorf("expected %q not to be retried, got %d attempts", failErr, pods.calls)
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	retry := retryPolicy{attempts: 4, delay: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pods := &flakyPods{failures: 10, failErr: apierrs.NewServiceUnavailable("etcd is catching up")}
+	if _, err := getPod(ctx, pods, "slugbuild-test", retry); err != context.Canceled {
+		t.Errorf("expected a cancelled build not to be retried, got %v", err)
+	}
+	if pods.calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", pods.calls)
+	}
+}
+
+func TestWaitForPodTransientErrors(t *testing.T) {
+	pods := &flakyPods{failures: 2, failErr: apierrs.NewServiceUnavailable("etcd is catching up")}
+	if err := waitForPodEnd(context.Background(), pods, "deis", "slugbuild-test", time.Millisecond, time.Second); err != nil {
+		t.Errorf("expected transient errors while polling to be skipped, got %s", err)
+	}
+}
@@ -3,10 +3,18 @@ package gitreceive
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/deis/pkg/log"
+	"github.com/deis/sa-builder/pkg/jsonlog"
+	"github.com/deis/sa-builder/pkg/metrics"
+	"golang.org/x/net/context"
 
 	client "k8s.io/kubernetes/pkg/client/unversioned"
 )
@@ -19,34 +27,200 @@ func readLine(line string) (string, string, string, error) {
 	return spl[0], spl[1], spl[2], nil
 }
 
+// metricsReportTimeout is how long to wait for the SSH server to take a build's metrics
+const metricsReportTimeout = 2 * time.Second
+
+// reportBuildMetrics reports the result of a build that failed with buildErr, or nil, to the SSH server's
+// metrics. A failure to report is logged, but doesn't fail the push.
+func reportBuildMetrics(conf *Config, result *BuildResult, buildErr error) {
+	if err := metrics.Report(conf.MetricsPort, conf.App(), buildErr, result.Duration, metricsReportTimeout); err != nil {
+		log.Err("reporting build metrics (%s)", err)
+	}
+}
+
+// cancelOnSignal returns a context that is cancelled once the hook gets one of sigs, as it does when the
+// client hangs up or the builder shuts down, so that the build in progress is stopped and its pod deleted.
+func cancelOnSignal(sigs ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, sigs...)
+	go func() {
+		defer signal.Stop(received)
+		select {
+		case sig := <-received:
+			log.Info("Received %s, stopping the build.", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 func Run(conf *Config) error {
+	var stdout, stderr *jsonlog.Writer
+	if jsonlog.Enabled() {
+		fields := jsonlog.Fields{"repo": conf.Repository, "user": conf.Username, "fingerprint": conf.Fingerprint}
+		stdout, stderr = jsonlog.NewWriter(os.Stdout, "info", fields), jsonlog.NewWriter(os.Stderr, "error", fields)
+		log.DefaultLogger = log.NewLogger(stdout, stderr, conf.Debug)
+	}
 	log.Debug("Running git hook")
+	ctx, cancel := cancelOnSignal(syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer cancel()
 
 	kubeClient, err := client.NewInCluster()
 	if err != nil {
 		return fmt.Errorf("couldn't reach the api server (%s)", err)
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		oldRev, newRev, refName, err := readLine(line)
+	reporters := newBuildReporters(conf)
 
-		if err != nil {
-			return fmt.Errorf("reading STDIN (%s)", err)
-		}
+	branches, err := listBranches(filepath.Join(conf.GitHome, conf.Repository))
+	if err != nil {
+		return err
+	}
 
-		log.Debug("read [%s,%s,%s]", oldRev, newRev, refName)
+	return receiveRefs(conf, os.Stdin, branches, func(oldRev, newRev, refName string) error {
+		if stdout != nil {
+			stdout.SetField("sha", newRev)
+			stderr.SetField("sha", newRev)
+		}
 
 		// if we're processing a receive-pack on an existing repo, run a build
-		if strings.HasPrefix(conf.SSHOriginalCommand, "git-receive-pack") {
-			if err := build(conf, kubeClient, newRev); err != nil {
-				return err
-			}
+		if !strings.HasPrefix(conf.SSHOriginalCommand, "git-receive-pack") {
+			return nil
+		}
+		_, err := checkedBuild(ctx, conf, kubeClient, reporters, oldRev, newRev, branchName(refName))
+		return err
+	})
+}
+
+// runBuild builds an app. It is a variable so tests can replace it.
+var runBuild = build
+
+// buildReporters are what every build of an app is checked against and reported to
+type buildReporters struct {
+	policies policyResolver
+	auditor  auditEmitter
+	events   *buildEventSender
+}
+
+func newBuildReporters(conf *Config) buildReporters {
+	return buildReporters{
+		policies: newPolicyResolver(conf),
+		auditor:  newAuditEmitter(conf),
+		events:   newBuildEventSender(conf),
+	}
+}
+
+// checkedBuild checks newRev against the app's deploy policy, builds it, and reports the build to the
+// metrics, the audit log and the build events, the same way for a push and a rebuild.
+func checkedBuild(ctx context.Context, conf *Config, kubeClient *client.Client, reporters buildReporters, oldRev, newRev, branch string) (*BuildResult, error) {
+	if err := checkPolicy(reporters.policies, conf.App(), newRev); err != nil {
+		return nil, err
+	}
+	if !conf.DryRun {
+		if err := emitBuildEvent(reporters.events, newBuildStartedEvent(conf, newRev, branch), conf.BuildEventsStrict); err != nil {
+			return nil, err
 		}
 	}
-	if err := scanner.Err(); err != nil {
+	result, err := runBuild(ctx, conf, kubeClient, oldRev, newRev, branch)
+	if conf.DryRun {
+		// nothing was built, so there is nothing to record
+		return result, err
+	}
+	reportBuildMetrics(conf, result, err)
+	auditErr := emitAudit(reporters.auditor, newAuditRecord(conf, newRev, result), conf.AuditFailClosed)
+	eventErr := emitBuildEvent(reporters.events, newBuildFinishedEvent(conf, newRev, branch, result), conf.BuildEventsStrict)
+	if err != nil {
+		return result, err
+	}
+	if auditErr != nil {
+		return result, auditErr
+	}
+	return result, eventErr
+}
+
+// receiveRefs reads every ref line of a push from r, then calls buildRef once for the deploy branch, as
+// chosen by deployBranch from the repo's branches and the push. A push that doesn't update the deploy branch
+// is accepted into the repo without a build, and deleting the deploy branch is rejected.
+func receiveRefs(conf *Config, r io.Reader, branches []string, buildRef func(oldRev, newRev, refName string) error) error {
+	refs, err := readRefs(conf, r)
+	if err != nil {
 		return err
 	}
-	return nil
+	branch := deployBranch(conf.DeployBranch, branches, refs)
+	var deploy *pushedRef
+	for i, ref := range refs {
+		if branch == "" {
+			log.Info("Not building %s, the branch to deploy is unknown. Push a main or master branch, or set DEPLOY_BRANCH", ref.refName)
+			continue
+		}
+		if !isDeployRef(ref.refName, branch) {
+			log.Info("Not building %s, only pushes to the %s branch are built", ref.refName, branch)
+			continue
+		}
+		if isDeletion(ref.newRev) {
+			return fmt.Errorf("deleting the %s branch is not allowed, it is the branch that is deployed", branch)
+		}
+		// git sends every ref once, but if the deploy branch shows up again its last update wins
+		deploy = &refs[i]
+	}
+	if deploy == nil {
+		return nil
+	}
+	return buildRef(deploy.oldRev, deploy.newRev, deploy.refName)
+}
+
+// isDeletion returns true if newRev means the ref is being deleted, not updated
+func isDeletion(newRev string) bool {
+	return newRev == zeroRev
+}
+
+// isDeployRef returns true if refName is the branch deployBranch. Tags are never deploy refs, even if
+// they share the branch's name.
+func isDeployRef(refName, deployBranch string) bool {
+	return refName == "refs/heads/"+deployBranch
+}
+
+// scanLines calls fn with every line read from r. It fails if a line is longer than maxLineSize bytes or if
+// r has more than maxLines lines. A maxLines of 0 or less does not limit the number of lines.
+func scanLines(r io.Reader, maxLineSize, maxLines int, fn func(line string) error) error {
+	br := bufio.NewReader(r)
+	lines := 0
+	for {
+		line, err := readLimitedLine(br, maxLineSize)
+		if err == io.EOF {
+			return nil
+		} else if err == bufio.ErrTooLong {
+			return fmt.Errorf("reading STDIN (line %d is longer than the %d byte limit)", lines+1, maxLineSize)
+		} else if err != nil {
+			return fmt.Errorf("reading STDIN (%s)", err)
+		}
+		lines++
+		if maxLines > 0 && lines > maxLines {
+			return fmt.Errorf("too many refs pushed at once, at most %d are allowed", maxLines)
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
+
+// readLimitedLine reads the next line from r, without its line ending. It fails with bufio.ErrTooLong as soon
+// as the line is longer than maxLineSize bytes, so that an over-long line is never held in memory whole.
+func readLimitedLine(r *bufio.Reader, maxLineSize int) (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxLineSize {
+			return "", bufio.ErrTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
 }
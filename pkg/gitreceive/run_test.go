@@ -0,0 +1,193 @@
+package gitreceive
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deis/sa-builder/pkg/metrics"
+)
+
+const testRefLine = "0000000000000000000000000000000000000000 c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de refs/heads/master"
+
+func TestScanLines(t *testing.T) {
+	input := strings.Repeat(testRefLine+"\n", 3)
+	var lines []string
+	err := scanLines(strings.NewReader(input), 1024, 3, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scanning lines (%s)", err)
+	}
+	if len(lines) != 3 || lines[0] != testRefLine {
+		t.Errorf("expected 3 ref lines, got %v", lines)
+	}
+}
+
+func TestScanLinesTooLong(t *testing.T) {
+	input := testRefLine + "\n" + testRefLine + strings.Repeat("x", 1024) + "\n"
+	called := 0
+	err := scanLines(strings.NewReader(input), 1024, 0, func(line string) error {
+		called++
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected an over-long line to be rejected")
+	}
+	if !strings.Contains(err.Error(), "line 2 is longer than the 1024 byte limit") {
+		t.Errorf("expected a line length error, got %s", err)
+	}
+	if called != 1 {
+		t.Errorf("expected only the first line to be processed, got %d", called)
+	}
+}
+
+func TestScanLinesLongerThanBuffer(t *testing.T) {
+	long := testRefLine + strings.Repeat("x", 8192)
+	var lines []string
+	err := scanLines(strings.NewReader(long+"\r\n"+testRefLine), 16384, 0, func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scanning lines (%s)", err)
+	}
+	if len(lines) != 2 || lines[0] != long || lines[1] != testRefLine {
+		t.Errorf("expected a line longer than the read buffer and an unterminated last line, got %d lines", len(lines))
+	}
+}
+
+func TestScanLinesTooMany(t *testing.T) {
+	input := strings.Repeat(testRefLine+"\n", 4)
+	called := 0
+	err := scanLines(strings.NewReader(input), 1024, 3, func(line string) error {
+		called++
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected too many lines to be rejected")
+	}
+	if !strings.Contains(err.Error(), "at most 3 are allowed") {
+		t.Errorf("expected a line count error, got %s", err)
+	}
+	if called != 3 {
+		t.Errorf("expected 3 lines to be processed before the limit, got %d", called)
+	}
+}
+
+func TestReportBuildMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	srv := httptest.NewServer(registry.Handler())
+	defer srv.Close()
+	port, err := strconv.Atoi(srv.URL[strings.LastIndex(srv.URL, ":")+1:])
+	if err != nil {
+		t.Fatalf("parsing test server port (%s)", err)
+	}
+	conf := &Config{Repository: "myapp.git", MetricsPort: port}
+
+	reportBuildMetrics(conf, &BuildResult{Duration: time.Second}, nil)
+	reportBuildMetrics(conf, &BuildResult{Duration: time.Second}, nil)
+	reportBuildMetrics(conf, &BuildResult{Duration: time.Second, Error: "Stopping build."}, errors.New("Stopping build."))
+	if n := registry.Count("myapp", metrics.ResultSuccess); n != 2 {
+		t.Errorf("expected 2 successful builds, got %d", n)
+	}
+	if n := registry.Count("myapp", metrics.ResultFailure); n != 1 {
+		t.Errorf("expected 1 failed build, got %d", n)
+	}
+}
+
+func TestReceiveRefsDeployBranch(t *testing.T) {
+	const sha = "c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de"
+	cases := []struct {
+		refName      string
+		deployBranch string
+		built        bool
+	}{
+		{"refs/heads/master", "master", true},
+		{"refs/heads/feature/login", "master", false},
+		{"refs/tags/v1.0.0", "master", false},
+		{"refs/tags/master", "master", false},
+		{"refs/heads/release", "release", true},
+		{"refs/heads/master", "release", false},
+	}
+	for _, c := range cases {
+		conf := &Config{DeployBranch: c.deployBranch, MaxLineSize: 1024}
+		var built []string
+		err := receiveRefs(conf, strings.NewReader("0000000000000000000000000000000000000000 "+sha+" "+c.refName+"\n"), nil, func(oldRev, newRev, refName string) error {
+			built = append(built, refName+"@"+newRev)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("handling %s (%s)", c.refName, err)
+			continue
+		}
+		if c.built && (len(built) != 1 || built[0] != c.refName+"@"+sha) {
+			t.Errorf("expected a push to %s to build %s on deploy branch %s, got %v", c.refName, sha, c.deployBranch, built)
+		}
+		if !c.built && len(built) != 0 {
+			t.Errorf("expected a push to %s not to be built on deploy branch %s, got %v", c.refName, c.deployBranch, built)
+		}
+	}
+}
+
+func TestReceiveRefsDeletion(t *testing.T) {
+	const sha = "c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de"
+	conf := &Config{DeployBranch: "master", MaxLineSize: 1024}
+	buildRef := func(oldRev, newRev, refName string) error {
+		t.Errorf("expected no build for the deletion of %s, got a build of %s", refName, newRev)
+		return nil
+	}
+
+	// git push origin :master
+	err := receiveRefs(conf, strings.NewReader(sha+" 0000000000000000000000000000000000000000 refs/heads/master\n"), nil, buildRef)
+	if err == nil || !strings.Contains(err.Error(), "deleting the master branch is not allowed") {
+		t.Errorf("expected the deletion of the deploy branch to be rejected, got %v", err)
+	}
+	// deleting any other branch is fine
+	if err := receiveRefs(conf, strings.NewReader(sha+" 0000000000000000000000000000000000000000 refs/heads/feature\n"), nil, buildRef); err != nil {
+		t.Errorf("expected the deletion of another branch to be accepted, got %s", err)
+	}
+}
+
+func TestReceiveRefsMultiple(t *testing.T) {
+	const (
+		masterSha  = "c3b4e4ba8b7267226ff02ad07a3a2cca9c9237de"
+		featureSha = "71a09fbed590558ff822536584fc77248f070384"
+		tagSha     = "39d8ef3ea964c98f884a67aecef56b4c8abfc700"
+	)
+	conf := &Config{DeployBranch: "master", MaxLineSize: 1024}
+	push := strings.Join([]string{
+		"0000000000000000000000000000000000000000 " + featureSha + " refs/heads/feature",
+		"1b48115b57304d04c8c2e72d62e0a9d1bcd0d48f " + masterSha + " refs/heads/master",
+		"0000000000000000000000000000000000000000 " + tagSha + " refs/tags/v1.0.0",
+	}, "\n") + "\n"
+
+	var built []string
+	err := receiveRefs(conf, strings.NewReader(push), nil, func(oldRev, newRev, refName string) error {
+		built = append(built, newRev)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("receiving push (%s)", err)
+	}
+	if len(built) != 1 || built[0] != masterSha {
+		t.Errorf("expected a single build of %s, got %v", masterSha, built)
+	}
+
+	// a push with no deploy branch ref builds nothing
+	built = nil
+	push = "0000000000000000000000000000000000000000 " + featureSha + " refs/heads/feature\n"
+	if err := receiveRefs(conf, strings.NewReader(push), nil, func(oldRev, newRev, refName string) error {
+		built = append(built, newRev)
+		return nil
+	}); err != nil {
+		t.Fatalf("receiving push (%s)", err)
+	}
+	if len(built) != 0 {
+		t.Errorf("expected no build without a deploy branch ref, got %v", built)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// TypeS3 stores build artifacts in an S3 API compatible object store, such as the builder's own
+	TypeS3 = "s3"
+	// TypeGCS stores build artifacts in a Google Cloud Storage bucket
+	TypeGCS = "gcs"
+	// TypeAzure stores build artifacts in an Azure Blob Storage container
+	TypeAzure = "azure"
+)
+
+// Backend is an object store that build artifacts are written to and read from. Object keys are the
+// same for every backend; only where they are located differs.
+type Backend interface {
+	// ObjectURL returns the location of the object stored under key
+	ObjectURL(key string) string
+}
+
+type s3Backend struct {
+	base string
+}
+
+// NewS3Backend returns a Backend that locates objects under prefix at the S3 API compatible endpoint
+func NewS3Backend(endpoint, prefix string) Backend {
+	return s3Backend{base: joinPrefix(strings.TrimSuffix(endpoint, "/"), prefix)}
+}
+
+func (s s3Backend) ObjectURL(key string) string {
+	return s.base + "/" + key
+}
+
+type gcsBackend struct {
+	base string
+}
+
+// NewGCSBackend returns a Backend that locates objects under prefix in the GCS bucket, as gs:// references
+func NewGCSBackend(bucket, prefix string) Backend {
+	return gcsBackend{base: joinPrefix("gs://"+bucket, prefix)}
+}
+
+func (g gcsBackend) ObjectURL(key string) string {
+	return g.base + "/" + key
+}
+
+type azureBackend struct {
+	base string
+}
+
+// NewAzureBackend returns a Backend that locates objects under prefix in a container of the Azure storage
+// account, as blob URLs
+func NewAzureBackend(account, container, prefix string) Backend {
+	return azureBackend{base: joinPrefix(fmt.Sprintf("https://%s.blob.core.windows.net/%s", account, container), prefix)}
+}
+
+func (a azureBackend) ObjectURL(key string) string {
+	return a.base + "/" + key
+}
+
+// BackendConfig selects and configures a Backend. Each backend type only reads its own fields.
+type BackendConfig struct {
+	Type   string
+	Prefix string
+	// Endpoint is the TypeS3 endpoint URL
+	Endpoint string
+	// Bucket is the TypeGCS bucket
+	Bucket string
+	// Account and Container locate TypeAzure blobs
+	Account   string
+	Container string
+}
+
+// NewBackend returns the Backend for conf.Type
+func NewBackend(conf BackendConfig) (Backend, error) {
+	switch conf.Type {
+	case TypeS3:
+		return NewS3Backend(conf.Endpoint, conf.Prefix), nil
+	case TypeGCS:
+		if conf.Bucket == "" {
+			return nil, fmt.Errorf("a bucket is required for %s storage", TypeGCS)
+		}
+		return NewGCSBackend(conf.Bucket, conf.Prefix), nil
+	case TypeAzure:
+		if conf.Account == "" || conf.Container == "" {
+			return nil, fmt.Errorf("an account and a container are required for %s storage", TypeAzure)
+		}
+		return NewAzureBackend(conf.Account, conf.Container, conf.Prefix), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q (expected %s, %s or %s)", conf.Type, TypeS3, TypeGCS, TypeAzure)
+	}
+}
+
+func joinPrefix(base, prefix string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		return base + "/" + prefix
+	}
+	return base
+}
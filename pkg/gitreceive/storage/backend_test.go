@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/deis/sa-builder/pkg/gitreceive/git"
+)
+
+func TestNewBackend(t *testing.T) {
+	cases := []struct {
+		storageType string
+		endpoint    string
+		bucket      string
+		url         string
+	}{
+		{TypeS3, "http://10.1.2.3:9090", "", "http://10.1.2.3:9090/git/home/myslug/tar"},
+		{TypeS3, "https://minio.storage.svc:9000", "ignored", "https://minio.storage.svc:9000/git/home/myslug/tar"},
+		{TypeGCS, "", "deis-slugs", "gs://deis-slugs/git/home/myslug/tar"},
+		{TypeGCS, "http://ignored:9090", "deis-slugs", "gs://deis-slugs/git/home/myslug/tar"},
+	}
+	for _, c := range cases {
+		backend, err := NewBackend(BackendConfig{Type: c.storageType, Prefix: DefaultPrefix, Endpoint: c.endpoint, Bucket: c.bucket})
+		if err != nil {
+			t.Errorf("%s: creating backend (%s)", c.storageType, err)
+			continue
+		}
+		if url := backend.ObjectURL("home/myslug/tar"); url != c.url {
+			t.Errorf("%s: expected object URL %s, got %s", c.storageType, c.url, url)
+		}
+	}
+
+	if _, err := NewBackend(BackendConfig{Type: TypeGCS}); err == nil {
+		t.Errorf("expected gcs storage without a bucket to be rejected")
+	}
+	if _, err := NewBackend(BackendConfig{Type: TypeAzure, Account: "deis"}); err == nil {
+		t.Errorf("expected azure storage without a container to be rejected")
+	}
+	if _, err := NewBackend(BackendConfig{Type: "ftp", Endpoint: "ftp://10.1.2.3"}); err == nil {
+		t.Errorf("expected an unknown storage type to be rejected")
+	}
+}
+
+func TestGCSSlugBuilderInfo(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	sbi, err := NewSlugBuilderInfoFromBackend(NewGCSBackend("deis-slugs", "builds"), appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
+	urls := map[string][2]string{
+		"PushURL": {sbi.PushURL(), "gs://deis-slugs/builds/home/myapp:git-c3b4e4ba/push"},
+		"TarURL":  {sbi.TarURL(), "gs://deis-slugs/builds/home/myslug/tar"},
+		"SlugURL": {sbi.SlugURL(), "gs://deis-slugs/builds/home/myapp:git-c3b4e4ba/slug"},
+	}
+	for name, vals := range urls {
+		if vals[0] != vals[1] {
+			t.Errorf("%s returned %s, expected %s", name, vals[0], vals[1])
+		}
+	}
+}
+
+func TestAzureSlugBuilderInfo(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	backend, err := NewBackend(BackendConfig{Type: TypeAzure, Prefix: DefaultPrefix, Account: "deisbuilds", Container: "slugs"})
+	if err != nil {
+		t.Fatalf("creating backend (%s)", err)
+	}
+	sbi, err := NewSlugBuilderInfoFromBackend(backend, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
+	s3, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
+	const base = "https://deisbuilds.blob.core.windows.net/slugs/git/"
+	objects := map[string][3]string{
+		"push": {sbi.PushKey(), s3.PushKey(), sbi.PushURL()},
+		"tar":  {sbi.TarKey(), s3.TarKey(), sbi.TarURL()},
+		"slug": {sbi.SlugKey(), s3.SlugKey(), sbi.SlugURL()},
+	}
+	for name, vals := range objects {
+		if vals[0] != vals[1] {
+			t.Errorf("%s key %s differs from the s3 key %s", name, vals[0], vals[1])
+		}
+		if vals[2] != base+vals[0] {
+			t.Errorf("%s URL %s, expected %s", name, vals[2], base+vals[0])
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The variables of a KeyScheme template
+const (
+	appKeyVar  = "{app}"
+	shaKeyVar  = "{sha}"
+	slugKeyVar = "{slug}"
+)
+
+// GzipSuffix is added to the keys of slugs that the slug builder gzips before uploading them
+const GzipSuffix = ".gz"
+
+// KeyScheme names the objects of a build. The zero value is the default layout, where the tarball is stored
+// at home/{slug}/tar and the slug at home/{app}:git-{sha}/push.
+type KeyScheme struct {
+	// Prefix is prepended to every key, so that several builders can share a bucket
+	Prefix string
+	// Template is the directory that holds the tar, push and slug objects of a build. {app} is replaced with
+	// the app name, {sha} with the short git sha and {slug} with the slug name.
+	Template string
+	// Gzip adds GzipSuffix to the push and slug keys, for slugs that are gzipped before they are uploaded
+	Gzip bool
+}
+
+// Validate returns an error if the objects of different builds of an app could get the same keys.
+func (k KeyScheme) Validate() error {
+	if k.Template != "" && !strings.Contains(k.Template, shaKeyVar) && !strings.Contains(k.Template, slugKeyVar) {
+		return fmt.Errorf("storage key template %q must contain %s or %s, so that builds don't overwrite each other", k.Template, shaKeyVar, slugKeyVar)
+	}
+	return nil
+}
+
+// keys returns the keys of the tar, push and slug objects of a build. If the build has a release version,
+// the objects are in a v<version> directory below the ones of the build's sha.
+func (k KeyScheme) keys(appName, slugName, shortSha, version string) (tarKey, pushKey, slugKey string) {
+	var tarDir, dir string
+	if k.Template == "" {
+		tarDir = fmt.Sprintf("home/%s", slugName)
+		// this is where workflow tells slugrunner to download the slug from, so we have to tell slugbuilder to upload it to here
+		dir = fmt.Sprintf("home/%s:git-%s", appName, shortSha)
+	} else {
+		dir = strings.Replace(k.Template, appKeyVar, appName, -1)
+		dir = strings.Replace(dir, shaKeyVar, shortSha, -1)
+		dir = strings.Trim(strings.Replace(dir, slugKeyVar, slugName, -1), "/")
+		tarDir = dir
+	}
+	if version != "" {
+		tarDir, dir = tarDir+"/v"+version, dir+"/v"+version
+	}
+	tarKey, pushKey, slugKey = tarDir+"/tar", dir+"/push", dir+"/slug"
+	if k.Gzip {
+		pushKey, slugKey = pushKey+GzipSuffix, slugKey+GzipSuffix
+	}
+	if prefix := strings.Trim(k.Prefix, "/"); prefix != "" {
+		tarKey, pushKey, slugKey = prefix+"/"+tarKey, prefix+"/"+pushKey, prefix+"/"+slugKey
+	}
+	return tarKey, pushKey, slugKey
+}
@@ -2,8 +2,10 @@ package storage
 
 import (
 	"io"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -27,3 +29,23 @@ func UploadObject(svc *s3.S3, bucketName, objKey string, reader io.Reader) error
 	_, err := svc.PutObject(params)
 	return err
 }
+
+// S3Objects reports whether objects exist in Bucket of an S3 API compatible store
+type S3Objects struct {
+	Svc    *s3.S3
+	Bucket string
+}
+
+// ObjectExists returns true if there is an object stored under key
+func (s S3Objects) ObjectExists(key string) (bool, error) {
+	_, err := s.Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -1,8 +1,7 @@
 package storage
 
 import (
-	"fmt"
-	"os"
+	"errors"
 
 	"github.com/deis/sa-builder/pkg/gitreceive/git"
 )
@@ -17,26 +16,52 @@ type SlugBuilderInfo struct {
 	slugURL string
 }
 
-// NewSlugBuilderInfo creates and populates a new SlugBuilderInfo based on the given data
-func NewSlugBuilderInfo(appName, slugName string, gitSha *git.SHA) *SlugBuilderInfo {
-	s3Endpoint := "http://" + os.Getenv("DEIS_BUILDER_SERVICE_HOST") + ":3000"
-	tarKey := fmt.Sprintf("home/%s/tar", slugName)
-	// this is where workflow tells slugrunner to download the slug from, so we have to tell slugbuilder to upload it to here
-	pushKey := fmt.Sprintf("home/%s:git-%s/push", appName, gitSha.Short())
-	slugKey := fmt.Sprintf("home/%s:git-%s/slug", appName, gitSha.Short())
+// DefaultPrefix is the path under the object storage endpoint that slugs and tarballs are stored in
+const DefaultPrefix = "git"
+
+var errNoGitSha = errors.New("no git sha given")
+
+// NewSlugBuilderInfo creates and populates a new SlugBuilderInfo based on the given data, storing objects under
+// DefaultPrefix at s3Endpoint. It returns an error if gitSha is not a valid git sha.
+func NewSlugBuilderInfo(s3Endpoint, appName, slugName string, gitSha *git.SHA) (*SlugBuilderInfo, error) {
+	return NewSlugBuilderInfoFromBackend(NewS3Backend(s3Endpoint, DefaultPrefix), appName, slugName, gitSha)
+}
+
+// NewSlugBuilderInfoFromBackend is NewSlugBuilderInfo for objects stored in backend
+func NewSlugBuilderInfoFromBackend(backend Backend, appName, slugName string, gitSha *git.SHA) (*SlugBuilderInfo, error) {
+	return NewSlugBuilderInfoWithKeys(backend, KeyScheme{}, appName, slugName, gitSha)
+}
+
+// NewSlugBuilderInfoWithKeys is NewSlugBuilderInfoFromBackend for objects named by keys
+func NewSlugBuilderInfoWithKeys(backend Backend, keys KeyScheme, appName, slugName string, gitSha *git.SHA) (*SlugBuilderInfo, error) {
+	return NewVersionedSlugBuilderInfo(backend, keys, appName, slugName, "", gitSha)
+}
+
+// NewVersionedSlugBuilderInfo is NewSlugBuilderInfoWithKeys for the build of the controller's release
+// version, which is part of the object keys unless it is empty
+func NewVersionedSlugBuilderInfo(backend Backend, keys KeyScheme, appName, slugName, version string, gitSha *git.SHA) (*SlugBuilderInfo, error) {
+	// a SHA built without NewSha, such as the zero value, has never been validated
+	if gitSha == nil {
+		return nil, errNoGitSha
+	}
+	if err := git.ValidateSha(gitSha.Full()); err != nil {
+		return nil, err
+	}
+	tarKey, pushKey, slugKey := keys.keys(appName, slugName, gitSha.Short(), version)
 
 	return &SlugBuilderInfo{
 		pushKey: pushKey,
-		pushURL: fmt.Sprintf("%s/git/%s", s3Endpoint, pushKey),
+		pushURL: backend.ObjectURL(pushKey),
 		tarKey:  tarKey,
-		tarURL:  fmt.Sprintf("%s/git/%s", s3Endpoint, tarKey),
+		tarURL:  backend.ObjectURL(tarKey),
 		slugKey: slugKey,
-		slugURL: fmt.Sprintf("%s/git/%s", s3Endpoint, slugKey),
-	}
+		slugURL: backend.ObjectURL(slugKey),
+	}, nil
 }
 
 func (s SlugBuilderInfo) PushKey() string { return s.pushKey }
 func (s SlugBuilderInfo) PushURL() string { return s.pushURL }
 func (s SlugBuilderInfo) TarKey() string  { return s.tarKey }
 func (s SlugBuilderInfo) TarURL() string  { return s.tarURL }
+func (s SlugBuilderInfo) SlugKey() string { return s.slugKey }
 func (s SlugBuilderInfo) SlugURL() string { return s.slugURL }
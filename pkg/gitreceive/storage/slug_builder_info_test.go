@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/deis/sa-builder/pkg/gitreceive/git"
@@ -18,7 +19,10 @@ func TestS3Endpoint(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error building git sha (%s)", err)
 	}
-	sbi := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	sbi, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
 
 	expectedPushURL := s3Endpoint + "/git/" + sbi.PushKey()
 	if sbi.PushURL() != expectedPushURL {
@@ -35,7 +39,10 @@ func TestPushKey(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error building git sha (%s)", err)
 	}
-	sbi := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	sbi, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
 	expectedPushKey := "home/" + appName + ":git-" + sha.Short() + "/push"
 	if sbi.PushKey() != expectedPushKey {
 		t.Errorf("push key %s didn't match expected %s", sbi.PushKey(), expectedPushKey)
@@ -47,9 +54,178 @@ func TestTarKey(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error building git sha (%s)", err)
 	}
-	sbi := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	sbi, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
 	expectedTarKey := "home/" + slugName + "/tar"
 	if sbi.TarKey() != expectedTarKey {
 		t.Errorf("tar key %s didn't match expected %s", sbi.TarKey(), expectedTarKey)
 	}
 }
+
+func TestAccessors(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	sbi, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha)
+	if err != nil {
+		t.Fatalf("building slug builder info (%s)", err)
+	}
+	accessors := map[string][2]string{
+		"PushKey": {sbi.PushKey(), "home/myapp:git-c3b4e4ba/push"},
+		"PushURL": {sbi.PushURL(), "http://10.1.2.3:9090/git/home/myapp:git-c3b4e4ba/push"},
+		"TarKey":  {sbi.TarKey(), "home/myslug/tar"},
+		"TarURL":  {sbi.TarURL(), "http://10.1.2.3:9090/git/home/myslug/tar"},
+		"SlugKey": {sbi.SlugKey(), "home/myapp:git-c3b4e4ba/slug"},
+		"SlugURL": {sbi.SlugURL(), "http://10.1.2.3:9090/git/home/myapp:git-c3b4e4ba/slug"},
+	}
+	for name, vals := range accessors {
+		if vals[0] != vals[1] {
+			t.Errorf("%s returned %s, expected %s", name, vals[0], vals[1])
+		}
+	}
+}
+
+func TestCustomEndpointAndPrefix(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	cases := []struct {
+		endpoint string
+		prefix   string
+		base     string
+	}{
+		{"https://minio.storage.svc:9000", "slugs", "https://minio.storage.svc:9000/slugs/"},
+		{"https://minio.storage.svc:9000/", "/builds/slugs/", "https://minio.storage.svc:9000/builds/slugs/"},
+		{"http://10.1.2.3:9090", "", "http://10.1.2.3:9090/"},
+	}
+	for _, c := range cases {
+		sbi, err := NewSlugBuilderInfoFromBackend(NewS3Backend(c.endpoint, c.prefix), appName, slugName, sha)
+		if err != nil {
+			t.Fatalf("building slug builder info (%s)", err)
+		}
+		if expected := c.base + sbi.PushKey(); sbi.PushURL() != expected {
+			t.Errorf("push URL %s didn't match expected %s", sbi.PushURL(), expected)
+		}
+		if expected := c.base + sbi.TarKey(); sbi.TarURL() != expected {
+			t.Errorf("tar URL %s didn't match expected %s", sbi.TarURL(), expected)
+		}
+		if expected := c.base + sbi.SlugKey(); sbi.SlugURL() != expected {
+			t.Errorf("slug URL %s didn't match expected %s", sbi.SlugURL(), expected)
+		}
+	}
+}
+
+func TestInvalidSha(t *testing.T) {
+	// neither a nil nor a zero value SHA has been through git.NewSha
+	for _, sha := range []*git.SHA{nil, &git.SHA{}} {
+		if sbi, err := NewSlugBuilderInfo(s3Endpoint, appName, slugName, sha); err == nil {
+			t.Errorf("expected an unvalidated sha to be rejected, got push key %s", sbi.PushKey())
+		}
+	}
+}
+
+func TestCustomKeys(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	cases := []struct {
+		keys KeyScheme
+		tar  string
+		push string
+		slug string
+	}{
+		{KeyScheme{}, "home/myslug/tar", "home/myapp:git-c3b4e4ba/push", "home/myapp:git-c3b4e4ba/slug"},
+		{KeyScheme{Prefix: "builder-a"}, "builder-a/home/myslug/tar", "builder-a/home/myapp:git-c3b4e4ba/push", "builder-a/home/myapp:git-c3b4e4ba/slug"},
+		{KeyScheme{Template: "builds/{app}/{sha}"}, "builds/myapp/c3b4e4ba/tar", "builds/myapp/c3b4e4ba/push", "builds/myapp/c3b4e4ba/slug"},
+		{KeyScheme{Prefix: "/team-b/", Template: "/{slug}/"}, "team-b/myslug/tar", "team-b/myslug/push", "team-b/myslug/slug"},
+	}
+	for _, c := range cases {
+		if err := c.keys.Validate(); err != nil {
+			t.Errorf("%+v: expected the key scheme to be valid, got %s", c.keys, err)
+		}
+		sbi, err := NewSlugBuilderInfoWithKeys(NewS3Backend(s3Endpoint, DefaultPrefix), c.keys, appName, slugName, sha)
+		if err != nil {
+			t.Fatalf("building slug builder info (%s)", err)
+		}
+		accessors := map[string][2]string{
+			"TarKey":  {sbi.TarKey(), c.tar},
+			"TarURL":  {sbi.TarURL(), s3Endpoint + "/git/" + c.tar},
+			"PushKey": {sbi.PushKey(), c.push},
+			"PushURL": {sbi.PushURL(), s3Endpoint + "/git/" + c.push},
+			"SlugKey": {sbi.SlugKey(), c.slug},
+			"SlugURL": {sbi.SlugURL(), s3Endpoint + "/git/" + c.slug},
+		}
+		for name, vals := range accessors {
+			if vals[0] != vals[1] {
+				t.Errorf("%+v: %s returned %s, expected %s", c.keys, name, vals[0], vals[1])
+			}
+		}
+	}
+
+	if err := (KeyScheme{Template: "builds/{app}"}).Validate(); err == nil {
+		t.Errorf("expected a template that every build of an app shares to be rejected")
+	}
+}
+
+func TestVersionedKeys(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	cases := []struct {
+		keys    KeyScheme
+		version string
+		tar     string
+		slug    string
+	}{
+		{KeyScheme{}, "", "home/myslug/tar", "home/myapp:git-c3b4e4ba/slug"},
+		{KeyScheme{}, "7", "home/myslug/v7/tar", "home/myapp:git-c3b4e4ba/v7/slug"},
+		{KeyScheme{Prefix: "builder-a", Template: "builds/{app}/{sha}"}, "7", "builder-a/builds/myapp/c3b4e4ba/v7/tar", "builder-a/builds/myapp/c3b4e4ba/v7/slug"},
+	}
+	for _, c := range cases {
+		sbi, err := NewVersionedSlugBuilderInfo(NewS3Backend(s3Endpoint, DefaultPrefix), c.keys, appName, slugName, c.version, sha)
+		if err != nil {
+			t.Fatalf("building slug builder info (%s)", err)
+		}
+		if sbi.TarKey() != c.tar || sbi.SlugKey() != c.slug {
+			t.Errorf("%+v version %q: expected keys %s and %s, got %s and %s", c.keys, c.version, c.tar, c.slug, sbi.TarKey(), sbi.SlugKey())
+		}
+	}
+}
+
+func TestGzipKeys(t *testing.T) {
+	sha, err := git.NewSha(rawSha)
+	if err != nil {
+		t.Fatalf("error building git sha (%s)", err)
+	}
+	cases := []struct {
+		keys KeyScheme
+		push string
+		slug string
+	}{
+		{KeyScheme{}, "home/myapp:git-c3b4e4ba/push", "home/myapp:git-c3b4e4ba/slug"},
+		{KeyScheme{Gzip: true}, "home/myapp:git-c3b4e4ba/push.gz", "home/myapp:git-c3b4e4ba/slug.gz"},
+		{KeyScheme{Prefix: "builder-a", Template: "builds/{app}/{sha}", Gzip: true}, "builder-a/builds/myapp/c3b4e4ba/push.gz", "builder-a/builds/myapp/c3b4e4ba/slug.gz"},
+	}
+	for _, c := range cases {
+		sbi, err := NewSlugBuilderInfoWithKeys(NewS3Backend(s3Endpoint, DefaultPrefix), c.keys, appName, slugName, sha)
+		if err != nil {
+			t.Fatalf("building slug builder info (%s)", err)
+		}
+		if sbi.PushKey() != c.push || sbi.SlugKey() != c.slug {
+			t.Errorf("%+v: expected keys %s and %s, got %s and %s", c.keys, c.push, c.slug, sbi.PushKey(), sbi.SlugKey())
+		}
+		if sbi.SlugURL() != s3Endpoint+"/git/"+c.slug {
+			t.Errorf("%+v: expected slug URL %s, got %s", c.keys, s3Endpoint+"/git/"+c.slug, sbi.SlugURL())
+		}
+		// the tarball of the app's source is never gzipped by the slug builder
+		if strings.HasSuffix(sbi.TarKey(), GzipSuffix) {
+			t.Errorf("%+v: expected the tar key not to have the gzip suffix, got %s", c.keys, sbi.TarKey())
+		}
+	}
+}
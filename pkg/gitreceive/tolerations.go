@@ -0,0 +1,85 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// tolerationsAnnotation is the annotation the scheduler reads a pod's tolerations from. Like affinity,
+// tolerations have no field in the Kubernetes 1.1 API this builder uses, so builder pods carry them in the
+// alpha annotation that later schedulers honor.
+const tolerationsAnnotation = "scheduler.alpha.kubernetes.io/tolerations"
+
+const (
+	tolerationOpEqual  = "Equal"
+	tolerationOpExists = "Exists"
+)
+
+// tolerationEffects are the taint effects a toleration may be limited to
+var tolerationEffects = []string{"NoSchedule", "PreferNoSchedule"}
+
+// toleration is an item of the value of tolerationsAnnotation, as in the v1 API's Toleration
+type toleration struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value,omitempty"`
+	Effect   string `json:"effect,omitempty"`
+}
+
+// PodTolerations returns the value of tolerationsAnnotation for builder pods, or "" if no tolerations are
+// configured.
+//
+// BuilderPodTolerations is a comma separated list of tolerations written like the taints of kubectl taint:
+// key=value:effect tolerates the taints of key with that value, and key:effect those of key with any value.
+// Without :effect, a toleration tolerates every effect of its taints.
+func (c Config) PodTolerations() (string, error) {
+	items := splitList(c.BuilderPodTolerations)
+	if len(items) == 0 {
+		return "", nil
+	}
+	tolerations := make([]toleration, 0, len(items))
+	for _, item := range items {
+		tol, err := parseToleration(item)
+		if err != nil {
+			return "", err
+		}
+		tolerations = append(tolerations, tol)
+	}
+	raw, err := json.Marshal(tolerations)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// parseToleration parses a toleration of BuilderPodTolerations
+func parseToleration(item string) (toleration, error) {
+	tol := toleration{Operator: tolerationOpExists}
+	s := item
+	if i := strings.LastIndex(s, ":"); i != -1 {
+		tol.Effect = s[i+1:]
+		s = s[:i]
+		if !isTolerationEffect(tol.Effect) {
+			return toleration{}, fmt.Errorf("builder pod toleration effect %q is invalid, it must be one of %s", tol.Effect, strings.Join(tolerationEffects, ", "))
+		}
+	}
+	if kv := strings.SplitN(s, "=", 2); len(kv) == 2 {
+		s = kv[0]
+		tol.Operator, tol.Value = tolerationOpEqual, kv[1]
+	}
+	if s == "" {
+		return toleration{}, fmt.Errorf("builder pod toleration %q has no key", item)
+	}
+	tol.Key = s
+	return tol, nil
+}
+
+func isTolerationEffect(effect string) bool {
+	for _, e := range tolerationEffects {
+		if effect == e {
+			return true
+		}
+	}
+	return false
+}
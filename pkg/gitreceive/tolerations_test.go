@@ -0,0 +1,45 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPodTolerations(t *testing.T) {
+	raw, err := Config{BuilderPodTolerations: "dedicated=builds:NoSchedule, gpu:PreferNoSchedule,spot=true,flaky"}.PodTolerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tolerations []toleration
+	if err := json.Unmarshal([]byte(raw), &tolerations); err != nil {
+		t.Fatalf("tolerations %q are not JSON (%s)", raw, err)
+	}
+	expected := []toleration{
+		{Key: "dedicated", Operator: "Equal", Value: "builds", Effect: "NoSchedule"},
+		{Key: "gpu", Operator: "Exists", Effect: "PreferNoSchedule"},
+		{Key: "spot", Operator: "Equal", Value: "true"},
+		{Key: "flaky", Operator: "Exists"},
+	}
+	if !reflect.DeepEqual(tolerations, expected) {
+		t.Errorf("expected tolerations %+v, got %+v", expected, tolerations)
+	}
+	if !strings.Contains(raw, `{"key":"gpu","operator":"Exists","effect":"PreferNoSchedule"}`) {
+		t.Errorf("expected a toleration of any value to have none, got %s", raw)
+	}
+
+	for _, empty := range []string{"", " , "} {
+		if raw, err := (Config{BuilderPodTolerations: empty}).PodTolerations(); raw != "" || err != nil {
+			t.Errorf("expected no tolerations for %q, got %q (%v)", empty, raw, err)
+		}
+	}
+}
+
+func TestPodTolerationsInvalid(t *testing.T) {
+	for _, invalid := range []string{"dedicated=builds:NoExecute", "=builds:NoSchedule", ":NoSchedule", "dedicated=builds:"} {
+		if err := (Config{BuilderPodTolerations: invalid}).Validate(); err == nil {
+			t.Errorf("expected toleration %q to be rejected", invalid)
+		}
+	}
+}
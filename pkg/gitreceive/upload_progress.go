@@ -0,0 +1,61 @@
+package gitreceive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deis/sa-builder/fetcher"
+)
+
+// uploadProgressURL returns the fetcher endpoint that reports on the slug upload to pushURL
+func uploadProgressURL(pushURL string) string {
+	return strings.TrimSuffix(pushURL, "/push") + "/progress"
+}
+
+func getUploadProgress(progressURL string) (*fetcher.UploadProgress, error) {
+	res, err := http.Get(progressURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetcher endpoint %s: expected status code 200, got %d", progressURL, res.StatusCode)
+	}
+	p := new(fetcher.UploadProgress)
+	if err := json.NewDecoder(res.Body).Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reportUploadProgress polls progressURL every tick and writes a line to out each time the number of
+// uploaded bytes changes. It returns when the upload is done or stop is closed. Since the hook's
+// stdout is relayed to the client, each line shows up as a remote: line on git push.
+func reportUploadProgress(out io.Writer, progressURL string, tick time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last := int64(-1)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		// the upload won't be registered with the fetcher until the slug builder starts it
+		p, err := getUploadProgress(progressURL)
+		if err != nil {
+			continue
+		}
+		if p.Bytes != last {
+			fmt.Fprintf(out, "Uploading slug: %d/%d bytes\n", p.Bytes, p.Total)
+			last = p.Bytes
+		}
+		if p.Done {
+			return
+		}
+	}
+}
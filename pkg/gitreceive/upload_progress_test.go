@@ -0,0 +1,81 @@
+package gitreceive
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deis/sa-builder/fetcher"
+)
+
+func TestUploadProgressURL(t *testing.T) {
+	if url := uploadProgressURL("http://fetcher:3000/git/home/myapp:git-c3b4e4ba/push"); url != "http://fetcher:3000/git/home/myapp:git-c3b4e4ba/progress" {
+		t.Errorf("unexpected progress URL %s", url)
+	}
+}
+
+func TestReportUploadProgress(t *testing.T) {
+	// the upload isn't registered at first, then makes progress, stays put for a while and finishes
+	var mut sync.Mutex
+	polls := []*fetcher.UploadProgress{
+		nil,
+		{Bytes: 4, Total: 10},
+		{Bytes: 4, Total: 10},
+		{Bytes: 10, Total: 10, Done: true},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		if len(polls) == 0 {
+			t.Errorf("expected no polls after the upload is done")
+			http.NotFound(w, r)
+			return
+		}
+		p := polls[0]
+		polls = polls[1:]
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		reportUploadProgress(&out, srv.URL, time.Millisecond, make(chan struct{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reporting to stop once the upload is done")
+	}
+	// each change is reported once
+	if expected := "Uploading slug: 4/10 bytes\nUploading slug: 10/10 bytes\n"; out.String() != expected {
+		t.Errorf("expected progress %q, got %q", expected, out.String())
+	}
+}
+
+func TestReportUploadProgressStopped(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		reportUploadProgress(&bytes.Buffer{}, srv.URL, time.Millisecond, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reporting to stop when the build ends")
+	}
+}
@@ -0,0 +1,95 @@
+// Package healthsrv serves the liveness and readiness endpoints of the builder for Kubernetes probes.
+//
+// /healthz reports that the process is up. /readyz reports whether the builder can reach the services a
+// push depends on, by running each of its checks.
+package healthsrv
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deis/sa-builder/pkg/controller"
+	"github.com/gorilla/mux"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// Check is a dependency of the builder that must be reachable for it to be ready
+type Check struct {
+	Name  string
+	Check func() error
+}
+
+// NamespaceGetter is the part of the Kubernetes client that KubeCheck uses
+type NamespaceGetter interface {
+	Get(name string) (*api.Namespace, error)
+}
+
+// KubeCheck returns a Check that the Kubernetes API can be reached, by looking up the builder's namespace
+func KubeCheck(namespaces NamespaceGetter, namespace string) Check {
+	return Check{Name: "kubernetes", Check: func() error {
+		_, err := namespaces.Get(namespace)
+		return err
+	}}
+}
+
+// ControllerCheck returns a Check that the controller responds to its health check within timeout
+func ControllerCheck(timeout time.Duration) Check {
+	return Check{Name: "controller", Check: func() error {
+		return controller.Healthy(timeout)
+	}}
+}
+
+// FailedCheck returns a Check that always fails with err, for a dependency whose client couldn't be created
+func FailedCheck(name string, err error) Check {
+	return Check{Name: name, Check: func() error { return err }}
+}
+
+// Handler returns a handler for /healthz and /readyz, which is ready when all of checks pass
+func Handler(checks []Check) http.Handler {
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}).Methods("GET")
+	rtr.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var failures []string
+		for _, c := range checks {
+			if err := c.Check(); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", c.Name, err))
+			}
+		}
+		if len(failures) > 0 {
+			http.Error(w, strings.Join(failures, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}).Methods("GET")
+	return rtr
+}
+
+// Server is a running health server
+type Server struct {
+	listener net.Listener
+}
+
+// Start listens on port and serves Handler(checks) in the background until Close is called
+func Start(port int, checks []Check) (*Server, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, Handler(checks))
+	return &Server{listener: l}, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server from accepting new connections
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
@@ -0,0 +1,85 @@
+package healthsrv
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// fakeNamespaces is a NamespaceGetter that fails with err if it's set
+type fakeNamespaces struct {
+	err error
+}
+
+func (f fakeNamespaces) Get(name string) (*api.Namespace, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &api.Namespace{ObjectMeta: api.ObjectMeta{Name: name}}, nil
+}
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatalf("creating request (%s)", err)
+	}
+	h.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func TestHealthz(t *testing.T) {
+	h := Handler([]Check{KubeCheck(fakeNamespaces{err: errors.New("connection refused")}, "deis")})
+	if code, _ := get(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz to be OK even when not ready, got %d", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := Handler([]Check{KubeCheck(fakeNamespaces{}, "deis"), {Name: "controller", Check: func() error { return nil }}})
+	if code, body := get(t, h, "/readyz"); code != http.StatusOK {
+		t.Errorf("expected ready, got %d: %s", code, body)
+	}
+
+	h = Handler([]Check{
+		KubeCheck(fakeNamespaces{err: errors.New("connection refused")}, "deis"),
+		{Name: "controller", Check: func() error { return nil }},
+	})
+	code, body := get(t, h, "/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready when the kube API is unreachable, got %d", code)
+	}
+	if !strings.Contains(body, "kubernetes: connection refused") || strings.Contains(body, "controller") {
+		t.Errorf("expected only the kubernetes check to be reported, got %q", body)
+	}
+}
+
+func TestStartAndClose(t *testing.T) {
+	srv, err := Start(0, []Check{FailedCheck("kubernetes", errors.New("not in a cluster"))})
+	if err != nil {
+		t.Fatalf("starting health server (%s)", err)
+	}
+	url := "http://" + srv.Addr().String()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := client.Get(url + "/readyz")
+	if err != nil {
+		t.Fatalf("getting /readyz (%s)", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "not in a cluster") {
+		t.Errorf("expected the failed check to be reported, got %d: %s", res.StatusCode, body)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("closing health server (%s)", err)
+	}
+	if _, err := client.Get(url + "/healthz"); err == nil {
+		t.Errorf("expected the health server to stop accepting connections after Close")
+	}
+}
@@ -0,0 +1,151 @@
+// Package jsonlog turns the builder's text log lines into JSON objects, one per line, for log aggregation.
+// It's enabled by setting LOG_FORMAT=json; otherwise logs stay in the human-readable text format.
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatEnvVar = "LOG_FORMAT"
+	// FormatJSON is the LOG_FORMAT value that enables JSON logs
+	FormatJSON = "json"
+
+	// fieldSep separates a message from the fields that Tag attaches to it
+	fieldSep = "\t"
+)
+
+var (
+	labelRegex = regexp.MustCompile(`^\[([a-z]+)\] `)
+	fieldRegex = regexp.MustCompile(`^([a-z_]+)=("(?:[^"\\]|\\.)*") ?`)
+)
+
+// Fields are the structured fields of a log line, such as repo, user, fingerprint and sha
+type Fields map[string]string
+
+// Enabled reports whether LOG_FORMAT selects JSON logs
+func Enabled() bool {
+	return os.Getenv(formatEnvVar) == FormatJSON
+}
+
+// Tag attaches fields to msg. When JSON logs are enabled, a Writer turns them into keys of the logged
+// object. Otherwise msg is returned unchanged, so the text format is unaffected.
+func Tag(msg string, fields Fields) string {
+	if !Enabled() || len(fields) == 0 {
+		return msg
+	}
+	pairs := make([]string, 0, len(fields))
+	for k, v := range fields {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	return strings.TrimRight(msg, "\n") + fieldSep + strings.Join(pairs, " ")
+}
+
+// Writer writes each line written to it to out as a JSON object with time, level and msg keys, plus its
+// own fields and any attached to the line with Tag. Lines starting with a cookoo log label such as
+// "[warning] " are logged at that level, and all others at the Writer's default level.
+type Writer struct {
+	mut    sync.Mutex
+	out    io.Writer
+	level  string
+	fields Fields
+	buf    []byte
+}
+
+// NewWriter returns a Writer that logs to out at level by default, with fields on every line
+func NewWriter(out io.Writer, level string, fields Fields) *Writer {
+	w := &Writer{out: out, level: level, fields: Fields{}}
+	for k, v := range fields {
+		w.fields[k] = v
+	}
+	return w
+}
+
+// SetField adds a field to every line written from now on. An empty value removes the field.
+func (w *Writer) SetField(key, value string) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	if value == "" {
+		delete(w.fields, key)
+		return
+	}
+	w.fields[key] = value
+}
+
+// Write logs every complete line in p. A trailing partial line is held until the rest of it is written.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (w *Writer) writeLine(line string) error {
+	entry := map[string]string{}
+	for k, v := range w.fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	entry["level"] = w.level
+	if m := labelRegex.FindStringSubmatch(line); m != nil {
+		entry["level"] = m[1]
+		line = line[len(m[0]):]
+	}
+	msg, fields := splitFields(line)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["msg"] = msg
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(append(b, '\n'))
+	return err
+}
+
+// splitFields separates the fields attached by Tag from the message in line. If the part after the last
+// field separator doesn't parse as fields, the whole line is the message.
+func splitFields(line string) (string, Fields) {
+	i := strings.LastIndex(line, fieldSep)
+	if i < 0 {
+		return line, nil
+	}
+	fields := Fields{}
+	rest := line[i+len(fieldSep):]
+	for rest != "" {
+		m := fieldRegex.FindStringSubmatch(rest)
+		if m == nil {
+			return line, nil
+		}
+		v, err := strconv.Unquote(m[2])
+		if err != nil {
+			return line, nil
+		}
+		fields[m[1]] = v
+		rest = rest[len(m[0]):]
+	}
+	return line[:i], fields
+}
@@ -0,0 +1,91 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	clog "github.com/Masterminds/cookoo/log"
+)
+
+func decodeLines(t *testing.T, out string) []map[string]string {
+	var entries []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		entry := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q is not valid JSON (%s)", line, err)
+		}
+		for _, key := range []string{"time", "level", "msg"} {
+			if _, ok := entry[key]; !ok {
+				t.Errorf("line %q has no %s key", line, key)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWriter(t *testing.T) {
+	os.Setenv(formatEnvVar, FormatJSON)
+	defer os.Unsetenv(formatEnvVar)
+
+	var out bytes.Buffer
+	w := NewWriter(&out, "info", Fields{"repo": "myapp", "user": "alice", "fingerprint": "SHA256:abc"})
+	w.Write([]byte("Starting build... but first, coffee!\n[warning] Rejected git "))
+	w.Write([]byte("operation\n\n"))
+	w.SetField("sha", "c3b4e4ba")
+	w.Write([]byte(Tag("Deploy complete.\n", Fields{"repo": "other", "operation": "git-receive-pack"}) + "\n"))
+
+	entries := decodeLines(t, out.String())
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 lines, got %d:\n%s", len(entries), out.String())
+	}
+	expected := []map[string]string{
+		{"level": "info", "msg": "Starting build... but first, coffee!", "repo": "myapp", "user": "alice", "fingerprint": "SHA256:abc"},
+		{"level": "warning", "msg": "Rejected git operation", "repo": "myapp"},
+		{"level": "info", "msg": "Deploy complete.", "repo": "other", "operation": "git-receive-pack", "sha": "c3b4e4ba", "user": "alice"},
+	}
+	for i, exp := range expected {
+		for k, v := range exp {
+			if entries[i][k] != v {
+				t.Errorf("line %d: expected %s %q, got %q", i, k, v, entries[i][k])
+			}
+		}
+	}
+}
+
+func TestCookooContext(t *testing.T) {
+	os.Setenv(formatEnvVar, FormatJSON)
+	defer os.Unsetenv(formatEnvVar)
+	defer log.SetOutput(os.Stderr)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer log.SetFlags(flags)
+
+	var out bytes.Buffer
+	c := cookoo.NewContext()
+	c.AddLogger("stdout", NewWriter(&out, "info", nil))
+	clog.Errf(c, "%s", Tag("Failed to run git pre-receive hook", Fields{"repo": "myapp"}))
+
+	entries := decodeLines(t, out.String())
+	if len(entries) != 1 || entries[0]["level"] != "error" || entries[0]["repo"] != "myapp" || entries[0]["msg"] != "Failed to run git pre-receive hook" {
+		t.Errorf("unexpected log lines %v", entries)
+	}
+}
+
+func TestTagText(t *testing.T) {
+	os.Unsetenv(formatEnvVar)
+	if msg := Tag("Deploy complete.\n", Fields{"repo": "myapp"}); msg != "Deploy complete.\n" {
+		t.Errorf("expected text logs to be unchanged, got %q", msg)
+	}
+}
+
+func TestUntaggedTab(t *testing.T) {
+	if msg, fields := splitFields("columns\tare not fields"); msg != "columns\tare not fields" || fields != nil {
+		t.Errorf("expected a tab without fields to be kept in the message, got %q %v", msg, fields)
+	}
+}
@@ -0,0 +1,190 @@
+// Package metrics serves Prometheus metrics for the builds run by the builder.
+//
+// Builds run in git-receive hook processes that exit once the push is done, so they report their outcome
+// to the metrics server in the long running SSH server process with Report. The server keeps the
+// counts and serves them in the Prometheus text format on /metrics.
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ResultSuccess and ResultFailure are the results a build is counted under
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+
+	contentType = "text/plain; version=0.0.4"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the build duration histogram buckets
+var DurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800}
+
+// Build is the outcome of a single build, as reported by a git-receive hook
+type Build struct {
+	App             string  `json:"app"`
+	Result          string  `json:"result"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+type histogram struct {
+	counts []uint64 // per bucket in DurationBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Registry holds the build counters and duration histograms
+type Registry struct {
+	mut       sync.Mutex
+	builds    map[[2]string]uint64 // keyed by app and result
+	durations map[string]*histogram
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{builds: map[[2]string]uint64{}, durations: map[string]*histogram{}}
+}
+
+// Record counts b and adds its duration to the app's histogram
+func (r *Registry) Record(b Build) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.builds[[2]string{b.App, b.Result}]++
+	h, ok := r.durations[b.App]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(DurationBuckets))}
+		r.durations[b.App] = h
+	}
+	for i, bound := range DurationBuckets {
+		if b.DurationSeconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += b.DurationSeconds
+}
+
+// Count returns how many builds of app were recorded with result
+func (r *Registry) Count(app, result string) uint64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.builds[[2]string{app, result}]
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString("# HELP deis_builder_builds_total Builds run by the builder, by app and result.\n")
+	buf.WriteString("# TYPE deis_builder_builds_total counter\n")
+	apps := make([]string, 0, len(r.durations))
+	for app := range r.durations {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		for _, result := range []string{ResultFailure, ResultSuccess} {
+			if n, ok := r.builds[[2]string{app, result}]; ok {
+				fmt.Fprintf(&buf, "deis_builder_builds_total{app=%q,result=%q} %d\n", app, result, n)
+			}
+		}
+	}
+
+	buf.WriteString("# HELP deis_builder_build_duration_seconds How long builds took, by app.\n")
+	buf.WriteString("# TYPE deis_builder_build_duration_seconds histogram\n")
+	for _, app := range apps {
+		h := r.durations[app]
+		var cumulative uint64
+		for i, bound := range DurationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&buf, "deis_builder_build_duration_seconds_bucket{app=%q,le=\"%g\"} %d\n", app, bound, cumulative)
+		}
+		fmt.Fprintf(&buf, "deis_builder_build_duration_seconds_bucket{app=%q,le=\"+Inf\"} %d\n", app, h.count)
+		fmt.Fprintf(&buf, "deis_builder_build_duration_seconds_sum{app=%q} %g\n", app, h.sum)
+		fmt.Fprintf(&buf, "deis_builder_build_duration_seconds_count{app=%q} %d\n", app, h.count)
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler returns the routes of the metrics server: GET /metrics for Prometheus, and POST /builds for
+// git-receive hooks to report builds on. Builds are only accepted from loopback addresses, since the hooks
+// run in the same pod.
+func (r *Registry) Handler() http.Handler {
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		r.WriteTo(w)
+	}).Methods("GET")
+	rtr.HandleFunc("/builds", func(w http.ResponseWriter, req *http.Request) {
+		if !fromLoopback(req) {
+			http.Error(w, "builds can only be reported from the builder", http.StatusForbidden)
+			return
+		}
+		var b Build
+		if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+			http.Error(w, fmt.Sprintf("malformed build (%s)", err), http.StatusBadRequest)
+			return
+		}
+		if b.App == "" || (b.Result != ResultSuccess && b.Result != ResultFailure) {
+			http.Error(w, "a build needs an app and a result of success or failure", http.StatusBadRequest)
+			return
+		}
+		r.Record(b)
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+	return rtr
+}
+
+func fromLoopback(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve starts the metrics server on port and blocks until it stops. Since it blocks, it's a best practice
+// to execute this func in a goroutine.
+func Serve(port int, r *Registry) error {
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), r.Handler())
+}
+
+// Report sends the outcome of a build of app to the metrics server on the local port. A port of 0 or less
+// disables reporting.
+func Report(port int, app string, buildErr error, duration, timeout time.Duration) error {
+	if port <= 0 {
+		return nil
+	}
+	b := Build{App: app, Result: ResultSuccess, DurationSeconds: duration.Seconds()}
+	if buildErr != nil {
+		b.Result = ResultFailure
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Post(fmt.Sprintf("http://127.0.0.1:%d/builds", port), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("metrics server returned status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.Record(Build{App: "myapp", Result: ResultSuccess, DurationSeconds: 25})
+	r.Record(Build{App: "myapp", Result: ResultSuccess, DurationSeconds: 90})
+	r.Record(Build{App: "myapp", Result: ResultFailure, DurationSeconds: 4000})
+
+	var out bytes.Buffer
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatalf("writing metrics (%s)", err)
+	}
+	for _, line := range []string{
+		`deis_builder_builds_total{app="myapp",result="failure"} 1`,
+		`deis_builder_builds_total{app="myapp",result="success"} 2`,
+		`deis_builder_build_duration_seconds_bucket{app="myapp",le="10"} 0`,
+		`deis_builder_build_duration_seconds_bucket{app="myapp",le="30"} 1`,
+		`deis_builder_build_duration_seconds_bucket{app="myapp",le="120"} 2`,
+		`deis_builder_build_duration_seconds_bucket{app="myapp",le="1800"} 2`,
+		`deis_builder_build_duration_seconds_bucket{app="myapp",le="+Inf"} 3`,
+		`deis_builder_build_duration_seconds_sum{app="myapp"} 4115`,
+		`deis_builder_build_duration_seconds_count{app="myapp"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected metrics to contain %s, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := NewRegistry()
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	_, portStr, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("parsing test server URL (%s)", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("parsing test server port (%s)", err)
+	}
+
+	if err := Report(port, "myapp", nil, time.Minute, time.Second); err != nil {
+		t.Fatalf("reporting a successful build (%s)", err)
+	}
+	if err := Report(port, "myapp", errors.New("Stopping build."), time.Minute, time.Second); err != nil {
+		t.Fatalf("reporting a failed build (%s)", err)
+	}
+	if n := r.Count("myapp", ResultSuccess); n != 1 {
+		t.Errorf("expected 1 successful build, got %d", n)
+	}
+	if n := r.Count("myapp", ResultFailure); n != 1 {
+		t.Errorf("expected 1 failed build, got %d", n)
+	}
+
+	res, err := http.Post(srv.URL+"/builds", "application/json", strings.NewReader(`{"app":"myapp","result":"maybe"}`))
+	if err != nil {
+		t.Fatalf("posting a build (%s)", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown result to be rejected, got status code %d", res.StatusCode)
+	}
+
+	if err := Report(0, "myapp", nil, time.Minute, time.Second); err != nil {
+		t.Errorf("expected reporting to be disabled on port 0, got %s", err)
+	}
+}
+
+func TestFromLoopback(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:5000":   true,
+		"[::1]:5000":       true,
+		"10.1.2.3:5000":    false,
+		"not an address":   false,
+		"192.168.0.1:5000": false,
+	} {
+		req := &http.Request{RemoteAddr: addr}
+		if fromLoopback(req) != expected {
+			t.Errorf("expected fromLoopback(%s) to be %t", addr, expected)
+		}
+	}
+}
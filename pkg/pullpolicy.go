@@ -0,0 +1,19 @@
+package pkg
+
+import (
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+// CheckImagePullPolicy returns an error if policy, the IMAGE_PULL_POLICY of builder containers, is not a pull
+// policy. The SSH server checks it on boot, so that a bad value stops the server rather than fail every build.
+// An empty policy leaves the choice to the builder, by image tag.
+func CheckImagePullPolicy(policy string) error {
+	switch api.PullPolicy(policy) {
+	case "", api.PullAlways, api.PullIfNotPresent, api.PullNever:
+		return nil
+	default:
+		return fmt.Errorf("IMAGE_PULL_POLICY %q is invalid, it must be one of %s, %s or %s", policy, api.PullIfNotPresent, api.PullAlways, api.PullNever)
+	}
+}
@@ -0,0 +1,18 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckImagePullPolicy(t *testing.T) {
+	for _, valid := range []string{"", "IfNotPresent", "Always", "Never"} {
+		if err := CheckImagePullPolicy(valid); err != nil {
+			t.Errorf("expected IMAGE_PULL_POLICY %q to be valid, got %s", valid, err)
+		}
+	}
+	err := CheckImagePullPolicy("always")
+	if err == nil || !strings.Contains(err.Error(), `IMAGE_PULL_POLICY "always" is invalid`) {
+		t.Errorf("expected a pull policy in the wrong case to be rejected, got %v", err)
+	}
+}
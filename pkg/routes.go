@@ -24,10 +24,19 @@ func routes(reg *cookoo.Registry) {
 			cookoo.Cmd{
 				Name: "installSshHostKeys",
 				Fn:   sshd.GenSSHKeys,
+				Using: []cookoo.Param{
+					{Name: "dir", From: "cxt:" + sshd.HostKeyDir},
+					{Name: "keytypes", From: "cxt:" + sshd.HostKeyTypes},
+				},
 			},
 			cookoo.Cmd{
 				Name: sshd.HostKeys,
 				Fn:   sshd.ParseHostKeys,
+				Using: []cookoo.Param{
+					{Name: "keytypes", From: "cxt:" + sshd.HostKeyTypes},
+					{Name: "dir", From: "cxt:" + sshd.HostKeyDir},
+					{Name: "paths", From: "cxt:" + sshd.HostKeyPaths},
+				},
 			},
 			cookoo.Cmd{
 				Name: sshd.ServerConfig,
@@ -82,6 +91,12 @@ func routes(reg *cookoo.Registry) {
 					{Name: "metadata", From: "cxt:metadata"},
 					{Name: "key", From: "cxt:key"},
 					{Name: "repoName", From: "cxt:repository"},
+					{Name: "authorizedKeys", From: "cxt:" + sshd.AuthorizedKeys},
+					{Name: "adminKeys", From: "cxt:" + sshd.AdminKeys},
+					{Name: "userCache", From: "cxt:" + sshd.UserCache},
+					{Name: "controllerTimeout", From: "cxt:" + sshd.ControllerTimeout},
+					{Name: "fingerprintAlgorithm", From: "cxt:" + sshd.FingerprintAlgorithm},
+					{Name: "keyPolicy", From: "cxt:" + sshd.AuthKeyPolicy},
 				},
 			},
 		},
@@ -100,9 +115,26 @@ func routes(reg *cookoo.Registry) {
 				Using: []cookoo.Param{
 					{Name: "request", From: "cxt:request"},
 					{Name: "channel", From: "cxt:channel"},
+					{Name: "channelClosed", From: "cxt:channelClosed"},
 					{Name: "operation", From: "cxt:operation"},
 					{Name: "repoName", From: "cxt:repository"},
 					{Name: "permissions", From: "cxt:authN"},
+					{Name: "allowUploadPack", From: "cxt:" + git.AllowUploadPack},
+					{Name: "onCorruptPack", From: "cxt:" + git.OnCorruptPack},
+					{Name: "protectedRepos", From: "cxt:" + git.ProtectedRepos},
+					{Name: "allowedApps", From: "cxt:" + git.AllowedApps},
+					{Name: "diskQuota", From: "cxt:" + git.DiskQuota},
+					{Name: "notifyURL", From: "cxt:" + git.NotifyURL},
+					{Name: "podNamespace", From: "cxt:" + git.PodNamespace},
+					{Name: "preReceiveHookTpl", From: "cxt:" + git.PreReceiveHookTemplate},
+					{Name: "gitBinaries", From: "cxt:" + git.GitBinaries},
+					{Name: "buildSlots", From: "cxt:" + git.BuildSlots},
+					{Name: "gitTrace", From: "cxt:" + git.GitTrace},
+					{Name: "keepHistory", From: "cxt:" + git.KeepHistory},
+					{Name: "repoModes", From: "cxt:" + git.RepoModes},
+					{Name: "keepAliveInterval", From: "cxt:" + sshd.KeepAliveInterval},
+					{Name: "key", From: "cxt:" + sshd.AuthenticatedKey},
+					{Name: "fingerprintAlgorithm", From: "cxt:" + sshd.FingerprintAlgorithm},
 				},
 			},
 		},
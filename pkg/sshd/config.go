@@ -1,8 +1,193 @@
 package sshd
 
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Config represents the required SSH server configuration
 type Config struct {
-	FetcherPort int    `envconfig:"FETCHER_PORT" default:"3000" required:"true"`
-	SSHHostIP   string `envconfig:"SSH_HOST_IP" default:"0.0.0.0" required:"true"`
-	SSHHostPort int    `envconfig:"SSH_HOST_PORT" default:"2223" required:"true"`
+	FetcherPort               int    `envconfig:"FETCHER_PORT" default:"3000" required:"true"`
+	SSHHostIP                 string `envconfig:"SSH_HOST_IP" default:"0.0.0.0" required:"true"`
+	SSHHostPort               int    `envconfig:"SSH_HOST_PORT" default:"2223" required:"true"`
+	SlugUploadStallTimeoutSec int    `envconfig:"SLUG_UPLOAD_STALL_TIMEOUT" default:"60"`
+	GitUploadPackEnabled      bool   `envconfig:"GIT_UPLOAD_PACK_ENABLED" default:"false"`
+	OnCorruptPack             string `envconfig:"ON_CORRUPT_PACK" default:"reset"`
+	ProtectedRepos            string `envconfig:"PROTECTED_REPOS" default:""` // e.g. deis-*,router
+	AllowedApps               string `envconfig:"ALLOWED_APPS" default:""`    // e.g. myapp,otherapp, defaults to any app
+	AuthorizedKeysFile        string `envconfig:"AUTHORIZED_KEYS_FILE" default:"/etc/deistest.pub"`
+	ControllerAuthEnabled     bool   `envconfig:"CONTROLLER_AUTH_ENABLED" default:"false"`
+	ControllerAuthTimeoutMSec int    `envconfig:"CONTROLLER_AUTH_TIMEOUT" default:"5000"`
+	ControllerAuthCacheTTLSec int    `envconfig:"CONTROLLER_AUTH_CACHE_TTL" default:"300"`
+	FingerprintAlgorithm      string `envconfig:"FINGERPRINT_ALGORITHM" default:"sha256"` // or md5 for older controllers
+	AdminKeysFile             string `envconfig:"ADMIN_KEYS_FILE" default:""`
+	MetricsPort               int    `envconfig:"METRICS_PORT" default:"0"`          // 0 disables the metrics server
+	HealthServerPort          int    `envconfig:"HEALTH_SERVER_PORT" default:"8092"` // 0 disables the health server
+	PodNamespace              string `envconfig:"POD_NAMESPACE" default:""`          // from the downward API, see Namespace
+	ShutdownGracePeriodSec    int    `envconfig:"SHUTDOWN_GRACE_PERIOD" default:"300"`
+	HostKeyTypes              string `envconfig:"SSH_HOST_KEY_TYPES" default:"rsa,ecdsa"`
+	HostKeyPaths              string `envconfig:"SSH_HOST_KEY_PATHS" default:""`
+	HostKeyDir                string `envconfig:"SSH_HOST_KEY_DIR" default:""`
+	MaxConnectionsPerIP       int    `envconfig:"MAX_CONNECTIONS_PER_IP" default:"60"`  // per minute, 0 for no limit
+	MaxConnections            int    `envconfig:"MAX_CONNECTIONS" default:"200"`        // open at once, 0 for no limit
+	HandshakeTimeoutSec       int    `envconfig:"SSH_HANDSHAKE_TIMEOUT" default:"30"`   // 0 for no limit
+	IdleTimeoutSec            int    `envconfig:"SSH_IDLE_TIMEOUT" default:"900"`       // 0 for no limit
+	KeepAliveIntervalSec      int    `envconfig:"SSH_KEEPALIVE_INTERVAL" default:"30"`  // 0 disables keepalives
+	RepoDiskQuotaMB           int    `envconfig:"REPO_DISK_QUOTA_MB" default:"0"`       // 0 for no quota
+	TotalDiskQuotaMB          int    `envconfig:"TOTAL_DISK_QUOTA_MB" default:"0"`      // 0 for no quota
+	MaxPushSizeMB             int    `envconfig:"MAX_PUSH_SIZE_MB" default:"0"`         // 0 for no limit
+	NotifyURL                 string `envconfig:"NOTIFY_URL" default:""`                // POSTed to after every deploy
+	PreReceiveHookTemplate    string `envconfig:"PRE_RECEIVE_HOOK_TEMPLATE" default:""` // path, defaults to the built-in hook
+	GitBin                    string `envconfig:"GIT_BIN" default:"git"`
+	GitReceivePackBin         string `envconfig:"GIT_RECEIVE_PACK_BIN" default:"git-receive-pack"`
+	GitUploadPackBin          string `envconfig:"GIT_UPLOAD_PACK_BIN" default:"git-upload-pack"`
+	GitTraceEnabled           bool   `envconfig:"GIT_TRACE_ENABLED" default:"false"`
+	KeepHistory               bool   `envconfig:"KEEP_HISTORY" default:"true"`
+	GitRepoMode               string `envconfig:"GIT_REPO_MODE" default:"0755"`          // octal permissions of new repos
+	GitHookMode               string `envconfig:"GIT_HOOK_MODE" default:"0755"`          // octal permissions of hooks, must be executable
+	MaxConcurrentBuilds       int    `envconfig:"MAX_CONCURRENT_BUILDS" default:"0"`     // 0 for no limit
+	BuildSlotTimeoutSec       int    `envconfig:"BUILD_SLOT_TIMEOUT" default:"600"`      // how long pushes queue for, 0 for no limit
+	RepoCleanupIntervalSec    int    `envconfig:"REPO_CLEANUP_INTERVAL" default:"0"`     // how often repos of deleted apps are removed, 0 to never
+	AllowedKeyAlgorithms      string `envconfig:"SSH_ALLOWED_KEY_ALGORITHMS" default:""` // e.g. ssh-ed25519,ssh-rsa, empty allows any
+	MinRSAKeyBits             int    `envconfig:"SSH_MIN_RSA_KEY_BITS" default:"0"`      // 0 allows any size
+	ImagePullPolicy           string `envconfig:"IMAGE_PULL_POLICY" default:""`          // of builder pods, which the hook creates
+}
+
+// ListenAddress returns the host:port the SSH server listens on, or an error if SSHHostIP is not an IP address
+// or SSHHostPort is not a valid port
+func (c Config) ListenAddress() (string, error) {
+	if c.SSHHostPort < 1 || c.SSHHostPort > 65535 {
+		return "", fmt.Errorf("SSH_HOST_PORT %d is invalid, it must be between 1 and 65535", c.SSHHostPort)
+	}
+	if net.ParseIP(c.SSHHostIP) == nil {
+		return "", fmt.Errorf("SSH_HOST_IP %q is not an IP address", c.SSHHostIP)
+	}
+	return net.JoinHostPort(c.SSHHostIP, strconv.Itoa(c.SSHHostPort)), nil
+}
+
+// serviceAccountNamespaceFile holds the namespace of the pod, if its service account is mounted
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace that the builder runs and builds in: PodNamespace, which is set from the
+// downward API, or else the namespace of the pod's service account. It returns an error if neither is known.
+func (c Config) Namespace() (string, error) {
+	return resolveNamespace(c.PodNamespace, serviceAccountNamespaceFile)
+}
+
+func resolveNamespace(podNamespace, namespaceFile string) (string, error) {
+	if podNamespace != "" {
+		return podNamespace, nil
+	}
+	data, err := ioutil.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("POD_NAMESPACE is not set and the service account namespace can't be read (%s)", err)
+	}
+	if ns := strings.TrimSpace(string(data)); ns != "" {
+		return ns, nil
+	}
+	return "", fmt.Errorf("POD_NAMESPACE is not set and the service account namespace in %s is empty", namespaceFile)
+}
+
+// SlugUploadStallTimeout returns the maximum time a slug upload to the fetcher may go without
+// making progress before it is aborted
+func (c Config) SlugUploadStallTimeout() time.Duration {
+	return time.Duration(c.SlugUploadStallTimeoutSec) * time.Second
+}
+
+// ShutdownGracePeriod returns how long to wait for git pushes in progress to finish when shutting down
+func (c Config) ShutdownGracePeriod() time.Duration {
+	return time.Duration(c.ShutdownGracePeriodSec) * time.Second
+}
+
+// HostKeyTypeNames returns the types of host keys to load, from the comma separated HostKeyTypes. DSA keys
+// are only loaded if dsa is one of them.
+func (c Config) HostKeyTypeNames() []string {
+	return splitList(c.HostKeyTypes)
+}
+
+// KeyPolicy returns the key algorithms and sizes that clients may authenticate with
+func (c Config) KeyPolicy() KeyPolicy {
+	return KeyPolicy{Algorithms: splitList(c.AllowedKeyAlgorithms), MinRSABits: c.MinRSAKeyBits}
+}
+
+// HostKeyPathList returns the host key files to load from the comma separated HostKeyPaths, or nil to load
+// the keys of HostKeyTypeNames from /etc/ssh
+func (c Config) HostKeyPathList() []string {
+	return splitList(c.HostKeyPaths)
+}
+
+// HandshakeTimeout returns how long a client may take to complete the SSH handshake
+func (c Config) HandshakeTimeout() time.Duration {
+	return time.Duration(c.HandshakeTimeoutSec) * time.Second
+}
+
+// IdleTimeout returns how long an SSH connection may go without traffic before it is closed
+func (c Config) IdleTimeout() time.Duration {
+	return time.Duration(c.IdleTimeoutSec) * time.Second
+}
+
+// KeepAliveInterval returns how often TCP and SSH keepalives are sent on connections that are waiting for a
+// build
+func (c Config) KeepAliveInterval() time.Duration {
+	return time.Duration(c.KeepAliveIntervalSec) * time.Second
+}
+
+// RepoCleanupInterval returns how often the repos of apps that were deleted in the controller are removed
+func (c Config) RepoCleanupInterval() time.Duration {
+	return time.Duration(c.RepoCleanupIntervalSec) * time.Second
+}
+
+// BuildSlotTimeout returns how long a push waits for a build slot when MaxConcurrentBuilds are running
+func (c Config) BuildSlotTimeout() time.Duration {
+	return time.Duration(c.BuildSlotTimeoutSec) * time.Second
+}
+
+// RepoDiskQuota returns the maximum size of a single repo, in bytes
+func (c Config) RepoDiskQuota() int64 {
+	return int64(c.RepoDiskQuotaMB) << 20
+}
+
+// TotalDiskQuota returns the maximum size of all repos together, in bytes
+func (c Config) TotalDiskQuota() int64 {
+	return int64(c.TotalDiskQuotaMB) << 20
+}
+
+// MaxPushSize returns the maximum amount of data a single push may send, in bytes
+func (c Config) MaxPushSize() int64 {
+	return int64(c.MaxPushSizeMB) << 20
+}
+
+// ControllerAuthTimeout returns the maximum time to wait for the controller to resolve an SSH key to a user
+func (c Config) ControllerAuthTimeout() time.Duration {
+	return time.Duration(c.ControllerAuthTimeoutMSec) * time.Millisecond
+}
+
+// ControllerAuthCacheTTL returns how long users resolved by the controller are cached
+func (c Config) ControllerAuthCacheTTL() time.Duration {
+	return time.Duration(c.ControllerAuthCacheTTLSec) * time.Second
+}
+
+// AllowedAppNames returns the apps that may be pushed to, or nil if any app may be
+func (c Config) AllowedAppNames() []string {
+	return splitList(c.AllowedApps)
+}
+
+// ProtectedRepoPatterns returns the repo name patterns that only admin keys may create or push to
+func (c Config) ProtectedRepoPatterns() []string {
+	return splitList(c.ProtectedRepos)
+}
+
+// splitList returns the non-empty, trimmed items of the comma separated list s, or nil if it has none
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,84 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListenAddress(t *testing.T) {
+	cases := []struct {
+		ip       string
+		port     int
+		expected string
+	}{
+		{"0.0.0.0", 2223, "0.0.0.0:2223"},
+		{"10.1.2.3", 22, "10.1.2.3:22"},
+		{"::", 2223, "[::]:2223"},
+		{"fe80::1", 65535, "[fe80::1]:65535"},
+	}
+	for _, c := range cases {
+		addr, err := Config{SSHHostIP: c.ip, SSHHostPort: c.port}.ListenAddress()
+		if err != nil {
+			t.Errorf("%s port %d: unexpected error (%s)", c.ip, c.port, err)
+		} else if addr != c.expected {
+			t.Errorf("%s port %d: expected %s, got %s", c.ip, c.port, c.expected, addr)
+		}
+	}
+
+	invalid := []struct {
+		ip   string
+		port int
+		msg  string
+	}{
+		{"0.0.0.0", 0, "SSH_HOST_PORT 0 is invalid"},
+		{"0.0.0.0", -1, "SSH_HOST_PORT -1 is invalid"},
+		{"0.0.0.0", 65536, "SSH_HOST_PORT 65536 is invalid"},
+		{"", 2223, `SSH_HOST_IP "" is not an IP address`},
+		{"builder.local", 2223, `SSH_HOST_IP "builder.local" is not an IP address`},
+	}
+	for _, c := range invalid {
+		if _, err := (Config{SSHHostIP: c.ip, SSHHostPort: c.port}).ListenAddress(); err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%s port %d: expected error %q, got %v", c.ip, c.port, c.msg, err)
+		}
+	}
+}
+
+func TestResolveNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	nsFile := filepath.Join(dir, "namespace")
+	if err := ioutil.WriteFile(nsFile, []byte("deis\n"), 0644); err != nil {
+		t.Fatalf("writing namespace file (%s)", err)
+	}
+
+	if ns, err := resolveNamespace("builds", nsFile); err != nil || ns != "builds" {
+		t.Errorf("expected POD_NAMESPACE to win, got %q (%v)", ns, err)
+	}
+	if ns, err := resolveNamespace("", nsFile); err != nil || ns != "deis" {
+		t.Errorf("expected the service account namespace, got %q (%v)", ns, err)
+	}
+	if _, err := resolveNamespace("", filepath.Join(dir, "missing")); err == nil || !strings.Contains(err.Error(), "POD_NAMESPACE") {
+		t.Errorf("expected a missing namespace to be reported, got %v", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	cases := map[string][]string{
+		"":                     nil,
+		" , ,":                 nil,
+		"myapp":                {"myapp"},
+		" myapp, otherapp ,,x": {"myapp", "otherapp", "x"},
+	}
+	for s, expected := range cases {
+		if items := splitList(s); !reflect.DeepEqual(items, expected) {
+			t.Errorf("%q: expected %#v, got %#v", s, expected, items)
+		}
+	}
+}
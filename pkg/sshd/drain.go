@@ -0,0 +1,67 @@
+package sshd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeOps tracks the git operations in progress, so that shutting down can wait for them to finish
+type activeOps struct {
+	mut   sync.Mutex
+	wg    sync.WaitGroup
+	next  int
+	repos map[int]string
+}
+
+func newActiveOps() *activeOps {
+	return &activeOps{repos: map[int]string{}}
+}
+
+// start records an operation on repo. The returned func must be called when the operation is done.
+func (a *activeOps) start(repo string) func() {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	id := a.next
+	a.next++
+	a.repos[id] = repo
+	a.wg.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mut.Lock()
+			delete(a.repos, id)
+			a.mut.Unlock()
+			a.wg.Done()
+		})
+	}
+}
+
+// active returns the repos with operations in progress, sorted
+func (a *activeOps) active() []string {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	repos := make([]string, 0, len(a.repos))
+	for _, repo := range a.repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// wait waits up to timeout for the operations in progress to finish. It returns the repos of those that
+// were still running when the timeout elapsed.
+func (a *activeOps) wait(timeout time.Duration) []string {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return a.active()
+	}
+}
@@ -0,0 +1,58 @@
+package sshd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// requestChannel is an ssh.Channel that records the requests sent on it
+type requestChannel struct {
+	bytes.Buffer
+	requests []*ssh.Request
+}
+
+func (r *requestChannel) Close() error          { return nil }
+func (r *requestChannel) CloseWrite() error     { return nil }
+func (r *requestChannel) Stderr() io.ReadWriter { return &r.Buffer }
+func (r *requestChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	r.requests = append(r.requests, &ssh.Request{Type: name, WantReply: wantReply, Payload: payload})
+	return true, nil
+}
+
+// statusError is an error of a command that exited with status
+type statusError uint32
+
+func (s statusError) Error() string      { return "command failed" }
+func (s statusError) ExitStatus() uint32 { return uint32(s) }
+
+func TestSendExitStatus(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected uint32
+	}{
+		{nil, 0},
+		{errors.New("rejected"), 1},
+		{statusError(128), 128},
+		{statusError(0), 1},
+	}
+	for _, c := range cases {
+		channel := &requestChannel{}
+		if err := sendExitStatus(exitStatus(c.err), channel); err != nil {
+			t.Fatalf("sending exit status (%s)", err)
+		}
+		if len(channel.requests) != 1 || channel.requests[0].Type != "exit-status" {
+			t.Fatalf("expected a single exit-status request, got %v", channel.requests)
+		}
+		var exit struct{ Status uint32 }
+		if err := ssh.Unmarshal(channel.requests[0].Payload, &exit); err != nil {
+			t.Fatalf("decoding exit-status payload (%s)", err)
+		}
+		if exit.Status != c.expected {
+			t.Errorf("%v: expected exit status %d, got %d", c.err, c.expected, exit.Status)
+		}
+	}
+}
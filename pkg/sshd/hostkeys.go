@@ -0,0 +1,122 @@
+package sshd
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/cookoo"
+	"github.com/Masterminds/cookoo/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyRing holds the host keys the server offers, which can be added to while it runs so that they can be
+// rotated without a restart. golang.org/x/crypto/ssh offers one host key per algorithm, and replacing the key
+// of a type clients already know would fail their host key checks, so a new key of a type that is offered is
+// refused. Rotating needs a key of a new type: it is offered alongside the current keys, so clients can learn
+// it before the old keys are removed on the next restart.
+//
+// Each addition makes a new ssh.ServerConfig, so the handshakes in progress keep the one they started with.
+type hostKeyRing struct {
+	mut  sync.Mutex
+	base ssh.ServerConfig
+	keys []ssh.Signer
+	conf *ssh.ServerConfig
+}
+
+// newHostKeyRing returns a hostKeyRing whose configs are copies of base with the added host keys. base is
+// expected to have no host keys of its own, as made by Configure.
+func newHostKeyRing(base *ssh.ServerConfig) *hostKeyRing {
+	return &hostKeyRing{base: *base, conf: base}
+}
+
+// add adds keys to the host keys offered. It keeps the current key of a type rather than replace it with a
+// different one, and returns the keys refused that way.
+func (r *hostKeyRing) add(keys ...ssh.Signer) (refused []ssh.Signer) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	current := make([]ssh.Signer, len(r.keys), len(r.keys)+len(keys))
+	copy(current, r.keys)
+	for _, key := range keys {
+		offered := false
+		for _, k := range current {
+			if k.PublicKey().Type() == key.PublicKey().Type() {
+				if !bytes.Equal(k.PublicKey().Marshal(), key.PublicKey().Marshal()) {
+					refused = append(refused, key)
+				}
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			current = append(current, key)
+		}
+	}
+	conf := r.base
+	for _, k := range current {
+		conf.AddHostKey(k)
+	}
+	r.keys, r.conf = current, &conf
+	return refused
+}
+
+// logRefused logs an error for each of the host keys that add refused.
+func logRefused(c cookoo.Context, refused []ssh.Signer) {
+	for _, key := range refused {
+		log.Errf(c, "Not replacing the %s host key with a new one, keeping the current key. Rotate host keys to a key of a new type.", key.PublicKey().Type())
+	}
+}
+
+// config returns the server config offering the current host keys.
+func (r *hostKeyRing) config() *ssh.ServerConfig {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.conf
+}
+
+// signers returns the host keys offered.
+func (r *hostKeyRing) signers() []ssh.Signer {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.keys
+}
+
+// types returns the types of the host keys offered, comma separated.
+func (r *hostKeyRing) types() string {
+	keys := r.signers()
+	types := make([]string, len(keys))
+	for i, k := range keys {
+		types[i] = k.PublicKey().Type()
+	}
+	return strings.Join(types, ", ")
+}
+
+// reloadHostKeys reloads the host keys each time a message is sent to reload, until stop is closed.
+func (s *server) reloadHostKeys(reload <-chan interface{}, stop <-chan struct{}) {
+	for {
+		select {
+		case <-reload:
+			if err := s.rotateHostKeys(); err != nil {
+				log.Errf(s.c, "Reloading host keys failed, still offering %s: %s", s.keys.types(), err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rotateHostKeys parses the host keys again, as ParseHostKeys did on boot, and adds them to the ones offered.
+func (s *server) rotateHostKeys() error {
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"keytypes": s.c.Get(HostKeyTypes, DefaultHostKeyTypes),
+		"dir":      s.c.Get(HostKeyDir, ""),
+		"paths":    s.c.Get(HostKeyPaths, []string{}),
+	})
+	keys, irq := ParseHostKeys(s.c, params)
+	if err, ok := irq.(error); ok {
+		return err
+	}
+	logRefused(s.c, s.keys.add(keys.([]ssh.Signer)...))
+	log.Infof(s.c, "Reloaded host keys, offering %s.", s.keys.types())
+	return nil
+}
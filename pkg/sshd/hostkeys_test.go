@@ -0,0 +1,180 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+func testECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ECDSA key (%s)", err)
+	}
+	return key
+}
+
+func testSigner(t *testing.T, key interface{}) ssh.Signer {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("creating signer (%s)", err)
+	}
+	return signer
+}
+
+// offeredHostKey returns the host key a client is offered by a server using conf.
+func offeredHostKey(t *testing.T, conf *ssh.ServerConfig) ssh.PublicKey {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ssh.NewServerConn(conn, conf)
+	}()
+
+	var offered ssh.PublicKey
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			offered = key
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("connecting to server (%s)", err)
+	}
+	client.Close()
+	return offered
+}
+
+func TestHostKeyRingAdd(t *testing.T) {
+	old, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := newHostKeyRing(&ssh.ServerConfig{NoClientAuth: true})
+	ring.add(old)
+	before := ring.config()
+
+	if refused := ring.add(testSigner(t, testECDSAKey(t))); len(refused) != 0 {
+		t.Errorf("expected a key of a new type to be added, %d refused", len(refused))
+	}
+	if types := hostKeyTypes(ring.signers()); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected the old and new host keys to be offered, got %s", types)
+	}
+	if ring.config() == before {
+		t.Fatalf("expected adding a host key to make a new server config")
+	}
+	if key := offeredHostKey(t, ring.config()); key.Type() != ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected a client preferring ECDSA to be offered the new host key, got %s", key.Type())
+	}
+	if key := offeredHostKey(t, before); !bytes.Equal(key.Marshal(), old.PublicKey().Marshal()) {
+		t.Errorf("expected the server config from before the rotation to keep offering the old host key")
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating RSA key (%s)", err)
+	}
+	newRSA := testSigner(t, rsaKey)
+	if refused := ring.add(newRSA, old); len(refused) != 1 || refused[0] != newRSA {
+		t.Errorf("expected only the new RSA key to be refused, got %d refused", len(refused))
+	}
+	keys := ring.signers()
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected the host key types to be unchanged, got %s", types)
+	}
+	if !bytes.Equal(keys[0].PublicKey().Marshal(), old.PublicKey().Marshal()) {
+		t.Errorf("expected the current RSA key to be kept")
+	}
+}
+
+func TestServerRotateHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	rsaKey, err := ioutil.ReadFile("test_host_rsa_key_do_not_use")
+	if err != nil {
+		t.Fatalf("reading test host key (%s)", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh_host_rsa_key"), rsaKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cxt := cookoo.NewContext()
+	cxt.Put(HostKeyDir, dir)
+	cxt.Put(HostKeyTypes, []string{"rsa", "ecdsa"})
+	srv := &server{c: cxt, keys: newHostKeyRing(&ssh.ServerConfig{})}
+	if err := srv.rotateHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if types := hostKeyTypes(srv.keys.signers()); types != ssh.KeyAlgoRSA {
+		t.Fatalf("expected the RSA host key to be offered, got %s", types)
+	}
+
+	der, err := x509.MarshalECPrivateKey(testECDSAKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh_host_ecdsa_key"), ecdsaKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.rotateHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if types := hostKeyTypes(srv.keys.signers()); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected the new ECDSA host key to be offered alongside the RSA one, got %s", types)
+	}
+
+	// a new key of a type that is offered is refused, the way clients that know the current one would refuse it
+	var buf bytes.Buffer
+	cxt.AddLogger("test", &buf)
+	defer cxt.RemoveLogger("test")
+	rsaKey2, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating RSA key (%s)", err)
+	}
+	newRSA := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey2)})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ssh_host_rsa_key"), newRSA, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.rotateHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if offered := srv.keys.signers()[0].PublicKey(); bytes.Equal(offered.Marshal(), testSigner(t, rsaKey2).PublicKey().Marshal()) {
+		t.Errorf("expected the current RSA host key to be kept")
+	}
+	if !strings.Contains(buf.String(), "Not replacing the ssh-rsa host key") {
+		t.Errorf("expected the refused RSA host key to be logged, got %q", buf.String())
+	}
+
+	os.Remove(filepath.Join(dir, "ssh_host_rsa_key"))
+	os.Remove(filepath.Join(dir, "ssh_host_ecdsa_key"))
+	if err := srv.rotateHostKeys(); err == nil {
+		t.Errorf("expected reloading without host keys to fail")
+	}
+	if types := hostKeyTypes(srv.keys.signers()); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected a failed reload to keep the host keys offered, got %s", types)
+	}
+}
@@ -0,0 +1,58 @@
+package sshd
+
+import (
+	"net"
+	"time"
+)
+
+// keepAliveRequest is the request OpenSSH servers send to check on their clients. Clients answer it with a
+// failure, since they don't know it, and that answer is all that is needed.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// requestSender is the part of an ssh.Channel that KeepAlive needs.
+type requestSender interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, error)
+}
+
+// KeepAlive sends a keepalive request on ch every interval until stop is closed, so that load balancers and
+// NAT don't drop connections that go quiet during long builds. A keepalive is only sent once the previous
+// one was answered, so a client that stopped responding gets no more traffic and its idle timeout still
+// expires. An interval of 0 sends none.
+func KeepAlive(ch requestSender, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	answered := make(chan struct{}, 1)
+	answered <- struct{}{}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		select {
+		case <-answered:
+		default:
+			// the last keepalive is still waiting for its answer
+			continue
+		}
+		go func() {
+			// SendRequest fails once the channel is closed, and then no more keepalives are sent
+			if _, err := ch.SendRequest(keepAliveRequest, true, nil); err == nil {
+				answered <- struct{}{}
+			}
+		}()
+	}
+}
+
+// setTCPKeepAlive turns on TCP keepalive on conn, if it is a TCP connection and interval isn't 0.
+func setTCPKeepAlive(conn net.Conn, interval time.Duration) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok || interval <= 0 {
+		return
+	}
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(interval)
+}
@@ -0,0 +1,82 @@
+package sshd
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keepAliveChannel counts the keepalive requests sent on it. Requests block until answer is closed.
+type keepAliveChannel struct {
+	mu     sync.Mutex
+	sent   int
+	answer chan struct{}
+	err    error
+}
+
+func (k *keepAliveChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	k.mu.Lock()
+	if name == keepAliveRequest && wantReply {
+		k.sent++
+	}
+	k.mu.Unlock()
+	<-k.answer
+	return false, k.err
+}
+
+func (k *keepAliveChannel) count() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.sent
+}
+
+// runKeepAlive runs KeepAlive on ch for d, and returns once it has stopped
+func runKeepAlive(ch *keepAliveChannel, interval, d time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		KeepAlive(ch, interval, stop)
+		close(done)
+	}()
+	time.Sleep(d)
+	close(stop)
+	<-done
+}
+
+func TestKeepAlive(t *testing.T) {
+	answer := make(chan struct{})
+	close(answer)
+	ch := &keepAliveChannel{answer: answer}
+	runKeepAlive(ch, 10*time.Millisecond, 200*time.Millisecond)
+	if n := ch.count(); n < 3 {
+		t.Errorf("expected keepalives to be sent every interval while waiting, got %d", n)
+	}
+}
+
+func TestKeepAliveUnanswered(t *testing.T) {
+	ch := &keepAliveChannel{answer: make(chan struct{})}
+	runKeepAlive(ch, 10*time.Millisecond, 100*time.Millisecond)
+	close(ch.answer)
+	if n := ch.count(); n != 1 {
+		t.Errorf("expected no keepalive to be sent before the last one was answered, got %d", n)
+	}
+}
+
+func TestKeepAliveClosedChannel(t *testing.T) {
+	answer := make(chan struct{})
+	close(answer)
+	ch := &keepAliveChannel{answer: answer, err: errors.New("channel closed")}
+	runKeepAlive(ch, 10*time.Millisecond, 100*time.Millisecond)
+	if n := ch.count(); n != 1 {
+		t.Errorf("expected keepalives to stop once the channel is closed, got %d", n)
+	}
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	ch := &keepAliveChannel{answer: make(chan struct{})}
+	KeepAlive(ch, 0, make(chan struct{}))
+	if n := ch.count(); n != 0 {
+		t.Errorf("expected no keepalives with an interval of 0, got %d", n)
+	}
+}
@@ -0,0 +1,63 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyPolicy restricts the keys that clients may authenticate with. The zero value allows any key.
+type KeyPolicy struct {
+	// Algorithms are the allowed key types, as in authorized_keys, e.g. ssh-ed25519. Empty allows any type.
+	Algorithms []string
+	// MinRSABits is the smallest RSA key allowed, in bits. 0 allows any size.
+	MinRSABits int
+}
+
+// Check returns an error saying why key isn't allowed by the policy, or nil if it is.
+func (k KeyPolicy) Check(key ssh.PublicKey) error {
+	if len(k.Algorithms) > 0 && !containsString(k.Algorithms, key.Type()) {
+		return fmt.Errorf("%s keys are not allowed", key.Type())
+	}
+	if key.Type() == ssh.KeyAlgoRSA && k.MinRSABits > 0 {
+		bits, err := rsaKeyBits(key)
+		if err != nil {
+			return err
+		}
+		if bits < k.MinRSABits {
+			return fmt.Errorf("%d bit RSA keys are not allowed, they must have at least %d bits", bits, k.MinRSABits)
+		}
+	}
+	return nil
+}
+
+// rsaKeyBits returns the size of the modulus of an RSA key, read from its wire format of the key type, the
+// exponent and the modulus.
+func rsaKeyBits(key ssh.PublicKey) (int, error) {
+	in := key.Marshal()
+	var fields [3][]byte
+	for i := range fields {
+		if len(in) < 4 {
+			return 0, errors.New("malformed RSA key")
+		}
+		n := binary.BigEndian.Uint32(in)
+		in = in[4:]
+		if uint32(len(in)) < n {
+			return 0, errors.New("malformed RSA key")
+		}
+		fields[i], in = in[:n], in[n:]
+	}
+	return new(big.Int).SetBytes(fields[2]).BitLen(), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+// ed25519Key is an ssh-ed25519 public key. Only its type matters to a KeyPolicy.
+type ed25519Key struct{}
+
+func (ed25519Key) Type() string                                 { return "ssh-ed25519" }
+func (ed25519Key) Marshal() []byte                              { return []byte("\x00\x00\x00\x0bssh-ed25519") }
+func (ed25519Key) Verify(data []byte, sig *ssh.Signature) error { return nil }
+
+func testRSAKey(t *testing.T, bits int) ssh.PublicKey {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("generating %d bit RSA key (%s)", bits, err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("creating public key (%s)", err)
+	}
+	return pub
+}
+
+func TestKeyPolicy(t *testing.T) {
+	weak, strong := testRSAKey(t, 1024), testRSAKey(t, 2048)
+	policy := KeyPolicy{Algorithms: []string{"ssh-ed25519", ssh.KeyAlgoRSA}, MinRSABits: 2048}
+	cases := []struct {
+		policy  KeyPolicy
+		key     ssh.PublicKey
+		allowed bool
+	}{
+		{KeyPolicy{}, weak, true},
+		{KeyPolicy{}, testPublicKey(t), true},
+		{policy, weak, false},
+		{policy, strong, true},
+		{policy, ed25519Key{}, true},
+		{policy, testPublicKey(t), false},
+		{KeyPolicy{MinRSABits: 2048}, testPublicKey(t), true},
+	}
+	for i, c := range cases {
+		if err := c.policy.Check(c.key); (err == nil) != c.allowed {
+			t.Errorf("case %d: expected %+v to allow a %s key: %t, got %v", i, c.policy, c.key.Type(), c.allowed, err)
+		}
+	}
+}
+
+func TestAuthKeyPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	weak, strong := testRSAKey(t, 1024), testRSAKey(t, 2048)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys", authorizedKeyLine(weak, "weak"), authorizedKeyLine(strong, "strong"))
+	policy := KeyPolicy{Algorithms: []string{"ssh-ed25519", ssh.KeyAlgoRSA}, MinRSABits: 2048}
+
+	auth := func(key ssh.PublicKey) (interface{}, cookoo.Interrupt) {
+		return AuthKey(cookoo.NewContext(), cookoo.NewParamsWithValues(map[string]interface{}{
+			"key":            key,
+			"authorizedKeys": authorizedKeys,
+			"keyPolicy":      policy,
+		}))
+	}
+	if perm, irq := auth(weak); irq == nil || perm != nil {
+		t.Errorf("expected the authorized 1024 bit RSA key to be rejected by the policy, got %v", perm)
+	}
+	perm, irq := auth(strong)
+	if irq != nil {
+		t.Fatalf("expected the 2048 bit RSA key to be allowed (%v)", irq)
+	}
+	if user := perm.(*ssh.Permissions).Extensions["user"]; user != "strong" {
+		t.Errorf("expected the strong key to authenticate as strong, got %q", user)
+	}
+}
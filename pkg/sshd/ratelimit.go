@@ -0,0 +1,100 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connLimiter limits the connections the server accepts, both per source IP within a window and in total at
+// once. It is checked before the SSH handshake, so that rejecting a connection is cheap.
+type connLimiter struct {
+	mut sync.Mutex
+	// perIP is the maximum number of connections from one IP per window, 0 for no limit
+	perIP  int
+	window time.Duration
+	// maxOpen is the maximum number of connections open at once, 0 for no limit
+	maxOpen int
+
+	open   int
+	recent map[string][]time.Time
+	swept  time.Time
+	now    func() time.Time
+}
+
+func newConnLimiter(perIP int, window time.Duration, maxOpen int) *connLimiter {
+	return &connLimiter{
+		perIP:   perIP,
+		window:  window,
+		maxOpen: maxOpen,
+		recent:  map[string][]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// allow returns an error if a connection from ip is over a limit. Otherwise the connection is counted as
+// open until the returned func is called.
+func (l *connLimiter) allow(ip string) (func(), error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if l.maxOpen > 0 && l.open >= l.maxOpen {
+		return nil, fmt.Errorf("%d connections are already open", l.open)
+	}
+	if l.perIP > 0 {
+		now := l.now()
+		// forget IPs that haven't connected for a window, so that scanners don't grow the map forever
+		if now.Sub(l.swept) >= l.window {
+			for addr, times := range l.recent {
+				if len(l.prune(times, now)) == 0 {
+					delete(l.recent, addr)
+				}
+			}
+			l.swept = now
+		}
+		times := l.prune(l.recent[ip], now)
+		if len(times) >= l.perIP {
+			l.recent[ip] = times
+			return nil, fmt.Errorf("%s made %d connections within %s", ip, len(times), l.window)
+		}
+		l.recent[ip] = append(times, now)
+	}
+
+	l.open++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mut.Lock()
+			l.open--
+			l.mut.Unlock()
+		})
+	}, nil
+}
+
+// prune drops the times that are a window or more before now
+func (l *connLimiter) prune(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= l.window {
+		i++
+	}
+	return times[i:]
+}
+
+// remoteIP returns the IP address of addr without its port, in canonical form so that every spelling of a
+// client's address is limited together: IPv6 zones are dropped and IPv4-mapped IPv6 addresses are given as
+// IPv4. Addresses that are not host:port pairs are returned as they are.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if i := strings.LastIndex(host, "%"); i != -1 {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
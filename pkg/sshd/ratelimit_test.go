@@ -0,0 +1,106 @@
+package sshd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterPerIP(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newConnLimiter(3, time.Minute, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		done, err := l.allow("10.0.0.1")
+		if err != nil {
+			t.Fatalf("connection %d: expected to be allowed, got %s", i+1, err)
+		}
+		done()
+	}
+	if _, err := l.allow("10.0.0.1"); err == nil {
+		t.Errorf("expected the 4th connection within a minute to be rejected")
+	}
+	if _, err := l.allow("10.0.0.2"); err != nil {
+		t.Errorf("expected another IP to be allowed, got %s", err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := l.allow("10.0.0.1"); err != nil {
+		t.Errorf("expected a connection a minute later to be allowed, got %s", err)
+	}
+	if len(l.recent) != 1 {
+		t.Errorf("expected IPs without recent connections to be forgotten, got %v", l.recent)
+	}
+}
+
+func TestConnLimiterMaxOpen(t *testing.T) {
+	l := newConnLimiter(0, time.Minute, 2)
+	first, err := l.allow("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.allow("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.allow("10.0.0.3"); err == nil {
+		t.Errorf("expected a 3rd open connection to be rejected")
+	}
+	first()
+	first()
+	if _, err := l.allow("10.0.0.3"); err != nil {
+		t.Errorf("expected a connection to be allowed once another closed, got %s", err)
+	}
+	if _, err := l.allow("10.0.0.4"); err == nil {
+		t.Errorf("expected closing a connection twice to free only one slot")
+	}
+
+	unlimited := newConnLimiter(0, time.Minute, 0)
+	for i := 0; i < 1000; i++ {
+		if _, err := unlimited.allow("10.0.0.1"); err != nil {
+			t.Fatalf("expected no limits, got %s", err)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 52000}, "192.0.2.10"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 52000}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:0db8:0000::0001"), Port: 52001}, "2001:db8::1"},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 52000, Zone: "eth0"}, "fe80::1"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 52000}, "192.0.2.10"},
+		{&net.UnixAddr{Name: "/tmp/sshd.sock", Net: "unix"}, "/tmp/sshd.sock"},
+	}
+	for _, test := range tests {
+		if ip := remoteIP(test.addr); ip != test.ip {
+			t.Errorf("remoteIP(%s): expected %q, got %q", test.addr, test.ip, ip)
+		}
+	}
+}
+
+func TestConnLimiterIPv6(t *testing.T) {
+	l := newConnLimiter(2, time.Minute, 0)
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 52000},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 52001, Zone: "eth0"},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 52002},
+	}
+	for i, addr := range addrs[:2] {
+		if _, err := l.allow(remoteIP(addr)); err != nil {
+			t.Fatalf("connection %d: expected to be allowed, got %s", i+1, err)
+		}
+	}
+	if _, err := l.allow(remoteIP(addrs[2])); err == nil {
+		t.Errorf("expected connections from other ports of the same IPv6 host to be limited together")
+	}
+	if _, err := l.allow(remoteIP(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 52000})); err != nil {
+		t.Errorf("expected another IPv6 host to be allowed, got %s", err)
+	}
+	if _, ok := l.recent["2001:db8::1"]; !ok {
+		t.Errorf("expected the limiter to key on the bare IPv6 address, got %v", l.recent)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"github.com/Masterminds/cookoo"
 	"github.com/Masterminds/cookoo/log"
@@ -23,10 +24,46 @@ import (
 const (
 	// HostKeys is the context key for Host Keys list.
 	HostKeys string = "ssh.HostKeys"
+	// HostKeyTypes is the context key for the types of host keys to parse.
+	HostKeyTypes string = "ssh.HostKeyTypes"
+	// HostKeyPaths is the context key for the host key files to parse instead of the ones of HostKeyTypes.
+	HostKeyPaths string = "ssh.HostKeyPaths"
+	// HostKeyDir is the context key for the dir that host keys are generated in and parsed from.
+	HostKeyDir string = "ssh.HostKeyDir"
 	// Address is the context key for SSH address.
 	Address string = "ssh.Address"
 	// ServerConfig is the context key for ServerConfig object.
 	ServerConfig string = "ssh.ServerConfig"
+	// AuthorizedKeys is the context key for the path to the authorized_keys file.
+	AuthorizedKeys string = "ssh.AuthorizedKeys"
+	// UserCache is the context key for the cache of users looked up in the controller.
+	UserCache string = "ssh.UserCache"
+	// ControllerTimeout is the context key for the maximum time to wait for a controller key lookup.
+	ControllerTimeout string = "ssh.ControllerTimeout"
+	// AuthenticatedKey is the context key for the public key the client authenticated with.
+	AuthenticatedKey string = "ssh.AuthenticatedKey"
+	// FingerprintAlgorithm is the context key for the algorithm used to fingerprint keys.
+	FingerprintAlgorithm string = "ssh.FingerprintAlgorithm"
+	// AuthKeyPolicy is the context key for the KeyPolicy that client keys must meet.
+	AuthKeyPolicy string = "ssh.KeyPolicy"
+	// AdminKeys is the context key for the path to the authorized_keys file of admin keys.
+	AdminKeys string = "ssh.AdminKeys"
+	// ShutdownGracePeriod is the context key for how long to wait for git operations to finish on shutdown.
+	ShutdownGracePeriod string = "ssh.ShutdownGracePeriod"
+	// Closer is the context key for the channel that shuts down the server.
+	Closer string = "sshd.Closer"
+	// ReloadHostKeys is the context key for the channel that reloads the host keys of the server.
+	ReloadHostKeys string = "sshd.ReloadHostKeys"
+	// MaxConnectionsPerIP is the context key for how many connections one IP may open per minute.
+	MaxConnectionsPerIP string = "ssh.MaxConnectionsPerIP"
+	// MaxConnections is the context key for how many connections may be open at once.
+	MaxConnections string = "ssh.MaxConnections"
+	// HandshakeTimeout is the context key for how long a client may take to complete the SSH handshake.
+	HandshakeTimeout string = "ssh.HandshakeTimeout"
+	// IdleTimeout is the context key for how long an established connection may go without traffic.
+	IdleTimeout string = "ssh.IdleTimeout"
+	// KeepAliveInterval is the context key for how often connections are kept alive during builds.
+	KeepAliveInterval string = "ssh.KeepAliveInterval"
 )
 
 // Serve starts a native SSH server.
@@ -43,16 +80,32 @@ const (
 // 	- ssh.Hostkeys ([]ssh.Signer): Host key, as an unparsed byte slice.
 // 	- ssh.Address (string): Address/port
 // 	- ssh.ServerConfig (*ssh.ServerConfig): The server config to use.
+// 	- ssh.MaxConnectionsPerIP (int): Connections one IP may open per minute. 0 for no limit.
+// 	- ssh.MaxConnections (int): Connections open at once. 0 for no limit.
+// 	- ssh.HandshakeTimeout (time.Duration): Time allowed for the SSH handshake. 0 for no limit.
+// 	- ssh.IdleTimeout (time.Duration): Time a connection may go without traffic. 0 for no limit.
+// 	- ssh.KeepAliveInterval (time.Duration): TCP keepalive period of connections. 0 for the OS default.
 //
-// This puts the following variables into the context:
-// 	- ssh.Closer (chan interface{}): Send a message to this to shutdown the server.
+// This puts the following variables into the context, unless it is already there:
+// 	- sshd.Closer (chan interface{}): Send a message to this to shutdown the server.
+// 	- sshd.ReloadHostKeys (chan interface{}): Send a message to this to parse the host keys again, from
+// 	  ssh.HostKeyTypes, ssh.HostKeyDir and ssh.HostKeyPaths as on boot, and offer them alongside the
+// 	  current ones.
+//
+// On shutdown, the server stops accepting connections and waits up to
+// ssh.ShutdownGracePeriod (time.Duration) for the git operations in progress to
+// finish.
 func Serve(reg *cookoo.Registry, router *cookoo.Router, c cookoo.Context) cookoo.Interrupt {
 	hostkeys := c.Get(HostKeys, []ssh.Signer{}).([]ssh.Signer)
 	addr := c.Get(Address, "0.0.0.0:2223").(string)
 	cfg := c.Get(ServerConfig, &ssh.ServerConfig{}).(*ssh.ServerConfig)
 
+	keys := newHostKeyRing(cfg)
 	for _, hk := range hostkeys {
-		cfg.AddHostKey(hk)
+		if refused := keys.add(hk); len(refused) > 0 {
+			logRefused(c, refused)
+			continue
+		}
 		log.Infof(c, "Added hostkey.")
 	}
 
@@ -64,13 +117,40 @@ func Serve(reg *cookoo.Registry, router *cookoo.Router, c cookoo.Context) cookoo
 	srv := &server{
 		c:       c,
 		gitHome: "/home/git",
+		ops:     newActiveOps(),
+		keys:    keys,
+		limiter: newConnLimiter(c.Get(MaxConnectionsPerIP, 0).(int), time.Minute, c.Get(MaxConnections, 0).(int)),
+
+		handshakeTimeout: c.Get(HandshakeTimeout, time.Duration(0)).(time.Duration),
+		idleTimeout:      c.Get(IdleTimeout, time.Duration(0)).(time.Duration),
+		keepAlive:        c.Get(KeepAliveInterval, time.Duration(0)).(time.Duration),
 	}
 
-	closer := make(chan interface{}, 1)
-	c.Put("sshd.Closer", closer)
+	closer, ok := c.Get(Closer, nil).(chan interface{})
+	if !ok {
+		closer = make(chan interface{}, 1)
+		c.Put(Closer, closer)
+	}
+
+	reload, ok := c.Get(ReloadHostKeys, nil).(chan interface{})
+	if !ok {
+		reload = make(chan interface{}, 1)
+		c.Put(ReloadHostKeys, reload)
+	}
+	stopReload := make(chan struct{})
+	defer close(stopReload)
+	go srv.reloadHostKeys(reload, stopReload)
 
 	log.Infof(c, "Listening on %s", addr)
-	srv.listen(listener, cfg, closer)
+	srv.listen(listener, closer)
+
+	grace := c.Get(ShutdownGracePeriod, time.Duration(0)).(time.Duration)
+	if active := srv.ops.active(); len(active) > 0 {
+		log.Infof(c, "Waiting up to %s for git operations on %s to finish.", grace, strings.Join(active, ", "))
+	}
+	if interrupted := srv.ops.wait(grace); len(interrupted) > 0 {
+		log.Warnf(c, "Shutdown grace period of %s elapsed, interrupting git operations on %s.", grace, strings.Join(interrupted, ", "))
+	}
 
 	return nil
 }
@@ -81,30 +161,58 @@ type server struct {
 	gitHome    string
 	hookTpl    *template.Template
 	createLock sync.Mutex
+	ops        *activeOps
+	limiter    *connLimiter
+	keys       *hostKeyRing
+
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+	keepAlive        time.Duration
 }
 
-// listen handles accepting and managing connections. However, since closer
-// is len(1), it will not block the sender.
-func (s *server) listen(l net.Listener, conf *ssh.ServerConfig, closer chan interface{}) error {
+// listen handles accepting and managing connections until a message is sent
+// to closer. However, since closer is len(1), it will not block the sender.
+func (s *server) listen(l net.Listener, closer chan interface{}) error {
 	cxt := s.c
 	log.Info(cxt, "Accepting new connections.")
 	defer l.Close()
 
-	// FIXME: Since Accept blocks, closer may not be checked often enough.
-	for {
-		log.Info(cxt, "Checking closer.")
-		if len(closer) > 0 {
-			<-closer
-			log.Info(cxt, "Shutting down SSHD listener.")
-			return nil
+	// Closing the listener unblocks Accept.
+	closing := make(chan struct{})
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-closer:
+			close(closing)
+			l.Close()
+		case <-stopped:
 		}
+	}()
+
+	for {
 		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-closing:
+				log.Info(cxt, "Shutting down SSHD listener.")
+				return nil
+			default:
+			}
 			log.Warnf(cxt, "Error during Accept: %s", err)
 			// We shouldn't kill the listener because of an error.
 			return err
 		}
+		done, err := s.limiter.allow(remoteIP(conn.RemoteAddr()))
+		if err != nil {
+			log.Warnf(cxt, "Rejected connection from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		setTCPKeepAlive(conn, s.keepAlive)
+		conf := s.keys.config()
 		safely.GoDo(cxt, func() {
+			defer done()
 			s.handleConn(conn, conf)
 		})
 	}
@@ -116,12 +224,20 @@ func (s *server) listen(l net.Listener, conf *ssh.ServerConfig, closer chan inte
 func (s *server) handleConn(conn net.Conn, conf *ssh.ServerConfig) {
 	defer conn.Close()
 	log.Info(s.c, "Accepted connection.")
-	_, chans, reqs, err := ssh.NewServerConn(conn, conf)
+	// A client that never finishes the handshake is cut off by its deadline. Once connected, it is cut
+	// off for going idle instead.
+	ic := &idleConn{Conn: conn}
+	if s.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
+	sconn, chans, reqs, err := ssh.NewServerConn(ic, conf)
 	if err != nil {
 		// Handshake failure.
 		log.Errf(s.c, "Failed handshake: %s (%v)", err, conn)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	ic.setTimeout(s.idleTimeout)
 
 	// Discard global requests. We're only concerned with channels.
 	safely.GoDo(s.c, func() { ssh.DiscardRequests(reqs) })
@@ -140,29 +256,66 @@ func (s *server) handleConn(conn net.Conn, conf *ssh.ServerConfig) {
 			// Should close request and move on.
 			panic(err)
 		}
-		safely.GoDo(s.c, func() { s.answer(channel, req, condata) })
+		safely.GoDo(s.c, func() { s.answer(channel, req, condata, sconn.Permissions) })
 	}
 	conn.Close()
 }
 
+// discardUntilClosed refuses the requests that arrive while a git operation runs, and returns a channel that
+// is closed once requests is, which happens when the client closes the channel or its connection drops.
+func discardUntilClosed(requests <-chan *ssh.Request) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		for req := range requests {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		close(closed)
+	}()
+	return closed
+}
+
 // sshConnection generates the SSH_CONNECTION environment variable.
 //
-// This is untested on UNIX sockets.
+// IPv6 addresses are given without brackets, as OpenSSH does. If either address is not a host:port pair
+// (a UNIX socket, say), "0 0 0 0" is returned rather than a value with empty fields.
 func sshConnection(conn net.Conn) string {
 	remote := conn.RemoteAddr().String()
 	local := conn.LocalAddr().String()
-	rhost, rport, _ := net.SplitHostPort(remote)
-	lhost, lport, _ := net.SplitHostPort(local)
+	rhost, rport, rerr := net.SplitHostPort(remote)
+	lhost, lport, lerr := net.SplitHostPort(local)
+	if rerr != nil || lerr != nil {
+		return "0 0 0 0"
+	}
 
 	return fmt.Sprintf("%s %s %s %s", rhost, rport, lhost, lport)
 }
 
+// sendExitStatus sends the client the exit status of the command run on channel.
 func sendExitStatus(status uint32, channel ssh.Channel) error {
-	exit := struct{ Status uint32 }{uint32(0)}
+	exit := struct{ Status uint32 }{status}
 	_, err := channel.SendRequest("exit-status", false, ssh.Marshal(exit))
 	return err
 }
 
+// exitStatuser is implemented by errors that know the exit status of the command that failed.
+type exitStatuser interface {
+	ExitStatus() uint32
+}
+
+// exitStatus returns the exit status to send the client for a command that finished with err: 0 if it
+// succeeded, the status of the failed command if err carries one, and 1 otherwise.
+func exitStatus(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(exitStatuser); ok && e.ExitStatus() != 0 {
+		return e.ExitStatus()
+	}
+	return 1
+}
+
 // answer handles answering requests and channel requests
 //
 // Currently, an exec must be either "ping", "git-receive-pack" or
@@ -171,7 +324,7 @@ func sendExitStatus(status uint32, channel ssh.Channel) error {
 // correct behavior for a failed exec is.
 //
 // Support for setting environment variables via `env` has been disabled.
-func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, sshConn string) error {
+func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, sshConn string, perm *ssh.Permissions) error {
 	defer channel.Close()
 
 	// Answer all the requests on this connection.
@@ -196,6 +349,9 @@ func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, sshCo
 			// We need a shallow copy of the context to avoid race conditions.
 			cxt := s.c.Copy()
 			cxt.Put("SSH_CONNECTION", sshConn)
+			// the auth results for this connection, rather than whichever connection authenticated last
+			cxt.Put("authN", perm)
+			cxt.Put(AuthenticatedKey, KeyFromPermissions(perm))
 
 			// Only allow commands that we know about.
 			switch parts[0] {
@@ -214,20 +370,23 @@ func (s *server) answer(channel ssh.Channel, requests <-chan *ssh.Request, sshCo
 					req.Reply(ok, nil)
 					break
 				}
-				req.Reply(true, nil) // We processed. Yay.
+				// the receive route replies to req, once it has taken the command on
 
 				cxt.Put("channel", channel)
 				cxt.Put("request", req)
 				cxt.Put("operation", parts[0])
 				cxt.Put("repository", parts[1])
+				cxt.Put("channelClosed", discardUntilClosed(requests))
 				sshGitReceive := cxt.Get("route.sshd.sshGitReceive", "sshGitReceive").(string)
+				done := s.ops.start(parts[1])
 				err := router.HandleRequest(sshGitReceive, cxt, true)
-				var xs uint32
+				done()
 				if err != nil {
 					log.Errf(s.c, "Failed git receive: %v", err)
-					xs = 1
 				}
-				sendExitStatus(xs, channel)
+				if err := sendExitStatus(exitStatus(err), channel); err != nil {
+					log.Errf(s.c, "Failed to write exit status: %s", err)
+				}
 				return nil
 			default:
 				log.Warnf(s.c, "Illegal command is '%s'\n", clean)
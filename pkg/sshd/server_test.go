@@ -1,6 +1,7 @@
 package sshd
 
 import (
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -157,3 +158,269 @@ v3+ZZfZMlci4pxBtXqrnoyj4uUoqZtR3ENLz53SN1i0vpT7DtC6gMnEF1UWiaoJ6
 
 	testingClientPubKey = `ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC/OImeiJppXJQY+fKpULj1cvM1FL5M9brc3Diqi8IbyVVvEoYMgcLri0msIOJl3SmkSFj5FAMZo/CswicedXwjB1LXBfbZRNG5cD+heYdwjE7bOZSeuMUOWkqbaj7Zd3XruJ91X0CKo0G2q47QzzzZFobL30ts09yX26ACfGjkNUjWMRKXm9iq2I4CdFK+YmfZz6GQl8pevIfuFTjL5uUMrlXPjh5KwLtuAbdlsp8oZH2aV/ajNWXMw2LYAJnny8MHGflZUtvVs9XUsemJwnTR9TdMNGcrcyTC+8Ceqnvxs3OL6i5ggDBhJnjWIc13n3otAlyGvW+zcWjypuBhotjz donotuse`
 )
+
+// TestServerDrainsOnShutdown tests that shutting down the server stops it accepting connections, but
+// waits for the git operation in progress to finish.
+func TestServerDrainsOnShutdown(t *testing.T) {
+	const addr = "127.0.0.1:2245"
+	key, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(key)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	reg, router, cxt := cookoo.Cookoo()
+	cxt.Put(ServerConfig, cfg)
+	cxt.Put(Address, addr)
+	cxt.Put(ShutdownGracePeriod, 5*time.Second)
+	cxt.Put("cookoo.Router", router)
+	reg.AddRoute(cookoo.Route{
+		Name: "sshGitReceive",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "receive",
+				Fn: func(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+					close(started)
+					<-release
+					return nil, nil
+				},
+			},
+		},
+	})
+	closer := make(chan interface{}, 1)
+	cxt.Put(Closer, closer)
+
+	stopped := make(chan struct{})
+	go func() {
+		Serve(reg, router, cxt)
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create client session: %s", err)
+	}
+	defer sess.Close()
+	go sess.Run("git-receive-pack 'myapp'")
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("git-receive-pack didn't start")
+	}
+	closer <- true
+
+	// the listener closes, but Serve waits for the push
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to stop accepting connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("expected the server to wait for the git operation in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the server to stop once the git operation finished")
+	}
+}
+
+// startTestServer serves on addr with the given context settings, and returns a func that stops the server
+func startTestServer(t *testing.T, addr string, settings map[string]interface{}) func() {
+	key, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(key)
+
+	reg, router, cxt := cookoo.Cookoo()
+	cxt.Put(ServerConfig, cfg)
+	cxt.Put(Address, addr)
+	cxt.Put("cookoo.Router", router)
+	for k, v := range settings {
+		cxt.Put(k, v)
+	}
+	closer := make(chan interface{}, 1)
+	cxt.Put(Closer, closer)
+	stopped := make(chan struct{})
+	go func() {
+		Serve(reg, router, cxt)
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	return func() {
+		closer <- true
+		<-stopped
+	}
+}
+
+func TestServerListensOnConfiguredAddress(t *testing.T) {
+	addr, err := Config{SSHHostIP: "127.0.0.1", SSHHostPort: 2246}.ListenAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer startTestServer(t, addr, nil)()
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2246", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("expected the server to listen on %s (%s)", addr, err)
+	}
+	client.Close()
+}
+
+func TestServerRateLimitsConnections(t *testing.T) {
+	const addr = "127.0.0.1:2247"
+	defer startTestServer(t, addr, map[string]interface{}{MaxConnectionsPerIP: 2})()
+
+	// accepted connections get the server's version banner, rejected ones are closed without it
+	banner := func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("connecting to %s (%s)", addr, err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4)
+		n, _ := conn.Read(buf)
+		return string(buf[:n]) == "SSH-"
+	}
+	for i := 0; i < 2; i++ {
+		if !banner() {
+			t.Fatalf("expected connection %d to be accepted", i+1)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if banner() {
+			t.Errorf("expected rapid connection %d to be rejected", i+3)
+		}
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	const addr = "127.0.0.1:2248"
+	defer startTestServer(t, addr, map[string]interface{}{HandshakeTimeout: 200 * time.Millisecond})()
+
+	// connect, but never send the client's version
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("connecting to %s (%s)", addr, err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("expected the server to close the stalled connection, got %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the stalled connection to be closed after the 200ms handshake timeout, took %s", elapsed)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	const addr = "127.0.0.1:2249"
+	defer startTestServer(t, addr, map[string]interface{}{
+		HandshakeTimeout: 100 * time.Millisecond,
+		IdleTimeout:      300 * time.Millisecond,
+	})()
+
+	// the idle timeout, not the handshake timeout, applies once connected
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("connecting to %s (%s)", addr, err)
+	}
+	defer client.Close()
+	closed := make(chan struct{})
+	start := time.Now()
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("expected the connection to stay open until it went idle, closed after %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle connection to be closed")
+	}
+}
+
+func TestActiveOpsWaitTimeout(t *testing.T) {
+	ops := newActiveOps()
+	doneA := ops.start("myapp")
+	ops.start("otherapp")
+	doneA()
+	doneA()
+
+	start := time.Now()
+	interrupted := ops.wait(50 * time.Millisecond)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected wait to last the whole grace period")
+	}
+	if len(interrupted) != 1 || interrupted[0] != "otherapp" {
+		t.Errorf("expected otherapp to be interrupted, got %v", interrupted)
+	}
+	if interrupted := newActiveOps().wait(time.Hour); interrupted != nil {
+		t.Errorf("expected no operations to wait for, got %v", interrupted)
+	}
+}
+
+// addrConn is a net.Conn with only its addresses set.
+type addrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+
+func TestSSHConnection(t *testing.T) {
+	tests := []struct {
+		conn net.Conn
+		env  string
+	}{
+		{
+			addrConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 52000}, local: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2223}},
+			"192.0.2.10 52000 192.0.2.1 2223",
+		},
+		{
+			addrConn{remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 52000}, local: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2223}},
+			"2001:db8::10 52000 2001:db8::1 2223",
+		},
+		{
+			addrConn{remote: &net.TCPAddr{IP: net.ParseIP("fe80::10"), Port: 52000, Zone: "eth0"}, local: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 2223, Zone: "eth0"}},
+			"fe80::10%eth0 52000 fe80::1%eth0 2223",
+		},
+		{
+			addrConn{remote: &net.UnixAddr{Name: "@", Net: "unix"}, local: &net.UnixAddr{Name: "/tmp/sshd.sock", Net: "unix"}},
+			"0 0 0 0",
+		},
+	}
+	for _, test := range tests {
+		if env := sshConnection(test.conn); env != test.env {
+			t.Errorf("expected SSH_CONNECTION %q, got %q", test.env, env)
+		}
+	}
+}
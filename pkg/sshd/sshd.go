@@ -1,50 +1,111 @@
 package sshd
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/Masterminds/cookoo"
 	"github.com/Masterminds/cookoo/log"
+	"github.com/deis/sa-builder/pkg/controller"
+	"github.com/deis/sa-builder/pkg/jsonlog"
 )
 
 const (
 	builderKeyLocation = "/var/run/secrets/api/auth/builder-key"
+
+	// ScopeExtension is the ssh.Permissions extension that holds the scope of an authenticated key.
+	ScopeExtension = "scope"
+	// KeyExtension is the ssh.Permissions extension that holds the authenticated key, in authorized_keys format.
+	KeyExtension = "pubkey"
+	// AppsExtension is the ssh.Permissions extension that holds the comma separated apps the key's user may
+	// push to. It is set for keys looked up in the controller, and for authorized keys with an apps option.
+	AppsExtension = "apps"
+	// ScopeUser is the scope of an ordinary key.
+	ScopeUser = "user"
+	// ScopeAdmin is the scope of a key listed in the admin keys file.
+	ScopeAdmin = "admin"
 )
 
+// DefaultHostKeyTypes are the host key types ParseHostKeys parses unless told otherwise. DSA is left out
+// because modern OpenSSH clients refuse it, so it has to be asked for explicitly.
+var DefaultHostKeyTypes = []string{"rsa", "ecdsa"}
+
+// parseableHostKeyTypes are the host key types the vendored golang.org/x/crypto/ssh can parse. It only reads
+// PEM keys, and ssh-keygen writes ed25519 keys in the OpenSSH format only, so ed25519 isn't one of them.
+var parseableHostKeyTypes = map[string]bool{"rsa": true, "ecdsa": true, "dsa": true}
+
 // ParseHostKeys parses the host key files.
 //
-// By default it looks in /etc/ssh for host keys of the patterh ssh_host_{{TYPE}}_key.
+// By default it looks in /etc/ssh for host keys of the patterh ssh_host_{{TYPE}}_key. A DSA key is only
+// parsed if dsa is one of keytypes, and a deprecation warning is logged when it is.
+//
+// If paths is given, exactly those files are parsed instead, e.g. keys mounted from a Kubernetes secret.
+// Listing a DSA key there opts in to it, and keytypes and path are ignored.
+//
+// A summary of the loaded and skipped keys is logged. It fails if no host key could be loaded, since the
+// server would refuse every connection without one.
 //
 // Params:
-// 	- keytypes ([]string): Key types to parse. Defaults to []string{rsa, dsa, ecdsa}
+// 	- keytypes ([]string): Key types to parse. Defaults to DefaultHostKeyTypes.
 // 	- enableV1 (bool): Allow V1 keys. By default this is disabled.
 // 	- path (string): Override the lookup pattern. If %s, it will be replaced with the keytype.
+// 	- dir (string): Look for the keys of the pattern ssh_host_{{TYPE}}_key in dir instead, as generated by
+// 	  GenSSHKeys. Overrides path.
+// 	- paths ([]string): The host key files to parse. Defaults to none, which uses the lookup pattern.
 //
 // Returns:
 // 	[]ssh.Signer
 func ParseHostKeys(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
 	log.Debugf(c, "Parsing ssh host keys")
-	hostKeyTypes := p.Get("keytypes", []string{"rsa", "dsa", "ecdsa"}).([]string)
+	hostKeyTypes := p.Get("keytypes", DefaultHostKeyTypes).([]string)
 	pathTpl := p.Get("path", "/etc/ssh/ssh_host_%s_key").(string)
-	hostKeys := make([]ssh.Signer, 0, len(hostKeyTypes))
-	for _, t := range hostKeyTypes {
-		path := fmt.Sprintf(pathTpl, t)
-
-		if key, err := ioutil.ReadFile(path); err == nil {
-			if hk, err := ssh.ParsePrivateKey(key); err == nil {
-				log.Infof(c, "Parsed host key %s.", path)
-				hostKeys = append(hostKeys, hk)
-			} else {
-				log.Errf(c, "Failed to parse host key %s (skipping): %s", path, err)
+	if dir, _ := p.Get("dir", "").(string); dir != "" {
+		pathTpl = filepath.Join(dir, hostKeyName)
+	}
+	paths, _ := p.Get("paths", nil).([]string)
+	explicit := len(paths) > 0
+	if !explicit {
+		for _, t := range hostKeyTypes {
+			paths = append(paths, fmt.Sprintf(pathTpl, t))
+		}
+	}
+	hostKeys := make([]ssh.Signer, 0, len(paths))
+	skipped := 0
+	for _, path := range paths {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			// not every type of key in the lookup pattern has to exist, but listed keys do
+			if explicit {
+				log.Errf(c, "Failed to read host key %s (skipping): %s", path, err)
+				skipped++
 			}
+			continue
+		}
+		hk, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Errf(c, "Failed to parse host key %s (skipping): %s", path, err)
+			skipped++
+			continue
+		}
+		log.Infof(c, "Parsed host key %s.", path)
+		if hk.PublicKey().Type() == ssh.KeyAlgoDSA {
+			log.Warnf(c, "Host key %s is a DSA key. DSA is deprecated and disabled by modern OpenSSH clients, use rsa or ecdsa instead.", path)
 		}
+		hostKeys = append(hostKeys, hk)
 	}
 	if c.Get("enableV1", false).(bool) {
 		path := "/etc/ssh/ssh_host_key"
@@ -55,38 +116,245 @@ func ParseHostKeys(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Inte
 			hostKeys = append(hostKeys, hk)
 		} else {
 			log.Errf(c, "Failed to parse host key %s: %s", path, err)
+			skipped++
 		}
 	}
+	log.Infof(c, "Loaded %d host keys, skipped %d.", len(hostKeys), skipped)
+	if len(hostKeys) == 0 {
+		return nil, fmt.Errorf("no host keys could be loaded from %s", strings.Join(paths, ", "))
+	}
 	return hostKeys, nil
 }
 
 // AuthKey authenticates based on a public key.
 //
+// The key must be in the authorizedKeys file. The comment of the matching entry is the name of the user,
+// which is returned in the "user" extension of the permissions. Keys found in adminKeys are given the
+// admin scope. All other allowed keys are given the user scope.
+//
+// An authorized key can be limited to some apps with an apps option, for builders shared by several teams:
+//
+//	apps="myapp,otherapp" ssh-rsa AAAA... alice
+//
+// The apps are returned in the AppsExtension, and pushes to other apps are rejected. Keys without the option
+// may push to any app.
+//
+// If userCache is given, the key is instead looked up in the Deis controller, and the user is the Deis user
+// the key belongs to, with the apps they may push to in the AppsExtension. Auth is denied if the controller doesn't answer within controllerTimeout.
+//
+// Keys that keyPolicy doesn't allow are rejected with an error before they are looked up, and keys that
+// aren't authorized with an error saying why. Permissions are only returned for authorized keys.
+//
+// Every attempt is logged with the client's address and the key's fingerprint, and rejected keys are
+// logged as warnings.
+//
 // Params:
 // 	- metadata (ssh.ConnMetadata)
 // 	- key (ssh.PublicKey)
+// 	- authorizedKeys (string): Path to an authorized_keys file. Defaults to /etc/deistest.pub.
+// 	- adminKeys (string): Path to an authorized_keys file of admin keys. Defaults to none.
+// 	- userCache (*controller.UserCache): Look keys up in the controller, caching them here. Defaults to nil.
+// 	- controllerTimeout (time.Duration): Maximum time to wait for the controller. Defaults to 5 seconds.
+// 	- fingerprintAlgorithm (string): Algorithm used to fingerprint key in the auth log. Defaults to sha256.
+// 	- keyPolicy (KeyPolicy): The key algorithms and sizes allowed. Defaults to allowing any key.
 //
 // Returns:
 // 	*ssh.Permissions
 //
 func AuthKey(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
 	log.Debugf(c, "Starting ssh authentication")
+	metadata, _ := p.Get("metadata", nil).(ssh.ConnMetadata)
 	key := p.Get("key", nil).(ssh.PublicKey)
-	allowedkey, _ := ioutil.ReadFile("/etc/deistest.pub")
-	allowed, _, _, _, err := ssh.ParseAuthorizedKey(allowedkey)
-	fmt.Println(err)
-	fmt.Println(allowed)
-	fmt.Println(key)
-	if compareKeys(key, allowed) {
-		perm := &ssh.Permissions{
-			Extensions: map[string]string{
-				"user": "builder",
-			},
-		}
-		return perm, nil
+	authorizedKeys := p.Get("authorizedKeys", "/etc/deistest.pub").(string)
+	adminKeys := p.Get("adminKeys", "").(string)
+	userCache, _ := p.Get("userCache", nil).(*controller.UserCache)
+	controllerTimeout := p.Get("controllerTimeout", 5*time.Second).(time.Duration)
+	fingerprintAlgorithm, _ := p.Get("fingerprintAlgorithm", FingerprintSHA256).(string)
+	policy, _ := p.Get("keyPolicy", KeyPolicy{}).(KeyPolicy)
+
+	if err := policy.Check(key); err != nil {
+		err = fmt.Errorf("key rejected by the key policy: %s", err)
+		logAuthAttempt(c, metadata, key, fingerprintAlgorithm, "", err)
+		return nil, err
 	}
-	return nil, nil
+	user, scope, apps, err := authorizeKey(c, key, authorizedKeys, adminKeys, userCache, controllerTimeout)
+	logAuthAttempt(c, metadata, key, fingerprintAlgorithm, user, err)
+	if err != nil {
+		return nil, err
+	}
+	perm := keyPermissions(key, user, scope)
+	if apps != nil {
+		perm.Extensions[AppsExtension] = strings.Join(apps, ",")
+	}
+	return perm, nil
+}
 
+// authorizeKey returns the user and scope key is authorized for, and the apps the user may push to if the
+// controller or the key's apps option limit them, or an error saying why it isn't authorized.
+func authorizeKey(c cookoo.Context, key ssh.PublicKey, authorizedKeys, adminKeys string, userCache *controller.UserCache, controllerTimeout time.Duration) (string, string, []string, error) {
+	if adminKeys != "" {
+		if allowed, ok := findAuthorizedKey(c, adminKeys, key); ok {
+			return allowed.user, ScopeAdmin, nil, nil
+		}
+	}
+	if userCache != nil {
+		info, err := controller.CachedUserInfoFromKey(userCache, key, controllerTimeout)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("controller lookup failed: %s", err)
+		}
+		apps := info.Apps
+		if apps == nil {
+			// a user without apps may push to none of them
+			apps = []string{}
+		}
+		return info.Username, ScopeUser, apps, nil
+	}
+	if allowed, ok := findAuthorizedKey(c, authorizedKeys, key); ok {
+		return allowed.user, ScopeUser, allowed.apps, nil
+	}
+	return "", "", nil, fmt.Errorf("no authorized %s key matched", key.Type())
+}
+
+// logAuthAttempt logs the outcome of a public key auth attempt, with the client's address, version and
+// session ID from m if there is one. Rejected keys are logged as warnings, so that intrusion detection
+// watching the logs can pick them up.
+func logAuthAttempt(c cookoo.Context, m ssh.ConnMetadata, key ssh.PublicKey, algorithm, user string, authErr error) {
+	fields := jsonlog.Fields{
+		"remote_addr": "unknown",
+		"key_type":    key.Type(),
+		"fingerprint": fingerprintKey(key, algorithm),
+	}
+	client := ""
+	if m != nil {
+		fields["remote_addr"] = m.RemoteAddr().String()
+		fields["remote_ip"] = remoteIP(m.RemoteAddr())
+		fields["client_version"] = string(m.ClientVersion())
+		fields["session_id"] = hex.EncodeToString(m.SessionID())
+		fields["ssh_user"] = m.User()
+		client = fmt.Sprintf(" (client %q, session %s)", fields["client_version"], fields["session_id"])
+	}
+	if authErr != nil {
+		fields["auth"] = "failed"
+		log.Warnf(c, "%s", jsonlog.Tag(fmt.Sprintf("Rejected %s key %s from %s%s: %s",
+			fields["key_type"], fields["fingerprint"], fields["remote_addr"], client, authErr), fields))
+		return
+	}
+	fields["auth"] = "success"
+	fields["user"] = user
+	log.Infof(c, "%s", jsonlog.Tag(fmt.Sprintf("Accepted %s key %s for %s from %s%s",
+		fields["key_type"], fields["fingerprint"], user, fields["remote_addr"], client), fields))
+}
+
+// defaultKeyUser is the user of authorized keys that have no comment.
+const defaultKeyUser = "builder"
+
+func keyPermissions(key ssh.PublicKey, user, scope string) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"user":         user,
+			ScopeExtension: scope,
+			KeyExtension:   string(ssh.MarshalAuthorizedKey(key)),
+		},
+	}
+}
+
+// KeyFromPermissions returns the key that perm was granted to, or nil if there is none.
+func KeyFromPermissions(perm *ssh.Permissions) ssh.PublicKey {
+	if perm == nil || perm.Extensions[KeyExtension] == "" {
+		return nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(perm.Extensions[KeyExtension]))
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// authorizedKey is a single entry of an authorized_keys file.
+type authorizedKey struct {
+	key  ssh.PublicKey
+	user string
+	// apps are the apps the key may push to, from its apps option, or nil if it may push to any
+	apps []string
+}
+
+// appsOption is the authorized_keys option that limits the apps a key may push to
+const appsOption = "apps="
+
+// parseAuthorizedKeys parses the contents of an authorized_keys file, one key per line. Blank lines, comment
+// lines starting with # and malformed entries are skipped.
+func parseAuthorizedKeys(c cookoo.Context, data []byte) []authorizedKey {
+	var keys []authorizedKey
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			log.Warnf(c, "Skipping malformed authorized key on line %d: %s", i+1, err)
+			continue
+		}
+		user := comment
+		if user == "" {
+			user = defaultKeyUser
+		}
+		keys = append(keys, authorizedKey{key: key, user: user, apps: keyApps(options)})
+	}
+	return keys
+}
+
+// keyApps returns the apps of the apps option in the options of an authorized key, or nil if there is none.
+// An empty apps option allows no apps.
+func keyApps(options []string) []string {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, appsOption) {
+			apps := splitList(strings.Trim(strings.TrimPrefix(opt, appsOption), `"`))
+			if apps == nil {
+				apps = []string{}
+			}
+			return apps
+		}
+	}
+	return nil
+}
+
+// findAuthorizedKey returns the entry of key if it is in the authorized_keys file at path.
+func findAuthorizedKey(c cookoo.Context, path string, key ssh.PublicKey) (authorizedKey, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Warnf(c, "Failed to read authorized keys %s: %s", path, err)
+		return authorizedKey{}, false
+	}
+	for _, allowed := range parseAuthorizedKeys(c, data) {
+		if compareKeys(key, allowed.key) {
+			return allowed, true
+		}
+	}
+	return authorizedKey{}, false
+}
+
+// AppsFromPermissions returns the apps that perm's user may push to, and false if perm doesn't limit them.
+func AppsFromPermissions(perm *ssh.Permissions) ([]string, bool) {
+	if perm == nil {
+		return nil, false
+	}
+	raw, ok := perm.Extensions[AppsExtension]
+	if !ok {
+		return nil, false
+	}
+	var apps []string
+	for _, app := range strings.Split(raw, ",") {
+		if app != "" {
+			apps = append(apps, app)
+		}
+	}
+	return apps, true
+}
+
+// IsAdmin reports whether perm was granted to a key with the admin scope.
+func IsAdmin(perm *ssh.Permissions) bool {
+	return perm != nil && perm.Extensions[ScopeExtension] == ScopeAdmin
 }
 
 func compareKeys(a, b ssh.PublicKey) bool {
@@ -114,21 +382,51 @@ func Configure(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrup
 
 	cfg := &ssh.ServerConfig{
 		PublicKeyCallback: func(m ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
-			c.Put("metadata", m)
-			c.Put("key", k)
+			// Handshakes run concurrently and the router doesn't copy the context, so each attempt gets
+			// its own copy. Otherwise one connection could be given the permissions of another.
+			cxt := c.Copy()
+			cxt.Put("metadata", m)
+			cxt.Put("key", k)
 
-			pubkeyAuth := c.Get("route.sshd.pubkeyAuth", "pubkeyAuth").(string)
-			err := router.HandleRequest(pubkeyAuth, c, true)
-			return c.Get("pubkeyAuth", &ssh.Permissions{}).(*ssh.Permissions), err
+			// the permissions of an earlier attempt must not be mistaken for this one's
+			cxt.Put("authN", nil)
+
+			pubkeyAuth := cxt.Get("route.sshd.pubkeyAuth", "pubkeyAuth").(string)
+			if err := router.HandleRequest(pubkeyAuth, cxt, true); err != nil {
+				return nil, err
+			}
+			// a key is only authenticated by the permissions AuthKey gives it, never by the lack of an error
+			perm, ok := cxt.Get("authN", nil).(*ssh.Permissions)
+			if !ok || perm == nil {
+				return nil, errNoPermissions
+			}
+			return perm, nil
 		},
 	}
 
 	return cfg, nil
 }
 
+// hostKeyName is the file name pattern of the host keys in a host key dir, as in /etc/ssh.
+const hostKeyName = "ssh_host_%s_key"
+
+// errNoPermissions rejects a key when authentication neither failed nor returned permissions for it.
+var errNoPermissions = errors.New("public key authentication returned no permissions")
+
 // GenSSHKeys generates the default set of SSH host keys.
+//
+// If dir is given, the keys of keytypes are generated in dir instead of /etc/ssh, and only the ones that
+// aren't there yet. With dir on a persistent volume, the host keys, and so the fingerprints clients know
+// the builder by, survive restarts.
+//
+// Params:
+// 	- dir (string): The dir to keep host keys in. Defaults to none, which generates them in /etc/ssh.
+// 	- keytypes ([]string): Key types to generate in dir. Defaults to DefaultHostKeyTypes.
 func GenSSHKeys(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
 	log.Debugf(c, "Generating ssh keys for sshd")
+	if dir, _ := p.Get("dir", "").(string); dir != "" {
+		return nil, genHostKeys(c, dir, p.Get("keytypes", DefaultHostKeyTypes).([]string))
+	}
 	// Generate a new key
 	out, err := exec.Command("ssh-keygen", "-A").CombinedOutput()
 	if err != nil {
@@ -138,11 +436,69 @@ func GenSSHKeys(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interru
 	return nil, nil
 }
 
-// Fingerprint generates a colon-separated fingerprint string from a public key.
-func Fingerprint() string {
-	allowedkey, _ := ioutil.ReadFile("/etc/deistest.pub")
-	key, _, _, _, err := ssh.ParseAuthorizedKey(allowedkey)
-	fmt.Println(err)
+// genHostKeys generates the keys of keyTypes in dir that don't exist yet.
+func genHostKeys(c cookoo.Context, dir string, keyTypes []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, t := range keyTypes {
+		if !parseableHostKeyTypes[t] {
+			log.Warnf(c, "Not generating a %s host key, it could not be loaded.", t)
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf(hostKeyName, t))
+		if _, err := os.Stat(path); err == nil {
+			log.Infof(c, "Keeping existing host key %s.", path)
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		log.Infof(c, "Generating host key %s.", path)
+		// PEM, because ParseHostKeys can't parse rsa, dsa and ecdsa keys in the newer OpenSSH format
+		if out, err := exec.Command("ssh-keygen", "-q", "-t", t, "-m", "PEM", "-N", "", "-f", path).CombinedOutput(); err != nil {
+			log.Infof(c, "ssh-keygen: %s", out)
+			return fmt.Errorf("generating %s host key %s (%s)", t, path, err)
+		}
+	}
+	return nil
+}
+
+// Fingerprint algorithms supported by Fingerprint.
+const (
+	// FingerprintSHA256 produces OpenSSH's SHA256:<base64> fingerprints.
+	FingerprintSHA256 = "sha256"
+	// FingerprintMD5 produces legacy colon-separated MD5 fingerprints, for controllers that match on them.
+	FingerprintMD5 = "md5"
+)
+
+// CheckFingerprintAlgorithm returns an error if algorithm is not one of the Fingerprint* algorithms.
+func CheckFingerprintAlgorithm(algorithm string) error {
+	switch algorithm {
+	case FingerprintSHA256, FingerprintMD5:
+		return nil
+	}
+	return fmt.Errorf("unknown fingerprint algorithm %q, expected %q or %q", algorithm, FingerprintSHA256, FingerprintMD5)
+}
+
+// Fingerprint generates a fingerprint string from a public key with the given algorithm, one of the
+// Fingerprint* constants. It returns an empty string if there is no key.
+func Fingerprint(key ssh.PublicKey, algorithm string) string {
+	if key == nil {
+		return ""
+	}
+	return fingerprintKey(key, algorithm)
+}
+
+func fingerprintKey(key ssh.PublicKey, algorithm string) string {
+	if algorithm == FingerprintMD5 {
+		return md5Fingerprint(key)
+	}
+	hash := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// md5Fingerprint generates a colon-separated MD5 fingerprint string from a public key.
+func md5Fingerprint(key ssh.PublicKey) string {
 	hash := md5.Sum(key.Marshal())
 	buf := make([]byte, hex.EncodedLen(len(hash)))
 	hex.Encode(buf, hash[:])
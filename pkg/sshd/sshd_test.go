@@ -0,0 +1,635 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key (%s)", err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("creating public key (%s)", err)
+	}
+	return pub
+}
+
+func authorizedKeyLine(key ssh.PublicKey, comment string) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + comment
+}
+
+func writeKeysFile(t *testing.T, dir, name string, lines ...string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("writing %s (%s)", path, err)
+	}
+	return path
+}
+
+func authKey(t *testing.T, key ssh.PublicKey, authorizedKeys, adminKeys string) *ssh.Permissions {
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"key":            key,
+		"authorizedKeys": authorizedKeys,
+		"adminKeys":      adminKeys,
+	})
+	perm, err := AuthKey(cookoo.NewContext(), params)
+	if (err == nil) != (perm != nil) {
+		t.Fatalf("expected either permissions or an error, got %v and %v", perm, err)
+	}
+	if err != nil {
+		return nil
+	}
+	return perm.(*ssh.Permissions)
+}
+
+func TestAuthKeyMultipleKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice, bob, admin, stranger := testPublicKey(t), testPublicKey(t), testPublicKey(t), testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys",
+		"# deis users",
+		"",
+		authorizedKeyLine(alice, "alice"),
+		"ssh-rsa not-a-valid-key broken",
+		"   ",
+		authorizedKeyLine(bob, "bob"),
+	)
+	adminKeys := writeKeysFile(t, dir, "admin_keys", authorizedKeyLine(admin, "root"))
+
+	for _, c := range []struct {
+		key   ssh.PublicKey
+		user  string
+		scope string
+	}{
+		{alice, "alice", ScopeUser},
+		{bob, "bob", ScopeUser},
+		{admin, "root", ScopeAdmin},
+	} {
+		perm := authKey(t, c.key, authorizedKeys, adminKeys)
+		if perm == nil {
+			t.Errorf("expected %s to be authenticated", c.user)
+			continue
+		}
+		if perm.Extensions["user"] != c.user {
+			t.Errorf("expected user %s, got %s", c.user, perm.Extensions["user"])
+		}
+		if perm.Extensions[ScopeExtension] != c.scope {
+			t.Errorf("expected %s to have scope %s, got %s", c.user, c.scope, perm.Extensions[ScopeExtension])
+		}
+	}
+
+	if perm := authKey(t, stranger, authorizedKeys, adminKeys); perm != nil {
+		t.Errorf("expected an unknown key not to be authenticated, got %+v", perm)
+	}
+}
+
+func TestAuthKeyAppsOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	payments, search, none, anyApp := testPublicKey(t), testPublicKey(t), testPublicKey(t), testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys",
+		`apps="checkout,billing" `+authorizedKeyLine(payments, "payments"),
+		`no-pty,apps="search" `+authorizedKeyLine(search, "search"),
+		`apps="" `+authorizedKeyLine(none, "nobody"),
+		authorizedKeyLine(anyApp, "ops"),
+	)
+	for _, c := range []struct {
+		key     ssh.PublicKey
+		user    string
+		apps    []string
+		limited bool
+	}{
+		{payments, "payments", []string{"checkout", "billing"}, true},
+		{search, "search", []string{"search"}, true},
+		{none, "nobody", nil, true},
+		{anyApp, "ops", nil, false},
+	} {
+		perm := authKey(t, c.key, authorizedKeys, "")
+		if perm == nil {
+			t.Errorf("expected %s to be authenticated", c.user)
+			continue
+		}
+		apps, limited := AppsFromPermissions(perm)
+		if limited != c.limited || !reflect.DeepEqual(apps, c.apps) {
+			t.Errorf("expected %s to be limited (%t) to %v, got %v (%t)", c.user, c.limited, c.apps, apps, limited)
+		}
+	}
+}
+
+// publicKeyCallback returns the PublicKeyCallback of Configure, with auth as the pubkeyAuth route
+func publicKeyCallback(t *testing.T, authorizedKeys string, auth cookoo.Command) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	reg, router, cxt := cookoo.Cookoo()
+	cxt.Put("cookoo.Router", router)
+	cxt.Put(AuthorizedKeys, authorizedKeys)
+	reg.AddRoute(cookoo.Route{
+		Name: "pubkeyAuth",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "authN",
+				Fn:   auth,
+				Using: []cookoo.Param{
+					{Name: "key", From: "cxt:key"},
+					{Name: "authorizedKeys", From: "cxt:" + AuthorizedKeys},
+				},
+			},
+		},
+	})
+	cfg, err := Configure(cxt, nil)
+	if err != nil {
+		t.Fatalf("configuring server (%s)", err)
+	}
+	return cfg.(*ssh.ServerConfig).PublicKeyCallback
+}
+
+func TestConfigurePublicKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	key, stranger := testPublicKey(t), testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys", authorizedKeyLine(key, "alice"))
+
+	callback := publicKeyCallback(t, authorizedKeys, AuthKey)
+	perm, err := callback(fakeConnMetadata{}, key)
+	if err != nil || perm == nil || perm.Extensions["user"] != "alice" {
+		t.Errorf("expected the authorized key to be allowed as alice, got %v (%v)", perm, err)
+	}
+	if perm, err := callback(fakeConnMetadata{}, stranger); err == nil || perm != nil {
+		t.Errorf("expected an unknown key to be rejected, got %v", perm)
+	}
+}
+
+func TestConfigureRejectsAuthWithoutPermissions(t *testing.T) {
+	key := testPublicKey(t)
+	// an auth route that forgets to fail only returns permissions for key
+	callback := publicKeyCallback(t, "", func(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+		if p.Get("key", nil).(ssh.PublicKey) == key {
+			return keyPermissions(key, "alice", ScopeUser), nil
+		}
+		return nil, nil
+	})
+	if _, err := callback(fakeConnMetadata{}, key); err != nil {
+		t.Fatalf("expected key to be allowed (%s)", err)
+	}
+	// the permissions of the last attempt are not mistaken for this one's
+	if perm, err := callback(fakeConnMetadata{}, testPublicKey(t)); err != errNoPermissions || perm != nil {
+		t.Errorf("expected a key without permissions to be rejected, got %v (%v)", perm, err)
+	}
+}
+
+func TestConfigureConcurrentCallbacks(t *testing.T) {
+	users := map[string]string{}
+	keys := make([]ssh.PublicKey, 4)
+	for i := range keys {
+		keys[i] = testPublicKey(t)
+		users[string(keys[i].Marshal())] = fmt.Sprintf("user%d", i)
+	}
+	// an auth route that takes a while and then reads the key from its context, as a later command of the
+	// route would, so that the attempts overlap
+	callback := publicKeyCallback(t, "", func(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+		time.Sleep(time.Millisecond)
+		key := c.Get("key", nil).(ssh.PublicKey)
+		return keyPermissions(key, users[string(key.Marshal())], ScopeUser), nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		key := keys[i%len(keys)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			perm, err := callback(fakeConnMetadata{}, key)
+			if expected := users[string(key.Marshal())]; err != nil || perm.Extensions["user"] != expected {
+				errs <- fmt.Sprintf("expected %s, got %v (%v)", expected, perm, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestParseAuthorizedKeysDefaultUser(t *testing.T) {
+	key := testPublicKey(t)
+	keys := parseAuthorizedKeys(cookoo.NewContext(), ssh.MarshalAuthorizedKey(key))
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(keys))
+	}
+	if keys[0].user != defaultKeyUser {
+		t.Errorf("expected a key without a comment to belong to %s, got %s", defaultKeyUser, keys[0].user)
+	}
+}
+
+func TestAuthKeyWritesNothingToStdout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	key, stranger := testPublicKey(t), testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys", authorizedKeyLine(key, "alice"), "not a key")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe (%s)", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	authKey(t, key, authorizedKeys, "")
+	authKey(t, stranger, authorizedKeys, "")
+	Fingerprint(key, FingerprintSHA256)
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading captured stdout (%s)", err)
+	}
+	if len(out) > 0 {
+		t.Errorf("expected nothing on stdout during auth, got %q", out)
+	}
+}
+
+func TestFingerprintKey(t *testing.T) {
+	data, err := ioutil.ReadFile("test_host_rsa_key_do_not_use.pub")
+	if err != nil {
+		t.Fatalf("reading test key (%s)", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatalf("parsing test key (%s)", err)
+	}
+
+	// expected values are from ssh-keygen -l -E <algorithm>
+	if fp := fingerprintKey(key, FingerprintSHA256); fp != "SHA256:RU8bFIhWvz0xV+TqUrJQr39Ia9yiAMf01zgOnCxwn94" {
+		t.Errorf("unexpected SHA256 fingerprint %s", fp)
+	}
+	if fp := fingerprintKey(key, FingerprintMD5); fp != "4e:c2:3e:a0:c1:87:22:b6:83:00:62:0a:de:02:6d:53" {
+		t.Errorf("unexpected MD5 fingerprint %s", fp)
+	}
+	if err := CheckFingerprintAlgorithm("sha1"); err == nil {
+		t.Errorf("expected an unknown fingerprint algorithm to be rejected")
+	}
+}
+
+func TestFingerprintDistinctKeys(t *testing.T) {
+	a, b := testPublicKey(t), testPublicKey(t)
+	for _, algorithm := range []string{FingerprintSHA256, FingerprintMD5} {
+		if Fingerprint(a, algorithm) == Fingerprint(b, algorithm) {
+			t.Errorf("expected different keys to have different %s fingerprints", algorithm)
+		}
+		if Fingerprint(a, algorithm) != Fingerprint(a, algorithm) {
+			t.Errorf("expected the %s fingerprint of a key to be stable", algorithm)
+		}
+	}
+	if fp := Fingerprint(nil, FingerprintSHA256); fp != "" {
+		t.Errorf("expected no fingerprint without a key, got %s", fp)
+	}
+}
+
+func TestKeyFromPermissions(t *testing.T) {
+	key := testPublicKey(t)
+	got := KeyFromPermissions(keyPermissions(key, "alice", ScopeUser))
+	if got == nil || !compareKeys(key, got) {
+		t.Errorf("expected the authenticated key to be stashed in the permissions")
+	}
+	if KeyFromPermissions(nil) != nil || KeyFromPermissions(&ssh.Permissions{}) != nil {
+		t.Errorf("expected no key without auth permissions")
+	}
+}
+
+func TestAppsFromPermissions(t *testing.T) {
+	perm := keyPermissions(testPublicKey(t), "alice", ScopeUser)
+	if apps, ok := AppsFromPermissions(perm); ok {
+		t.Errorf("expected keys from authorized_keys not to limit apps, got %v", apps)
+	}
+	perm.Extensions[AppsExtension] = "myapp,otherapp"
+	if apps, ok := AppsFromPermissions(perm); !ok || len(apps) != 2 || apps[0] != "myapp" || apps[1] != "otherapp" {
+		t.Errorf("expected myapp and otherapp, got %v (%t)", apps, ok)
+	}
+	perm.Extensions[AppsExtension] = ""
+	if apps, ok := AppsFromPermissions(perm); !ok || len(apps) != 0 {
+		t.Errorf("expected a user without apps to be limited to none, got %v (%t)", apps, ok)
+	}
+	if _, ok := AppsFromPermissions(nil); ok {
+		t.Errorf("expected no limit without permissions")
+	}
+}
+
+// fakeConnMetadata is the ssh.ConnMetadata of a client connecting from 192.0.2.10.
+type fakeConnMetadata struct{}
+
+func (fakeConnMetadata) User() string          { return "git" }
+func (fakeConnMetadata) SessionID() []byte     { return []byte{0xde, 0xad, 0xbe, 0xef} }
+func (fakeConnMetadata) ClientVersion() []byte { return []byte("SSH-2.0-OpenSSH_7.2") }
+func (fakeConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-Go") }
+func (fakeConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 52000}
+}
+func (fakeConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2223}
+}
+
+func TestAuthKeyLogsAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	key, stranger := testPublicKey(t), testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys", authorizedKeyLine(key, "alice"))
+
+	tests := []struct {
+		key      ssh.PublicKey
+		accepted bool
+		expected []string
+	}{
+		{key, true, []string{"[info] ", "Accepted", "for alice", "192.0.2.10:52000", "SSH-2.0-OpenSSH_7.2", "deadbeef", Fingerprint(key, FingerprintSHA256)}},
+		{stranger, false, []string{"[warning] ", "Rejected", "192.0.2.10:52000", "SSH-2.0-OpenSSH_7.2", "deadbeef", Fingerprint(stranger, FingerprintSHA256), "no authorized"}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c := cookoo.NewContext()
+		c.AddLogger("test", &buf)
+		params := cookoo.NewParamsWithValues(map[string]interface{}{
+			"metadata":       fakeConnMetadata{},
+			"key":            test.key,
+			"authorizedKeys": authorizedKeys,
+		})
+		perm, err := AuthKey(c, params)
+		if (perm != nil) != test.accepted || (err == nil) != test.accepted {
+			t.Errorf("expected accepted to be %t, got permissions %v and error %v", test.accepted, perm, err)
+		}
+		for _, s := range test.expected {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("expected auth log to contain %q, got %q", s, buf.String())
+			}
+		}
+	}
+}
+
+// ipv6ConnMetadata is the ssh.ConnMetadata of a client connecting from 2001:db8::10.
+type ipv6ConnMetadata struct{ fakeConnMetadata }
+
+func (ipv6ConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 52000}
+}
+
+func TestAuthKeyLogsIPv6Attempts(t *testing.T) {
+	os.Setenv("LOG_FORMAT", "json")
+	defer os.Unsetenv("LOG_FORMAT")
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	key := testPublicKey(t)
+	authorizedKeys := writeKeysFile(t, dir, "authorized_keys", authorizedKeyLine(key, "alice"))
+
+	var buf bytes.Buffer
+	c := cookoo.NewContext()
+	c.AddLogger("test", &buf)
+	params := cookoo.NewParamsWithValues(map[string]interface{}{
+		"metadata":       ipv6ConnMetadata{},
+		"key":            key,
+		"authorizedKeys": authorizedKeys,
+	})
+	if _, err := AuthKey(c, params); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"from [2001:db8::10]:52000", `remote_addr="[2001:db8::10]:52000"`, `remote_ip="2001:db8::10"`} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected auth log to contain %q, got %q", s, buf.String())
+		}
+	}
+}
+
+// writeHostKeys writes an RSA and a DSA host key to dir, named like the host keys in /etc/ssh, and returns
+// the path pattern of ParseHostKeys for them
+func writeHostKeys(t *testing.T, dir string) string {
+	rsaKey, err := ioutil.ReadFile("test_host_rsa_key_do_not_use")
+	if err != nil {
+		t.Fatalf("reading test host key (%s)", err)
+	}
+	var priv dsa.PrivateKey
+	if err := dsa.GenerateParameters(&priv.Parameters, rand.Reader, dsa.L1024N160); err != nil {
+		t.Fatalf("generating DSA parameters (%s)", err)
+	}
+	if err := dsa.GenerateKey(&priv, rand.Reader); err != nil {
+		t.Fatalf("generating DSA key (%s)", err)
+	}
+	der, err := asn1.Marshal(struct {
+		Version       int
+		P, Q, G, Y, X *big.Int
+	}{0, priv.P, priv.Q, priv.G, priv.Y, priv.X})
+	if err != nil {
+		t.Fatalf("encoding DSA key (%s)", err)
+	}
+	dsaKey := pem.EncodeToMemory(&pem.Block{Type: "DSA PRIVATE KEY", Bytes: der})
+	for name, key := range map[string][]byte{"ssh_host_rsa_key": rsaKey, "ssh_host_dsa_key": dsaKey} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), key, 0600); err != nil {
+			t.Fatalf("writing %s (%s)", name, err)
+		}
+	}
+	return filepath.Join(dir, "ssh_host_%s_key")
+}
+
+func parseHostKeys(t *testing.T, values map[string]interface{}) []ssh.Signer {
+	keys, err := ParseHostKeys(cookoo.NewContext(), cookoo.NewParamsWithValues(values))
+	if err != nil {
+		t.Fatalf("parsing host keys (%s)", err)
+	}
+	return keys.([]ssh.Signer)
+}
+
+func hostKeyTypes(keys []ssh.Signer) string {
+	var types []string
+	for _, k := range keys {
+		types = append(types, k.PublicKey().Type())
+	}
+	return strings.Join(types, ",")
+}
+
+func TestParseHostKeysSkipsDSA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	pathTpl := writeHostKeys(t, dir)
+
+	keys := parseHostKeys(t, map[string]interface{}{"path": pathTpl})
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoRSA {
+		t.Errorf("expected only the RSA host key to be loaded by default, got %s", types)
+	}
+
+	keys = parseHostKeys(t, map[string]interface{}{"path": pathTpl, "keytypes": []string{"rsa", "dsa"}})
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoDSA {
+		t.Errorf("expected the DSA host key to be loaded when asked for, got %s", types)
+	}
+}
+
+func TestParseHostKeysPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	writeHostKeys(t, dir)
+	// keys mounted from a secret have names that don't follow any pattern
+	secretKey := filepath.Join(dir, "host-key")
+	if err := os.Rename(filepath.Join(dir, "ssh_host_rsa_key"), secretKey); err != nil {
+		t.Fatalf("renaming host key (%s)", err)
+	}
+
+	paths := []string{secretKey, filepath.Join(dir, "missing")}
+	keys := parseHostKeys(t, map[string]interface{}{"paths": paths, "path": filepath.Join(dir, "ssh_host_%s_key")})
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoRSA {
+		t.Errorf("expected only the listed host key to be loaded, got %s", types)
+	}
+
+	keys = parseHostKeys(t, map[string]interface{}{"path": filepath.Join(dir, "ssh_host_%s_key"), "keytypes": []string{"rsa", "dsa"}})
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoDSA {
+		t.Errorf("expected the lookup pattern to be used without paths, got %s", types)
+	}
+}
+
+func TestParseHostKeysNoneLoaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"ssh_host_rsa_key", "ssh_host_ecdsa_key"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("not a key"), 0600); err != nil {
+			t.Fatalf("writing %s (%s)", name, err)
+		}
+	}
+
+	_, interrupt := ParseHostKeys(cookoo.NewContext(), cookoo.NewParamsWithValues(map[string]interface{}{"dir": dir}))
+	err, ok := interrupt.(error)
+	if !ok {
+		t.Fatalf("expected parsing a directory of unparseable host keys to fail, got %v", interrupt)
+	}
+	if !strings.Contains(err.Error(), "no host keys") {
+		t.Errorf("expected an error saying no host keys were loaded, got %s", err)
+	}
+}
+
+func TestGenSSHKeysDir(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir := filepath.Join(dir, "keys")
+	genKeys := func() {
+		params := cookoo.NewParamsWithValues(map[string]interface{}{"dir": keyDir, "keytypes": []string{"rsa", "ecdsa"}})
+		if _, err := GenSSHKeys(cookoo.NewContext(), params); err != nil {
+			t.Fatalf("generating host keys (%s)", err)
+		}
+	}
+	readKey := func(keyType string) string {
+		key, err := ioutil.ReadFile(filepath.Join(keyDir, "ssh_host_"+keyType+"_key"))
+		if err != nil {
+			t.Fatalf("reading %s host key (%s)", keyType, err)
+		}
+		return string(key)
+	}
+
+	genKeys()
+	rsaKey, ecdsaKey := readKey("rsa"), readKey("ecdsa")
+	keys := parseHostKeys(t, map[string]interface{}{"dir": keyDir, "keytypes": []string{"rsa", "ecdsa"}})
+	if types := hostKeyTypes(keys); types != ssh.KeyAlgoRSA+","+ssh.KeyAlgoECDSA256 {
+		t.Errorf("expected the generated host keys to be parsed from the dir, got %s", types)
+	}
+
+	if err := os.Remove(filepath.Join(keyDir, "ssh_host_ecdsa_key")); err != nil {
+		t.Fatalf("removing ecdsa host key (%s)", err)
+	}
+	genKeys()
+	if readKey("rsa") != rsaKey {
+		t.Errorf("expected the existing RSA host key not to be regenerated")
+	}
+	if key := readKey("ecdsa"); key == ecdsaKey {
+		t.Errorf("expected the missing ECDSA host key to be generated")
+	}
+}
+
+func TestDefaultHostKeyTypesLoad(t *testing.T) {
+	field, _ := reflect.TypeOf(Config{}).FieldByName("HostKeyTypes")
+	if types := (Config{HostKeyTypes: field.Tag.Get("default")}).HostKeyTypeNames(); !reflect.DeepEqual(types, DefaultHostKeyTypes) {
+		t.Errorf("expected SSH_HOST_KEY_TYPES to default to %v, got %v", DefaultHostKeyTypes, types)
+	}
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "host-keys")
+	if err != nil {
+		t.Fatalf("creating temp dir (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	c := cookoo.NewContext()
+	c.AddLogger("test", &buf)
+	if _, err := GenSSHKeys(c, cookoo.NewParamsWithValues(map[string]interface{}{"dir": dir})); err != nil {
+		t.Fatalf("generating host keys (%s)", err)
+	}
+	keys, irq := ParseHostKeys(c, cookoo.NewParamsWithValues(map[string]interface{}{"dir": dir}))
+	if irq != nil {
+		t.Fatalf("parsing host keys (%s)", irq)
+	}
+	if n := len(keys.([]ssh.Signer)); n != len(DefaultHostKeyTypes) {
+		t.Errorf("expected a host key of each of %v, got %d", DefaultHostKeyTypes, n)
+	}
+	if !strings.Contains(buf.String(), "skipped 0.") {
+		t.Errorf("expected every default host key to load, got %q", buf.String())
+	}
+
+	// a type that can't be loaded isn't generated
+	if _, err := GenSSHKeys(c, cookoo.NewParamsWithValues(map[string]interface{}{"dir": dir, "keytypes": []string{"ed25519"}})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ssh_host_ed25519_key")); !os.IsNotExist(err) {
+		t.Errorf("expected no ed25519 host key to be generated, got %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package sshd
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn is a net.Conn that times out once it has neither read nor written for its timeout. The timeout
+// is off until setTimeout is called, so that it can be set once the SSH handshake is done.
+type idleConn struct {
+	net.Conn
+	timeout int64 // a time.Duration, accessed atomically
+}
+
+// setTimeout sets the idle timeout of c, starting now. 0 turns it off.
+func (c *idleConn) setTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(timeout))
+	c.extend()
+}
+
+func (c *idleConn) extend() {
+	if timeout := time.Duration(atomic.LoadInt64(&c.timeout)); timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}